@@ -0,0 +1,477 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/apitoken"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"github.com/zain-saqer/twitch-chatgpt/web"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiPrefix         = `/api/v1`
+	apiDefaultPerPage = 50
+	apiMaxPerPage     = 100
+)
+
+func (s *Server) setupAPIRoutes() {
+	s.Echo.GET(apiPrefix+`/openapi.json`, getOpenAPI)
+
+	read := requireScope(apitoken.ScopeReadOnly)
+	manage := requireScope(apitoken.ScopeManageChannels)
+	admin := requireScope(apitoken.ScopeAdmin)
+	route := s.Echo.Group(apiPrefix, authMiddleware(s.Config, s.App.Repository))
+	route.GET(`/users`, s.getAPIUsers, read)
+	route.GET(`/users/:id`, s.getAPIUser, read)
+	route.DELETE(`/users/:id`, s.deleteAPIUser, admin)
+	route.GET(`/users/:id/channels`, s.getAPIUserChannels, read)
+	route.POST(`/users/:id/channels`, s.postAPIUserChannel, manage)
+	route.GET(`/channels/:id`, s.getAPIChannel, read)
+	route.PATCH(`/channels/:id`, s.patchAPIChannel, manage)
+	route.DELETE(`/channels/:id`, s.deleteAPIChannel, manage)
+	route.POST(`/channels/:id/pause`, s.postAPIPauseChannel, manage)
+	route.POST(`/channels/:id/resume`, s.postAPIResumeChannel, manage)
+	route.GET(`/channels/:id/event-rules`, s.getAPIEventRules, read)
+	route.PUT(`/channels/:id/event-rules/:event`, s.putAPIEventRule, manage)
+	route.GET(`/channels/:id/question-tiers`, s.getAPIQuestionTiers, read)
+	route.POST(`/channels/:id/question-tiers`, s.postAPIQuestionTier, manage)
+	route.DELETE(`/channels/:id/question-tiers/:tierId`, s.deleteAPIQuestionTier, manage)
+	route.GET(`/channels/:id/timers`, s.getAPITimers, read)
+	route.POST(`/channels/:id/timers`, s.postAPITimer, manage)
+	route.PUT(`/channels/:id/timers/:timerId`, s.putAPITimer, manage)
+	route.DELETE(`/channels/:id/timers/:timerId`, s.deleteAPITimer, manage)
+	route.GET(`/channels/:id/interactions`, s.getAPIInteractions, read)
+}
+
+func getOpenAPI(c echo.Context) error {
+	document, err := web.F.ReadFile(`openapi.json`)
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSON, document)
+}
+
+// apiErrorHandler answers failed API requests with an APIError instead of an error page.
+func (s *Server) apiErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	code, message := http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+	var httpError *echo.HTTPError
+	if page := repositoryErrorPage(err); page != nil {
+		code, message = page.Code, page.Message
+	} else if errors.As(err, &httpError) {
+		code, message = httpError.Code, fmt.Sprint(httpError.Message)
+	}
+	if code >= http.StatusInternalServerError {
+		sentry.CaptureException(err)
+		log.Err(err).Str(`URI`, c.Request().RequestURI).Msg(`api error`)
+	}
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(code)
+	} else {
+		err = c.JSON(code, APIError{Error: message})
+	}
+	if err != nil {
+		log.Err(err).Msg(`error sending the api error`)
+	}
+}
+
+func apiValidationError(c echo.Context, errors []string) error {
+	return c.JSON(http.StatusUnprocessableEntity, APIError{Error: `validation failed`, Errors: errors})
+}
+
+// paginate returns the page of items asked for with the page and per_page query parameters.
+func paginate[T any](c echo.Context, items []T) (*APIList[T], error) {
+	page, err := queryInt(c, `page`, 1, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	perPage, err := queryInt(c, `per_page`, apiDefaultPerPage, 1, apiMaxPerPage)
+	if err != nil {
+		return nil, err
+	}
+	// pages past the end are empty, and checking that first keeps huge page numbers from overflowing
+	start := len(items)
+	if page-1 <= len(items)/perPage {
+		start = min((page-1)*perPage, len(items))
+	}
+	end := min(start+perPage, len(items))
+	return &APIList[T]{Items: items[start:end], Page: page, PerPage: perPage, Total: len(items)}, nil
+}
+
+// queryInt parses the query parameter, which must be at least minimum and, unless maximum is 0, at most maximum.
+func queryInt(c echo.Context, name string, fallback, minimum, maximum int) (int, error) {
+	value := c.QueryParam(name)
+	if value == `` {
+		return fallback, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < minimum || (maximum > 0 && number > maximum) {
+		if maximum > 0 {
+			return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(`%s must be a number between %d and %d`, name, minimum, maximum))
+		}
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(`%s must be a number of at least %d`, name, minimum))
+	}
+	return number, nil
+}
+
+func mapAPI[T, R any](items []T, convert func(T) R) []R {
+	converted := make([]R, 0, len(items))
+	for _, item := range items {
+		converted = append(converted, convert(item))
+	}
+	return converted
+}
+
+func (s *Server) getAPIUsers(c echo.Context) error {
+	users, err := s.App.Repository.GetUsers(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	list, err := paginate(c, mapAPI(users, newAPIUser))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func (s *Server) getAPIUser(c echo.Context) error {
+	user, err := s.App.Repository.GetUser(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newAPIUser(user))
+}
+
+func (s *Server) deleteAPIUser(c echo.Context) error {
+	user, err := s.App.Repository.GetUser(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	if err = s.App.Repository.DeleteUser(c.Request().Context(), user.ID); err != nil {
+		return err
+	}
+	s.App.RemoveUser(user)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) getAPIUserChannels(c echo.Context) error {
+	user, err := s.App.Repository.GetUser(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	channels, err := s.App.Repository.GetChannelsByUser(c.Request().Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	list, err := paginate(c, mapAPI(channels, newAPIChannel))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func (s *Server) postAPIUserChannel(c echo.Context) error {
+	body := &APIAddChannel{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+	form := &AddChannel{Username: body.Name, UserId: c.Param(`id`)}
+	form.Trim()
+	if !form.Validate() {
+		return apiValidationError(c, form.Errors)
+	}
+	user, err := s.App.Repository.GetUser(c.Request().Context(), form.UserId)
+	if err != nil {
+		return err
+	}
+	twitchChannel, err := s.App.TwitterAPI.GetUserAs(c.Request().Context(), user, form.Username)
+	if errors.Is(err, twitch.ErrUserNotFound) {
+		return apiValidationError(c, []string{`There is no Twitch channel with that name`})
+	}
+	if err != nil {
+		return err
+	}
+	channel := &chat.Channel{ID: twitchChannel.ID, UserId: user.ID, Name: form.Username, CreatedAt: time.Now()}
+	if err = s.App.Repository.SaveChannel(c.Request().Context(), channel); err != nil {
+		return err
+	}
+	s.App.AddChannel(user, channel)
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf(`%s/channels/%s`, apiPrefix, channel.ID))
+	return c.JSON(http.StatusCreated, newAPIChannel(channel))
+}
+
+func (s *Server) getAPIChannel(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newAPIChannel(channel))
+}
+
+func (s *Server) patchAPIChannel(c echo.Context) error {
+	body := &APIChannelSettings{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	form := &ChannelSettings{Channel: channel, ChannelID: channel.ID, AnswerWhen: newAPIChannel(channel).AnswerWhen, StreamContext: channel.StreamContext, Paused: channel.Paused}
+	if body.AnswerWhen != nil {
+		form.AnswerWhen = *body.AnswerWhen
+	}
+	if body.StreamContext != nil {
+		form.StreamContext = *body.StreamContext
+	}
+	form.Trim()
+	if !form.Validate() {
+		return apiValidationError(c, form.Errors)
+	}
+	channel.AnswerWhen = form.AnswerWhen
+	channel.StreamContext = form.StreamContext
+	if err = s.saveChannelSettings(c.Request().Context(), channel); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newAPIChannel(channel))
+}
+
+func (s *Server) deleteAPIChannel(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	if err = s.removeChannel(c.Request().Context(), channel); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) postAPIPauseChannel(c echo.Context) error {
+	return s.setAPIChannelPaused(c, true)
+}
+
+func (s *Server) postAPIResumeChannel(c echo.Context) error {
+	return s.setAPIChannelPaused(c, false)
+}
+
+func (s *Server) setAPIChannelPaused(c echo.Context, paused bool) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	if channel.Paused != paused {
+		channel.Paused = paused
+		if err = s.saveChannelSettings(c.Request().Context(), channel); err != nil {
+			return err
+		}
+	}
+	return c.JSON(http.StatusOK, newAPIChannel(channel))
+}
+
+func (s *Server) getAPIEventRules(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	rules, err := s.App.Repository.GetEventRulesByChannel(c.Request().Context(), channel.ID)
+	if err != nil {
+		return err
+	}
+	list, err := paginate(c, mapAPI(rules, newAPIEventRule))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+// putAPIEventRule creates or replaces the channel's rule for the event in the path.
+func (s *Server) putAPIEventRule(c echo.Context) error {
+	body := &APIEventRule{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	form := body.Form(channel.ID, c.Param(`event`))
+	if !form.Validate() {
+		return apiValidationError(c, form.Errors)
+	}
+	rules, err := s.App.Repository.GetEventRulesByChannel(c.Request().Context(), channel.ID)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Event == form.Event {
+			form.Apply(rule)
+			if err = s.App.Repository.UpdateEventRule(c.Request().Context(), rule); err != nil {
+				return err
+			}
+			return c.JSON(http.StatusOK, newAPIEventRule(rule))
+		}
+	}
+	rule := &chat.EventRule{ID: uuid.New().String(), ChannelID: channel.ID, Event: form.Event, CreatedAt: time.Now()}
+	form.Apply(rule)
+	if err = s.App.Repository.SaveEventRule(c.Request().Context(), rule); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, newAPIEventRule(rule))
+}
+
+func (s *Server) getAPIQuestionTiers(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	tiers, err := s.App.Repository.GetQuestionTiersByChannel(c.Request().Context(), channel.ID)
+	if err != nil {
+		return err
+	}
+	list, err := paginate(c, mapAPI(tiers, newAPIQuestionTier))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func (s *Server) postAPIQuestionTier(c echo.Context) error {
+	body := &APIQuestionTier{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	form := body.Form(channel.ID)
+	if !form.Validate() {
+		return apiValidationError(c, form.Errors)
+	}
+	tiers, err := s.App.Repository.GetQuestionTiersByChannel(c.Request().Context(), channel.ID)
+	if err != nil {
+		return err
+	}
+	for _, tier := range tiers {
+		if tier.MinBits == form.MinBits {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf(`There already is a tier for %d bits`, form.MinBits))
+		}
+	}
+	tier := &chat.QuestionTier{ID: uuid.New().String(), ChannelID: channel.ID, MinBits: form.MinBits, Model: form.Model, MaxTokens: form.MaxTokens, CreatedAt: time.Now()}
+	if err = s.App.Repository.SaveQuestionTier(c.Request().Context(), tier); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, newAPIQuestionTier(tier))
+}
+
+func (s *Server) deleteAPIQuestionTier(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	tiers, err := s.App.Repository.GetQuestionTiersByChannel(c.Request().Context(), channel.ID)
+	if err != nil {
+		return err
+	}
+	for _, tier := range tiers {
+		if tier.ID == c.Param(`tierId`) {
+			if err = s.App.Repository.DeleteQuestionTier(c.Request().Context(), tier.ID); err != nil {
+				return err
+			}
+			return c.NoContent(http.StatusNoContent)
+		}
+	}
+	return echo.ErrNotFound
+}
+
+func (s *Server) getAPITimers(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	timers, err := s.App.Repository.GetTimersByChannel(c.Request().Context(), channel.ID)
+	if err != nil {
+		return err
+	}
+	list, err := paginate(c, mapAPI(timers, newAPITimer))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func (s *Server) postAPITimer(c echo.Context) error {
+	body := &APITimer{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	form := body.Form(channel.ID)
+	if !form.Validate() {
+		return apiValidationError(c, form.Errors)
+	}
+	timer := &chat.Timer{ID: uuid.New().String(), ChannelID: channel.ID, CreatedAt: time.Now()}
+	form.Apply(timer)
+	if err = s.App.Repository.SaveTimer(c.Request().Context(), timer); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, newAPITimer(timer))
+}
+
+func (s *Server) putAPITimer(c echo.Context) error {
+	body := &APITimer{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+	timer, err := s.findChannelTimer(c)
+	if err != nil {
+		return err
+	}
+	form := body.Form(timer.ChannelID)
+	if !form.Validate() {
+		return apiValidationError(c, form.Errors)
+	}
+	form.Apply(timer)
+	if err = s.App.Repository.UpdateTimer(c.Request().Context(), timer); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newAPITimer(timer))
+}
+
+func (s *Server) deleteAPITimer(c echo.Context) error {
+	timer, err := s.findChannelTimer(c)
+	if err != nil {
+		return err
+	}
+	if err = s.App.Repository.DeleteTimer(c.Request().Context(), timer.ID); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// getAPIInteractions will list the questions the bot answered in the channel; nothing stores them yet.
+func (s *Server) getAPIInteractions(c echo.Context) error {
+	if _, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`)); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusNotImplemented, APIError{Error: `interaction history is not stored yet`})
+}
+
+func isAPIRequest(c echo.Context) bool {
+	return strings.HasPrefix(c.Request().URL.Path, apiPrefix+`/`)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"github.com/zain-saqer/twitch-chatgpt/internal/apitoken"
+	"github.com/zain-saqer/twitch-chatgpt/internal/bot"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat/repotest"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch/twitchtest"
+	"github.com/zain-saqer/twitch-chatgpt/web"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testTransport struct{}
+
+func (testTransport) MessageStream(ctx context.Context, messageTypes []uint8) (<-chan *chat.Message, error) {
+	return make(chan *chat.Message), nil
+}
+
+func (testTransport) Join(user *chat.User, channel *chat.Channel) {}
+
+func (testTransport) Depart(user *chat.User, channel *chat.Channel) {}
+
+func newTestServer(t *testing.T) (*Server, chat.Repository) {
+	t.Helper()
+	helix := twitchtest.NewServer()
+	t.Cleanup(helix.Close)
+	accessToken, refreshToken := helix.AddUser(`1`, `bot`)
+	helix.AddUser(`2`, `streamer`)
+	repo := repotest.NewMemoryRepository()
+	user := &chat.User{ID: `1`, Username: `bot`, AccessToken: accessToken, RefreshToken: refreshToken, ExpiresAt: time.Now().Add(time.Hour), CreatedAt: time.Now()}
+	if err := repo.SaveUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	app := &bot.App{
+		Repository:     repo,
+		Transport:      testTransport{},
+		Users:          map[string]*chat.User{},
+		ChannelsByUser: make(map[string]map[string]*chat.Channel),
+		TwitterAPI:     bot.NewTwitchApiCaller(helix.API(), repo),
+	}
+	app.AddUser(user)
+	server := NewServer(app, echo.New(), &Config{AuthUser: `admin`, AuthPass: `secret`, Secret: `secret`}, nil, &oauth2.Config{})
+	server.middlewares()
+	server.setupRoutes()
+	return server, repo
+}
+
+func apiRequest(t *testing.T, server *Server, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return tokenRequest(t, server, ``, method, path, body)
+}
+
+// tokenRequest authenticates with the API token, or with basic auth when token is empty.
+func tokenRequest(t *testing.T, server *Server, token, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token == `` {
+		request.SetBasicAuth(`admin`, `secret`)
+	} else {
+		request.Header.Set(echo.HeaderAuthorization, `Bearer `+token)
+	}
+	if body != `` {
+		request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	recorder := httptest.NewRecorder()
+	server.Echo.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func decode[T any](t *testing.T, recorder *httptest.ResponseRecorder, status int) T {
+	t.Helper()
+	var decoded T
+	if recorder.Code != status {
+		t.Fatalf("expected status %d, got %d: %s", status, recorder.Code, recorder.Body)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("expected a JSON body, got %s: %v", recorder.Body, err)
+	}
+	return decoded
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	server, _ := newTestServer(t)
+	recorder := httptest.NewRecorder()
+	server.Echo.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, `/api/v1/users`, nil))
+	if body := decode[APIError](t, recorder, http.StatusUnauthorized); body.Error == `` {
+		t.Fatalf("expected an error message, got %+v", body)
+	}
+	recorder = httptest.NewRecorder()
+	server.Echo.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, `/api/v1/openapi.json`, nil))
+	if document := decode[map[string]any](t, recorder, http.StatusOK); document[`openapi`] == nil {
+		t.Fatalf("expected the OpenAPI document, got %s", recorder.Body)
+	}
+}
+
+func TestAPIUsers(t *testing.T) {
+	server, repo := newTestServer(t)
+	for _, id := range []string{`2`, `3`} {
+		if err := repo.SaveUser(context.Background(), &chat.User{ID: id, Username: `user` + id, AccessToken: `access`, CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := decode[APIList[*APIUser]](t, apiRequest(t, server, http.MethodGet, `/api/v1/users?per_page=2&page=2`, ``), http.StatusOK)
+	if list.Total != 3 || list.Page != 2 || list.PerPage != 2 || len(list.Items) != 1 {
+		t.Fatalf("expected the second page of three users, got %+v", list)
+	}
+	list = decode[APIList[*APIUser]](t, apiRequest(t, server, http.MethodGet, `/api/v1/users?page=9223372036854775807`, ``), http.StatusOK)
+	if list.Total != 3 || len(list.Items) != 0 {
+		t.Fatalf("expected an empty page past the end, got %+v", list)
+	}
+	for _, query := range []string{`page=0`, `per_page=101`, `per_page=many`} {
+		decode[APIError](t, apiRequest(t, server, http.MethodGet, `/api/v1/users?`+query, ``), http.StatusBadRequest)
+	}
+
+	recorder := apiRequest(t, server, http.MethodGet, `/api/v1/users/2`, ``)
+	if user := decode[*APIUser](t, recorder, http.StatusOK); user.Username != `user2` || user.ValidatedAt != nil {
+		t.Fatalf("expected user 2, got %+v", user)
+	}
+	if strings.Contains(recorder.Body.String(), `access`) {
+		t.Fatalf("expected the tokens to be left out, got %s", recorder.Body)
+	}
+
+	if recorder := apiRequest(t, server, http.MethodDelete, `/api/v1/users/2`, ``); recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected the user to be deleted, got %d: %s", recorder.Code, recorder.Body)
+	}
+	decode[APIError](t, apiRequest(t, server, http.MethodGet, `/api/v1/users/2`, ``), http.StatusNotFound)
+	decode[APIError](t, apiRequest(t, server, http.MethodGet, `/api/v1/users/2/channels`, ``), http.StatusNotFound)
+}
+
+func TestAPIChannels(t *testing.T) {
+	server, repo := newTestServer(t)
+
+	recorder := apiRequest(t, server, http.MethodPost, `/api/v1/users/1/channels`, `{"name": " streamer "}`)
+	channel := decode[*APIChannel](t, recorder, http.StatusCreated)
+	if channel.ID != `2` || channel.Name != `streamer` || channel.UserID != `1` || channel.AnswerWhen != chat.AnswerAlways || channel.Paused {
+		t.Fatalf("expected the streamer's channel, got %+v", channel)
+	}
+	if location := recorder.Header().Get(echo.HeaderLocation); location != `/api/v1/channels/2` {
+		t.Fatalf("expected the channel's location, got %q", location)
+	}
+	if _, ok := server.App.ChannelsByUser[`bot`][`streamer`]; !ok {
+		t.Fatal("expected the bot to join the channel")
+	}
+	decode[APIError](t, apiRequest(t, server, http.MethodPost, `/api/v1/users/1/channels`, `{"name": "streamer"}`), http.StatusConflict)
+	if body := decode[APIError](t, apiRequest(t, server, http.MethodPost, `/api/v1/users/1/channels`, `{"name": ""}`), http.StatusUnprocessableEntity); len(body.Errors) != 1 {
+		t.Fatalf("expected the validation errors, got %+v", body)
+	}
+	decode[APIError](t, apiRequest(t, server, http.MethodPost, `/api/v1/users/1/channels`, `{"name": "nobody"}`), http.StatusUnprocessableEntity)
+	decode[APIError](t, apiRequest(t, server, http.MethodPost, `/api/v1/users/1/channels`, `{"name":`), http.StatusBadRequest)
+
+	list := decode[APIList[*APIChannel]](t, apiRequest(t, server, http.MethodGet, `/api/v1/users/1/channels`, ``), http.StatusOK)
+	if list.Total != 1 || list.Items[0].ID != `2` {
+		t.Fatalf("expected the added channel, got %+v", list)
+	}
+
+	decode[APIError](t, apiRequest(t, server, http.MethodPatch, `/api/v1/channels/2`, `{"answer_when": "sometimes"}`), http.StatusUnprocessableEntity)
+	channel = decode[*APIChannel](t, apiRequest(t, server, http.MethodPatch, `/api/v1/channels/2`, `{"answer_when": "live"}`), http.StatusOK)
+	if channel.AnswerWhen != chat.AnswerLive || channel.StreamContext {
+		t.Fatalf("expected only the answering mode to change, got %+v", channel)
+	}
+
+	channel = decode[*APIChannel](t, apiRequest(t, server, http.MethodPost, `/api/v1/channels/2/pause`, ``), http.StatusOK)
+	stored, err := repo.GetChannel(context.Background(), `2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !channel.Paused || !stored.Paused || stored.AnswerWhen != chat.AnswerLive || !server.App.ChannelsByUser[`bot`][`streamer`].Paused {
+		t.Fatalf("expected the channel to be paused, got %+v and %+v", channel, stored)
+	}
+	if channel = decode[*APIChannel](t, apiRequest(t, server, http.MethodPost, `/api/v1/channels/2/resume`, ``), http.StatusOK); channel.Paused {
+		t.Fatalf("expected the channel to be resumed, got %+v", channel)
+	}
+
+	if recorder := apiRequest(t, server, http.MethodDelete, `/api/v1/channels/2`, ``); recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected the channel to be deleted, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if _, ok := server.App.ChannelsByUser[`bot`][`streamer`]; ok {
+		t.Fatal("expected the bot to leave the channel")
+	}
+	decode[APIError](t, apiRequest(t, server, http.MethodPost, `/api/v1/channels/2/pause`, ``), http.StatusNotFound)
+}
+
+func TestAPIChannelSettings(t *testing.T) {
+	server, repo := newTestServer(t)
+	if err := repo.SaveChannel(context.Background(), &chat.Channel{ID: `2`, Name: `streamer`, UserId: `1`, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := decode[*APIEventRule](t, apiRequest(t, server, http.MethodPut, `/api/v1/channels/2/event-rules/raid`, `{"enabled": true, "prompt": "Thank the raiders", "cooldown_seconds": 30}`), http.StatusCreated)
+	if rule.Event != chat.EventRaid || !rule.Enabled || rule.CooldownSeconds != 30 {
+		t.Fatalf("expected the raid rule, got %+v", rule)
+	}
+	replaced := decode[*APIEventRule](t, apiRequest(t, server, http.MethodPut, `/api/v1/channels/2/event-rules/raid`, `{"prompt": "Welcome the raiders"}`), http.StatusOK)
+	if replaced.ID != rule.ID || replaced.Enabled || replaced.Prompt != `Welcome the raiders` {
+		t.Fatalf("expected the rule to be replaced, got %+v", replaced)
+	}
+	decode[APIError](t, apiRequest(t, server, http.MethodPut, `/api/v1/channels/2/event-rules/follow`, `{"prompt": "Hi"}`), http.StatusUnprocessableEntity)
+	if rules := decode[APIList[*APIEventRule]](t, apiRequest(t, server, http.MethodGet, `/api/v1/channels/2/event-rules`, ``), http.StatusOK); rules.Total != 1 {
+		t.Fatalf("expected one rule, got %+v", rules)
+	}
+
+	tier := decode[*APIQuestionTier](t, apiRequest(t, server, http.MethodPost, `/api/v1/channels/2/question-tiers`, `{"min_bits": 500, "model": "gpt-4o", "max_tokens": 300}`), http.StatusCreated)
+	decode[APIError](t, apiRequest(t, server, http.MethodPost, `/api/v1/channels/2/question-tiers`, `{"min_bits": 500}`), http.StatusConflict)
+	decode[APIError](t, apiRequest(t, server, http.MethodPost, `/api/v1/channels/2/question-tiers`, `{"min_bits": 0}`), http.StatusUnprocessableEntity)
+	if recorder := apiRequest(t, server, http.MethodDelete, `/api/v1/channels/2/question-tiers/`+tier.ID, ``); recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected the tier to be deleted, got %d: %s", recorder.Code, recorder.Body)
+	}
+	decode[APIError](t, apiRequest(t, server, http.MethodDelete, `/api/v1/channels/2/question-tiers/`+tier.ID, ``), http.StatusNotFound)
+
+	timer := decode[*APITimer](t, apiRequest(t, server, http.MethodPost, `/api/v1/channels/2/timers`, `{"name": "socials", "enabled": true, "interval_minutes": 15, "lines": ["Follow me", " "]}`), http.StatusCreated)
+	if timer.Name != `socials` || timer.IntervalMinutes != 15 || !slices.Equal(timer.Lines, []string{`Follow me`}) {
+		t.Fatalf("expected the timer, got %+v", timer)
+	}
+	if body := decode[APIError](t, apiRequest(t, server, http.MethodPost, `/api/v1/channels/2/timers`, `{"interval_minutes": 0}`), http.StatusUnprocessableEntity); len(body.Errors) != 3 {
+		t.Fatalf("expected every validation error, got %+v", body)
+	}
+	timer = decode[*APITimer](t, apiRequest(t, server, http.MethodPut, `/api/v1/channels/2/timers/`+timer.ID, `{"name": "socials", "interval_minutes": 30, "prompt": "Remind chat of the socials"}`), http.StatusOK)
+	if timer.Enabled || timer.IntervalMinutes != 30 || len(timer.Lines) != 0 {
+		t.Fatalf("expected the timer to be replaced, got %+v", timer)
+	}
+	decode[APIError](t, apiRequest(t, server, http.MethodPut, `/api/v1/channels/3/timers/`+timer.ID, `{"name": "socials", "interval_minutes": 30, "prompt": "Hi"}`), http.StatusNotFound)
+	if recorder := apiRequest(t, server, http.MethodDelete, `/api/v1/channels/2/timers/`+timer.ID, ``); recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected the timer to be deleted, got %d: %s", recorder.Code, recorder.Body)
+	}
+	if timers := decode[APIList[*APITimer]](t, apiRequest(t, server, http.MethodGet, `/api/v1/channels/2/timers`, ``), http.StatusOK); timers.Total != 0 {
+		t.Fatalf("expected no timers, got %+v", timers)
+	}
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	server, _ := newTestServer(t)
+	data, err := web.F.ReadFile(`openapi.json`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	var operation struct {
+		Scope string `json:"x-scope"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		t.Fatal(err)
+	}
+	tokens := make(map[string]string)
+	for _, scope := range apitoken.Scopes {
+		tokens[scope], _, err = apitoken.Create(context.Background(), server.App.Repository, scope, []string{scope}, time.Time{}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	parameter := regexp.MustCompile(`:(\w+)`)
+	routes := 0
+	for _, route := range server.Echo.Routes() {
+		path, ok := strings.CutPrefix(route.Path, apiPrefix)
+		if !ok || path == `` || strings.Contains(path, `*`) {
+			continue
+		}
+		routes++
+		documented, ok := document.Paths[parameter.ReplaceAllString(path, `{$1}`)][strings.ToLower(route.Method)]
+		if !ok {
+			t.Errorf("expected %s %s in the OpenAPI document", route.Method, path)
+			continue
+		}
+		if path == `/openapi.json` {
+			continue
+		}
+		// the documented scope is enough, and the one below it isn't
+		if err := json.Unmarshal(documented, &operation); err != nil {
+			t.Fatal(err)
+		}
+		scope := slices.Index(apitoken.Scopes, operation.Scope)
+		if scope < 0 {
+			t.Errorf("expected %s %s to document its scope, got %q", route.Method, path, operation.Scope)
+			continue
+		}
+		path = apiPrefix + parameter.ReplaceAllString(path, `missing`)
+		if recorder := tokenRequest(t, server, tokens[apitoken.Scopes[scope]], route.Method, path, `{}`); recorder.Code == http.StatusForbidden {
+			t.Errorf("expected the %s scope to be enough for %s %s", operation.Scope, route.Method, path)
+		}
+		if scope > 0 {
+			if recorder := tokenRequest(t, server, tokens[apitoken.Scopes[scope-1]], route.Method, path, `{}`); recorder.Code != http.StatusForbidden {
+				t.Errorf("expected %s %s to need more than the %s scope, got %d", route.Method, path, apitoken.Scopes[scope-1], recorder.Code)
+			}
+		}
+	}
+	if routes == 0 {
+		t.Fatal("expected API routes")
+	}
+}
+
+func TestAPIInteractionsNotImplemented(t *testing.T) {
+	server, repo := newTestServer(t)
+	if err := repo.SaveChannel(context.Background(), &chat.Channel{ID: `2`, Name: `streamer`, UserId: `1`, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if body := decode[APIError](t, apiRequest(t, server, http.MethodGet, `/api/v1/channels/2/interactions`, ``), http.StatusNotImplemented); body.Error == `` {
+		t.Fatalf("expected an error body, got %+v", body)
+	}
+	decode[APIError](t, apiRequest(t, server, http.MethodGet, `/api/v1/channels/3/interactions`, ``), http.StatusNotFound)
+}
+
+func TestAPITokens(t *testing.T) {
+	server, repo := newTestServer(t)
+	ctx := context.Background()
+	readOnly, _, err := apitoken.Create(ctx, repo, `monitoring`, []string{apitoken.ScopeReadOnly}, time.Time{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := apitoken.Create(ctx, repo, `old`, []string{apitoken.ScopeAdmin}, time.Now().Add(-time.Second), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list := decode[APIList[*APIUser]](t, tokenRequest(t, server, readOnly, http.MethodGet, `/api/v1/users`, ``), http.StatusOK); list.Total != 1 {
+		t.Fatalf("expected the read-only token to list users, got %+v", list)
+	}
+	if tokens, _ := repo.GetAPITokens(ctx); tokens[1].Name != `monitoring` || tokens[1].LastUsedAt.IsZero() {
+		t.Fatalf("expected the token's use to be recorded, got %+v", tokens[1])
+	}
+	if body := decode[APIError](t, tokenRequest(t, server, readOnly, http.MethodDelete, `/api/v1/users/1`, ``), http.StatusForbidden); !strings.Contains(body.Error, apitoken.ScopeAdmin) {
+		t.Fatalf("expected the missing scope to be named, got %+v", body)
+	}
+	for _, token := range []string{expired, `tcg_unknown`, `not-a-token`} {
+		recorder := tokenRequest(t, server, token, http.MethodGet, `/api/v1/users`, ``)
+		decode[APIError](t, recorder, http.StatusUnauthorized)
+		if recorder.Header().Get(echo.HeaderWWWAuthenticate) != `Bearer` {
+			t.Fatalf("expected a bearer challenge, got %v", recorder.Header())
+		}
+	}
+	if recorder := tokenRequest(t, server, readOnly, http.MethodGet, `/`, ``); recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected the admin pages to need the admin scope, got %d", recorder.Code)
+	}
+}
+
+func TestAdminAPITokens(t *testing.T) {
+	server, repo := newTestServer(t)
+	form := url.Values{`name`: {`deploy`}, `scopes`: {apitoken.ScopeManageChannels}, `expires_in_days`: {`30`}}
+	request := httptest.NewRequest(http.MethodPost, `/api-tokens`, strings.NewReader(form.Encode()))
+	request.SetBasicAuth(`admin`, `secret`)
+	request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	recorder := httptest.NewRecorder()
+	server.Echo.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected the token to be created, got %d: %s", recorder.Code, recorder.Body)
+	}
+	secret := regexp.MustCompile(`tcg_[\w-]+`).FindString(recorder.Body.String())
+	tokens, err := repo.GetAPITokens(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret == `` || len(tokens) != 1 || tokens[0].Hash != apitoken.Hash(secret) || !slices.Equal(tokens[0].Scopes, []string{apitoken.ScopeManageChannels}) || tokens[0].ExpiresAt.Before(time.Now().AddDate(0, 0, 29)) {
+		t.Fatalf("expected the created token to be shown once and stored hashed, got %+v", tokens)
+	}
+	decode[APIList[*APIChannel]](t, tokenRequest(t, server, secret, http.MethodGet, `/api/v1/users/1/channels`, ``), http.StatusOK)
+
+	if recorder := apiRequest(t, server, http.MethodDelete, `/api-tokens/`+tokens[0].ID, ``); recorder.Code != http.StatusOK {
+		t.Fatalf("expected the token to be revoked, got %d", recorder.Code)
+	}
+	decode[APIError](t, tokenRequest(t, server, secret, http.MethodGet, `/api/v1/users/1/channels`, ``), http.StatusUnauthorized)
+	if recorder := apiRequest(t, server, http.MethodDelete, `/api-tokens/`+tokens[0].ID, ``); recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected a revoked token to be gone, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/apitoken"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/web"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func (s *Server) getAdminAPITokens(c echo.Context) error {
+	return s.renderAPITokens(c, http.StatusOK, &APITokensView{Form: &APITokenForm{Scopes: []string{apitoken.ScopeReadOnly}, ExpiresInDays: 90}})
+}
+
+func (s *Server) postAdminAPIToken(c echo.Context) error {
+	form := &APITokenForm{}
+	if err := c.Bind(form); err != nil {
+		return err
+	}
+	form.Trim()
+	if !form.Validate() {
+		return s.renderAPITokens(c, http.StatusBadRequest, &APITokensView{Form: form})
+	}
+	now := time.Now()
+	var expiresAt time.Time
+	if form.ExpiresInDays > 0 {
+		expiresAt = now.AddDate(0, 0, form.ExpiresInDays)
+	}
+	secret, token, err := apitoken.Create(c.Request().Context(), s.App.Repository, form.Name, form.Scopes, expiresAt, now)
+	if err != nil {
+		return err
+	}
+	return s.renderAPITokens(c, http.StatusOK, &APITokensView{Form: &APITokenForm{Scopes: []string{apitoken.ScopeReadOnly}, ExpiresInDays: 90}, Created: token, Secret: secret})
+}
+
+func (s *Server) deleteAdminAPIToken(c echo.Context) error {
+	err := s.App.Repository.DeleteAPIToken(c.Request().Context(), c.Param(`id`))
+	if errors.Is(err, chat.ErrNotFound) {
+		return echo.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Add(`HX-Refresh`, `true`)
+	return c.String(http.StatusOK, ``)
+}
+
+func (s *Server) renderAPITokens(c echo.Context, code int, view *APITokensView) error {
+	var t *template.Template
+	sync.OnceFunc(func() {
+		var err error
+		t, err = template.ParseFS(web.F, `templates/layout.gohtml`, `templates/nav.gohtml`, `templates/api_tokens.gohtml`)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Fatal().Err(err).Stack().Msg(`error parsing templates`)
+		}
+	})()
+	tokens, err := s.App.Repository.GetAPITokens(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	view.Tokens = tokens
+	view.Now = time.Now()
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().WriteHeader(code)
+	return t.ExecuteTemplate(c.Response(), `base`, view)
+}
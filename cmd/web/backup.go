@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/backup"
+	"github.com/zain-saqer/twitch-chatgpt/internal/db"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const backupUsage = `usage: app backup export [-with-tokens] [-o file]
+       app backup import [-strategy skip|merge|overwrite] [file]
+       app backup sqlite path`
+
+const (
+	backupFilePrefix = `backup-`
+	backupFileSuffix = `.db`
+)
+
+// backupCommand moves the configuration between databases and returns the exit code:
+//
+//	export  writes the users, channels and channel settings as JSON to stdout or -o; -with-tokens adds the OAuth tokens
+//	import  reads an export from the file or stdin; -strategy decides what happens to what exists, skip by default
+//	sqlite  writes a copy of the live SQLite database to path
+func backupCommand(ctx context.Context, args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, backupUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet(`backup `+args[0], flag.ContinueOnError)
+	withTokens := flags.Bool(`with-tokens`, false, `add the OAuth tokens to the export, unencrypted`)
+	output := flags.String(`o`, ``, `file to write the export to instead of stdout`)
+	strategy := flags.String(`strategy`, string(backup.Skip), `what to do with users, channels and settings that exist: skip, merge or overwrite`)
+	if err := flags.Parse(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, backupUsage)
+		return 2
+	}
+	database, repo, err := openDatabase(getDatabaseConfig())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer database.Close()
+	if err := repo.CheckMigrations(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	switch args[0] {
+	case `export`:
+		if *withTokens {
+			fmt.Fprintln(os.Stderr, `warning: the export has the users' OAuth tokens in plain text, keep it as safe as a password`)
+		}
+		err = exportBackup(ctx, repo, *output, *withTokens)
+	case `import`:
+		err = importBackup(ctx, repo, flags.Arg(0), *strategy)
+	case `sqlite`:
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, backupUsage)
+			return 2
+		}
+		err = repo.Backup(ctx, flags.Arg(0))
+	default:
+		fmt.Fprintln(os.Stderr, backupUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func exportBackup(ctx context.Context, repo db.Database, output string, withTokens bool) error {
+	file, err := backup.Export(ctx, repo, withTokens)
+	if err != nil {
+		return err
+	}
+	if output == `` {
+		return file.Write(os.Stdout)
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := file.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func importBackup(ctx context.Context, repo db.Database, input, strategy string) error {
+	s, err := backup.ParseStrategy(strategy)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if input != `` && input != `-` {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	file, err := backup.Read(r)
+	if err != nil {
+		return err
+	}
+	report, err := backup.Import(ctx, repo, file, s)
+	printImportReport(report)
+	if err == nil && len(report.ChangedUsers)+len(report.CreatedChannels)+len(report.UpdatedChannels) > 0 {
+		fmt.Println(`restart the bot to join the imported channels`)
+	}
+	return err
+}
+
+func printImportReport(report *backup.Report) {
+	if report == nil {
+		return
+	}
+	fmt.Printf("users: %s\n", report.Users)
+	fmt.Printf("channels: %s\n", report.Channels)
+	fmt.Printf("event rules: %s\n", report.EventRules)
+	fmt.Printf("question tiers: %s\n", report.QuestionTiers)
+	fmt.Printf("timers: %s\n", report.Timers)
+}
+
+// startBackups copies the SQLite database into BACKUP_DIR on start and every BACKUP_INTERVAL_MINUTES after, keeping
+// the newest BACKUP_KEEP copies.
+func startBackups(ctx context.Context, repo db.Database, config *Config) {
+	if config.BackupDir == `` {
+		return
+	}
+	if config.Database.Driver != db.DriverSqlite {
+		log.Warn().Msg(`BACKUP_DIR is ignored, scheduled backups are only supported for sqlite`)
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(config.BackupInterval)
+		defer ticker.Stop()
+		for {
+			if err := rotateBackup(ctx, repo, config.BackupDir, config.BackupKeep); err != nil && !errors.Is(err, context.Canceled) {
+				sentry.CaptureException(err)
+				log.Err(err).Msg(`error while backing up the database`)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func rotateBackup(ctx context.Context, repo db.Database, dir string, keep int) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	// the timestamps sort the backups from oldest to newest
+	name := backupFilePrefix + time.Now().UTC().Format(`20060102T150405Z`) + backupFileSuffix
+	if err := repo.Backup(ctx, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	log.Info().Str(`file`, name).Msg(`backed up the database`)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), backupFilePrefix) && strings.HasSuffix(entry.Name(), backupFileSuffix) {
+			backups = append(backups, entry.Name())
+		}
+	}
+	slices.Sort(backups)
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/backup"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/web"
+	"html/template"
+	"net/http"
+	"sync"
+)
+
+func (s *Server) getAdminBackup(c echo.Context) error {
+	return s.renderBackup(c, http.StatusOK, &BackupView{Strategy: string(backup.Skip)})
+}
+
+// getAdminBackupExport downloads the configuration without the OAuth tokens; ?tokens=1 adds them, unencrypted.
+func (s *Server) getAdminBackupExport(c echo.Context) error {
+	file, err := backup.Export(c.Request().Context(), s.App.Repository, c.QueryParam(`tokens`) == `1`)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="twitch-chatgpt-%s.json"`, file.ExportedAt.Format(`20060102-150405`)))
+	c.Response().WriteHeader(http.StatusOK)
+	return file.Write(c.Response())
+}
+
+func (s *Server) postAdminBackupImport(c echo.Context) error {
+	view := &BackupView{Strategy: c.FormValue(`strategy`)}
+	strategy, err := backup.ParseStrategy(view.Strategy)
+	if err != nil {
+		view.Errors = append(view.Errors, `Choose what to do with what already exists`)
+		return s.renderBackup(c, http.StatusBadRequest, view)
+	}
+	header, err := c.FormFile(`file`)
+	if err != nil {
+		view.Errors = append(view.Errors, `Choose an exported file`)
+		return s.renderBackup(c, http.StatusBadRequest, view)
+	}
+	f, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	file, err := backup.Read(f)
+	if err != nil {
+		view.Errors = append(view.Errors, `The file isn't an export of this bot: `+err.Error())
+		return s.renderBackup(c, http.StatusBadRequest, view)
+	}
+	view.Report, err = backup.Import(c.Request().Context(), s.App.Repository, file, strategy)
+	if view.Report != nil {
+		if err := s.applyImport(c.Request().Context(), view.Report); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.renderBackup(c, http.StatusOK, view)
+}
+
+// applyImport has the running bot join the imported channels and use the imported users and settings.
+func (s *Server) applyImport(ctx context.Context, report *backup.Report) error {
+	for _, id := range report.ChangedUsers {
+		user, err := s.App.Repository.GetUser(ctx, id)
+		if err != nil {
+			return err
+		}
+		s.App.AddUser(user)
+	}
+	for _, id := range report.CreatedChannels {
+		user, channel, err := s.channelWithUser(ctx, id)
+		if err != nil {
+			return err
+		}
+		s.App.AddChannel(user, channel)
+	}
+	for _, id := range report.UpdatedChannels {
+		user, channel, err := s.channelWithUser(ctx, id)
+		if err != nil {
+			return err
+		}
+		// also takes the changed settings
+		s.App.SetChannelReward(user, channel)
+	}
+	return nil
+}
+
+func (s *Server) channelWithUser(ctx context.Context, channelId string) (*chat.User, *chat.Channel, error) {
+	channel, err := s.App.Repository.GetChannel(ctx, channelId)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := s.App.Repository.GetUser(ctx, channel.UserId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, channel, nil
+}
+
+func (s *Server) renderBackup(c echo.Context, code int, view *BackupView) error {
+	var t *template.Template
+	sync.OnceFunc(func() {
+		var err error
+		t, err = template.ParseFS(web.F, `templates/layout.gohtml`, `templates/nav.gohtml`, `templates/backup.gohtml`)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Fatal().Err(err).Stack().Msg(`error parsing templates`)
+		}
+	})()
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().WriteHeader(code)
+	return t.ExecuteTemplate(c.Response(), `base`, view)
+}
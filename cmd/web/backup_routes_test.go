@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/zain-saqer/twitch-chatgpt/internal/backup"
+	"net/http"
+	"testing"
+)
+
+func TestAdminBackupExportLeavesTokensOutByDefault(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	file := decode[backup.File](t, apiRequest(t, server, http.MethodGet, `/backup/export`, ``), http.StatusOK)
+	if file.Tokens || len(file.Users) != 1 || file.Users[0].AccessToken != `` || file.Users[0].RefreshToken != `` {
+		t.Fatalf("expected an export without tokens, got %+v", file.Users[0])
+	}
+	file = decode[backup.File](t, apiRequest(t, server, http.MethodGet, `/backup/export?tokens=1`, ``), http.StatusOK)
+	if !file.Tokens || file.Users[0].AccessToken == `` || file.Users[0].RefreshToken == `` {
+		t.Fatalf("expected the tokens to be exported when asked for, got %+v", file.Users[0])
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"github.com/zain-saqer/twitch-chatgpt/internal/db"
 	"github.com/zain-saqer/twitch-chatgpt/internal/env"
+	"github.com/zain-saqer/twitch-chatgpt/internal/privacy"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"golang.org/x/oauth2"
+	oauth2Twitch "golang.org/x/oauth2/twitch"
 	"os"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -10,7 +17,7 @@ type Config struct {
 	AuthUser             string
 	AuthPass             string
 	ServerAddress        string
-	SqliteDbPath         string
+	Database             *DatabaseConfig
 	SentryDsn            string
 	Secret               string
 	Domain               string
@@ -19,14 +26,33 @@ type Config struct {
 	OpenAIAPIKey         string
 	ChatGPTSystemMessage string
 	ChatGPTModel         string
+	TwitchHelixURL       string
+	TwitchOAuth2URL      string
+	ChatTransport        string
+	EventSubWebSocketURL string
+	EventSubSecret       string
+	IRCConnections       int
+	BackupDir            string
+	BackupInterval       time.Duration
+	BackupKeep           int
+	Retention            privacy.Retention
+	PurgeInterval        time.Duration
 }
 
+const (
+	chatTransportIRC               = `irc`
+	chatTransportEventSubWebSocket = `eventsub-websocket`
+	chatTransportEventSubWebhook   = `eventsub-webhook`
+
+	eventSubCallbackPath = `/eventsub/callback`
+)
+
 func getConfigs() *Config {
 	_, debug := os.LookupEnv(`DEBUG`)
 	return &Config{
 		Debug:                debug,
 		ServerAddress:        env.MustGetEnv(`SERVER_ADDRESS`),
-		SqliteDbPath:         env.MustGetEnv(`SQLITE_DB_PATH`),
+		Database:             getDatabaseConfig(),
 		AuthUser:             env.MustGetEnv(`AUTH_USER`),
 		AuthPass:             env.MustGetEnv(`AUTH_PASS`),
 		SentryDsn:            env.MustGetEnv(`SENTRY_DSN`),
@@ -37,5 +63,67 @@ func getConfigs() *Config {
 		OpenAIAPIKey:         env.MustGetEnv(`OPENAI_API_KEY`),
 		ChatGPTSystemMessage: env.MustGetEnv(`CHAT_GPT_SYSTEM_MESSAGE`),
 		ChatGPTModel:         env.MustGetEnv(`CHAT_GPT_MODEL`),
+		TwitchHelixURL:       env.GetEnvOrDefault(`TWITCH_HELIX_URL`, twitch.DefaultEndpoints.Helix),
+		TwitchOAuth2URL:      env.GetEnvOrDefault(`TWITCH_OAUTH2_URL`, twitch.DefaultEndpoints.OAuth2),
+		ChatTransport:        env.GetEnvOrDefault(`CHAT_TRANSPORT`, chatTransportIRC),
+		EventSubWebSocketURL: env.GetEnvOrDefault(`EVENTSUB_WEBSOCKET_URL`, twitch.DefaultEventSubWebSocketURL),
+		EventSubSecret:       env.GetEnvOrDefault(`EVENTSUB_SECRET`, ``),
+		IRCConnections:       env.MustGetIntEnvOrDefault(`IRC_CONNECTIONS`, 1),
+		BackupDir:            env.GetEnvOrDefault(`BACKUP_DIR`, ``),
+		BackupInterval:       time.Duration(env.MustGetIntEnvOrDefault(`BACKUP_INTERVAL_MINUTES`, 24*60)) * time.Minute,
+		BackupKeep:           env.MustGetIntEnvOrDefault(`BACKUP_KEEP`, 7),
+		Retention:            getRetention(),
+		PurgeInterval:        time.Duration(env.MustGetIntEnvOrDefault(`PURGE_INTERVAL_MINUTES`, 60)) * time.Minute,
+	}
+}
+
+// getRetention reads the retention period of every data type from RETENTION_<DATA TYPE>_HOURS, e.g.
+// RETENTION_CHAT_BUFFER_HOURS; a missing or zero period keeps the data forever.
+func getRetention() privacy.Retention {
+	retention := privacy.Retention{}
+	for _, dataType := range privacy.DataTypes {
+		hours := env.MustGetIntEnvOrDefault(`RETENTION_`+strings.ToUpper(dataType)+`_HOURS`, 0)
+		retention[dataType] = time.Duration(hours) * time.Hour
+	}
+	return retention
+}
+
+// DatabaseConfig is the part of the configuration the subcommands need as well.
+type DatabaseConfig struct {
+	Driver              string
+	SqliteDbPath        string
+	PostgresURL         string
+	MaxOpenConns        int
+	MaxIdleConns        int
+	ConnMaxLifetime     time.Duration
+	Migrate             string
+	TokenEncryptionKeys string
+}
+
+func getDatabaseConfig() *DatabaseConfig {
+	config := &DatabaseConfig{
+		Driver:              env.GetEnvOrDefault(`DB_DRIVER`, db.DriverSqlite),
+		MaxOpenConns:        env.MustGetIntEnvOrDefault(`DB_MAX_OPEN_CONNS`, 10),
+		MaxIdleConns:        env.MustGetIntEnvOrDefault(`DB_MAX_IDLE_CONNS`, 5),
+		ConnMaxLifetime:     time.Duration(env.MustGetIntEnvOrDefault(`DB_CONN_MAX_LIFETIME_MINUTES`, 30)) * time.Minute,
+		Migrate:             env.GetEnvOrDefault(`DB_MIGRATE`, dbMigrateAuto),
+		TokenEncryptionKeys: env.MustGetEnv(`TOKEN_ENCRYPTION_KEYS`),
+	}
+	if config.Driver == db.DriverPostgres {
+		config.PostgresURL = env.MustGetEnv(`DATABASE_URL`)
+	} else {
+		config.SqliteDbPath = env.MustGetEnv(`SQLITE_DB_PATH`)
+	}
+	return config
+}
+
+func oauth2Endpoint(config *Config) oauth2.Endpoint {
+	if config.TwitchOAuth2URL == twitch.DefaultEndpoints.OAuth2 {
+		return oauth2Twitch.Endpoint
+	}
+	return oauth2.Endpoint{
+		AuthURL:   config.TwitchOAuth2URL + "/authorize",
+		TokenURL:  config.TwitchOAuth2URL + "/token",
+		AuthStyle: oauth2.AuthStyleInParams,
 	}
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/db"
+)
+
+const (
+	dbMigrateAuto  = `auto`
+	dbMigrateCheck = `check`
+)
+
+// openDatabase connects to SQLite, or with DB_DRIVER=postgres to the Postgres database several replicas can share.
+func openDatabase(config *DatabaseConfig) (*sql.DB, db.Database, error) {
+	tokens, err := db.ParseTokenKeys(config.TokenEncryptionKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	dsn := config.SqliteDbPath
+	if config.Driver == db.DriverPostgres {
+		dsn = config.PostgresURL
+	}
+	return db.Open(db.Options{
+		Driver:          config.Driver,
+		DSN:             dsn,
+		MaxOpenConns:    config.MaxOpenConns,
+		MaxIdleConns:    config.MaxIdleConns,
+		ConnMaxLifetime: config.ConnMaxLifetime,
+		Tokens:          tokens,
+	})
+}
+
+// prepareDatabase migrates the database on startup, or with DB_MIGRATE=check only makes sure it already is, for
+// deployments that migrate as a separate step.
+func prepareDatabase(ctx context.Context, repo db.Database, mode string) error {
+	if mode == dbMigrateCheck {
+		return repo.CheckMigrations(ctx)
+	}
+	applied, err := repo.Migrate(ctx)
+	for _, m := range applied {
+		log.Info().Int(`version`, m.Version).Str(`name`, m.Name).Msg(`applied database migration`)
+	}
+	return err
+}
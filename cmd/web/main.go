@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/gempir/go-twitch-irc/v4"
 	"github.com/getsentry/sentry-go"
 	"github.com/gorilla/sessions"
@@ -13,20 +13,31 @@ import (
 	"github.com/zain-saqer/twitch-chatgpt/internal/bot"
 	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
 	"github.com/zain-saqer/twitch-chatgpt/internal/chatgpt"
-	"github.com/zain-saqer/twitch-chatgpt/internal/db"
 	twitch2 "github.com/zain-saqer/twitch-chatgpt/internal/twitch"
 	"golang.org/x/oauth2"
-	oauth2Twitch "golang.org/x/oauth2/twitch"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
 func main() {
+	commands := map[string]func(ctx context.Context, args []string) int{
+		`migrate`: migrateCommand,
+		`tokens`:  tokensCommand,
+		`backup`:  backupCommand,
+		`privacy`: privacyCommand,
+	}
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		code := commands[os.Args[1]](ctx, os.Args[2:])
+		stop()
+		os.Exit(code)
+	}
 	config := getConfigs()
 	if err := sentry.Init(sentry.ClientOptions{
 		Dsn:              config.SentryDsn,
@@ -42,23 +53,28 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	twitchIrcClient := twitch.NewAnonymousClient()
-
-	database, err := sql.Open("sqlite3", config.SqliteDbPath)
+	_, repo, err := openDatabase(config.Database)
 	if err != nil {
 		sentry.CaptureException(err)
 		log.Fatal().Err(err).Msg("Could not connect to database")
 	}
-	repo := db.NewRepository(database)
-	if err := repo.PrepareDatabase(ctx); err != nil {
+	if err := prepareDatabase(ctx, repo, config.Database.Migrate); err != nil {
 		sentry.CaptureException(err)
 		log.Fatal().Err(err).Stack().Msg(`error while preparing database`)
 	}
-	twitchApi := bot.NewTwitchApiCaller(twitch2.NewApi(config.Oauth2ClientID, &http.Client{}), repo)
+	twitchEndpoints := twitch2.Endpoints{Helix: config.TwitchHelixURL, OAuth2: config.TwitchOAuth2URL}
+	helixApi := twitch2.NewApiWithEndpoints(config.Oauth2ClientID, config.Oauth2Secret, &http.Client{}, twitchEndpoints)
+	twitchApi := bot.NewTwitchApiCaller(helixApi, repo)
+	transport, err := newChatTransport(config, helixApi, twitchApi)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Fatal().Err(err).Stack().Msg(`error creating the chat transport`)
+	}
 	chatGPTAPI := chatgpt.NewAPI(&http.Client{}, config.ChatGPTSystemMessage, config.ChatGPTModel, config.OpenAIAPIKey)
 	app := &bot.App{
 		Repository:     repo,
-		TwitchClient:   twitchIrcClient,
+		Transport:      transport,
+		Redemptions:    twitch2.NewEventSubRedemptionTransport(config.EventSubWebSocketURL, twitchApi),
 		Users:          map[string]*chat.User{},
 		ChannelsByUser: make(map[string]map[string]*chat.Channel),
 		TwitterAPI:     twitchApi,
@@ -68,6 +84,10 @@ func main() {
 		sentry.CaptureException(err)
 		log.Fatal().Err(err).Stack().Msg(`error starting the message pipeline`)
 	}
+	app.StartTokenValidation(ctx, bot.TokenValidationInterval)
+	app.StartStreamTracking(ctx, bot.StreamPollInterval)
+	startBackups(ctx, repo, config)
+	startPurges(ctx, repo, config)
 	e := echo.New()
 	e.Debug = config.Debug
 	cookieStore := sessions.NewCookieStore([]byte(config.Secret))
@@ -79,8 +99,8 @@ func main() {
 	oauth2Config := &oauth2.Config{
 		ClientID:     config.Oauth2ClientID,
 		ClientSecret: config.Oauth2Secret,
-		Scopes:       []string{"user:write:chat", "user:read:email"},
-		Endpoint:     oauth2Twitch.Endpoint,
+		Scopes:       []string{"user:write:chat", "user:read:chat", "user:read:email", "user:read:moderated_channels", "user:bot", "moderator:manage:chat_messages", "channel:manage:redemptions"},
+		Endpoint:     oauth2Endpoint(config),
 		RedirectURL:  oauthRedirect,
 	}
 	server := NewServer(app, e, config, cookieStore, oauth2Config)
@@ -117,3 +137,26 @@ func main() {
 
 	wg.Wait()
 }
+
+func newChatTransport(config *Config, helixApi *twitch2.API, twitchApi *bot.TwitchApiCaller) (chat.Transport, error) {
+	switch config.ChatTransport {
+	case chatTransportIRC:
+		return twitch2.NewIRCTransport(twitch.NewAnonymousClient, config.IRCConnections), nil
+	case chatTransportEventSubWebSocket:
+		return twitch2.NewEventSubWebSocketTransport(config.EventSubWebSocketURL, twitchApi), nil
+	case chatTransportEventSubWebhook:
+		// Twitch requires the secret to be 10 to 100 characters long
+		if len(config.EventSubSecret) < 10 || len(config.EventSubSecret) > 100 {
+			return nil, errors.New(`EVENTSUB_SECRET must be between 10 and 100 characters long`)
+		}
+		callback, err := url.JoinPath(config.Domain, eventSubCallbackPath)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(callback, `https://`) {
+			return nil, fmt.Errorf(`eventsub webhooks need an https callback, got %q`, callback)
+		}
+		return twitch2.NewEventSubWebhookTransport(helixApi, callback, config.EventSubSecret), nil
+	}
+	return nil, fmt.Errorf(`unknown chat transport %q`, config.ChatTransport)
+}
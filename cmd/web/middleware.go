@@ -2,12 +2,23 @@ package main
 
 import (
 	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
 	sentryecho "github.com/getsentry/sentry-go/echo"
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/apitoken"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/web"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
 func (s *Server) middlewares() {
@@ -15,6 +26,56 @@ func (s *Server) middlewares() {
 	s.Echo.Use(loggerMiddleware())
 	s.Echo.Use(session.Middleware(sessions.NewCookieStore([]byte(s.Config.Secret))))
 	s.Echo.Use(sentryecho.New(sentryecho.Options{Repanic: true, WaitForDelivery: true}))
+	s.Echo.HTTPErrorHandler = s.httpErrorHandler
+}
+
+// httpErrorHandler renders the repository errors as error pages with their own status, and leaves everything else
+// to echo's default handler. API requests get JSON errors instead.
+func (s *Server) httpErrorHandler(err error, c echo.Context) {
+	if isAPIRequest(c) {
+		s.apiErrorHandler(err, c)
+		return
+	}
+	page := repositoryErrorPage(err)
+	if page == nil || c.Response().Committed {
+		s.Echo.DefaultHTTPErrorHandler(err, c)
+		return
+	}
+	if page.Code >= http.StatusInternalServerError {
+		sentry.CaptureException(err)
+		log.Err(err).Str(`URI`, c.Request().RequestURI).Msg(`database error`)
+	}
+	var t *template.Template
+	sync.OnceFunc(func() {
+		var err error
+		t, err = template.ParseFS(web.F, `templates/layout.gohtml`, `templates/nav.gohtml`, `templates/error.gohtml`)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Fatal().Err(err).Stack().Msg(`error parsing templates`)
+		}
+	})()
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().WriteHeader(page.Code)
+	if c.Request().Method == http.MethodHead {
+		return
+	}
+	if err := t.ExecuteTemplate(c.Response(), `base`, page); err != nil {
+		log.Err(err).Msg(`error rendering the error page`)
+	}
+}
+
+func repositoryErrorPage(err error) *ErrorPage {
+	switch {
+	case errors.Is(err, chat.ErrNotFound):
+		return &ErrorPage{Code: http.StatusNotFound, Message: `We couldn't find what you were looking for, it may have been deleted.`}
+	case errors.Is(err, chat.ErrConflict):
+		return &ErrorPage{Code: http.StatusConflict, Message: `That already exists.`}
+	case errors.Is(err, chat.ErrInvalid):
+		return &ErrorPage{Code: http.StatusBadRequest, Message: `The database refused that value.`}
+	case errors.Is(err, chat.ErrUnavailable):
+		return &ErrorPage{Code: http.StatusServiceUnavailable, Message: `The database is unavailable, try again in a moment.`}
+	}
+	return nil
 }
 
 func loggerMiddleware() echo.MiddlewareFunc {
@@ -38,12 +99,56 @@ func loggerMiddleware() echo.MiddlewareFunc {
 	})
 }
 
-func authMiddleware(config *Config) echo.MiddlewareFunc {
-	return middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
+// apiTokenKey is where authMiddleware keeps the *chat.APIToken of requests authenticated with one.
+const apiTokenKey = `apiToken`
+
+// authMiddleware accepts the admin's basic auth, or an API token as a bearer token.
+func authMiddleware(config *Config, repo chat.Repository) echo.MiddlewareFunc {
+	basicAuth := middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
 		if subtle.ConstantTimeCompare([]byte(username), []byte(config.AuthUser)) == 1 &&
 			subtle.ConstantTimeCompare([]byte(password), []byte(config.AuthPass)) == 1 {
 			return true, nil
 		}
 		return false, nil
 	})
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withBasicAuth := basicAuth(next)
+		return func(c echo.Context) error {
+			plain, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), `Bearer `)
+			if !ok {
+				return withBasicAuth(c)
+			}
+			token, err := apitoken.Authenticate(c.Request().Context(), repo, strings.TrimSpace(plain), time.Now())
+			if errors.Is(err, apitoken.ErrInvalidToken) || errors.Is(err, apitoken.ErrExpired) {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer`)
+				return echo.NewHTTPError(http.StatusUnauthorized, `invalid or expired API token`).SetInternal(err)
+			}
+			if err != nil {
+				return err
+			}
+			c.Set(apiTokenKey, token)
+			return next(c)
+		}
+	}
+}
+
+// requireScope turns away requests whose API token lacks the scope. Basic auth is the admin, who may do anything.
+func requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token, ok := c.Get(apiTokenKey).(*chat.APIToken); ok && !apitoken.Allows(token, scope) {
+				return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf(`the API token needs the %s scope`, scope))
+			}
+			return next(c)
+		}
+	}
+}
+
+// requestActor names who made the request, for the audit log.
+func requestActor(c echo.Context) string {
+	if token, ok := c.Get(apiTokenKey).(*chat.APIToken); ok {
+		return `token:` + token.Name
+	}
+	username, _, _ := c.Request().BasicAuth()
+	return username
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const migrateUsage = `usage: app migrate status|dry-run|up`
+
+// migrateCommand manages the schema of the configured database and returns the exit code:
+//
+//	status   lists the migrations and whether they were applied
+//	dry-run  applies the pending migrations in a transaction that is rolled back
+//	up       applies the pending migrations
+func migrateCommand(ctx context.Context, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	database, repo, err := openDatabase(getDatabaseConfig())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer database.Close()
+	switch args[0] {
+	case `status`:
+		statuses, err := repo.MigrationStatus(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := `pending`
+			if status.Applied {
+				applied = status.AppliedAt.Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		w.Flush()
+	case `dry-run`:
+		pending, err := repo.DryRunMigrations(ctx)
+		for _, m := range pending {
+			fmt.Printf("would apply %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(pending) == 0 {
+			fmt.Println(`nothing to migrate`)
+		}
+	case `up`:
+		applied, err := repo.Migrate(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
@@ -1,17 +1,59 @@
 package main
 
 import (
+	"fmt"
+	"github.com/zain-saqer/twitch-chatgpt/internal/apitoken"
+	"github.com/zain-saqer/twitch-chatgpt/internal/backup"
 	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/privacy"
+	"net/http"
+	"slices"
 	"strings"
+	"time"
 )
 
 type IndexView struct {
-	Users []*chat.User
+	Users       []*IndexUser
+	Connections []chat.ConnectionState
+}
+
+type IndexUser struct {
+	*chat.User
+	Health      string
+	HealthClass string
+}
+
+func newIndexUser(user *chat.User, requiredScopes []string, now time.Time) *IndexUser {
+	indexUser := &IndexUser{User: user, Health: `healthy`, HealthClass: `text-bg-success`}
+	switch {
+	case user.NeedsReauth:
+		indexUser.Health, indexUser.HealthClass = `needs re-authorisation`, `text-bg-danger`
+	case user.ValidatedAt.IsZero():
+		indexUser.Health, indexUser.HealthClass = `not validated yet`, `text-bg-secondary`
+	case slices.ContainsFunc(requiredScopes, func(scope string) bool { return !slices.Contains(user.Scopes, scope) }):
+		indexUser.Health, indexUser.HealthClass = `missing scopes`, `text-bg-danger`
+	case now.Sub(user.ValidatedAt) > 2*time.Hour:
+		indexUser.Health, indexUser.HealthClass = `validation overdue`, `text-bg-warning`
+	case now.After(user.ExpiresAt):
+		indexUser.Health, indexUser.HealthClass = `expired`, `text-bg-warning`
+	}
+	return indexUser
 }
 
 type UserView struct {
 	Channels []*chat.Channel
 	UserID   string
+	// Streams is the last known stream of each channel, by channel id.
+	Streams map[string]chat.StreamState
+}
+
+type ErrorPage struct {
+	Code    int
+	Message string
+}
+
+func (p *ErrorPage) Title() string {
+	return http.StatusText(p.Code)
 }
 
 type AddChannel struct {
@@ -37,6 +79,31 @@ func (c *AddChannel) Validate() bool {
 	return len(errors) == 0
 }
 
+type ChannelReward struct {
+	Errors    []string
+	ChannelID string `param:"id"`
+	UserID    string
+	Title     string `form:"title"`
+	Cost      int    `form:"cost"`
+}
+
+func (r *ChannelReward) Trim() {
+	r.ChannelID = strings.TrimSpace(r.ChannelID)
+	r.Title = strings.TrimSpace(r.Title)
+}
+
+func (r *ChannelReward) Validate() bool {
+	errors := make([]string, 0)
+	if r.Title == "" || len(r.Title) > 45 {
+		errors = append(errors, "Title is required and can be at most 45 characters long")
+	}
+	if r.Cost < 1 {
+		errors = append(errors, "Cost must be at least 1 point")
+	}
+	r.Errors = errors
+	return len(errors) == 0
+}
+
 type DeleteChannel struct {
 	ID string `param:"id"`
 }
@@ -44,3 +111,430 @@ type DeleteChannel struct {
 type DeleteUser struct {
 	ID string `param:"id"`
 }
+
+type EventRulesView struct {
+	Channel *chat.Channel
+	Rules   []*EventRuleForm
+}
+
+type EventRuleForm struct {
+	Errors             []string
+	ChannelID          string `param:"id"`
+	Event              string `form:"event"`
+	Enabled            bool   `form:"enabled"`
+	Prompt             string `form:"prompt"`
+	CooldownSeconds    int    `form:"cooldown"`
+	BatchWindowSeconds int    `form:"batch_window"`
+}
+
+func newEventRuleForm(channelId, event string, rule *chat.EventRule) *EventRuleForm {
+	if rule == nil {
+		form := &EventRuleForm{ChannelID: channelId, Event: event, Prompt: chat.DefaultEventPrompts[event], CooldownSeconds: 60}
+		if event == chat.EventSubGift {
+			form.BatchWindowSeconds = 10
+		}
+		return form
+	}
+	return &EventRuleForm{
+		ChannelID:          channelId,
+		Event:              event,
+		Enabled:            rule.Enabled,
+		Prompt:             rule.Prompt,
+		CooldownSeconds:    int(rule.Cooldown / time.Second),
+		BatchWindowSeconds: int(rule.BatchWindow / time.Second),
+	}
+}
+
+func (f *EventRuleForm) Trim() {
+	f.ChannelID = strings.TrimSpace(f.ChannelID)
+	f.Event = strings.TrimSpace(f.Event)
+	f.Prompt = strings.TrimSpace(f.Prompt)
+}
+
+func (f *EventRuleForm) Validate() bool {
+	errors := make([]string, 0)
+	if !slices.Contains(chat.Events, f.Event) {
+		errors = append(errors, "Unknown event")
+	}
+	if f.Prompt == "" {
+		errors = append(errors, "Prompt is required")
+	} else if err := chat.ValidateEventPrompt(f.Prompt); err != nil {
+		errors = append(errors, fmt.Sprintf("Prompt is not a valid template: %v", err))
+	}
+	if f.CooldownSeconds < 0 {
+		errors = append(errors, "Cooldown can't be negative")
+	}
+	if f.BatchWindowSeconds < 0 || f.BatchWindowSeconds > 300 {
+		errors = append(errors, "Batching window must be between 0 and 300 seconds")
+	}
+	f.Errors = errors
+	return len(errors) == 0
+}
+
+type ChannelSettings struct {
+	Errors        []string
+	Channel       *chat.Channel
+	ChannelID     string `param:"id"`
+	AnswerWhen    string `form:"answer_when"`
+	StreamContext bool   `form:"stream_context"`
+	Paused        bool   `form:"paused"`
+}
+
+func (f *ChannelSettings) Trim() {
+	f.ChannelID = strings.TrimSpace(f.ChannelID)
+	f.AnswerWhen = strings.TrimSpace(f.AnswerWhen)
+}
+
+func (f *ChannelSettings) Validate() bool {
+	errors := make([]string, 0)
+	if !slices.Contains([]string{chat.AnswerAlways, chat.AnswerLive, chat.AnswerOffline}, f.AnswerWhen) {
+		errors = append(errors, "Unknown answering mode")
+	}
+	f.Errors = errors
+	return len(errors) == 0
+}
+
+type QuestionTiersView struct {
+	Channel *chat.Channel
+	Tiers   []*chat.QuestionTier
+	Form    *QuestionTierForm
+}
+
+type QuestionTierForm struct {
+	Errors    []string
+	ChannelID string `param:"id"`
+	MinBits   int    `form:"min_bits"`
+	Model     string `form:"model"`
+	MaxTokens int    `form:"max_tokens"`
+}
+
+func (f *QuestionTierForm) Trim() {
+	f.ChannelID = strings.TrimSpace(f.ChannelID)
+	f.Model = strings.TrimSpace(f.Model)
+}
+
+func (f *QuestionTierForm) Validate() bool {
+	errors := make([]string, 0)
+	if f.MinBits < 1 {
+		errors = append(errors, "Bits must be at least 1")
+	}
+	if f.MaxTokens < 0 || f.MaxTokens > 4096 {
+		errors = append(errors, "Max tokens must be between 0 and 4096")
+	}
+	f.Errors = errors
+	return len(errors) == 0
+}
+
+type TimersView struct {
+	Channel *chat.Channel
+	Timers  []*chat.Timer
+	Form    *TimerForm
+}
+
+type TimerForm struct {
+	Errors          []string
+	ChannelID       string `param:"id"`
+	Name            string `form:"name"`
+	Enabled         bool   `form:"enabled"`
+	IntervalMinutes int    `form:"interval"`
+	MinChatLines    int    `form:"min_lines"`
+	Prompt          string `form:"prompt"`
+	Lines           string `form:"lines"`
+}
+
+func (f *TimerForm) Trim() {
+	f.ChannelID = strings.TrimSpace(f.ChannelID)
+	f.Name = strings.TrimSpace(f.Name)
+	f.Prompt = strings.TrimSpace(f.Prompt)
+	f.Lines = strings.TrimSpace(f.Lines)
+}
+
+func (f *TimerForm) Validate() bool {
+	errors := make([]string, 0)
+	if f.Name == "" {
+		errors = append(errors, "Name is required")
+	}
+	if f.IntervalMinutes < 1 || f.IntervalMinutes > 24*60 {
+		errors = append(errors, "Interval must be between 1 and 1440 minutes")
+	}
+	if f.MinChatLines < 0 {
+		errors = append(errors, "Chat lines can't be negative")
+	}
+	if f.Prompt == "" && len(f.StaticLines()) == 0 {
+		errors = append(errors, "Either a prompt or static lines are required")
+	}
+	for _, line := range f.StaticLines() {
+		if len([]rune(line)) > 500 {
+			errors = append(errors, "Static lines can't be longer than 500 characters")
+			break
+		}
+	}
+	f.Errors = errors
+	return len(errors) == 0
+}
+
+// StaticLines returns the non-empty lines of the lines textarea.
+func (f *TimerForm) StaticLines() []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(f.Lines, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func (f *EventRuleForm) Apply(rule *chat.EventRule) {
+	rule.Enabled = f.Enabled
+	rule.Prompt = f.Prompt
+	rule.Cooldown = time.Duration(f.CooldownSeconds) * time.Second
+	rule.BatchWindow = time.Duration(f.BatchWindowSeconds) * time.Second
+}
+
+type BackupView struct {
+	Errors   []string
+	Strategy string
+	Report   *backup.Report
+}
+
+// Strategies lists the import strategies for the form.
+func (v BackupView) Strategies() []backup.Strategy {
+	return []backup.Strategy{backup.Skip, backup.Merge, backup.Overwrite}
+}
+
+type PrivacyView struct {
+	Errors    []string
+	Username  string
+	Forgotten *privacy.Forgotten
+	Purged    []*chat.AuditEntry
+	// Retention lists the stored data types; it is empty until the bot stores any that can be purged.
+	Retention []RetentionPeriod
+	AuditLog  []*chat.AuditEntry
+}
+
+// RetentionPeriod is how long one data type is kept, for the privacy page.
+type RetentionPeriod struct {
+	DataType string
+	Period   string
+}
+
+// APIList is a page of a list endpoint of the JSON API.
+type APIList[T any] struct {
+	Items   []T `json:"items"`
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	Total   int `json:"total"`
+}
+
+// APIError is the body of every failed JSON API request; Errors lists what failed validation.
+type APIError struct {
+	Error  string   `json:"error"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// APIUser leaves out the user's tokens.
+type APIUser struct {
+	ID          string     `json:"id"`
+	Username    string     `json:"username"`
+	NeedsReauth bool       `json:"needs_reauth"`
+	Scopes      []string   `json:"scopes"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	ValidatedAt *time.Time `json:"validated_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+func newAPIUser(user *chat.User) *APIUser {
+	apiUser := &APIUser{ID: user.ID, Username: user.Username, NeedsReauth: user.NeedsReauth, Scopes: user.Scopes, ExpiresAt: user.ExpiresAt, CreatedAt: user.CreatedAt}
+	if apiUser.Scopes == nil {
+		apiUser.Scopes = make([]string, 0)
+	}
+	if !user.ValidatedAt.IsZero() {
+		apiUser.ValidatedAt = &user.ValidatedAt
+	}
+	return apiUser
+}
+
+type APIChannel struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	UserID        string     `json:"user_id"`
+	AnswerWhen    string     `json:"answer_when"`
+	StreamContext bool       `json:"stream_context"`
+	Paused        bool       `json:"paused"`
+	RewardID      string     `json:"reward_id"`
+	DropReason    string     `json:"drop_reason"`
+	DropMessage   string     `json:"drop_message"`
+	DroppedAt     *time.Time `json:"dropped_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+func newAPIChannel(channel *chat.Channel) *APIChannel {
+	apiChannel := &APIChannel{
+		ID:            channel.ID,
+		Name:          channel.Name,
+		UserID:        channel.UserId,
+		AnswerWhen:    channel.AnswerWhen,
+		StreamContext: channel.StreamContext,
+		Paused:        channel.Paused,
+		RewardID:      channel.RewardID,
+		DropReason:    channel.DropReason,
+		DropMessage:   channel.DropMessage,
+		CreatedAt:     channel.CreatedAt,
+	}
+	if apiChannel.AnswerWhen == `` {
+		apiChannel.AnswerWhen = chat.AnswerAlways
+	}
+	if !channel.DroppedAt.IsZero() {
+		apiChannel.DroppedAt = &channel.DroppedAt
+	}
+	return apiChannel
+}
+
+type APIAddChannel struct {
+	Name string `json:"name"`
+}
+
+// APIChannelSettings changes only the settings present in the request.
+type APIChannelSettings struct {
+	AnswerWhen    *string `json:"answer_when"`
+	StreamContext *bool   `json:"stream_context"`
+}
+
+type APIEventRule struct {
+	ID                 string    `json:"id"`
+	Event              string    `json:"event"`
+	Enabled            bool      `json:"enabled"`
+	Prompt             string    `json:"prompt"`
+	CooldownSeconds    int       `json:"cooldown_seconds"`
+	BatchWindowSeconds int       `json:"batch_window_seconds"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+func newAPIEventRule(rule *chat.EventRule) *APIEventRule {
+	return &APIEventRule{
+		ID:                 rule.ID,
+		Event:              rule.Event,
+		Enabled:            rule.Enabled,
+		Prompt:             rule.Prompt,
+		CooldownSeconds:    int(rule.Cooldown / time.Second),
+		BatchWindowSeconds: int(rule.BatchWindow / time.Second),
+		CreatedAt:          rule.CreatedAt,
+	}
+}
+
+// Form validates the rule like the admin form does.
+func (r *APIEventRule) Form(channelId, event string) *EventRuleForm {
+	form := &EventRuleForm{ChannelID: channelId, Event: event, Enabled: r.Enabled, Prompt: r.Prompt, CooldownSeconds: r.CooldownSeconds, BatchWindowSeconds: r.BatchWindowSeconds}
+	form.Trim()
+	return form
+}
+
+type APIQuestionTier struct {
+	ID        string    `json:"id"`
+	MinBits   int       `json:"min_bits"`
+	Model     string    `json:"model"`
+	MaxTokens int       `json:"max_tokens"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newAPIQuestionTier(tier *chat.QuestionTier) *APIQuestionTier {
+	return &APIQuestionTier{ID: tier.ID, MinBits: tier.MinBits, Model: tier.Model, MaxTokens: tier.MaxTokens, CreatedAt: tier.CreatedAt}
+}
+
+func (t *APIQuestionTier) Form(channelId string) *QuestionTierForm {
+	form := &QuestionTierForm{ChannelID: channelId, MinBits: t.MinBits, Model: t.Model, MaxTokens: t.MaxTokens}
+	form.Trim()
+	return form
+}
+
+type APITimer struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Enabled         bool      `json:"enabled"`
+	IntervalMinutes int       `json:"interval_minutes"`
+	MinChatLines    int       `json:"min_chat_lines"`
+	Prompt          string    `json:"prompt"`
+	Lines           []string  `json:"lines"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func newAPITimer(timer *chat.Timer) *APITimer {
+	apiTimer := &APITimer{
+		ID:              timer.ID,
+		Name:            timer.Name,
+		Enabled:         timer.Enabled,
+		IntervalMinutes: int(timer.Interval / time.Minute),
+		MinChatLines:    timer.MinChatLines,
+		Prompt:          timer.Prompt,
+		Lines:           timer.Lines,
+		CreatedAt:       timer.CreatedAt,
+	}
+	if apiTimer.Lines == nil {
+		apiTimer.Lines = make([]string, 0)
+	}
+	return apiTimer
+}
+
+func (t *APITimer) Form(channelId string) *TimerForm {
+	form := &TimerForm{ChannelID: channelId, Name: t.Name, Enabled: t.Enabled, IntervalMinutes: t.IntervalMinutes, MinChatLines: t.MinChatLines, Prompt: t.Prompt, Lines: strings.Join(t.Lines, "\n")}
+	form.Trim()
+	return form
+}
+
+// Apply copies the validated form onto the timer.
+func (f *TimerForm) Apply(timer *chat.Timer) {
+	timer.Name = f.Name
+	timer.Enabled = f.Enabled
+	timer.Interval = time.Duration(f.IntervalMinutes) * time.Minute
+	timer.MinChatLines = f.MinChatLines
+	timer.Prompt = f.Prompt
+	timer.Lines = f.StaticLines()
+}
+
+type APITokensView struct {
+	Form *APITokenForm
+	// Created is the token that was just created; it can't be shown again.
+	Created *chat.APIToken
+	Secret  string
+	Tokens  []*chat.APIToken
+	Now     time.Time
+}
+
+// Scopes lists the scopes for the form.
+func (v APITokensView) Scopes() []string {
+	return apitoken.Scopes
+}
+
+func (v APITokensView) Expired(token *chat.APIToken) bool {
+	return apitoken.Expired(token, v.Now)
+}
+
+type APITokenForm struct {
+	Errors        []string
+	Name          string   `form:"name"`
+	Scopes        []string `form:"scopes"`
+	ExpiresInDays int      `form:"expires_in_days"`
+}
+
+func (f *APITokenForm) Trim() {
+	f.Name = strings.TrimSpace(f.Name)
+}
+
+func (f *APITokenForm) Validate() bool {
+	errors := make([]string, 0)
+	if f.Name == "" || len(f.Name) > 100 {
+		errors = append(errors, "Name is required and can be at most 100 characters long")
+	}
+	if len(f.Scopes) == 0 || slices.ContainsFunc(f.Scopes, func(scope string) bool { return !slices.Contains(apitoken.Scopes, scope) }) {
+		errors = append(errors, "Pick at least one scope")
+	}
+	if f.ExpiresInDays < 0 || f.ExpiresInDays > 3650 {
+		errors = append(errors, "Expiry must be between 0 and 3650 days")
+	}
+	f.Errors = errors
+	return len(errors) == 0
+}
+
+func (f *APITokenForm) HasScope(scope string) bool {
+	return slices.Contains(f.Scopes, scope)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"testing"
+	"time"
+)
+
+func TestIndexUserHealth(t *testing.T) {
+	now := time.Now()
+	required := []string{`user:bot`, `user:write:chat`}
+	tests := []struct {
+		name   string
+		user   chat.User
+		health string
+		class  string
+	}{
+		{`healthy`, chat.User{Scopes: required, ValidatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}, `healthy`, `text-bg-success`},
+		{`revoked`, chat.User{NeedsReauth: true, Scopes: required, ValidatedAt: now}, `needs re-authorisation`, `text-bg-danger`},
+		{`never validated`, chat.User{Scopes: required, ExpiresAt: now.Add(time.Hour)}, `not validated yet`, `text-bg-secondary`},
+		{`missing scopes`, chat.User{Scopes: required[:1], ValidatedAt: now, ExpiresAt: now.Add(time.Hour)}, `missing scopes`, `text-bg-danger`},
+		{`overdue`, chat.User{Scopes: required, ValidatedAt: now.Add(-3 * time.Hour), ExpiresAt: now.Add(time.Hour)}, `validation overdue`, `text-bg-warning`},
+		{`expired`, chat.User{Scopes: required, ValidatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}, `expired`, `text-bg-warning`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := test.user
+			indexUser := newIndexUser(&user, required, now)
+			if indexUser.Health != test.health || indexUser.HealthClass != test.class {
+				t.Fatalf("expected %s (%s), got %s (%s)", test.health, test.class, indexUser.Health, indexUser.HealthClass)
+			}
+		})
+	}
+}
@@ -81,7 +81,14 @@ func (s *Server) getOAuth2Callback(c echo.Context) (err error) {
 		ExpiresAt:    token.Expiry,
 		CreatedAt:    time.Now(),
 	}
-	err = s.App.Repository.SaveUser(c.Request().Context(), user)
+	existing, err := s.App.Repository.GetUser(c.Request().Context(), user.ID)
+	switch {
+	case err == nil:
+		user.CreatedAt = existing.CreatedAt
+		err = s.App.Repository.UpdateUser(c.Request().Context(), user)
+	case errors.Is(err, chat.ErrNotFound):
+		err = s.App.Repository.SaveUser(c.Request().Context(), user)
+	}
 	if err != nil {
 		return err
 	}
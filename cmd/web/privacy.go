@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/privacy"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+const privacyUsage = `usage: app privacy forget <username>
+       app privacy purge
+       app privacy audit`
+
+// auditEntriesShown is how many audit log entries the CLI and the admin UI list.
+const auditEntriesShown = 100
+
+// privacyCommand handles requests to delete personal data and returns the exit code:
+//
+//	forget  deletes the bot accounts and channels of the Twitch username, recording it in the audit log
+//	purge   deletes the data older than its RETENTION_<DATA TYPE>_HOURS, recording it in the audit log
+//	audit   lists the newest audit log entries
+func privacyCommand(ctx context.Context, args []string) int {
+	if len(args) < 1 || args[0] == `forget` && len(args) != 2 || args[0] != `forget` && len(args) != 1 {
+		fmt.Fprintln(os.Stderr, privacyUsage)
+		return 2
+	}
+	database, repo, err := openDatabase(getDatabaseConfig())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer database.Close()
+	if err := repo.CheckMigrations(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	switch args[0] {
+	case `forget`:
+		forgotten, err := privacy.Forget(ctx, repo, args[1], `cli`)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("forgot %s: %s\n", forgotten.Entry.Subject, forgotten.Entry.Details)
+		if len(forgotten.Users)+len(forgotten.Channels) > 0 {
+			fmt.Println(`restart the bot to leave the deleted channels`)
+		}
+	case `purge`:
+		purgers := privacy.Purgers()
+		if len(purgers) == 0 {
+			fmt.Println(`nothing to purge, the bot doesn't store interactions, conversation memory or a chat buffer yet`)
+			return 0
+		}
+		entries, err := privacy.Purge(ctx, repo, getRetention(), purgers, `cli`, time.Now())
+		for _, entry := range entries {
+			fmt.Printf("purged %s: %s\n", entry.Subject, entry.Details)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(entries) == 0 {
+			fmt.Println(`nothing to purge, no RETENTION_<DATA TYPE>_HOURS is set`)
+		}
+	case `audit`:
+		entries, err := repo.GetAuditEntries(ctx, auditEntriesShown)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tACTION\tSUBJECT\tACTOR\tDETAILS")
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", entry.CreatedAt.Local().Format(time.DateTime), entry.Action, entry.Subject, entry.Actor, entry.Details)
+		}
+		w.Flush()
+	default:
+		fmt.Fprintln(os.Stderr, privacyUsage)
+		return 2
+	}
+	return 0
+}
+
+// startPurges deletes the data that outlived its retention period on start and every PURGE_INTERVAL_MINUTES after.
+// Nothing is scheduled while none of the data types with a retention period is stored.
+func startPurges(ctx context.Context, repo chat.Repository, config *Config) {
+	purgers := privacy.Purgers()
+	for _, dataType := range privacy.DataTypes {
+		if _, ok := purgers[dataType]; !ok && config.Retention[dataType] > 0 {
+			log.Warn().Str(`data_type`, dataType).Msg(`a retention period is set for data the bot doesn't store yet`)
+		}
+	}
+	if !slices.ContainsFunc(privacy.DataTypes, func(dataType string) bool { return config.Retention[dataType] > 0 && purgers[dataType] != nil }) {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(config.PurgeInterval)
+		defer ticker.Stop()
+		for {
+			entries, err := privacy.Purge(ctx, repo, config.Retention, purgers, privacy.ActorScheduler, time.Now())
+			if err != nil && !errors.Is(err, context.Canceled) {
+				sentry.CaptureException(err)
+				log.Err(err).Msg(`error while purging expired data`)
+			}
+			for _, entry := range entries {
+				log.Info().Str(`data_type`, entry.Subject).Str(`details`, entry.Details).Msg(`purged expired data`)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/privacy"
+	"github.com/zain-saqer/twitch-chatgpt/web"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func (s *Server) getAdminPrivacy(c echo.Context) error {
+	return s.renderPrivacy(c, http.StatusOK, &PrivacyView{})
+}
+
+func (s *Server) postAdminForget(c echo.Context) error {
+	view := &PrivacyView{Username: c.FormValue(`username`)}
+	forgotten, err := privacy.Forget(c.Request().Context(), s.App.Repository, view.Username, requestActor(c))
+	if errors.Is(err, privacy.ErrInvalidUsername) {
+		view.Errors = append(view.Errors, `Enter a Twitch username`)
+		return s.renderPrivacy(c, http.StatusBadRequest, view)
+	}
+	if err != nil {
+		return err
+	}
+	for _, owned := range forgotten.Channels {
+		s.App.RemoveChannel(owned.User, owned.Channel)
+	}
+	for _, user := range forgotten.Users {
+		s.App.RemoveUser(user)
+	}
+	view.Forgotten = forgotten
+	view.Username = ``
+	return s.renderPrivacy(c, http.StatusOK, view)
+}
+
+func (s *Server) postAdminPurge(c echo.Context) error {
+	view := &PrivacyView{}
+	entries, err := privacy.Purge(c.Request().Context(), s.App.Repository, s.Config.Retention, privacy.Purgers(), requestActor(c), time.Now())
+	if err != nil {
+		return err
+	}
+	view.Purged = entries
+	if len(entries) == 0 {
+		view.Errors = append(view.Errors, `No retention period is set for the stored data, so there is nothing to purge`)
+	}
+	return s.renderPrivacy(c, http.StatusOK, view)
+}
+
+func (s *Server) renderPrivacy(c echo.Context, code int, view *PrivacyView) error {
+	var t *template.Template
+	sync.OnceFunc(func() {
+		var err error
+		t, err = template.ParseFS(web.F, `templates/layout.gohtml`, `templates/nav.gohtml`, `templates/privacy.gohtml`)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Fatal().Err(err).Stack().Msg(`error parsing templates`)
+		}
+	})()
+	entries, err := s.App.Repository.GetAuditEntries(c.Request().Context(), auditEntriesShown)
+	if err != nil {
+		return err
+	}
+	view.AuditLog = entries
+	purgers := privacy.Purgers()
+	for _, dataType := range privacy.DataTypes {
+		if purgers[dataType] != nil {
+			view.Retention = append(view.Retention, RetentionPeriod{DataType: dataType, Period: privacy.FormatPeriod(s.Config.Retention[dataType])})
+		}
+	}
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().WriteHeader(code)
+	return t.ExecuteTemplate(c.Response(), `base`, view)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"github.com/zain-saqer/twitch-chatgpt/internal/privacy"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminPurge(t *testing.T) {
+	server, repo := newTestServer(t)
+	server.Config.Retention = privacy.Retention{privacy.DataInteractions: 30 * 24 * time.Hour, privacy.DataChatBuffer: time.Hour}
+
+	rec := apiRequest(t, server, http.MethodGet, `/privacy`, ``)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `PURGE NOW`) || !strings.Contains(rec.Body.String(), `nothing to purge`) {
+		t.Fatalf("expected no retention controls while no data type is stored, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = apiRequest(t, server, http.MethodPost, `/privacy/purge`, ``)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `there is nothing to purge`) {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+	entries, err := repo.GetAuditEntries(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected nothing to be audited, got %+v", entries)
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/getsentry/sentry-go"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/apitoken"
 	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
 	"github.com/zain-saqer/twitch-chatgpt/web"
 	"html/template"
 	"net/http"
@@ -16,16 +20,46 @@ import (
 )
 
 func (s *Server) setupRoutes() {
-	route := s.Echo.Group(`/`, authMiddleware(s.Config))
+	// Twitch authenticates webhook deliveries with the HMAC signature instead of basic auth
+	if handler, ok := s.App.Transport.(http.Handler); ok {
+		s.Echo.POST(eventSubCallbackPath, echo.WrapHandler(handler))
+	}
+
+	route := s.Echo.Group(`/`, authMiddleware(s.Config, s.App.Repository), requireScope(apitoken.ScopeAdmin))
 	route.GET(``, s.getIndex)
 	route.GET(`:userId/channels`, s.getAdminChannels)
 	route.GET(`:userId/add-channel`, s.getAdminAddChannel)
 	route.POST(`:userId/add-channel`, s.postAdminAddChannel)
 	route.DELETE(`channels/:id`, s.deleteAdminDeleteChannel)
+	route.GET(`channels/:id/settings`, s.getAdminChannelSettings)
+	route.POST(`channels/:id/settings`, s.postAdminChannelSettings)
+	route.GET(`channels/:id/events`, s.getAdminEventRules)
+	route.POST(`channels/:id/events`, s.postAdminEventRule)
+	route.GET(`channels/:id/tiers`, s.getAdminQuestionTiers)
+	route.POST(`channels/:id/tiers`, s.postAdminQuestionTier)
+	route.DELETE(`channels/:id/tiers/:tierId`, s.deleteAdminQuestionTier)
+	route.GET(`channels/:id/timers`, s.getAdminTimers)
+	route.POST(`channels/:id/timers`, s.postAdminTimer)
+	route.POST(`channels/:id/timers/:timerId/toggle`, s.postAdminToggleTimer)
+	route.DELETE(`channels/:id/timers/:timerId`, s.deleteAdminTimer)
+	route.GET(`channels/:id/reward`, s.getAdminChannelReward)
+	route.POST(`channels/:id/reward`, s.postAdminChannelReward)
+	route.DELETE(`channels/:id/reward`, s.deleteAdminChannelReward)
 	route.DELETE(`users/:id`, s.deleteAdminDeleteUser)
+	route.GET(`backup`, s.getAdminBackup)
+	route.GET(`backup/export`, s.getAdminBackupExport)
+	route.POST(`backup/import`, s.postAdminBackupImport)
+	route.GET(`privacy`, s.getAdminPrivacy)
+	route.POST(`privacy/forget`, s.postAdminForget)
+	route.POST(`privacy/purge`, s.postAdminPurge)
+	route.GET(`api-tokens`, s.getAdminAPITokens)
+	route.POST(`api-tokens`, s.postAdminAPIToken)
+	route.DELETE(`api-tokens/:id`, s.deleteAdminAPIToken)
 
 	route.GET(`add-user`, s.getAddUser)
 	route.GET(`add-user/redirect`, s.getOAuth2Callback)
+
+	s.setupAPIRoutes()
 }
 
 func (s *Server) getIndex(c echo.Context) error {
@@ -38,11 +72,16 @@ func (s *Server) getIndex(c echo.Context) error {
 			log.Fatal().Err(err).Stack().Msg(`error parsing templates`)
 		}
 	})()
-	usernames, err := s.App.Repository.GetUsers(c.Request().Context())
+	users, err := s.App.Repository.GetUsers(c.Request().Context())
 	if err != nil {
 		return err
 	}
-	return t.ExecuteTemplate(c.Response(), `base`, IndexView{Users: usernames})
+	now := time.Now()
+	indexUsers := make([]*IndexUser, 0, len(users))
+	for _, user := range users {
+		indexUsers = append(indexUsers, newIndexUser(user, s.Oauth2Config.Scopes, now))
+	}
+	return t.ExecuteTemplate(c.Response(), `base`, IndexView{Users: indexUsers, Connections: s.App.Connections()})
 }
 
 func (s *Server) getAdminChannels(c echo.Context) error {
@@ -59,7 +98,11 @@ func (s *Server) getAdminChannels(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	return t.ExecuteTemplate(c.Response(), `base`, UserView{UserID: c.Param(`userId`), Channels: channels})
+	streams := make(map[string]chat.StreamState, len(channels))
+	for _, channel := range channels {
+		streams[channel.ID] = s.App.StreamState(channel)
+	}
+	return t.ExecuteTemplate(c.Response(), `base`, UserView{UserID: c.Param(`userId`), Channels: channels, Streams: streams})
 }
 
 func (s *Server) getAdminAddChannel(c echo.Context) error {
@@ -99,12 +142,18 @@ func (s *Server) postAdminAddChannel(c echo.Context) error {
 		return err
 	}
 
-	twitchChannel, err := s.App.TwitterAPI.GetUser(c.Request().Context(), user.AccessToken, addChannel.Username)
+	twitchChannel, err := s.App.TwitterAPI.GetUserAs(c.Request().Context(), user, addChannel.Username)
 	if err != nil {
 		return err
 	}
 	channel := &chat.Channel{ID: twitchChannel.ID, UserId: addChannel.UserId, Name: addChannel.Username, CreatedAt: time.Now()}
-	if err = s.App.Repository.SaveChannel(c.Request().Context(), channel); err != nil {
+	err = s.App.Repository.SaveChannel(c.Request().Context(), channel)
+	if errors.Is(err, chat.ErrConflict) {
+		addChannel.Errors = append(addChannel.Errors, `This channel was already added`)
+		c.Response().WriteHeader(http.StatusConflict)
+		return t.ExecuteTemplate(c.Response(), `base`, addChannel)
+	}
+	if err != nil {
 		return err
 	}
 	s.App.AddChannel(user, channel)
@@ -125,15 +174,413 @@ func (s *Server) deleteAdminDeleteChannel(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	err = s.App.Repository.DeleteChannel(c.Request().Context(), id)
+	if err = s.removeChannel(c.Request().Context(), channel); err != nil {
+		return err
+	}
+	c.Response().Header().Add(`HX-Refresh`, `true`)
+	return c.String(http.StatusOK, ``)
+}
+
+// removeChannel deletes the channel with its paid-question reward, and makes the bot leave it.
+func (s *Server) removeChannel(ctx context.Context, channel *chat.Channel) error {
+	user, err := s.App.Repository.GetUser(ctx, channel.UserId)
 	if err != nil {
 		return err
 	}
-	s.App.Depart(channel.Name)
+	if channel.RewardID != "" {
+		if err := s.App.TwitterAPI.DeleteCustomReward(ctx, user, channel.RewardID); err != nil {
+			log.Err(err).Str(`channel`, channel.Name).Msg(`error while deleting the paid-question reward`)
+		}
+	}
+	if err = s.App.Repository.DeleteChannel(ctx, channel.ID); err != nil {
+		return err
+	}
+	s.App.RemoveChannel(user, channel)
+	return nil
+}
+
+func (s *Server) getAdminChannelSettings(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	return s.renderChannelSettings(c, &ChannelSettings{Channel: channel, ChannelID: channel.ID, AnswerWhen: channel.AnswerWhen, StreamContext: channel.StreamContext, Paused: channel.Paused})
+}
+
+func (s *Server) postAdminChannelSettings(c echo.Context) error {
+	form := &ChannelSettings{}
+	if err := c.Bind(form); err != nil {
+		return err
+	}
+	form.Trim()
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), form.ChannelID)
+	if err != nil {
+		return err
+	}
+	form.Channel = channel
+	if !form.Validate() {
+		return s.renderChannelSettings(c, form)
+	}
+	channel.AnswerWhen = form.AnswerWhen
+	channel.StreamContext = form.StreamContext
+	channel.Paused = form.Paused
+	if err = s.saveChannelSettings(c.Request().Context(), channel); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf(`/%s/channels`, channel.UserId))
+}
+
+// saveChannelSettings stores the channel's changed settings and hands them to the running bot.
+func (s *Server) saveChannelSettings(ctx context.Context, channel *chat.Channel) error {
+	if err := s.App.Repository.UpdateChannel(ctx, channel); err != nil {
+		return err
+	}
+	user, err := s.App.Repository.GetUser(ctx, channel.UserId)
+	if err != nil {
+		return err
+	}
+	s.App.UpdateChannelSettings(user, channel)
+	return nil
+}
+
+func (s *Server) renderChannelSettings(c echo.Context, form *ChannelSettings) error {
+	var t *template.Template
+	sync.OnceFunc(func() {
+		var err error
+		t, err = template.ParseFS(web.F, `templates/layout.gohtml`, `templates/nav.gohtml`, `templates/channel_settings.gohtml`)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Fatal().Err(err).Stack().Msg(`error parsing templates`)
+		}
+	})()
+	return t.ExecuteTemplate(c.Response(), `base`, form)
+}
+
+func (s *Server) getAdminEventRules(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	return s.renderEventRules(c, channel, nil)
+}
+
+func (s *Server) postAdminEventRule(c echo.Context) error {
+	form := &EventRuleForm{}
+	if err := c.Bind(form); err != nil {
+		return err
+	}
+	form.Trim()
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), form.ChannelID)
+	if err != nil {
+		return err
+	}
+	if !form.Validate() {
+		return s.renderEventRules(c, channel, form)
+	}
+	rules, err := s.App.Repository.GetEventRulesByChannel(c.Request().Context(), channel.ID)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Event == form.Event {
+			form.Apply(rule)
+			if err = s.App.Repository.UpdateEventRule(c.Request().Context(), rule); err != nil {
+				return err
+			}
+			return c.Redirect(http.StatusSeeOther, fmt.Sprintf(`/channels/%s/events`, channel.ID))
+		}
+	}
+	rule := &chat.EventRule{ID: uuid.New().String(), ChannelID: channel.ID, Event: form.Event, CreatedAt: time.Now()}
+	form.Apply(rule)
+	if err = s.App.Repository.SaveEventRule(c.Request().Context(), rule); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf(`/channels/%s/events`, channel.ID))
+}
+
+// renderEventRules shows a form per event, keeping the submitted one when it has errors.
+func (s *Server) renderEventRules(c echo.Context, channel *chat.Channel, submitted *EventRuleForm) error {
+	var t *template.Template
+	sync.OnceFunc(func() {
+		var err error
+		t, err = template.ParseFS(web.F, `templates/layout.gohtml`, `templates/nav.gohtml`, `templates/event_rules.gohtml`)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Fatal().Err(err).Stack().Msg(`error parsing templates`)
+		}
+	})()
+	rules, err := s.App.Repository.GetEventRulesByChannel(c.Request().Context(), channel.ID)
+	if err != nil {
+		return err
+	}
+	view := EventRulesView{Channel: channel}
+	for _, event := range chat.Events {
+		if submitted != nil && submitted.Event == event {
+			view.Rules = append(view.Rules, submitted)
+			continue
+		}
+		var existing *chat.EventRule
+		for _, rule := range rules {
+			if rule.Event == event {
+				existing = rule
+			}
+		}
+		view.Rules = append(view.Rules, newEventRuleForm(channel.ID, event, existing))
+	}
+	return t.ExecuteTemplate(c.Response(), `base`, view)
+}
+
+func (s *Server) getAdminQuestionTiers(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	return s.renderQuestionTiers(c, channel, &QuestionTierForm{ChannelID: channel.ID, MinBits: 100})
+}
+
+func (s *Server) postAdminQuestionTier(c echo.Context) error {
+	form := &QuestionTierForm{}
+	if err := c.Bind(form); err != nil {
+		return err
+	}
+	form.Trim()
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), form.ChannelID)
+	if err != nil {
+		return err
+	}
+	if !form.Validate() {
+		return s.renderQuestionTiers(c, channel, form)
+	}
+	tiers, err := s.App.Repository.GetQuestionTiersByChannel(c.Request().Context(), channel.ID)
+	if err != nil {
+		return err
+	}
+	for _, tier := range tiers {
+		if tier.MinBits == form.MinBits {
+			form.Errors = append(form.Errors, fmt.Sprintf(`There already is a tier for %d bits`, form.MinBits))
+			return s.renderQuestionTiers(c, channel, form)
+		}
+	}
+	tier := &chat.QuestionTier{ID: uuid.New().String(), ChannelID: channel.ID, MinBits: form.MinBits, Model: form.Model, MaxTokens: form.MaxTokens, CreatedAt: time.Now()}
+	if err = s.App.Repository.SaveQuestionTier(c.Request().Context(), tier); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf(`/channels/%s/tiers`, channel.ID))
+}
+
+func (s *Server) deleteAdminQuestionTier(c echo.Context) error {
+	tiers, err := s.App.Repository.GetQuestionTiersByChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	for _, tier := range tiers {
+		if tier.ID == c.Param(`tierId`) {
+			if err = s.App.Repository.DeleteQuestionTier(c.Request().Context(), tier.ID); err != nil {
+				return err
+			}
+			c.Response().Header().Add(`HX-Refresh`, `true`)
+			return c.String(http.StatusOK, ``)
+		}
+	}
+	return echo.ErrNotFound
+}
+
+func (s *Server) renderQuestionTiers(c echo.Context, channel *chat.Channel, form *QuestionTierForm) error {
+	var t *template.Template
+	sync.OnceFunc(func() {
+		var err error
+		t, err = template.ParseFS(web.F, `templates/layout.gohtml`, `templates/nav.gohtml`, `templates/question_tiers.gohtml`)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Fatal().Err(err).Stack().Msg(`error parsing templates`)
+		}
+	})()
+	tiers, err := s.App.Repository.GetQuestionTiersByChannel(c.Request().Context(), channel.ID)
+	if err != nil {
+		return err
+	}
+	return t.ExecuteTemplate(c.Response(), `base`, QuestionTiersView{Channel: channel, Tiers: tiers, Form: form})
+}
+
+func (s *Server) getAdminTimers(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	return s.renderTimers(c, channel, &TimerForm{ChannelID: channel.ID, Enabled: true, IntervalMinutes: 15, MinChatLines: 10})
+}
+
+func (s *Server) postAdminTimer(c echo.Context) error {
+	form := &TimerForm{}
+	if err := c.Bind(form); err != nil {
+		return err
+	}
+	form.Trim()
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), form.ChannelID)
+	if err != nil {
+		return err
+	}
+	if !form.Validate() {
+		return s.renderTimers(c, channel, form)
+	}
+	timer := &chat.Timer{ID: uuid.New().String(), ChannelID: channel.ID, CreatedAt: time.Now()}
+	form.Apply(timer)
+	if err = s.App.Repository.SaveTimer(c.Request().Context(), timer); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf(`/channels/%s/timers`, channel.ID))
+}
+
+// findChannelTimer returns the timer in the path, but only if it belongs to the channel in the path.
+func (s *Server) findChannelTimer(c echo.Context) (*chat.Timer, error) {
+	timers, err := s.App.Repository.GetTimersByChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return nil, err
+	}
+	for _, timer := range timers {
+		if timer.ID == c.Param(`timerId`) {
+			return timer, nil
+		}
+	}
+	return nil, echo.ErrNotFound
+}
+
+func (s *Server) postAdminToggleTimer(c echo.Context) error {
+	timer, err := s.findChannelTimer(c)
+	if err != nil {
+		return err
+	}
+	timer.Enabled = !timer.Enabled
+	if err = s.App.Repository.UpdateTimer(c.Request().Context(), timer); err != nil {
+		return err
+	}
+	c.Response().Header().Add(`HX-Refresh`, `true`)
+	return c.String(http.StatusOK, ``)
+}
+
+func (s *Server) deleteAdminTimer(c echo.Context) error {
+	timer, err := s.findChannelTimer(c)
+	if err != nil {
+		return err
+	}
+	if err = s.App.Repository.DeleteTimer(c.Request().Context(), timer.ID); err != nil {
+		return err
+	}
+	c.Response().Header().Add(`HX-Refresh`, `true`)
+	return c.String(http.StatusOK, ``)
+}
+
+func (s *Server) renderTimers(c echo.Context, channel *chat.Channel, form *TimerForm) error {
+	var t *template.Template
+	sync.OnceFunc(func() {
+		var err error
+		t, err = template.ParseFS(web.F, `templates/layout.gohtml`, `templates/nav.gohtml`, `templates/timers.gohtml`)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Fatal().Err(err).Stack().Msg(`error parsing templates`)
+		}
+	})()
+	timers, err := s.App.Repository.GetTimersByChannel(c.Request().Context(), channel.ID)
+	if err != nil {
+		return err
+	}
+	return t.ExecuteTemplate(c.Response(), `base`, TimersView{Channel: channel, Timers: timers, Form: form})
+}
+
+func (s *Server) getAdminChannelReward(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	return s.renderChannelReward(c, &ChannelReward{ChannelID: channel.ID, UserID: channel.UserId, Title: `Ask the AI`, Cost: 1000})
+}
+
+func (s *Server) postAdminChannelReward(c echo.Context) error {
+	form := &ChannelReward{}
+	if err := c.Bind(form); err != nil {
+		return err
+	}
+	form.Trim()
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), form.ChannelID)
+	if err != nil {
+		return err
+	}
+	form.UserID = channel.UserId
+	if !form.Validate() {
+		return s.renderChannelReward(c, form)
+	}
+	// Twitch only lets broadcasters manage their own rewards
+	if channel.ID != channel.UserId {
+		form.Errors = append(form.Errors, `Paid questions need the broadcaster to add the bot with their own account`)
+		return s.renderChannelReward(c, form)
+	}
+	user, err := s.App.Repository.GetUser(c.Request().Context(), channel.UserId)
+	if err != nil {
+		return err
+	}
+	reward, err := s.App.TwitterAPI.CreateCustomReward(c.Request().Context(), user, &twitch.CustomReward{
+		Title:               form.Title,
+		Cost:                form.Cost,
+		Prompt:              `Ask the AI a question`,
+		IsEnabled:           true,
+		IsUserInputRequired: true,
+	})
+	if errors.Is(err, twitch.ErrForbidden) {
+		form.Errors = append(form.Errors, `Twitch refused to create the reward, channel points need an affiliate or partner channel`)
+		return s.renderChannelReward(c, form)
+	}
+	if err != nil {
+		return err
+	}
+	if channel.RewardID != "" {
+		if err := s.App.TwitterAPI.DeleteCustomReward(c.Request().Context(), user, channel.RewardID); err != nil {
+			log.Err(err).Str(`channel`, channel.Name).Msg(`error while deleting the previous paid-question reward`)
+		}
+	}
+	channel.RewardID = reward.ID
+	if err = s.App.Repository.UpdateChannel(c.Request().Context(), channel); err != nil {
+		return err
+	}
+	s.App.SetChannelReward(user, channel)
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf(`/%s/channels`, channel.UserId))
+}
+
+func (s *Server) deleteAdminChannelReward(c echo.Context) error {
+	channel, err := s.App.Repository.GetChannel(c.Request().Context(), c.Param(`id`))
+	if err != nil {
+		return err
+	}
+	user, err := s.App.Repository.GetUser(c.Request().Context(), channel.UserId)
+	if err != nil {
+		return err
+	}
+	if channel.RewardID != "" {
+		if err = s.App.TwitterAPI.DeleteCustomReward(c.Request().Context(), user, channel.RewardID); err != nil {
+			return err
+		}
+	}
+	channel.RewardID = ""
+	if err = s.App.Repository.UpdateChannel(c.Request().Context(), channel); err != nil {
+		return err
+	}
+	s.App.SetChannelReward(user, channel)
 	c.Response().Header().Add(`HX-Refresh`, `true`)
 	return c.String(http.StatusOK, ``)
 }
 
+func (s *Server) renderChannelReward(c echo.Context, form *ChannelReward) error {
+	var t *template.Template
+	sync.OnceFunc(func() {
+		var err error
+		t, err = template.ParseFS(web.F, `templates/layout.gohtml`, `templates/nav.gohtml`, `templates/channel_reward.gohtml`)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Fatal().Err(err).Stack().Msg(`error parsing templates`)
+		}
+	})()
+	return t.ExecuteTemplate(c.Response(), `base`, form)
+}
+
 func (s *Server) deleteAdminDeleteUser(c echo.Context) error {
 	userChannel := &DeleteUser{}
 	err := c.Bind(userChannel)
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+const tokensUsage = `usage: app tokens reencrypt`
+
+// tokensCommand manages the encryption of the stored OAuth tokens and returns the exit code:
+//
+//	reencrypt  moves every token to the first key in TOKEN_ENCRYPTION_KEYS
+//
+// To rotate, put the new key in front of the old one, run reencrypt, then remove the old key.
+func tokensCommand(ctx context.Context, args []string) int {
+	if len(args) != 1 || args[0] != `reencrypt` {
+		fmt.Fprintln(os.Stderr, tokensUsage)
+		return 2
+	}
+	database, repo, err := openDatabase(getDatabaseConfig())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer database.Close()
+	if err := repo.CheckMigrations(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	updated, err := repo.ReencryptTokens(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("reencrypted the tokens of %d users\n", updated)
+	return 0
+}
@@ -0,0 +1,110 @@
+// Package apitoken creates the tokens scripts call the JSON API with, and checks them. Only a hash of each token is
+// stored, so a lost token can't be shown again, only revoked and replaced.
+package apitoken
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes of a token, from the narrowest: each one allows what the ones before it do.
+const (
+	ScopeReadOnly       = `read-only`
+	ScopeManageChannels = `manage-channels`
+	ScopeAdmin          = `admin`
+)
+
+var Scopes = []string{ScopeReadOnly, ScopeManageChannels, ScopeAdmin}
+
+// prefix makes the tokens recognisable, e.g. to secret scanners.
+const prefix = `tcg_`
+
+// lastUsedPrecision keeps a busy token from writing its last use on every request.
+const lastUsedPrecision = time.Minute
+
+var (
+	ErrInvalidName  = errors.New("apitoken: invalid name")
+	ErrUnknownScope = errors.New("apitoken: unknown scope")
+	ErrInvalidToken = errors.New("apitoken: invalid token")
+	ErrExpired      = errors.New("apitoken: token expired")
+)
+
+// Hash is what is stored of a token. The tokens are random enough that a plain SHA-256 can't be reversed.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create stores a new token and returns it with its only copy of the secret. A zero expiresAt never expires.
+func Create(ctx context.Context, repo chat.Repository, name string, scopes []string, expiresAt, now time.Time) (string, *chat.APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == `` || len(name) > 100 {
+		return ``, nil, ErrInvalidName
+	}
+	if len(scopes) == 0 || slices.ContainsFunc(scopes, func(scope string) bool { return !slices.Contains(Scopes, scope) }) {
+		return ``, nil, ErrUnknownScope
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return ``, nil, err
+	}
+	plain := prefix + base64.RawURLEncoding.EncodeToString(secret)
+	token := &chat.APIToken{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Hash:      Hash(plain),
+		Scopes:    slices.DeleteFunc(slices.Clone(Scopes), func(scope string) bool { return !slices.Contains(scopes, scope) }),
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	}
+	if err := repo.SaveAPIToken(ctx, token); err != nil {
+		return ``, nil, err
+	}
+	return plain, token, nil
+}
+
+// Authenticate returns the stored token of plain and records that it was used.
+func Authenticate(ctx context.Context, repo chat.Repository, plain string, now time.Time) (*chat.APIToken, error) {
+	if !strings.HasPrefix(plain, prefix) {
+		return nil, ErrInvalidToken
+	}
+	token, err := repo.GetAPITokenByHash(ctx, Hash(plain))
+	if errors.Is(err, chat.ErrNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if Expired(token, now) {
+		return nil, ErrExpired
+	}
+	if now.Sub(token.LastUsedAt) >= lastUsedPrecision {
+		token.LastUsedAt = now
+		if err = repo.SetAPITokenLastUsed(ctx, token.ID, now); err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+// Expired reports whether the token can no longer be used.
+func Expired(token *chat.APIToken, now time.Time) bool {
+	return !token.ExpiresAt.IsZero() && !now.Before(token.ExpiresAt)
+}
+
+// Allows reports whether one of the token's scopes includes scope.
+func Allows(token *chat.APIToken, scope string) bool {
+	needed := slices.Index(Scopes, scope)
+	return needed >= 0 && slices.ContainsFunc(token.Scopes, func(granted string) bool {
+		return slices.Index(Scopes, granted) >= needed
+	})
+}
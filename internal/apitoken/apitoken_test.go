@@ -0,0 +1,89 @@
+package apitoken
+
+import (
+	"context"
+	"errors"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat/repotest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateAndAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	repo := repotest.NewMemoryRepository()
+	now := time.Now()
+
+	plain, token, err := Create(ctx, repo, ` deploy `, []string{ScopeAdmin, ScopeReadOnly, ScopeAdmin}, now.Add(time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(plain, prefix) || token.Name != `deploy` || !slices.Equal(token.Scopes, []string{ScopeReadOnly, ScopeAdmin}) {
+		t.Fatalf("expected the token with its scopes in order, got %q and %+v", plain, token)
+	}
+	stored, err := repo.GetAPITokenByHash(ctx, Hash(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Hash == plain || strings.Contains(stored.Hash, plain) {
+		t.Fatal("expected only the hash to be stored")
+	}
+
+	authenticated, err := Authenticate(ctx, repo, plain, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authenticated.ID != token.ID || !authenticated.LastUsedAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected the token with its last use, got %+v", authenticated)
+	}
+	if _, err = Authenticate(ctx, repo, plain, now.Add(time.Minute+time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ = repo.GetAPITokenByHash(ctx, Hash(plain)); !stored.LastUsedAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected uses within a minute to keep the first one, got %+v", stored)
+	}
+
+	for _, invalid := range []string{``, plain + `x`, strings.TrimPrefix(plain, prefix)} {
+		if _, err = Authenticate(ctx, repo, invalid, now); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("expected ErrInvalidToken for %q, got %v", invalid, err)
+		}
+	}
+	if _, err = Authenticate(ctx, repo, plain, now.Add(time.Hour)); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected ErrExpired, got %v", err)
+	}
+}
+
+func TestCreateValidation(t *testing.T) {
+	repo := repotest.NewMemoryRepository()
+	now := time.Now()
+	if _, _, err := Create(context.Background(), repo, ` `, []string{ScopeAdmin}, time.Time{}, now); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+	for _, scopes := range [][]string{nil, {`root`}, {ScopeReadOnly, `root`}} {
+		if _, _, err := Create(context.Background(), repo, `deploy`, scopes, time.Time{}, now); !errors.Is(err, ErrUnknownScope) {
+			t.Fatalf("expected ErrUnknownScope for %v, got %v", scopes, err)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	for _, test := range []struct {
+		scopes  []string
+		allowed []string
+	}{
+		{nil, nil},
+		{[]string{ScopeReadOnly}, []string{ScopeReadOnly}},
+		{[]string{ScopeManageChannels}, []string{ScopeReadOnly, ScopeManageChannels}},
+		{[]string{ScopeAdmin}, Scopes},
+		{[]string{`root`}, nil},
+	} {
+		token := &chat.APIToken{Scopes: test.scopes}
+		for _, scope := range append(slices.Clone(Scopes), `root`) {
+			if allowed := Allows(token, scope); allowed != slices.Contains(test.allowed, scope) {
+				t.Errorf("expected a token with %v to allow %s: %v, got %v", test.scopes, scope, !allowed, allowed)
+			}
+		}
+	}
+}
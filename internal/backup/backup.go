@@ -0,0 +1,487 @@
+// Package backup moves the bot's configuration between databases as a portable JSON file: the users, their channels
+// and each channel's event rules, question tiers and timers.
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"io"
+	"time"
+)
+
+// Version is the format of the files Export writes; Read refuses any other.
+const Version = 1
+
+var (
+	ErrUnsupportedVersion = errors.New("backup: unsupported file version")
+	ErrUnknownStrategy    = errors.New("backup: unknown conflict strategy")
+)
+
+// Strategy decides what Import does with what is already in the database.
+type Strategy string
+
+const (
+	// Skip only adds what is missing and leaves everything that exists as it is.
+	Skip Strategy = `skip`
+	// Merge updates what exists from the file and keeps what the file doesn't mention.
+	Merge Strategy = `merge`
+	// Overwrite is Merge, except that a channel's question tiers and timers that aren't in the file are deleted and
+	// its event rules that aren't in the file are disabled. Users and channels are never deleted.
+	Overwrite Strategy = `overwrite`
+)
+
+func ParseStrategy(s string) (Strategy, error) {
+	switch strategy := Strategy(s); strategy {
+	case Skip, Merge, Overwrite:
+		return strategy, nil
+	}
+	return ``, fmt.Errorf(`%w %q`, ErrUnknownStrategy, s)
+}
+
+// File is the exported configuration. Runtime state, like whether a message was dropped or when a token was last
+// validated, isn't part of it.
+type File struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	// Tokens tells whether the users' OAuth tokens were exported; without them imported users have to authorise again.
+	Tokens bool    `json:"tokens"`
+	Users  []*User `json:"users"`
+}
+
+type User struct {
+	ID           string     `json:"id"`
+	Username     string     `json:"username"`
+	AccessToken  string     `json:"access_token,omitempty"`
+	RefreshToken string     `json:"refresh_token,omitempty"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	Scopes       []string   `json:"scopes,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Channels     []*Channel `json:"channels"`
+}
+
+type Channel struct {
+	ID            string          `json:"id"`
+	Name          string          `json:"name"`
+	RewardID      string          `json:"reward_id,omitempty"`
+	AnswerWhen    string          `json:"answer_when"`
+	StreamContext bool            `json:"stream_context"`
+	Paused        bool            `json:"paused,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	EventRules    []*EventRule    `json:"event_rules"`
+	QuestionTiers []*QuestionTier `json:"question_tiers"`
+	Timers        []*Timer        `json:"timers"`
+}
+
+// EventRule is matched to the existing rules by its event, as a channel has one rule per event.
+type EventRule struct {
+	Event              string `json:"event"`
+	Enabled            bool   `json:"enabled"`
+	Prompt             string `json:"prompt"`
+	CooldownSeconds    int    `json:"cooldown_seconds"`
+	BatchWindowSeconds int    `json:"batch_window_seconds"`
+}
+
+// QuestionTier is matched to the existing tiers by its bits, as a channel has one tier per amount of bits.
+type QuestionTier struct {
+	MinBits   int    `json:"min_bits"`
+	Model     string `json:"model,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+}
+
+// Timer is matched to the existing timers by its name.
+type Timer struct {
+	Name            string   `json:"name"`
+	Enabled         bool     `json:"enabled"`
+	IntervalSeconds int      `json:"interval_seconds"`
+	MinChatLines    int      `json:"min_chat_lines"`
+	Prompt          string   `json:"prompt,omitempty"`
+	Lines           []string `json:"lines,omitempty"`
+}
+
+// Export reads the whole configuration from repo, leaving out the OAuth tokens unless withTokens is set.
+func Export(ctx context.Context, repo chat.Repository, withTokens bool) (*File, error) {
+	users, err := repo.GetUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	file := &File{Version: Version, ExportedAt: time.Now().UTC(), Tokens: withTokens, Users: make([]*User, 0, len(users))}
+	for _, user := range users {
+		exported := &User{ID: user.ID, Username: user.Username, ExpiresAt: user.ExpiresAt, Scopes: user.Scopes, CreatedAt: user.CreatedAt, Channels: make([]*Channel, 0)}
+		if withTokens {
+			exported.AccessToken = user.AccessToken
+			exported.RefreshToken = user.RefreshToken
+		}
+		channels, err := repo.GetChannelsByUser(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, channel := range channels {
+			c, err := exportChannel(ctx, repo, channel)
+			if err != nil {
+				return nil, err
+			}
+			exported.Channels = append(exported.Channels, c)
+		}
+		file.Users = append(file.Users, exported)
+	}
+	return file, nil
+}
+
+func exportChannel(ctx context.Context, repo chat.Repository, channel *chat.Channel) (*Channel, error) {
+	exported := &Channel{
+		ID:            channel.ID,
+		Name:          channel.Name,
+		RewardID:      channel.RewardID,
+		AnswerWhen:    channel.AnswerWhen,
+		StreamContext: channel.StreamContext,
+		Paused:        channel.Paused,
+		CreatedAt:     channel.CreatedAt,
+		EventRules:    make([]*EventRule, 0),
+		QuestionTiers: make([]*QuestionTier, 0),
+		Timers:        make([]*Timer, 0),
+	}
+	rules, err := repo.GetEventRulesByChannel(ctx, channel.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		exported.EventRules = append(exported.EventRules, &EventRule{Event: rule.Event, Enabled: rule.Enabled, Prompt: rule.Prompt, CooldownSeconds: int(rule.Cooldown.Seconds()), BatchWindowSeconds: int(rule.BatchWindow.Seconds())})
+	}
+	tiers, err := repo.GetQuestionTiersByChannel(ctx, channel.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, tier := range tiers {
+		exported.QuestionTiers = append(exported.QuestionTiers, &QuestionTier{MinBits: tier.MinBits, Model: tier.Model, MaxTokens: tier.MaxTokens})
+	}
+	timers, err := repo.GetTimersByChannel(ctx, channel.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, timer := range timers {
+		exported.Timers = append(exported.Timers, &Timer{Name: timer.Name, Enabled: timer.Enabled, IntervalSeconds: int(timer.Interval.Seconds()), MinChatLines: timer.MinChatLines, Prompt: timer.Prompt, Lines: timer.Lines})
+	}
+	return exported, nil
+}
+
+// Write encodes the file as indented JSON.
+func (f *File) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent(``, `  `)
+	return encoder.Encode(f)
+}
+
+// Read decodes a file written by Write, refusing versions it doesn't know.
+func Read(r io.Reader) (*File, error) {
+	file := &File{}
+	if err := json.NewDecoder(r).Decode(file); err != nil {
+		return nil, fmt.Errorf(`backup: reading file: %w`, err)
+	}
+	if file.Version != Version {
+		return nil, fmt.Errorf(`%w %d`, ErrUnsupportedVersion, file.Version)
+	}
+	return file, nil
+}
+
+type Count struct {
+	Created int
+	Updated int
+	Skipped int
+	// Removed counts the deleted tiers and timers and the disabled event rules of Overwrite.
+	Removed int
+}
+
+func (c Count) String() string {
+	return fmt.Sprintf(`%d created, %d updated, %d skipped, %d removed`, c.Created, c.Updated, c.Skipped, c.Removed)
+}
+
+// Report tells what Import changed.
+type Report struct {
+	Users         Count
+	Channels      Count
+	EventRules    Count
+	QuestionTiers Count
+	Timers        Count
+	// ChangedUsers, CreatedChannels and UpdatedChannels hold ids, so a running bot can pick up the changes.
+	ChangedUsers    []string
+	CreatedChannels []string
+	UpdatedChannels []string
+}
+
+// Import writes the file to repo, resolving what already exists with strategy. It isn't atomic: when it fails the
+// report tells what was imported before the error.
+func Import(ctx context.Context, repo chat.Repository, file *File, strategy Strategy) (*Report, error) {
+	if _, err := ParseStrategy(string(strategy)); err != nil {
+		return nil, err
+	}
+	i := &importer{repo: repo, strategy: strategy, report: &Report{}, now: time.Now()}
+	for _, user := range file.Users {
+		if err := i.user(ctx, user); err != nil {
+			return i.report, fmt.Errorf(`backup: importing user %s: %w`, user.Username, err)
+		}
+	}
+	return i.report, nil
+}
+
+type importer struct {
+	repo     chat.Repository
+	strategy Strategy
+	report   *Report
+	now      time.Time
+}
+
+func (i *importer) user(ctx context.Context, imported *User) error {
+	existing, err := i.repo.GetUser(ctx, imported.ID)
+	switch {
+	case errors.Is(err, chat.ErrNotFound):
+		user := &chat.User{
+			ID:           imported.ID,
+			Username:     imported.Username,
+			AccessToken:  imported.AccessToken,
+			RefreshToken: imported.RefreshToken,
+			ExpiresAt:    imported.ExpiresAt,
+			NeedsReauth:  imported.RefreshToken == ``,
+			Scopes:       imported.Scopes,
+			CreatedAt:    createdAt(imported.CreatedAt, i.now),
+		}
+		if err := i.repo.SaveUser(ctx, user); err != nil {
+			return err
+		}
+		i.report.Users.Created++
+		i.report.ChangedUsers = append(i.report.ChangedUsers, user.ID)
+	case err != nil:
+		return err
+	case i.strategy == Skip:
+		i.report.Users.Skipped++
+	default:
+		existing.Username = imported.Username
+		// a file without tokens doesn't take away the tokens the user already has
+		if imported.RefreshToken != `` {
+			existing.AccessToken = imported.AccessToken
+			existing.RefreshToken = imported.RefreshToken
+			existing.ExpiresAt = imported.ExpiresAt
+			existing.Scopes = imported.Scopes
+			existing.NeedsReauth = false
+		}
+		if err := i.repo.UpdateUser(ctx, existing); err != nil {
+			return err
+		}
+		i.report.Users.Updated++
+		i.report.ChangedUsers = append(i.report.ChangedUsers, existing.ID)
+	}
+	for _, channel := range imported.Channels {
+		if err := i.channel(ctx, imported.ID, channel); err != nil {
+			return fmt.Errorf(`channel %s: %w`, channel.Name, err)
+		}
+	}
+	return nil
+}
+
+func (i *importer) channel(ctx context.Context, userId string, imported *Channel) error {
+	existing, err := i.repo.GetChannel(ctx, imported.ID)
+	switch {
+	case errors.Is(err, chat.ErrNotFound):
+		channel := &chat.Channel{
+			ID:            imported.ID,
+			Name:          imported.Name,
+			UserId:        userId,
+			RewardID:      imported.RewardID,
+			AnswerWhen:    imported.AnswerWhen,
+			StreamContext: imported.StreamContext,
+			Paused:        imported.Paused,
+			CreatedAt:     createdAt(imported.CreatedAt, i.now),
+		}
+		if err := i.repo.SaveChannel(ctx, channel); err != nil {
+			return err
+		}
+		i.report.Channels.Created++
+		i.report.CreatedChannels = append(i.report.CreatedChannels, channel.ID)
+	case err != nil:
+		return err
+	case existing.UserId != userId:
+		return fmt.Errorf(`%w: the channel belongs to user %s`, chat.ErrConflict, existing.UserId)
+	case i.strategy == Skip:
+		i.report.Channels.Skipped++
+	default:
+		existing.Name = imported.Name
+		existing.RewardID = imported.RewardID
+		existing.AnswerWhen = imported.AnswerWhen
+		existing.StreamContext = imported.StreamContext
+		existing.Paused = imported.Paused
+		if err := i.repo.UpdateChannel(ctx, existing); err != nil {
+			return err
+		}
+		i.report.Channels.Updated++
+		i.report.UpdatedChannels = append(i.report.UpdatedChannels, existing.ID)
+	}
+	if err := i.eventRules(ctx, imported); err != nil {
+		return err
+	}
+	if err := i.questionTiers(ctx, imported); err != nil {
+		return err
+	}
+	return i.timers(ctx, imported)
+}
+
+func (i *importer) eventRules(ctx context.Context, channel *Channel) error {
+	rules, err := i.repo.GetEventRulesByChannel(ctx, channel.ID)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]*chat.EventRule, len(rules))
+	for _, rule := range rules {
+		existing[rule.Event] = rule
+	}
+	for _, imported := range channel.EventRules {
+		rule, ok := existing[imported.Event]
+		delete(existing, imported.Event)
+		if ok && i.strategy == Skip {
+			i.report.EventRules.Skipped++
+			continue
+		}
+		if !ok {
+			rule = &chat.EventRule{ID: uuid.New().String(), ChannelID: channel.ID, Event: imported.Event, CreatedAt: i.now}
+		}
+		rule.Enabled = imported.Enabled
+		rule.Prompt = imported.Prompt
+		rule.Cooldown = time.Duration(imported.CooldownSeconds) * time.Second
+		rule.BatchWindow = time.Duration(imported.BatchWindowSeconds) * time.Second
+		if !ok {
+			if err := i.repo.SaveEventRule(ctx, rule); err != nil {
+				return err
+			}
+			i.report.EventRules.Created++
+			continue
+		}
+		if err := i.repo.UpdateEventRule(ctx, rule); err != nil {
+			return err
+		}
+		i.report.EventRules.Updated++
+	}
+	if i.strategy != Overwrite {
+		return nil
+	}
+	// event rules can't be deleted, only disabled, as in the admin UI
+	for _, rule := range existing {
+		if !rule.Enabled {
+			continue
+		}
+		rule.Enabled = false
+		if err := i.repo.UpdateEventRule(ctx, rule); err != nil {
+			return err
+		}
+		i.report.EventRules.Removed++
+	}
+	return nil
+}
+
+func (i *importer) questionTiers(ctx context.Context, channel *Channel) error {
+	tiers, err := i.repo.GetQuestionTiersByChannel(ctx, channel.ID)
+	if err != nil {
+		return err
+	}
+	existing := make(map[int]*chat.QuestionTier, len(tiers))
+	for _, tier := range tiers {
+		existing[tier.MinBits] = tier
+	}
+	for _, imported := range channel.QuestionTiers {
+		tier, ok := existing[imported.MinBits]
+		delete(existing, imported.MinBits)
+		if ok && (i.strategy == Skip || tier.Model == imported.Model && tier.MaxTokens == imported.MaxTokens) {
+			i.report.QuestionTiers.Skipped++
+			continue
+		}
+		replacement := &chat.QuestionTier{ID: uuid.New().String(), ChannelID: channel.ID, MinBits: imported.MinBits, Model: imported.Model, MaxTokens: imported.MaxTokens, CreatedAt: i.now}
+		if ok {
+			// tiers have no update, so a changed tier is replaced
+			if err := i.repo.DeleteQuestionTier(ctx, tier.ID); err != nil {
+				return err
+			}
+			replacement.ID = tier.ID
+			replacement.CreatedAt = tier.CreatedAt
+		}
+		if err := i.repo.SaveQuestionTier(ctx, replacement); err != nil {
+			return err
+		}
+		if ok {
+			i.report.QuestionTiers.Updated++
+		} else {
+			i.report.QuestionTiers.Created++
+		}
+	}
+	if i.strategy != Overwrite {
+		return nil
+	}
+	for _, tier := range existing {
+		if err := i.repo.DeleteQuestionTier(ctx, tier.ID); err != nil {
+			return err
+		}
+		i.report.QuestionTiers.Removed++
+	}
+	return nil
+}
+
+func (i *importer) timers(ctx context.Context, channel *Channel) error {
+	timers, err := i.repo.GetTimersByChannel(ctx, channel.ID)
+	if err != nil {
+		return err
+	}
+	// names aren't unique, so each imported timer takes the first unmatched existing one of the same name
+	existing := make(map[string][]*chat.Timer, len(timers))
+	for _, timer := range timers {
+		existing[timer.Name] = append(existing[timer.Name], timer)
+	}
+	for _, imported := range channel.Timers {
+		var timer *chat.Timer
+		if matches := existing[imported.Name]; len(matches) > 0 {
+			timer, existing[imported.Name] = matches[0], matches[1:]
+		}
+		if timer != nil && i.strategy == Skip {
+			i.report.Timers.Skipped++
+			continue
+		}
+		created := timer == nil
+		if created {
+			timer = &chat.Timer{ID: uuid.New().String(), ChannelID: channel.ID, Name: imported.Name, CreatedAt: i.now}
+		}
+		timer.Enabled = imported.Enabled
+		timer.Interval = time.Duration(imported.IntervalSeconds) * time.Second
+		timer.MinChatLines = imported.MinChatLines
+		timer.Prompt = imported.Prompt
+		timer.Lines = imported.Lines
+		if created {
+			if err := i.repo.SaveTimer(ctx, timer); err != nil {
+				return err
+			}
+			i.report.Timers.Created++
+			continue
+		}
+		if err := i.repo.UpdateTimer(ctx, timer); err != nil {
+			return err
+		}
+		i.report.Timers.Updated++
+	}
+	if i.strategy != Overwrite {
+		return nil
+	}
+	for _, left := range existing {
+		for _, timer := range left {
+			if err := i.repo.DeleteTimer(ctx, timer.ID); err != nil {
+				return err
+			}
+			i.report.Timers.Removed++
+		}
+	}
+	return nil
+}
+
+func createdAt(t, now time.Time) time.Time {
+	if t.IsZero() {
+		return now
+	}
+	return t
+}
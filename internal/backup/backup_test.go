@@ -0,0 +1,255 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat/repotest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newConfiguredRepository(t *testing.T, now time.Time) *repotest.MemoryRepository {
+	ctx := context.Background()
+	repo := repotest.NewMemoryRepository()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(repo.SaveUser(ctx, &chat.User{ID: `1`, Username: `bot`, AccessToken: `access`, RefreshToken: `refresh`, ExpiresAt: now.Add(time.Hour), Scopes: []string{`user:bot`}, CreatedAt: now}))
+	must(repo.SaveChannel(ctx, &chat.Channel{ID: `10`, Name: `streamer`, UserId: `1`, RewardID: `reward`, AnswerWhen: chat.AnswerLive, StreamContext: true, Paused: true, DropReason: `banned`, CreatedAt: now}))
+	must(repo.SaveEventRule(ctx, &chat.EventRule{ID: `r1`, ChannelID: `10`, Event: chat.EventRaid, Enabled: true, Prompt: `welcome`, Cooldown: time.Minute, BatchWindow: 10 * time.Second, CreatedAt: now}))
+	must(repo.SaveQuestionTier(ctx, &chat.QuestionTier{ID: `q1`, ChannelID: `10`, MinBits: 100, Model: `gpt-4`, MaxTokens: 200, CreatedAt: now}))
+	must(repo.SaveTimer(ctx, &chat.Timer{ID: `t1`, ChannelID: `10`, Name: `socials`, Enabled: true, Interval: 15 * time.Minute, MinChatLines: 3, Lines: []string{`follow`, `subscribe`}, CreatedAt: now}))
+	return repo
+}
+
+func roundTrip(t *testing.T, file *File) *File {
+	var buf bytes.Buffer
+	if err := file.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return read
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	file, err := Export(ctx, newConfiguredRepository(t, now), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := repotest.NewMemoryRepository()
+	report, err := Import(ctx, repo, roundTrip(t, file), Skip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Users.Created != 1 || report.Channels.Created != 1 || report.EventRules.Created != 1 || report.QuestionTiers.Created != 1 || report.Timers.Created != 1 {
+		t.Fatalf("expected everything to be created, got %+v", report)
+	}
+	if len(report.ChangedUsers) != 1 || len(report.CreatedChannels) != 1 || report.CreatedChannels[0] != `10` {
+		t.Fatalf("expected the changed ids in the report, got %+v", report)
+	}
+
+	user, err := repo.GetUser(ctx, `1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != `bot` || user.AccessToken != `access` || user.RefreshToken != `refresh` || user.NeedsReauth || !user.CreatedAt.Equal(now) || len(user.Scopes) != 1 {
+		t.Fatalf("expected the exported user, got %+v", user)
+	}
+	channel, err := repo.GetChannel(ctx, `10`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Name != `streamer` || channel.UserId != `1` || channel.RewardID != `reward` || channel.AnswerWhen != chat.AnswerLive || !channel.StreamContext || !channel.Paused || channel.DropReason != `` {
+		t.Fatalf("expected the exported channel without its drop, got %+v", channel)
+	}
+	rules, _ := repo.GetEventRulesByChannel(ctx, `10`)
+	if len(rules) != 1 || rules[0].Event != chat.EventRaid || !rules[0].Enabled || rules[0].Prompt != `welcome` || rules[0].Cooldown != time.Minute || rules[0].BatchWindow != 10*time.Second {
+		t.Fatalf("expected the exported rule, got %+v", rules)
+	}
+	tiers, _ := repo.GetQuestionTiersByChannel(ctx, `10`)
+	if len(tiers) != 1 || tiers[0].MinBits != 100 || tiers[0].Model != `gpt-4` || tiers[0].MaxTokens != 200 {
+		t.Fatalf("expected the exported tier, got %+v", tiers)
+	}
+	timers, _ := repo.GetTimersByChannel(ctx, `10`)
+	if len(timers) != 1 || timers[0].Name != `socials` || timers[0].Interval != 15*time.Minute || timers[0].MinChatLines != 3 || len(timers[0].Lines) != 2 {
+		t.Fatalf("expected the exported timer, got %+v", timers)
+	}
+}
+
+func TestExportWithoutTokens(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	file, err := Export(ctx, newConfiguredRepository(t, now), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := file.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), `refresh`) || strings.Contains(buf.String(), `"access`) {
+		t.Fatalf("expected no tokens in the export, got %s", buf.String())
+	}
+
+	repo := repotest.NewMemoryRepository()
+	if _, err := Import(ctx, repo, roundTrip(t, file), Merge); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := repo.GetUser(ctx, `1`); !user.NeedsReauth || user.RefreshToken != `` {
+		t.Fatalf("expected a new user without tokens to need re-authorising, got %+v", user)
+	}
+
+	existing := newConfiguredRepository(t, now)
+	if _, err := Import(ctx, existing, file, Overwrite); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := existing.GetUser(ctx, `1`); user.NeedsReauth || user.RefreshToken != `refresh` {
+		t.Fatalf("expected an existing user to keep their tokens, got %+v", user)
+	}
+}
+
+// changedFile is the exported configuration with the rule, tier and timer changed, and one of each added.
+func changedFile(t *testing.T, now time.Time) *File {
+	file, err := Export(context.Background(), newConfiguredRepository(t, now), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := file.Users[0].Channels[0]
+	channel.AnswerWhen = chat.AnswerOffline
+	channel.EventRules[0].Prompt = `changed`
+	channel.QuestionTiers[0].Model = `gpt-4o`
+	channel.Timers[0].IntervalSeconds = 60
+	channel.EventRules = append(channel.EventRules, &EventRule{Event: chat.EventSub, Enabled: true, Prompt: `thanks`})
+	channel.QuestionTiers = append(channel.QuestionTiers, &QuestionTier{MinBits: 500})
+	channel.Timers = append(channel.Timers, &Timer{Name: `discord`, IntervalSeconds: 600, Lines: []string{`join`}})
+	return file
+}
+
+func TestImportStrategies(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+
+	t.Run(`skip`, func(t *testing.T) {
+		repo := newConfiguredRepository(t, now)
+		report, err := Import(ctx, repo, changedFile(t, now), Skip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Users.Skipped != 1 || report.Channels.Skipped != 1 || report.EventRules.Skipped != 1 || report.EventRules.Created != 1 || report.Timers.Skipped != 1 || report.Timers.Created != 1 {
+			t.Fatalf("expected existing rows to be skipped and new ones created, got %+v", report)
+		}
+		if channel, _ := repo.GetChannel(ctx, `10`); channel.AnswerWhen != chat.AnswerLive {
+			t.Fatalf("expected the channel to be left as it was, got %+v", channel)
+		}
+		if rules, _ := repo.GetEventRulesByChannel(ctx, `10`); len(rules) != 2 || rules[0].Prompt != `welcome` {
+			t.Fatalf("expected the existing rule to be left as it was, got %+v", rules)
+		}
+		if tiers, _ := repo.GetQuestionTiersByChannel(ctx, `10`); len(tiers) != 2 || tiers[0].Model != `gpt-4` {
+			t.Fatalf("expected the existing tier to be left as it was, got %+v", tiers)
+		}
+	})
+
+	t.Run(`merge`, func(t *testing.T) {
+		repo := newConfiguredRepository(t, now)
+		ctx := context.Background()
+		if err := repo.SaveTimer(ctx, &chat.Timer{ID: `t2`, ChannelID: `10`, Name: `local`, Interval: time.Hour, CreatedAt: now.Add(time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+		report, err := Import(ctx, repo, changedFile(t, now), Merge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Users.Updated != 1 || report.Channels.Updated != 1 || report.EventRules.Updated != 1 || report.QuestionTiers.Updated != 1 || report.Timers.Updated != 1 || len(report.UpdatedChannels) != 1 {
+			t.Fatalf("expected existing rows to be updated, got %+v", report)
+		}
+		if channel, _ := repo.GetChannel(ctx, `10`); channel.AnswerWhen != chat.AnswerOffline || channel.DropReason != `banned` {
+			t.Fatalf("expected the channel's settings to be updated and its drop kept, got %+v", channel)
+		}
+		if rules, _ := repo.GetEventRulesByChannel(ctx, `10`); len(rules) != 2 || rules[0].ID != `r1` || rules[0].Prompt != `changed` {
+			t.Fatalf("expected the existing rule to be updated, got %+v", rules)
+		}
+		if tiers, _ := repo.GetQuestionTiersByChannel(ctx, `10`); len(tiers) != 2 || tiers[0].ID != `q1` || tiers[0].Model != `gpt-4o` {
+			t.Fatalf("expected the existing tier to be updated, got %+v", tiers)
+		}
+		timers, _ := repo.GetTimersByChannel(ctx, `10`)
+		if len(timers) != 3 || timers[0].ID != `t1` || timers[0].Interval != time.Minute {
+			t.Fatalf("expected the existing timer to be updated and the local one kept, got %+v", timers)
+		}
+	})
+
+	t.Run(`overwrite`, func(t *testing.T) {
+		repo := newConfiguredRepository(t, now)
+		ctx := context.Background()
+		if err := repo.SaveTimer(ctx, &chat.Timer{ID: `t2`, ChannelID: `10`, Name: `local`, Interval: time.Hour, CreatedAt: now.Add(time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SaveQuestionTier(ctx, &chat.QuestionTier{ID: `q2`, ChannelID: `10`, MinBits: 1000, CreatedAt: now}); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SaveEventRule(ctx, &chat.EventRule{ID: `r2`, ChannelID: `10`, Event: chat.EventSubGift, Enabled: true, CreatedAt: now}); err != nil {
+			t.Fatal(err)
+		}
+		report, err := Import(ctx, repo, changedFile(t, now), Overwrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Timers.Removed != 1 || report.QuestionTiers.Removed != 1 || report.EventRules.Removed != 1 {
+			t.Fatalf("expected what isn't in the file to be removed, got %+v", report)
+		}
+		if timers, _ := repo.GetTimersByChannel(ctx, `10`); len(timers) != 2 || timers[0].ID != `t1` || timers[1].Name != `discord` {
+			t.Fatalf("expected only the file's timers, got %+v", timers)
+		}
+		if tiers, _ := repo.GetQuestionTiersByChannel(ctx, `10`); len(tiers) != 2 || tiers[1].MinBits != 500 {
+			t.Fatalf("expected only the file's tiers, got %+v", tiers)
+		}
+		rules, _ := repo.GetEventRulesByChannel(ctx, `10`)
+		for _, rule := range rules {
+			if rule.Enabled != (rule.Event != chat.EventSubGift) {
+				t.Fatalf("expected only the rule missing from the file to be disabled, got %+v", rules)
+			}
+		}
+	})
+}
+
+func TestImportChannelOfAnotherUser(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	file, err := Export(ctx, newConfiguredRepository(t, now), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := repotest.NewMemoryRepository()
+	if err := repo.SaveChannel(ctx, &chat.Channel{ID: `10`, Name: `streamer`, UserId: `2`, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Import(ctx, repo, file, Merge)
+	if !errors.Is(err, chat.ErrConflict) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if report.Users.Created != 1 {
+		t.Fatalf("expected the report to tell what was imported before the error, got %+v", report)
+	}
+}
+
+func TestRead(t *testing.T) {
+	if _, err := Read(strings.NewReader(`{"version": 2, "users": []}`)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	if _, err := Read(strings.NewReader(`not json`)); err == nil {
+		t.Fatal(`expected an error for a file that isn't JSON`)
+	}
+	if _, err := ParseStrategy(`replace`); !errors.Is(err, ErrUnknownStrategy) {
+		t.Fatalf("expected ErrUnknownStrategy, got %v", err)
+	}
+}
@@ -2,63 +2,122 @@ package bot
 
 import (
 	"context"
-	twitchirc "github.com/gempir/go-twitch-irc/v4"
 	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
 	"github.com/zain-saqer/twitch-chatgpt/internal/chatgpt"
 	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"slices"
 	"sync"
+	"time"
 )
 
+// timerTick is how often timers are checked, so a timer posts at most this late.
+const timerTick = 30 * time.Second
+
 type App struct {
-	Repository     chat.Repository
-	TwitchClient   *twitchirc.Client
+	Repository chat.Repository
+	Transport  chat.Transport
+	// Redemptions streams channel points redemptions of the channels that have a paid-question reward.
+	Redemptions    chat.Transport
 	lock           sync.Mutex
 	Users          map[string]*chat.User
 	ChannelsByUser map[string]map[string]*chat.Channel
 	TwitterAPI     *TwitchApiCaller
 	ChatGPTAPI     *chatgpt.API
-}
 
-func (a *App) JoinChannel(channel ...string) {
-	a.TwitchClient.Join(channel...)
-}
-
-func (a *App) Depart(channel string) {
-	a.TwitchClient.Depart(channel)
+	droppedChannels map[string]bool
+	// streamStates is the last polled state of each channel's stream, by channel id.
+	streamStates map[string]chat.StreamState
+	// roomModes is each channel's chat mode, kept by the message stream once the app starts.
+	roomModes *chat.RoomModes
 }
 
 func (a *App) AddUser(user *chat.User) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
-	if _, ok := a.Users[user.Username]; ok {
+	if existing, ok := a.Users[user.Username]; ok {
+		if existing != user {
+			a.TwitterAPI.Tokens().Replace(existing, user)
+		}
 		return
 	}
 	a.Users[user.Username] = user
 	a.ChannelsByUser[user.Username] = make(map[string]*chat.Channel)
 }
 
+// RemoveUser departs the user's channels. Like the other methods that join or depart, it calls the transports
+// only after releasing the lock: they call back into channelNames while holding their own.
 func (a *App) RemoveUser(user *chat.User) {
 	a.lock.Lock()
-	defer a.lock.Unlock()
+	channels := a.ChannelsByUser[user.Username]
 	delete(a.Users, user.Username)
 	delete(a.ChannelsByUser, user.Username)
+	a.lock.Unlock()
+	for _, channel := range channels {
+		a.Transport.Depart(user, channel)
+		a.departRedemptions(user, channel)
+	}
 }
 
 func (a *App) AddChannel(user *chat.User, channel *chat.Channel) {
 	a.lock.Lock()
-	defer a.lock.Unlock()
 	a.ChannelsByUser[user.Username][channel.Name] = channel
-	a.JoinChannel(channel.Name)
+	if channel.DropReason != "" {
+		a.markDropped(channel.ID)
+	}
+	a.lock.Unlock()
+	a.Transport.Join(user, channel)
+	if a.Redemptions != nil && channel.RewardID != "" {
+		a.Redemptions.Join(user, channel)
+	}
 }
 
 func (a *App) RemoveChannel(user *chat.User, channel *chat.Channel) {
 	a.lock.Lock()
-	defer a.lock.Unlock()
 	if _, ok := a.ChannelsByUser[user.Username]; !ok {
+		a.lock.Unlock()
 		return
 	}
 	delete(a.ChannelsByUser[user.Username], channel.Name)
-	a.Depart(channel.Name)
+	a.lock.Unlock()
+	a.Transport.Depart(user, channel)
+	a.departRedemptions(user, channel)
+}
+
+// SetChannelReward starts or stops listening to redemptions after the channel's reward was created or deleted.
+func (a *App) SetChannelReward(user *chat.User, channel *chat.Channel) {
+	a.lock.Lock()
+	if _, ok := a.ChannelsByUser[user.Username]; !ok {
+		a.lock.Unlock()
+		return
+	}
+	a.ChannelsByUser[user.Username][channel.Name] = channel
+	a.lock.Unlock()
+	a.departRedemptions(user, channel)
+	if a.Redemptions != nil && channel.RewardID != "" {
+		a.Redemptions.Join(user, channel)
+	}
+}
+
+// UpdateChannelSettings makes the pipeline see the channel's changed settings.
+func (a *App) UpdateChannelSettings(user *chat.User, channel *chat.Channel) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.ChannelsByUser[user.Username][channel.Name]; ok {
+		a.ChannelsByUser[user.Username][channel.Name] = channel
+	}
+}
+
+func (a *App) departRedemptions(user *chat.User, channel *chat.Channel) {
+	if a.Redemptions != nil {
+		a.Redemptions.Depart(user, channel)
+	}
+}
+
+func (a *App) markDropped(channelId string) {
+	if a.droppedChannels == nil {
+		a.droppedChannels = make(map[string]bool)
+	}
+	a.droppedChannels[channelId] = true
 }
 
 func (a *App) findUser(username string) *chat.User {
@@ -76,9 +135,103 @@ func (a *App) findChannel(user *chat.User, channelName string) *chat.Channel {
 	return a.ChannelsByUser[user.Username][channelName]
 }
 
-func (a *App) sendTwitchMessage(ctx context.Context, user *chat.User, channel *chat.Channel, message string) error {
-	_, err := a.TwitterAPI.SendMessage(ctx, user, channel.ID, message)
-	return err
+// channelNames returns every channel some user has added, for transports that rejoin after reconnecting.
+func (a *App) channelNames() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	names := make([]string, 0)
+	for _, channels := range a.ChannelsByUser {
+		for name := range channels {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// channelUnavailable records that Twitch refused to let us read the channel, e.g. because it was suspended.
+func (a *App) channelUnavailable(channelName, reason, message string) {
+	a.lock.Lock()
+	channels := make([]*chat.Channel, 0)
+	for _, userChannels := range a.ChannelsByUser {
+		if channel, ok := userChannels[channelName]; ok {
+			channels = append(channels, channel)
+		}
+	}
+	a.lock.Unlock()
+	for _, channel := range channels {
+		a.recordDrop(context.Background(), channel, &twitch.DropError{Code: reason, Message: message})
+	}
+}
+
+// findChannelOwner returns the channel and the user who added it.
+func (a *App) findChannelOwner(channelName string) (*chat.User, *chat.Channel) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for username, channels := range a.ChannelsByUser {
+		if channel, ok := channels[channelName]; ok {
+			return a.Users[username], channel
+		}
+	}
+	return nil, nil
+}
+
+func (a *App) findEventRule(ctx context.Context, channel *chat.Channel, event string) (*chat.EventRule, error) {
+	rules, err := a.Repository.GetEventRulesByChannel(ctx, channel.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.Event == event {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+// findQuestionTier returns the highest of the channel's tiers the bits reach, or nil when they don't reach any.
+func (a *App) findQuestionTier(ctx context.Context, channel *chat.Channel, bits int) (*chat.QuestionTier, error) {
+	tiers, err := a.Repository.GetQuestionTiersByChannel(ctx, channel.ID)
+	if err != nil {
+		return nil, err
+	}
+	var found *chat.QuestionTier
+	for _, tier := range tiers {
+		if tier.MinBits <= bits && (found == nil || tier.MinBits > found.MinBits) {
+			found = tier
+		}
+	}
+	return found, nil
+}
+
+// joinedChannels lists every channel with the user who added it.
+func (a *App) joinedChannels() []chat.JoinedChannel {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	joined := make([]chat.JoinedChannel, 0)
+	for username, channels := range a.ChannelsByUser {
+		for _, channel := range channels {
+			joined = append(joined, chat.JoinedChannel{User: a.Users[username], Channel: channel})
+		}
+	}
+	return joined
+}
+
+func (a *App) findTimers(ctx context.Context, channel *chat.Channel) ([]*chat.Timer, error) {
+	return a.Repository.GetTimersByChannel(ctx, channel.ID)
+}
+
+func (a *App) updateRedemption(ctx context.Context, user *chat.User, channel *chat.Channel, rewardId, redemptionId, status string) error {
+	return a.TwitterAPI.UpdateRedemptionStatus(ctx, user, rewardId, redemptionId, status)
+}
+
+// Connections reports on the chat transport's connections, if it keeps any.
+func (a *App) Connections() []chat.ConnectionState {
+	if supervised, ok := a.Transport.(chat.SupervisedTransport); ok {
+		return supervised.Connections()
+	}
+	return nil
 }
 
 func (a *App) gpt(ctx context.Context, query string) (string, error) {
@@ -89,12 +242,15 @@ func (a *App) gpt(ctx context.Context, query string) (string, error) {
 	return answer, nil
 }
 
+func (a *App) tieredGPT(ctx context.Context, query string, tier *chat.QuestionTier) (string, error) {
+	return a.ChatGPTAPI.CompletionsWith(ctx, query, tier.Model, tier.MaxTokens)
+}
+
 func (a *App) StartMessagePipeline(ctx context.Context) error {
 	users, err := a.Repository.GetUsers(ctx)
 	if err != nil {
 		return err
 	}
-	var channels []string
 	for _, user := range users {
 		a.AddUser(user)
 		userChannels, err := a.Repository.GetChannelsByUser(ctx, user.ID)
@@ -102,16 +258,49 @@ func (a *App) StartMessagePipeline(ctx context.Context) error {
 			return err
 		}
 		for _, channel := range userChannels {
-			channels = append(channels, channel.Name)
 			a.AddChannel(user, channel)
 		}
 	}
-	messageTypes := []uint8{chat.PrivMsg}
-	messageStream, err := twitch.NewMessagePipeline(a.TwitchClient)(ctx, messageTypes)
+	if supervised, ok := a.Transport.(chat.SupervisedTransport); ok {
+		supervised.Supervise(a.channelNames, a.channelUnavailable)
+	}
+	messageTypes := []uint8{chat.PrivMsg, chat.ClearChat, chat.ClearMsg, chat.RoomState, chat.UserNotice}
+	messageStream, err := a.Transport.MessageStream(ctx, messageTypes)
 	if err != nil {
 		return err
 	}
+	// the bot's own lines don't count as chat activity
+	activity := chat.NewChatActivity(func(username string) bool { return a.findUser(username) != nil })
+	messageStream = chat.CountChatLines(ctx, messageStream, activity)
 	filteredMessageStream := chat.FilterMessageStream(ctx, messageStream, messageTypes)
-	chat.ServeMessageStream(ctx, filteredMessageStream, a.findUser, a.findChannel, a.sendTwitchMessage, a.gpt)
+	if a.Redemptions != nil {
+		redemptionStream, err := a.Redemptions.MessageStream(ctx, []uint8{chat.Redemption})
+		if err != nil {
+			return err
+		}
+		filteredMessageStream = chat.MergeMessageStreams(ctx, filteredMessageStream, redemptionStream)
+	}
+	a.roomModes = chat.NewRoomModes()
+	chat.ServeMessageStream(ctx, filteredMessageStream, chat.MessageHandlers{
+		FindUser:         a.findUser,
+		FindChannel:      a.findChannel,
+		FindChannelOwner: a.findChannelOwner,
+		FindEventRule:    a.findEventRule,
+		SendMessage:      a.sendTwitchMessage,
+		DeleteMessage:    a.deleteTwitchMessage,
+		UpdateRedemption: a.updateRedemption,
+		FindQuestionTier: a.findQuestionTier,
+		FindStreamState:  a.StreamState,
+		GPT:              a.gpt,
+		TieredGPT:        a.tieredGPT,
+		RoomModes:        a.roomModes,
+	})
+	chat.RunTimers(ctx, activity, chat.TimerHandlers{
+		ListChannels: a.joinedChannels,
+		FindTimers:   a.findTimers,
+		IsLive:       a.isLive,
+		SendMessage:  a.sendTwitchMessage,
+		GPT:          a.gpt,
+	}, timerTick)
 	return nil
 }
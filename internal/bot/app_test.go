@@ -0,0 +1,63 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"sync"
+	"testing"
+	"time"
+)
+
+// supervisedTransport asks for the wanted channels while holding its own lock, as the IRC transport does when a
+// connection comes up; here that happens during every Join and Depart.
+type supervisedTransport struct {
+	lock       sync.Mutex
+	wanted     func() []string
+	deadlocked bool
+}
+
+func (s *supervisedTransport) MessageStream(context.Context, []uint8) (<-chan *chat.Message, error) {
+	return make(chan *chat.Message), nil
+}
+
+func (s *supervisedTransport) Join(*chat.User, *chat.Channel)   { s.connected() }
+func (s *supervisedTransport) Depart(*chat.User, *chat.Channel) { s.connected() }
+
+func (s *supervisedTransport) connected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	asked := make(chan []string, 1)
+	go func() { asked <- s.wanted() }()
+	select {
+	case <-asked:
+	case <-time.After(time.Second):
+		s.deadlocked = true
+	}
+}
+
+func (s *supervisedTransport) Supervise(channels func() []string, _ func(channelName, reason, message string)) {
+	s.wanted = channels
+}
+
+func (s *supervisedTransport) Connections() []chat.ConnectionState { return nil }
+
+func TestAddChannelWhileTransportConnects(t *testing.T) {
+	app, _, user, _ := newTestApp(t)
+	transport := &supervisedTransport{}
+	app.Transport = transport
+	transport.Supervise(app.channelNames, app.channelUnavailable)
+	app.AddUser(user)
+
+	for i := 0; i < 10; i++ {
+		channel := &chat.Channel{ID: fmt.Sprint(i), Name: fmt.Sprintf(`streamer%d`, i), UserId: user.ID}
+		app.AddChannel(user, channel)
+		if i%2 == 1 {
+			app.RemoveChannel(user, channel)
+		}
+	}
+	app.RemoveUser(user)
+	if transport.deadlocked {
+		t.Fatal(`the app held its lock while joining, so the transport could not ask for channels`)
+	}
+}
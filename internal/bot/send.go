@@ -0,0 +1,119 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"time"
+)
+
+// duplicateSuffix is an invisible tag character that makes Twitch treat a repeated message as new.
+const duplicateSuffix = " \U000E0000"
+
+// slowModeRetryDelays are the waits before each retry of a message dropped by slow mode, while the room's slow-mode
+// interval isn't known.
+var slowModeRetryDelays = []time.Duration{5 * time.Second, 15 * time.Second, 30 * time.Second}
+
+// slowModeMargin is added to a known slow-mode interval, so the retry doesn't arrive a moment too early.
+const slowModeMargin = time.Second
+
+// slowModeRetryDelay is how long to wait before the retry: the room's slow-mode interval when ROOMSTATE reported it,
+// the next fixed delay otherwise.
+func slowModeRetryDelay(slow time.Duration, retry int) time.Duration {
+	if slow > 0 {
+		return slow + slowModeMargin
+	}
+	return slowModeRetryDelays[retry]
+}
+
+func (a *App) slowMode(channel *chat.Channel) time.Duration {
+	if a.roomModes == nil {
+		return 0
+	}
+	return a.roomModes.Get(channel.Name).Slow
+}
+
+func (a *App) sendTwitchMessage(ctx context.Context, user *chat.User, channel *chat.Channel, message string) (string, error) {
+	slowModeRetries := 0
+	tweaked := false
+	for {
+		response, err := a.TwitterAPI.SendMessage(ctx, user, channel.ID, message)
+		if err == nil {
+			a.clearDrop(ctx, channel)
+			return response.MessageId, nil
+		}
+		var dropErr *twitch.DropError
+		if !errors.As(err, &dropErr) {
+			return "", err
+		}
+		log.Warn().
+			Str(`user`, user.Username).
+			Str(`channel`, channel.Name).
+			Str(`drop_code`, dropErr.Code).
+			Str(`drop_message`, dropErr.Message).
+			Str(`message`, message).
+			Msg(`twitch dropped the message`)
+		switch {
+		case errors.Is(err, twitch.ErrSlowMode) && slowModeRetries < len(slowModeRetryDelays):
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(slowModeRetryDelay(a.slowMode(channel), slowModeRetries)):
+			}
+			slowModeRetries++
+		case errors.Is(err, twitch.ErrDuplicateMessage) && !tweaked:
+			message += duplicateSuffix
+			tweaked = true
+		default:
+			if dropErr.Persistent() {
+				a.recordDrop(ctx, channel, dropErr)
+			}
+			return "", err
+		}
+	}
+}
+
+func (a *App) deleteTwitchMessage(ctx context.Context, user *chat.User, channel *chat.Channel, messageId string) error {
+	return a.TwitterAPI.DeleteChatMessage(ctx, user, channel.ID, messageId)
+}
+
+func (a *App) recordDrop(ctx context.Context, channel *chat.Channel, dropErr *twitch.DropError) {
+	a.lock.Lock()
+	a.markDropped(channel.ID)
+	a.lock.Unlock()
+	stored, err := a.Repository.GetChannel(ctx, channel.ID)
+	if err != nil {
+		return
+	}
+	stored.DropReason = dropErr.Code
+	stored.DropMessage = dropErr.Message
+	stored.DroppedAt = time.Now()
+	if err := a.Repository.UpdateChannel(ctx, stored); err != nil {
+		sentry.CaptureException(err)
+		log.Err(err).Msg(`error while recording a dropped message`)
+	}
+}
+
+func (a *App) clearDrop(ctx context.Context, channel *chat.Channel) {
+	a.lock.Lock()
+	dropped := a.droppedChannels[channel.ID]
+	delete(a.droppedChannels, channel.ID)
+	a.lock.Unlock()
+	if !dropped {
+		return
+	}
+	stored, err := a.Repository.GetChannel(ctx, channel.ID)
+	if err != nil {
+		return
+	}
+	stored.DropReason = ""
+	stored.DropMessage = ""
+	stored.DroppedAt = time.Time{}
+	if err := a.Repository.UpdateChannel(ctx, stored); err != nil {
+		sentry.CaptureException(err)
+		log.Err(err).Msg(`error while clearing a dropped message`)
+	}
+}
@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch/twitchtest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestApp(t *testing.T) (*App, *twitchtest.Server, *chat.User, *chat.Channel) {
+	t.Helper()
+	caller, server, repo, user := newTestCaller(t)
+	channel := &chat.Channel{ID: `2`, Name: `streamer`, UserId: user.ID, CreatedAt: time.Now()}
+	if err := repo.SaveChannel(context.Background(), channel); err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		Repository:     repo,
+		Users:          map[string]*chat.User{},
+		ChannelsByUser: make(map[string]map[string]*chat.Channel),
+		TwitterAPI:     caller,
+	}
+	return app, server, user, channel
+}
+
+func TestSendTwitchMessageRetriesOnSlowMode(t *testing.T) {
+	defer func(delays []time.Duration) { slowModeRetryDelays = delays }(slowModeRetryDelays)
+	slowModeRetryDelays = []time.Duration{time.Millisecond, time.Millisecond}
+	app, server, user, channel := newTestApp(t)
+	server.FailNext(twitchtest.EndpointSendMessage, twitchtest.Dropped(`msg_slowmode`, `slow mode`), twitchtest.Dropped(`msg_slowmode`, `slow mode`))
+
+	if _, err := app.sendTwitchMessage(context.Background(), user, channel, `hello`); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Calls(twitchtest.EndpointSendMessage); got != 3 {
+		t.Fatalf("expected 3 attempts, got %d", got)
+	}
+	if messages := server.Messages(); len(messages) != 1 || messages[0].Message != `hello` {
+		t.Fatalf("unexpected messages %+v", messages)
+	}
+}
+
+func TestSendTwitchMessageGivesUpOnSlowMode(t *testing.T) {
+	defer func(delays []time.Duration) { slowModeRetryDelays = delays }(slowModeRetryDelays)
+	slowModeRetryDelays = []time.Duration{time.Millisecond}
+	app, server, user, channel := newTestApp(t)
+	server.FailNext(twitchtest.EndpointSendMessage, twitchtest.Dropped(`msg_slowmode`, ``), twitchtest.Dropped(`msg_slowmode`, ``))
+
+	_, err := app.sendTwitchMessage(context.Background(), user, channel, `hello`)
+	if !errors.Is(err, twitch.ErrSlowMode) {
+		t.Fatalf("expected ErrSlowMode, got %v", err)
+	}
+}
+
+func TestSlowModeRetryDelayFollowsTheRoom(t *testing.T) {
+	if delay := slowModeRetryDelay(30*time.Second, 0); delay != 30*time.Second+slowModeMargin {
+		t.Fatalf("expected to wait out the room's slow mode, got %s", delay)
+	}
+	for retry, want := range slowModeRetryDelays {
+		if delay := slowModeRetryDelay(0, retry); delay != want {
+			t.Fatalf("expected retry %d to wait %s without a known slow mode, got %s", retry, want, delay)
+		}
+	}
+}
+
+func TestSendTwitchMessageTweaksDuplicates(t *testing.T) {
+	app, server, user, channel := newTestApp(t)
+	server.FailNext(twitchtest.EndpointSendMessage, twitchtest.Dropped(`msg_duplicate`, `duplicate`))
+
+	if _, err := app.sendTwitchMessage(context.Background(), user, channel, `hello`); err != nil {
+		t.Fatal(err)
+	}
+	messages := server.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if messages[0].Message == `hello` || !strings.HasPrefix(messages[0].Message, `hello`) {
+		t.Fatalf("expected a tweaked message, got %q", messages[0].Message)
+	}
+}
+
+func TestSendTwitchMessageRecordsPersistentDrops(t *testing.T) {
+	app, server, user, channel := newTestApp(t)
+	server.FailNext(twitchtest.EndpointSendMessage, twitchtest.Dropped(`msg_banned`, `You are permanently banned`))
+
+	_, err := app.sendTwitchMessage(context.Background(), user, channel, `hello`)
+	if !errors.Is(err, twitch.ErrSenderBanned) {
+		t.Fatalf("expected ErrSenderBanned, got %v", err)
+	}
+	stored, err := app.Repository.GetChannel(context.Background(), channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.DropReason != `msg_banned` || stored.DroppedAt.IsZero() {
+		t.Fatalf("expected the drop to be recorded, got %+v", stored)
+	}
+
+	if _, err := app.sendTwitchMessage(context.Background(), user, channel, `hello`); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = app.Repository.GetChannel(context.Background(), channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.DropReason != `` || !stored.DroppedAt.IsZero() {
+		t.Fatalf("expected the drop to be cleared after a successful send, got %+v", stored)
+	}
+}
+
+func TestSendTwitchMessageDoesNotRetryAutoMod(t *testing.T) {
+	app, server, user, channel := newTestApp(t)
+	server.FailNext(twitchtest.EndpointSendMessage, twitchtest.Dropped(`msg_rejected`, `automod`))
+
+	_, err := app.sendTwitchMessage(context.Background(), user, channel, `hello`)
+	if !errors.Is(err, twitch.ErrAutoMod) || !errors.Is(err, twitch.ErrMessageDropped) {
+		t.Fatalf("expected ErrAutoMod, got %v", err)
+	}
+	if got := server.Calls(twitchtest.EndpointSendMessage); got != 1 {
+		t.Fatalf("expected 1 attempt, got %d", got)
+	}
+	stored, err := app.Repository.GetChannel(context.Background(), channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.DropReason != `` {
+		t.Fatalf("expected transient drops not to be recorded, got %q", stored.DropReason)
+	}
+}
@@ -0,0 +1,103 @@
+package bot
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"time"
+)
+
+// StreamPollInterval is how often the channels' live state is polled from Helix.
+const StreamPollInterval = time.Minute
+
+// streamStateMaxAge is how long a polled state is trusted. When Helix fails for longer, the state is unknown again
+// rather than stuck at whatever it was before the failures.
+const streamStateMaxAge = 3 * StreamPollInterval
+
+// streamsPerRequest is how many broadcasters Helix accepts in one /streams request.
+const streamsPerRequest = 100
+
+func (a *App) StartStreamTracking(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			a.PollStreams(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// PollStreams updates the live state of every joined channel. Any user's token can read streams, so the first one
+// that works is used for all channels. A batch that fails keeps its old state, which expires unless a later poll
+// succeeds.
+func (a *App) PollStreams(ctx context.Context) {
+	joined := a.joinedChannels()
+	if len(joined) == 0 {
+		return
+	}
+	var reader *chat.User
+	for _, j := range joined {
+		if !a.TwitterAPI.Tokens().NeedsReauth(j.User) {
+			reader = j.User
+			break
+		}
+	}
+	if reader == nil {
+		return
+	}
+	ids := make([]string, 0, len(joined))
+	for _, j := range joined {
+		ids = append(ids, j.Channel.ID)
+	}
+	for start := 0; start < len(ids); start += streamsPerRequest {
+		batch := ids[start:min(start+streamsPerRequest, len(ids))]
+		streams, err := a.TwitterAPI.GetStreams(ctx, reader, batch)
+		if err != nil {
+			log.Err(err).Int(`channels`, len(batch)).Msg(`error while polling streams`)
+			continue
+		}
+		now := time.Now()
+		states := make(map[string]chat.StreamState, len(batch))
+		for _, id := range batch {
+			states[id] = chat.StreamState{CheckedAt: now}
+		}
+		for _, stream := range streams {
+			states[stream.UserId] = chat.StreamState{Live: true, Title: stream.Title, Game: stream.GameName, StartedAt: stream.StartedAt, CheckedAt: now}
+		}
+		a.setStreamStates(states)
+	}
+}
+
+func (a *App) setStreamStates(states map[string]chat.StreamState) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.streamStates == nil {
+		a.streamStates = make(map[string]chat.StreamState)
+	}
+	for id, state := range states {
+		if previous := a.streamStates[id]; previous.Live != state.Live && !previous.CheckedAt.IsZero() {
+			log.Info().Str(`channel_id`, id).Bool(`live`, state.Live).Msg(`stream state changed`)
+		}
+		a.streamStates[id] = state
+	}
+}
+
+// StreamState returns the channel's stream as of the last poll, or an unknown state when that poll is too old.
+func (a *App) StreamState(channel *chat.Channel) chat.StreamState {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	state := a.streamStates[channel.ID]
+	if time.Since(state.CheckedAt) > streamStateMaxAge {
+		return chat.StreamState{}
+	}
+	return state
+}
+
+func (a *App) isLive(ctx context.Context, user *chat.User, channel *chat.Channel) (bool, error) {
+	return a.StreamState(channel).Live, nil
+}
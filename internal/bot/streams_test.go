@@ -0,0 +1,88 @@
+package bot
+
+import (
+	"context"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch/twitchtest"
+	"testing"
+	"time"
+)
+
+func TestPollStreamsTracksLiveState(t *testing.T) {
+	app, server, user, channel := newTestApp(t)
+	app.Users[user.Username] = user
+	app.ChannelsByUser[user.Username] = map[string]*chat.Channel{channel.Name: channel}
+	server.AddUser(channel.ID, channel.Name)
+
+	if state := app.StreamState(channel); !state.CheckedAt.IsZero() {
+		t.Fatalf("expected an unknown state before polling, got %+v", state)
+	}
+	app.PollStreams(context.Background())
+	if state := app.StreamState(channel); state.Live || state.CheckedAt.IsZero() {
+		t.Fatalf("expected the channel to be offline, got %+v", state)
+	}
+
+	server.SetStreamInfo(channel.ID, `speedruns`, `Celeste`)
+	server.SetLive(channel.ID, true)
+	app.PollStreams(context.Background())
+	state := app.StreamState(channel)
+	if !state.Live || state.Title != `speedruns` || state.Game != `Celeste` {
+		t.Fatalf("expected the channel to be live, got %+v", state)
+	}
+	if live, _ := app.isLive(context.Background(), user, channel); !live {
+		t.Fatal(`expected timers to see the channel live`)
+	}
+}
+
+func TestPollStreamsWhileTokensAreRevoked(t *testing.T) {
+	app, server, user, channel := newTestApp(t)
+	app.Users[user.Username] = user
+	app.ChannelsByUser[user.Username] = map[string]*chat.Channel{channel.Name: channel}
+	server.AddUser(channel.ID, channel.Name)
+	server.FailNext(twitchtest.EndpointValidate, twitchtest.Unauthorized())
+	server.RevokeRefreshToken(user.RefreshToken)
+
+	// the validation finds the tokens revoked and flags the user while streams are polled
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = app.TwitterAPI.Tokens().Validate(context.Background(), user)
+	}()
+	for polling := true; polling; {
+		select {
+		case <-done:
+			polling = false
+		default:
+			app.PollStreams(context.Background())
+		}
+	}
+	if !app.TwitterAPI.Tokens().NeedsReauth(user) {
+		t.Fatal(`expected the user to need re-authorising`)
+	}
+	checkedAt := app.StreamState(channel).CheckedAt
+	app.PollStreams(context.Background())
+	if state := app.StreamState(channel); !state.CheckedAt.Equal(checkedAt) {
+		t.Fatalf("expected no poll without a usable token, got %+v", state)
+	}
+}
+
+func TestStreamStateExpires(t *testing.T) {
+	app, _, user, channel := newTestApp(t)
+	channel.AnswerWhen = chat.AnswerLive
+	app.setStreamStates(map[string]chat.StreamState{
+		channel.ID: {Live: true, CheckedAt: time.Now().Add(-streamStateMaxAge - time.Second)},
+	})
+
+	// the stream may have ended since, so the channel is answered as if it was never checked, and timers stop
+	if state := app.StreamState(channel); state.Live || !state.CheckedAt.IsZero() {
+		t.Fatalf("expected a stale state to be unknown, got %+v", state)
+	}
+	if live, _ := app.isLive(context.Background(), user, channel); live {
+		t.Fatal(`expected timers not to see a stale live state`)
+	}
+
+	app.setStreamStates(map[string]chat.StreamState{channel.ID: {Live: true, CheckedAt: time.Now()}})
+	if state := app.StreamState(channel); !state.Live {
+		t.Fatalf("expected a fresh state to be kept, got %+v", state)
+	}
+}
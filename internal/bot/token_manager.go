@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"sync"
+	"time"
+)
+
+var ErrReauthRequired = errors.New("user needs to re-authorise the bot")
+
+const defaultRefreshMargin = 5 * time.Minute
+
+// tokenAPI is the part of the Twitch API the TokenManager calls.
+type tokenAPI interface {
+	RefreshAccessToken(ctx context.Context, refreshToken string) (*twitch.RefreshAccessTokenResponse, error)
+	ValidateToken(ctx context.Context, accessToken string) (*twitch.ValidateTokenResponse, error)
+}
+
+// TokenManager owns the OAuth tokens of every chat.User: refreshes are proactive, serialised per user and persisted.
+type TokenManager struct {
+	api           tokenAPI
+	repository    chat.Repository
+	refreshMargin time.Duration
+	lock          sync.Mutex
+	userLocks     map[string]*sync.Mutex
+}
+
+func NewTokenManager(api *twitch.API, repository chat.Repository) *TokenManager {
+	return &TokenManager{
+		api:           api,
+		repository:    repository,
+		refreshMargin: defaultRefreshMargin,
+		userLocks:     make(map[string]*sync.Mutex),
+	}
+}
+
+func (m *TokenManager) userLock(userId string) *sync.Mutex {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	lock, ok := m.userLocks[userId]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.userLocks[userId] = lock
+	}
+	return lock
+}
+
+// AccessToken returns a usable access token for the user, refreshing it first when it is about to expire.
+func (m *TokenManager) AccessToken(ctx context.Context, user *chat.User) (string, error) {
+	lock := m.userLock(user.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	if user.NeedsReauth {
+		return "", ErrReauthRequired
+	}
+	if user.ExpiresAt.IsZero() || time.Until(user.ExpiresAt) > m.refreshMargin {
+		return user.AccessToken, nil
+	}
+	if err := m.refresh(ctx, user); err != nil {
+		return "", err
+	}
+	return user.AccessToken, nil
+}
+
+// Refresh refreshes the user's tokens after staleAccessToken was rejected. If another caller already replaced it, the newer token is kept.
+func (m *TokenManager) Refresh(ctx context.Context, user *chat.User, staleAccessToken string) (string, error) {
+	lock := m.userLock(user.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	if user.NeedsReauth {
+		return "", ErrReauthRequired
+	}
+	if user.AccessToken != staleAccessToken {
+		return user.AccessToken, nil
+	}
+	if err := m.refresh(ctx, user); err != nil {
+		return "", err
+	}
+	return user.AccessToken, nil
+}
+
+// NeedsReauth reports whether the user has to authorise the bot again, under the lock refreshes and validations
+// hold while they change it.
+func (m *TokenManager) NeedsReauth(user *chat.User) bool {
+	lock := m.userLock(user.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	return user.NeedsReauth
+}
+
+// Replace copies freshly authorised tokens into the user, e.g. after the streamer went through the OAuth flow again.
+func (m *TokenManager) Replace(user *chat.User, authorised *chat.User) {
+	lock := m.userLock(user.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	copyTokens(user, authorised)
+}
+
+func (m *TokenManager) refresh(ctx context.Context, user *chat.User) error {
+	// another replica or another copy of the user may have refreshed already
+	stored, err := m.repository.GetUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if stored.AccessToken != user.AccessToken && time.Until(stored.ExpiresAt) > m.refreshMargin {
+		copyTokens(user, stored)
+		return nil
+	}
+	response, err := m.api.RefreshAccessToken(ctx, stored.RefreshToken)
+	if errors.Is(err, twitch.ErrInvalidRefreshToken) {
+		log.Warn().Str(`user`, user.Username).Msg(`refresh token was revoked, user needs to re-authorise`)
+		user.NeedsReauth = true
+		if err := m.repository.UpdateUser(ctx, user); err != nil {
+			sentry.CaptureException(err)
+			log.Err(err).Msg(`error while flagging user for re-authorisation`)
+		}
+		return ErrReauthRequired
+	}
+	if err != nil {
+		return err
+	}
+	user.AccessToken = response.AccessToken
+	if response.RefreshToken != "" {
+		user.RefreshToken = response.RefreshToken
+	}
+	user.ExpiresAt = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	user.NeedsReauth = false
+	return m.repository.UpdateUser(ctx, user)
+}
+
+// Validate checks the user's access token against Twitch, refreshing it when it is no longer valid, and records the scopes and expiry Twitch reports.
+func (m *TokenManager) Validate(ctx context.Context, user *chat.User) error {
+	lock := m.userLock(user.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	if user.NeedsReauth {
+		return ErrReauthRequired
+	}
+	response, err := m.api.ValidateToken(ctx, user.AccessToken)
+	if errors.Is(err, twitch.ErrUnauthorized) {
+		if err := m.refresh(ctx, user); err != nil {
+			return err
+		}
+		response, err = m.api.ValidateToken(ctx, user.AccessToken)
+	}
+	if err != nil {
+		return err
+	}
+	user.Scopes = response.Scopes
+	user.ExpiresAt = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	user.ValidatedAt = time.Now()
+	return m.repository.UpdateUser(ctx, user)
+}
+
+func copyTokens(user *chat.User, from *chat.User) {
+	user.AccessToken = from.AccessToken
+	user.RefreshToken = from.RefreshToken
+	user.ExpiresAt = from.ExpiresAt
+	user.NeedsReauth = from.NeedsReauth
+	user.Scopes = from.Scopes
+	user.ValidatedAt = from.ValidatedAt
+}
@@ -0,0 +1,190 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubTokenAPI hands out numbered tokens. While release is set, every refresh waits for it to be closed.
+type stubTokenAPI struct {
+	lock      sync.Mutex
+	refreshes int
+	revoked   bool
+	rejected  map[string]bool
+	scopes    []string
+	started   chan struct{}
+	release   chan struct{}
+}
+
+func (s *stubTokenAPI) RefreshAccessToken(_ context.Context, _ string) (*twitch.RefreshAccessTokenResponse, error) {
+	s.lock.Lock()
+	s.refreshes++
+	n, revoked, release := s.refreshes, s.revoked, s.release
+	s.lock.Unlock()
+	if release != nil {
+		s.started <- struct{}{}
+		<-release
+	}
+	if revoked {
+		return nil, twitch.ErrInvalidRefreshToken
+	}
+	return &twitch.RefreshAccessTokenResponse{
+		AccessToken:  fmt.Sprintf(`access-%d`, n),
+		RefreshToken: fmt.Sprintf(`refresh-%d`, n),
+		ExpiresIn:    3600,
+	}, nil
+}
+
+func (s *stubTokenAPI) ValidateToken(_ context.Context, accessToken string) (*twitch.ValidateTokenResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.rejected[accessToken] {
+		return nil, twitch.ErrUnauthorized
+	}
+	return &twitch.ValidateTokenResponse{Scopes: s.scopes, ExpiresIn: 1800}, nil
+}
+
+func (s *stubTokenAPI) refreshCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.refreshes
+}
+
+func newTestTokenManager(t *testing.T) (*TokenManager, *stubTokenAPI, chat.Repository, *chat.User) {
+	t.Helper()
+	repo := newTestRepository(t)
+	user := &chat.User{
+		ID:           `1`,
+		Username:     `bot`,
+		AccessToken:  `access-0`,
+		RefreshToken: `refresh-0`,
+		ExpiresAt:    time.Now().Add(time.Hour),
+		CreatedAt:    time.Now(),
+	}
+	if err := repo.SaveUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	api := &stubTokenAPI{rejected: map[string]bool{}}
+	m := NewTokenManager(nil, repo)
+	m.api = api
+	return m, api, repo, user
+}
+
+func TestTokenManagerKeepsFreshTokens(t *testing.T) {
+	m, api, _, user := newTestTokenManager(t)
+	accessToken, err := m.AccessToken(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken != `access-0` || api.refreshCount() != 0 {
+		t.Fatalf("expected the current token without a refresh, got %s after %d refreshes", accessToken, api.refreshCount())
+	}
+}
+
+func TestTokenManagerRefreshesBeforeExpiry(t *testing.T) {
+	m, api, repo, user := newTestTokenManager(t)
+	user.ExpiresAt = time.Now().Add(defaultRefreshMargin - time.Second)
+
+	accessToken, err := m.AccessToken(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken != `access-1` || user.RefreshToken != `refresh-1` || time.Until(user.ExpiresAt) < 59*time.Minute {
+		t.Fatalf("expected the token to be refreshed proactively, got %+v", user)
+	}
+	stored, err := repo.GetUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.AccessToken != `access-1` || stored.RefreshToken != `refresh-1` || stored.ExpiresAt.Sub(user.ExpiresAt).Abs() > time.Second {
+		t.Fatalf("expected the refreshed tokens to be persisted, got %+v", stored)
+	}
+	if api.refreshCount() != 1 {
+		t.Fatalf("expected 1 refresh, got %d", api.refreshCount())
+	}
+}
+
+func TestTokenManagerRefreshesOnceForConcurrentCallers(t *testing.T) {
+	m, api, _, user := newTestTokenManager(t)
+	api.started = make(chan struct{}, 1)
+	api.release = make(chan struct{})
+
+	// every caller saw access-0 rejected; the first one refreshes while the others wait for it
+	var wg sync.WaitGroup
+	tokens := make(chan string, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			accessToken, err := m.Refresh(context.Background(), user, `access-0`)
+			if err != nil {
+				t.Error(err)
+			}
+			tokens <- accessToken
+		}()
+	}
+	<-api.started
+	close(api.release)
+	wg.Wait()
+	close(tokens)
+	for accessToken := range tokens {
+		if accessToken != `access-1` {
+			t.Fatalf("expected every caller to get the one refreshed token, got %s", accessToken)
+		}
+	}
+	if api.refreshCount() != 1 {
+		t.Fatalf("expected 1 refresh, got %d", api.refreshCount())
+	}
+}
+
+func TestTokenManagerAdoptsTokensRefreshedElsewhere(t *testing.T) {
+	m, api, repo, user := newTestTokenManager(t)
+	stored := *user
+	stored.AccessToken = `access-elsewhere`
+	stored.RefreshToken = `refresh-elsewhere`
+	stored.ExpiresAt = time.Now().Add(time.Hour)
+	if err := repo.UpdateUser(context.Background(), &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	accessToken, err := m.Refresh(context.Background(), user, `access-0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken != `access-elsewhere` || user.RefreshToken != `refresh-elsewhere` || api.refreshCount() != 0 {
+		t.Fatalf("expected the stored tokens to be used without a refresh, got %+v after %d refreshes", user, api.refreshCount())
+	}
+}
+
+func TestTokenManagerFlagsRevokedRefreshToken(t *testing.T) {
+	m, api, repo, user := newTestTokenManager(t)
+	api.revoked = true
+
+	if _, err := m.Refresh(context.Background(), user, `access-0`); !errors.Is(err, ErrReauthRequired) {
+		t.Fatalf("expected ErrReauthRequired, got %v", err)
+	}
+	stored, err := repo.GetUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.NeedsReauth || !m.NeedsReauth(user) {
+		t.Fatal(`expected the user to be flagged for re-authorisation`)
+	}
+	if _, err := m.AccessToken(context.Background(), user); !errors.Is(err, ErrReauthRequired) {
+		t.Fatalf("expected ErrReauthRequired, got %v", err)
+	}
+	if api.refreshCount() != 1 {
+		t.Fatalf("expected no further refreshes, got %d", api.refreshCount())
+	}
+
+	m.Replace(user, &chat.User{AccessToken: `access-new`, RefreshToken: `refresh-new`, ExpiresAt: time.Now().Add(time.Hour)})
+	if accessToken, err := m.AccessToken(context.Background(), user); err != nil || accessToken != `access-new` {
+		t.Fatalf("expected the re-authorised token, got %s, %v", accessToken, err)
+	}
+}
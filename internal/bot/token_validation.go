@@ -0,0 +1,53 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// TokenValidationInterval is how often Twitch requires apps to validate user tokens.
+const TokenValidationInterval = time.Hour
+
+func (a *App) StartTokenValidation(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			a.ValidateTokens(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (a *App) ValidateTokens(ctx context.Context) {
+	users, err := a.Repository.GetUsers(ctx)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Err(err).Msg(`error while loading users for token validation`)
+		return
+	}
+	for _, user := range users {
+		if ctx.Err() != nil {
+			return
+		}
+		// validate the in-memory copy so the pipeline sees refreshed tokens right away
+		if appUser := a.findUser(user.Username); appUser != nil {
+			user = appUser
+		}
+		err := a.TwitterAPI.Tokens().Validate(ctx, user)
+		if errors.Is(err, ErrReauthRequired) {
+			continue
+		}
+		if err != nil {
+			sentry.CaptureException(err)
+			log.Err(err).Str(`user`, user.Username).Msg(`error while validating user token`)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package bot
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestValidateTokensRecordsScopesAndExpiry(t *testing.T) {
+	app, _, user, _ := newTestApp(t)
+	api := &stubTokenAPI{rejected: map[string]bool{}, scopes: []string{`user:bot`, `user:write:chat`}}
+	app.TwitterAPI.tokens.api = api
+	app.AddUser(user)
+
+	before := time.Now()
+	app.ValidateTokens(context.Background())
+	if !slices.Equal(user.Scopes, api.scopes) || user.ValidatedAt.Before(before) || user.NeedsReauth {
+		t.Fatalf("expected the validation to be recorded on the app's user, got %+v", user)
+	}
+	if expiresIn := time.Until(user.ExpiresAt); expiresIn < 29*time.Minute || expiresIn > 30*time.Minute {
+		t.Fatalf("expected the expiry Twitch reported, got %s", expiresIn)
+	}
+	stored, err := app.Repository.GetUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(stored.Scopes, api.scopes) || stored.ValidatedAt.IsZero() || stored.NeedsReauth {
+		t.Fatalf("expected the validation to be persisted, got %+v", stored)
+	}
+}
+
+func TestValidateTokensRefreshesRejectedToken(t *testing.T) {
+	app, _, user, _ := newTestApp(t)
+	api := &stubTokenAPI{rejected: map[string]bool{user.AccessToken: true}, scopes: []string{`user:bot`}}
+	app.TwitterAPI.tokens.api = api
+	app.AddUser(user)
+
+	app.ValidateTokens(context.Background())
+	if user.AccessToken != `access-1` || api.refreshCount() != 1 {
+		t.Fatalf("expected the rejected token to be refreshed, got %s after %d refreshes", user.AccessToken, api.refreshCount())
+	}
+	if !slices.Equal(user.Scopes, api.scopes) || user.ValidatedAt.IsZero() {
+		t.Fatalf("expected the refreshed token to be validated, got %+v", user)
+	}
+}
+
+func TestValidateTokensFlagsRevokedTokens(t *testing.T) {
+	app, _, user, _ := newTestApp(t)
+	api := &stubTokenAPI{rejected: map[string]bool{user.AccessToken: true}, revoked: true}
+	app.TwitterAPI.tokens.api = api
+	app.AddUser(user)
+
+	app.ValidateTokens(context.Background())
+	if !app.TwitterAPI.Tokens().NeedsReauth(user) || !user.ValidatedAt.IsZero() {
+		t.Fatalf("expected the user to need re-authorising, got %+v", user)
+	}
+	stored, err := app.Repository.GetUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.NeedsReauth {
+		t.Fatal(`expected the flag to be persisted`)
+	}
+
+	// the next round leaves the user alone until they authorise the bot again
+	app.ValidateTokens(context.Background())
+	if api.refreshCount() != 1 {
+		t.Fatalf("expected no further refreshes, got %d", api.refreshCount())
+	}
+}
@@ -3,23 +3,39 @@ package bot
 import (
 	"context"
 	"errors"
+	"github.com/rs/zerolog/log"
 	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
 	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"sync"
 	"time"
 )
 
+const moderatedChannelsTTL = 10 * time.Minute
+
 type TwitchApiCaller struct {
 	api        *twitch.API
 	repository chat.Repository
+	tokens     *TokenManager
+
+	lock                  sync.Mutex
+	moderatedChannelsAt   map[string]time.Time
+	moderatedChannelsLock map[string]*sync.Mutex
 }
 
 func NewTwitchApiCaller(api *twitch.API, repository chat.Repository) *TwitchApiCaller {
 	return &TwitchApiCaller{
-		api:        api,
-		repository: repository,
+		api:                   api,
+		repository:            repository,
+		tokens:                NewTokenManager(api, repository),
+		moderatedChannelsAt:   make(map[string]time.Time),
+		moderatedChannelsLock: make(map[string]*sync.Mutex),
 	}
 }
 
+func (a *TwitchApiCaller) Tokens() *TokenManager {
+	return a.tokens
+}
+
 func (a *TwitchApiCaller) GetUser(ctx context.Context, accessToken, username string) (*twitch.User, error) {
 	return a.api.GetUser(ctx, accessToken, username)
 }
@@ -28,21 +44,129 @@ func (a *TwitchApiCaller) GetCurrentUser(ctx context.Context, accessToken string
 	return a.api.GetCurrentUser(ctx, accessToken)
 }
 
+func (a *TwitchApiCaller) GetUserAs(ctx context.Context, user *chat.User, username string) (*twitch.User, error) {
+	var twitchUser *twitch.User
+	err := a.withAccessToken(ctx, user, func(accessToken string) (err error) {
+		twitchUser, err = a.api.GetUser(ctx, accessToken, username)
+		return err
+	})
+	return twitchUser, err
+}
+
 func (a *TwitchApiCaller) SendMessage(ctx context.Context, user *chat.User, broadcasterId, message string) (*twitch.SendMessageResponse, error) {
-	response, err := a.api.SendMessage(ctx, user, broadcasterId, message)
-	if err == nil {
-		return response, nil
+	a.refreshModeratedChannels(ctx, user)
+	// take the chat slot once, a retry after refreshing the token is still the same message
+	if err := a.api.Limiter().WaitChat(ctx, user.ID, broadcasterId); err != nil {
+		return nil, err
 	}
+	var response *twitch.SendMessageResponse
+	err := a.withAccessToken(ctx, user, func(accessToken string) (err error) {
+		response, err = a.api.SendMessage(ctx, accessToken, user.ID, broadcasterId, message)
+		return err
+	})
+	return response, err
+}
+
+func (a *TwitchApiCaller) DeleteChatMessage(ctx context.Context, user *chat.User, broadcasterId, messageId string) error {
+	return a.withAccessToken(ctx, user, func(accessToken string) error {
+		return a.api.DeleteChatMessage(ctx, accessToken, broadcasterId, user.ID, messageId)
+	})
+}
+
+// CreateCustomReward creates a reward in the user's own channel.
+func (a *TwitchApiCaller) CreateCustomReward(ctx context.Context, user *chat.User, reward *twitch.CustomReward) (*twitch.CustomReward, error) {
+	var created *twitch.CustomReward
+	err := a.withAccessToken(ctx, user, func(accessToken string) (err error) {
+		created, err = a.api.CreateCustomReward(ctx, accessToken, user.ID, reward)
+		return err
+	})
+	return created, err
+}
+
+func (a *TwitchApiCaller) DeleteCustomReward(ctx context.Context, user *chat.User, rewardId string) error {
+	return a.withAccessToken(ctx, user, func(accessToken string) error {
+		return a.api.DeleteCustomReward(ctx, accessToken, user.ID, rewardId)
+	})
+}
+
+func (a *TwitchApiCaller) UpdateRedemptionStatus(ctx context.Context, user *chat.User, rewardId, redemptionId, status string) error {
+	return a.withAccessToken(ctx, user, func(accessToken string) error {
+		return a.api.UpdateRedemptionStatus(ctx, accessToken, user.ID, rewardId, redemptionId, status)
+	})
+}
+
+func (a *TwitchApiCaller) GetStreams(ctx context.Context, user *chat.User, broadcasterIds []string) ([]*twitch.Stream, error) {
+	var streams []*twitch.Stream
+	err := a.withAccessToken(ctx, user, func(accessToken string) (err error) {
+		streams, err = a.api.GetStreams(ctx, accessToken, broadcasterIds)
+		return err
+	})
+	return streams, err
+}
+
+func (a *TwitchApiCaller) withAccessToken(ctx context.Context, user *chat.User, call func(accessToken string) error) error {
+	accessToken, err := a.tokens.AccessToken(ctx, user)
+	if err != nil {
+		return err
+	}
+	err = call(accessToken)
 	if !errors.Is(err, twitch.ErrUnauthorized) {
-		return nil, err
+		return err
 	}
-	refreshTokenResponse, err := a.api.RefreshAccessToken(user.RefreshToken)
+	accessToken, err = a.tokens.Refresh(ctx, user, accessToken)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	user.AccessToken = refreshTokenResponse.AccessToken
-	user.RefreshToken = refreshTokenResponse.RefreshToken
-	user.ExpiresAt = time.Now().Add(time.Duration(refreshTokenResponse.ExpiresIn) * time.Second)
-	response, err = a.api.SendMessage(ctx, user, broadcasterId, message)
-	return response, err
+	return call(accessToken)
+}
+
+// refreshModeratedChannels tells the rate limiter where the user is a moderator, so those channels get the higher chat limit.
+func (a *TwitchApiCaller) refreshModeratedChannels(ctx context.Context, user *chat.User) {
+	a.lock.Lock()
+	lock, ok := a.moderatedChannelsLock[user.ID]
+	if !ok {
+		lock = &sync.Mutex{}
+		a.moderatedChannelsLock[user.ID] = lock
+	}
+	a.lock.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+	a.lock.Lock()
+	fetchedAt := a.moderatedChannelsAt[user.ID]
+	a.lock.Unlock()
+	if time.Since(fetchedAt) < moderatedChannelsTTL {
+		return
+	}
+	var channels []*twitch.ModeratedChannel
+	// a 401 here usually means the scope is missing, so don't go through the refresh-and-retry path
+	accessToken, err := a.tokens.AccessToken(ctx, user)
+	if err == nil {
+		channels, err = a.api.GetModeratedChannels(ctx, accessToken, user.ID)
+	}
+	a.lock.Lock()
+	a.moderatedChannelsAt[user.ID] = time.Now()
+	a.lock.Unlock()
+	if err != nil {
+		log.Debug().Err(err).Str(`user`, user.Username).Msg(`could not list moderated channels, using the default chat limit`)
+		return
+	}
+	a.api.Limiter().ResetModerator(user.ID)
+	for _, channel := range channels {
+		a.api.Limiter().SetModerator(user.ID, channel.BroadcasterId, true)
+	}
+}
+
+func (a *TwitchApiCaller) CreateEventSubSubscription(ctx context.Context, user *chat.User, subscription *twitch.EventSubSubscription) (*twitch.EventSubSubscription, error) {
+	var created *twitch.EventSubSubscription
+	err := a.withAccessToken(ctx, user, func(accessToken string) (err error) {
+		created, err = a.api.CreateEventSubSubscription(ctx, accessToken, subscription)
+		return err
+	})
+	return created, err
+}
+
+func (a *TwitchApiCaller) DeleteEventSubSubscription(ctx context.Context, user *chat.User, id string) error {
+	return a.withAccessToken(ctx, user, func(accessToken string) error {
+		return a.api.DeleteEventSubSubscription(ctx, accessToken, id)
+	})
 }
@@ -0,0 +1,263 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat/repotest"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch/twitchtest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRepository(t *testing.T) chat.Repository {
+	return repotest.NewMemoryRepository()
+}
+
+func newTestCaller(t *testing.T) (*TwitchApiCaller, *twitchtest.Server, chat.Repository, *chat.User) {
+	t.Helper()
+	server := twitchtest.NewServer()
+	t.Cleanup(server.Close)
+	repo := newTestRepository(t)
+	accessToken, refreshToken := server.AddUser(`1`, `bot`, `user:write:chat`)
+	server.AddUser(`2`, `streamer`)
+	user := &chat.User{
+		ID:           `1`,
+		Username:     `bot`,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresAt:    time.Now().Add(time.Hour),
+		CreatedAt:    time.Now(),
+	}
+	if err := repo.SaveUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return NewTwitchApiCaller(server.API(), repo), server, repo, user
+}
+
+func TestTwitchApiCallerSendMessage(t *testing.T) {
+	caller, server, _, user := newTestCaller(t)
+	response, err := caller.SendMessage(context.Background(), user, `2`, `hello`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.IsSent {
+		t.Fatal(`expected message to be sent`)
+	}
+	messages := server.Messages()
+	if len(messages) != 1 || messages[0].Message != `hello` || messages[0].BroadcasterId != `2` || messages[0].SenderId != `1` {
+		t.Fatalf("unexpected messages %+v", messages)
+	}
+}
+
+func TestTwitchApiCallerRefreshesOnUnauthorized(t *testing.T) {
+	caller, server, repo, user := newTestCaller(t)
+	oldAccessToken := user.AccessToken
+	server.ExpireAccessToken(oldAccessToken)
+
+	if _, err := caller.SendMessage(context.Background(), user, `2`, `hello`); err != nil {
+		t.Fatal(err)
+	}
+	if user.AccessToken == oldAccessToken {
+		t.Fatal(`expected access token to be refreshed`)
+	}
+	if got := server.Calls(twitchtest.EndpointToken); got != 1 {
+		t.Fatalf("expected 1 refresh, got %d", got)
+	}
+	stored, err := repo.GetUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.AccessToken != user.AccessToken || stored.RefreshToken != user.RefreshToken {
+		t.Fatal(`expected refreshed tokens to be persisted`)
+	}
+	if messages := server.Messages(); len(messages) != 1 || messages[0].AccessToken != user.AccessToken {
+		t.Fatalf("expected the retry to use the new token, got %+v", messages)
+	}
+}
+
+func TestTwitchApiCallerRetryTakesNoSecondChatSlot(t *testing.T) {
+	caller, server, _, user := newTestCaller(t)
+	// leave one slot of the 20 messages a sender may post in 30 seconds
+	for i := 0; i < 19; i++ {
+		if _, err := caller.SendMessage(context.Background(), user, `2`, `hello`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.ExpireAccessToken(user.AccessToken)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := caller.SendMessage(ctx, user, `2`, `last`); err != nil {
+		t.Fatalf("expected the retry to reuse the message's chat slot, got %v", err)
+	}
+	if messages := server.Messages(); len(messages) != 20 || messages[19].Message != `last` {
+		t.Fatalf("unexpected messages %+v", messages)
+	}
+}
+
+func TestTwitchApiCallerRefreshesBeforeExpiry(t *testing.T) {
+	caller, server, _, user := newTestCaller(t)
+	oldAccessToken := user.AccessToken
+	user.ExpiresAt = time.Now().Add(time.Minute)
+
+	if _, err := caller.SendMessage(context.Background(), user, `2`, `hello`); err != nil {
+		t.Fatal(err)
+	}
+	if user.AccessToken == oldAccessToken {
+		t.Fatal(`expected access token to be refreshed proactively`)
+	}
+	if time.Until(user.ExpiresAt) < time.Hour {
+		t.Fatalf("expected a new expiry, got %s", user.ExpiresAt)
+	}
+	if got := server.Calls(twitchtest.EndpointSendMessage); got != 1 {
+		t.Fatalf("expected a single send, got %d", got)
+	}
+}
+
+func TestTwitchApiCallerSerialisesRefreshes(t *testing.T) {
+	caller, server, _, user := newTestCaller(t)
+	server.ExpireAccessToken(user.AccessToken)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := caller.SendMessage(context.Background(), user, `2`, `hello`)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := server.Calls(twitchtest.EndpointToken); got != 1 {
+		t.Fatalf("expected 1 refresh, got %d", got)
+	}
+	if got := len(server.Messages()); got != 5 {
+		t.Fatalf("expected 5 messages, got %d", got)
+	}
+}
+
+func TestTwitchApiCallerFlagsRevokedRefreshToken(t *testing.T) {
+	caller, server, repo, user := newTestCaller(t)
+	server.ExpireAccessToken(user.AccessToken)
+	server.RevokeRefreshToken(user.RefreshToken)
+
+	_, err := caller.SendMessage(context.Background(), user, `2`, `hello`)
+	if !errors.Is(err, ErrReauthRequired) {
+		t.Fatalf("expected ErrReauthRequired, got %v", err)
+	}
+	stored, err := repo.GetUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.NeedsReauth {
+		t.Fatal(`expected user to be flagged for re-authorisation`)
+	}
+	_, err = caller.SendMessage(context.Background(), user, `2`, `hello`)
+	if !errors.Is(err, ErrReauthRequired) {
+		t.Fatalf("expected ErrReauthRequired, got %v", err)
+	}
+	if got := server.Calls(twitchtest.EndpointToken); got != 1 {
+		t.Fatalf("expected no further refresh attempts, got %d", got)
+	}
+}
+
+func TestTwitchApiCallerQueuesRateLimitedSends(t *testing.T) {
+	caller, server, _, user := newTestCaller(t)
+	server.FailNext(twitchtest.EndpointSendMessage, twitchtest.RateLimited(0))
+
+	if _, err := caller.SendMessage(context.Background(), user, `2`, `hello`); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Calls(twitchtest.EndpointSendMessage); got != 2 {
+		t.Fatalf("expected the send to be retried, got %d calls", got)
+	}
+	if len(server.Messages()) != 1 {
+		t.Fatal(`expected the message to be sent`)
+	}
+}
+
+func TestTwitchApiCallerUsesModeratorChatLimit(t *testing.T) {
+	caller, server, _, user := newTestCaller(t)
+	server.AddUser(`3`, `other`)
+	server.AddModerator(user.ID, `2`)
+
+	if _, err := caller.SendMessage(context.Background(), user, `2`, `hello`); err != nil {
+		t.Fatal(err)
+	}
+	if !caller.api.Limiter().IsModerator(user.ID, `2`) {
+		t.Fatal(`expected the bot to be known as a moderator in channel 2`)
+	}
+	if caller.api.Limiter().IsModerator(user.ID, `3`) {
+		t.Fatal(`expected the bot not to be a moderator in channel 3`)
+	}
+	if _, err := caller.SendMessage(context.Background(), user, `3`, `hello`); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Calls(twitchtest.EndpointModerated); got != 1 {
+		t.Fatalf("expected moderated channels to be cached, got %d calls", got)
+	}
+}
+
+func TestTwitchApiCallerGetUserAs(t *testing.T) {
+	caller, server, _, user := newTestCaller(t)
+	server.FailNext(twitchtest.EndpointUsers, twitchtest.Unauthorized())
+
+	twitchUser, err := caller.GetUserAs(context.Background(), user, `streamer`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if twitchUser.ID != `2` {
+		t.Fatalf("expected user 2, got %s", twitchUser.ID)
+	}
+}
+
+func TestTokenManagerValidate(t *testing.T) {
+	caller, server, repo, user := newTestCaller(t)
+	server.ExpireAccessToken(user.AccessToken)
+
+	if err := caller.Tokens().Validate(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := repo.GetUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ValidatedAt.IsZero() {
+		t.Fatal(`expected validation time to be recorded`)
+	}
+	if len(stored.Scopes) != 1 || stored.Scopes[0] != `user:write:chat` {
+		t.Fatalf("unexpected scopes %v", stored.Scopes)
+	}
+	if _, err := server.API().ValidateToken(context.Background(), stored.AccessToken); err != nil {
+		t.Fatalf("expected the stored token to be valid: %v", err)
+	}
+	_, err = server.API().ValidateToken(context.Background(), `unknown`)
+	if !errors.Is(err, twitch.ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+}
+
+func TestTwitchApiCallerDeleteChatMessage(t *testing.T) {
+	caller, server, _, user := newTestCaller(t)
+	err := caller.DeleteChatMessage(context.Background(), user, `2`, `message-1`)
+	if !errors.Is(err, twitch.ErrForbidden) {
+		t.Fatalf("expected a forbidden error when the bot is not a moderator, got %v", err)
+	}
+	server.AddModerator(user.ID, `2`)
+	if err := caller.DeleteChatMessage(context.Background(), user, `2`, `message-1`); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := server.DeletedChatMessages(); len(deleted) != 1 || deleted[0] != `message-1` {
+		t.Fatalf("unexpected deleted messages %v", deleted)
+	}
+}
@@ -0,0 +1,100 @@
+package chat
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+type askedQuestion struct {
+	asker     string
+	messageId string
+}
+
+type inflightQuestion struct {
+	questions []askedQuestion
+}
+
+// questionCoalescer lets concurrent identical questions in the same channel share one completion.
+type questionCoalescer struct {
+	lock  sync.Mutex
+	calls map[string]*inflightQuestion
+}
+
+func newQuestionCoalescer() *questionCoalescer {
+	return &questionCoalescer{calls: make(map[string]*inflightQuestion)}
+}
+
+func questionKey(channelName, question string) string {
+	return strings.ToLower(channelName) + "\x00" + strings.ToLower(strings.Join(strings.Fields(question), " "))
+}
+
+// join registers the asker for the question and reports whether the caller is the leader that must run the completion.
+func (c *questionCoalescer) join(key, asker, messageId string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if call, ok := c.calls[key]; ok {
+		call.questions = append(call.questions, askedQuestion{asker: asker, messageId: messageId})
+		return false
+	}
+	c.calls[key] = &inflightQuestion{questions: []askedQuestion{{asker: asker, messageId: messageId}}}
+	return true
+}
+
+// done removes the in-flight question and returns everyone who asked it while it was running, along with the ids of
+// the messages they asked it in.
+func (c *questionCoalescer) done(key string) (askers []string, messageIds []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	call, ok := c.calls[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(c.calls, key)
+	for _, question := range call.questions {
+		if !slices.Contains(askers, question.asker) {
+			askers = append(askers, question.asker)
+		}
+		if question.messageId != "" {
+			messageIds = append(messageIds, question.messageId)
+		}
+	}
+	return askers, messageIds
+}
+
+// forget drops the asker's in-flight questions in the channel, or everyone's when asker is empty.
+func (c *questionCoalescer) forget(channelName, asker string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	prefix := strings.ToLower(channelName) + "\x00"
+	for key, call := range c.calls {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		call.questions = slices.DeleteFunc(call.questions, func(question askedQuestion) bool {
+			return asker == "" || strings.EqualFold(question.asker, asker)
+		})
+	}
+}
+
+// forgetMessage drops the in-flight question that was asked in the given message.
+func (c *questionCoalescer) forgetMessage(messageId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, call := range c.calls {
+		call.questions = slices.DeleteFunc(call.questions, func(question askedQuestion) bool {
+			return question.messageId == messageId
+		})
+	}
+}
+
+func mentionAskers(askers []string, answer string) string {
+	var b strings.Builder
+	for _, asker := range askers {
+		b.WriteString("@")
+		b.WriteString(asker)
+		b.WriteString(" ")
+	}
+	b.WriteString(answer)
+	return b.String()
+}
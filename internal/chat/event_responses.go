@@ -0,0 +1,221 @@
+package chat
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Events that can have an EventRule, named after the msg-id of their USERNOTICE.
+const (
+	EventSub           = `sub`
+	EventResub         = `resub`
+	EventRaid          = `raid`
+	EventSubGift       = `subgift`
+	EventBitsBadgeTier = `bitsbadgetier`
+)
+
+var Events = []string{EventSub, EventResub, EventRaid, EventSubGift, EventBitsBadgeTier}
+
+var DefaultEventPrompts = map[string]string{
+	EventSub:           `Write one short, excited chat message thanking {{.User}} for subscribing to {{.Channel}}.`,
+	EventResub:         `Write one short chat message thanking {{.User}} for subscribing to {{.Channel}} for {{.Months}} months.`,
+	EventRaid:          `Write one short shout-out welcoming {{.User}} and their {{.Viewers}} raiders to {{.Channel}}'s stream.`,
+	EventSubGift:       `Write one short chat message thanking {{join .Users ", "}} for gifting {{.Count}} subs in {{.Channel}}'s chat.`,
+	EventBitsBadgeTier: `Write one short chat message congratulating {{.User}} on reaching the {{.Bits}} bits badge in {{.Channel}}'s chat.`,
+}
+
+// EventData is what an EventRule prompt is rendered with. When several events were batched, the fields describe the
+// first one, while Users, Recipients and Count cover the whole batch.
+type EventData struct {
+	Event      string
+	Channel    string
+	User       string
+	Users      []string
+	Recipients []string
+	Count      int
+	Months     string
+	Tier       string
+	Viewers    string
+	Bits       string
+	Message    string
+}
+
+type FindEventRule func(ctx context.Context, channel *Channel, event string) (*EventRule, error)
+
+var promptFuncs = template.FuncMap{`join`: strings.Join}
+
+func parseEventPrompt(prompt string) (*template.Template, error) {
+	return template.New(`prompt`).Funcs(promptFuncs).Parse(prompt)
+}
+
+// ValidateEventPrompt reports whether the prompt template parses and only uses fields of EventData.
+func ValidateEventPrompt(prompt string) error {
+	t, err := parseEventPrompt(prompt)
+	if err != nil {
+		return err
+	}
+	return t.Execute(&strings.Builder{}, EventData{})
+}
+
+func renderEventPrompt(prompt string, data *EventData) (string, error) {
+	t, err := parseEventPrompt(prompt)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err = t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// noticeEvent maps the msg-id of a USERNOTICE to the event it has rules under.
+func noticeEvent(msgId string) string {
+	if msgId == `anonsubgift` {
+		return EventSubGift
+	}
+	if slices.Contains(Events, msgId) {
+		return msgId
+	}
+	return ""
+}
+
+func newEventData(event, channelName string, notices []*Message) *EventData {
+	first := notices[0]
+	data := &EventData{
+		Event:   event,
+		Channel: channelName,
+		User:    noticeUser(first),
+		Count:   len(notices),
+		Months:  first.Tags[`msg-param-cumulative-months`],
+		Tier:    subTier(first.Tags[`msg-param-sub-plan`]),
+		Viewers: first.Tags[`msg-param-viewerCount`],
+		Bits:    first.Tags[`msg-param-threshold`],
+		Message: first.Message,
+	}
+	for _, notice := range notices {
+		if user := noticeUser(notice); !slices.Contains(data.Users, user) {
+			data.Users = append(data.Users, user)
+		}
+		if recipient := notice.Tags[`msg-param-recipient-display-name`]; recipient != "" {
+			data.Recipients = append(data.Recipients, recipient)
+		}
+	}
+	return data
+}
+
+func noticeUser(notice *Message) string {
+	// raids name the raiding channel in msg-param-displayName
+	for _, tag := range []string{`msg-param-displayName`, `display-name`} {
+		if name := notice.Tags[tag]; name != "" {
+			return name
+		}
+	}
+	return notice.Username
+}
+
+func subTier(plan string) string {
+	if plan == `Prime` {
+		return plan
+	}
+	if n, err := strconv.Atoi(plan); err == nil && n >= 1000 {
+		return strconv.Itoa(n / 1000)
+	}
+	return plan
+}
+
+type eventBatch struct {
+	notices []*Message
+}
+
+// eventResponder batches events per rule and keeps each rule quiet for its cooldown after it responded.
+type eventResponder struct {
+	lock      sync.Mutex
+	batches   map[string]*eventBatch
+	respondAt map[string]time.Time
+}
+
+func newEventResponder() *eventResponder {
+	return &eventResponder{batches: make(map[string]*eventBatch), respondAt: make(map[string]time.Time)}
+}
+
+// add queues the notice under the rule and reports whether it opened a new batch that the caller has to respond to.
+func (r *eventResponder) add(rule *EventRule, notice *Message, now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if batch, ok := r.batches[rule.ID]; ok {
+		batch.notices = append(batch.notices, notice)
+		return false
+	}
+	if last, ok := r.respondAt[rule.ID]; ok && now.Before(last.Add(rule.Cooldown)) {
+		return false
+	}
+	r.batches[rule.ID] = &eventBatch{notices: []*Message{notice}}
+	return true
+}
+
+// take closes the rule's batch and starts its cooldown.
+func (r *eventResponder) take(rule *EventRule, now time.Time) []*Message {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	batch, ok := r.batches[rule.ID]
+	if !ok {
+		return nil
+	}
+	delete(r.batches, rule.ID)
+	r.respondAt[rule.ID] = now
+	return batch.notices
+}
+
+func (s *messageServer) eventReceived(ctx context.Context, message *Message) {
+	event := noticeEvent(message.Tags[`msg-id`])
+	if event == "" {
+		return
+	}
+	user, channel := s.FindChannelOwner(message.ChannelName)
+	if channel == nil || channel.Paused {
+		return
+	}
+	rule, err := s.FindEventRule(ctx, channel, event)
+	if err != nil {
+		log.Err(err).Str(`channel`, message.ChannelName).Msg(`error while looking up the event rule`)
+		return
+	}
+	if rule == nil || !rule.Enabled {
+		return
+	}
+	if !s.events.add(rule, message, time.Now()) {
+		return
+	}
+	if rule.BatchWindow > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rule.BatchWindow):
+		}
+	}
+	notices := s.events.take(rule, time.Now())
+	if s.modes.Get(channel.Name).EmoteOnly {
+		log.Debug().Str(`channel`, channel.Name).Msg(`not responding to an event in emote-only mode`)
+		return
+	}
+	prompt, err := renderEventPrompt(rule.Prompt, newEventData(event, channel.Name, notices))
+	if err != nil {
+		log.Err(err).Str(`channel`, channel.Name).Str(`event`, event).Msg(`error while rendering the event prompt`)
+		return
+	}
+	response, err := s.GPT(ctx, prompt)
+	if err != nil {
+		log.Err(err).Msg("gpt query failed")
+		return
+	}
+	if _, err = s.SendMessage(ctx, user, channel, response); err != nil {
+		log.Err(err).Msg(`error while sending a twitch message`)
+	}
+}
@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+type eventRuleFixture struct {
+	stream  chan *Message
+	prompts chan string
+	sent    chan string
+}
+
+func newEventRuleFixture(t *testing.T, rules ...*EventRule) *eventRuleFixture {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	f := &eventRuleFixture{
+		stream:  make(chan *Message),
+		prompts: make(chan string, 10),
+		sent:    make(chan string, 10),
+	}
+	user := &User{ID: `1`, Username: `bot`}
+	channel := &Channel{ID: `10`, Name: `streamer`}
+	findChannelOwner := func(channelName string) (*User, *Channel) { return user, channel }
+	findEventRule := func(ctx context.Context, channel *Channel, event string) (*EventRule, error) {
+		for _, rule := range rules {
+			if rule.Event == event {
+				return rule, nil
+			}
+		}
+		return nil, nil
+	}
+	gpt := func(ctx context.Context, query string) (string, error) {
+		f.prompts <- query
+		return `thanks!`, nil
+	}
+	sendMessage := func(ctx context.Context, user *User, channel *Channel, message string) (string, error) {
+		f.sent <- message
+		return ``, nil
+	}
+	ServeMessageStream(ctx, f.stream, MessageHandlers{FindChannelOwner: findChannelOwner, FindEventRule: findEventRule, SendMessage: sendMessage, GPT: gpt})
+	return f
+}
+
+func (f *eventRuleFixture) notice(msgId, login string, tags map[string]string) {
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	tags[`msg-id`] = msgId
+	tags[`display-name`] = login
+	f.stream <- &Message{Username: login, ChannelName: `streamer`, MessageType: UserNotice, Tags: tags}
+}
+
+func (f *eventRuleFixture) expectPrompt(t *testing.T) string {
+	t.Helper()
+	select {
+	case prompt := <-f.prompts:
+		select {
+		case <-f.sent:
+		case <-time.After(time.Second):
+			t.Fatal(`response was not sent`)
+		}
+		return prompt
+	case <-time.After(time.Second):
+		t.Fatal(`no completion was requested`)
+	}
+	return ``
+}
+
+func (f *eventRuleFixture) expectNothing(t *testing.T, wait time.Duration) {
+	t.Helper()
+	select {
+	case prompt := <-f.prompts:
+		t.Fatalf("expected no response, got prompt %q", prompt)
+	case <-time.After(wait):
+	}
+}
+
+func TestServeMessageStreamRespondsToRaids(t *testing.T) {
+	f := newEventRuleFixture(t, &EventRule{ID: `r`, Event: EventRaid, Enabled: true, Prompt: DefaultEventPrompts[EventRaid]})
+	f.notice(`raid`, `raider`, map[string]string{`msg-param-displayName`: `Raider`, `msg-param-viewerCount`: `42`})
+	prompt := f.expectPrompt(t)
+	if !strings.Contains(prompt, `Raider and their 42 raiders to streamer`) {
+		t.Fatalf("unexpected prompt %q", prompt)
+	}
+}
+
+func TestServeMessageStreamIgnoresDisabledAndMissingRules(t *testing.T) {
+	f := newEventRuleFixture(t, &EventRule{ID: `s`, Event: EventSub, Enabled: false, Prompt: DefaultEventPrompts[EventSub]})
+	f.notice(`sub`, `viewer`, nil)
+	f.notice(`raid`, `raider`, nil)
+	f.notice(`announcement`, `mod`, nil)
+	f.expectNothing(t, 50*time.Millisecond)
+}
+
+func TestServeMessageStreamBatchesGiftBombs(t *testing.T) {
+	f := newEventRuleFixture(t, &EventRule{ID: `g`, Event: EventSubGift, Enabled: true, Prompt: `{{join .Users ", "}} gifted {{.Count}} to {{join .Recipients ","}}`, BatchWindow: 50 * time.Millisecond})
+	for _, recipient := range []string{`a`, `b`, `c`} {
+		f.notice(`subgift`, `gifter`, map[string]string{`msg-param-recipient-display-name`: recipient})
+	}
+	f.notice(`anonsubgift`, `AnAnonymousGifter`, map[string]string{`msg-param-recipient-display-name`: `d`})
+	// notices are looked up concurrently, so the batch is not necessarily in chat order
+	prompt := f.expectPrompt(t)
+	gifters, recipients, _ := strings.Cut(prompt, ` gifted 4 to `)
+	for _, want := range []string{`gifter`, `AnAnonymousGifter`} {
+		if !strings.Contains(gifters, want) {
+			t.Fatalf("expected one response for the whole batch, got %q", prompt)
+		}
+	}
+	if len(strings.Split(recipients, `,`)) != 4 {
+		t.Fatalf("expected all recipients in the batch, got %q", prompt)
+	}
+	f.expectNothing(t, 80*time.Millisecond)
+}
+
+func TestServeMessageStreamHonoursEventCooldown(t *testing.T) {
+	f := newEventRuleFixture(t, &EventRule{ID: `s`, Event: EventSub, Enabled: true, Prompt: `thank {{.User}}`, Cooldown: 100 * time.Millisecond})
+	f.notice(`sub`, `first`, nil)
+	f.expectPrompt(t)
+	f.notice(`sub`, `second`, nil)
+	f.expectNothing(t, 150*time.Millisecond)
+	f.notice(`sub`, `third`, nil)
+	if prompt := f.expectPrompt(t); prompt != `thank third` {
+		t.Fatalf("expected a response once the cooldown ended, got %q", prompt)
+	}
+}
+
+func TestValidateEventPrompt(t *testing.T) {
+	for _, prompt := range DefaultEventPrompts {
+		if err := ValidateEventPrompt(prompt); err != nil {
+			t.Fatalf("default prompt %q is invalid: %v", prompt, err)
+		}
+	}
+	for _, prompt := range []string{`{{.User`, `{{.Nope}}`, `{{unknown .User}}`} {
+		if ValidateEventPrompt(prompt) == nil {
+			t.Fatalf("expected %q to be rejected", prompt)
+		}
+	}
+}
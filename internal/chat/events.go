@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RoomMode is the chat mode of a channel as last reported by ROOMSTATE. Sub-only and followers-only aren't kept: the
+// bot may still post in them as a moderator or VIP, and when it can't, Twitch's drop is recorded on the channel.
+type RoomMode struct {
+	EmoteOnly bool
+	// Slow is how long chatters wait between messages, 0 when slow mode is off.
+	Slow time.Duration
+}
+
+// RoomModes tracks the chat mode of every channel the bot is in.
+type RoomModes struct {
+	lock  sync.Mutex
+	modes map[string]RoomMode
+}
+
+func NewRoomModes() *RoomModes {
+	return &RoomModes{modes: make(map[string]RoomMode)}
+}
+
+// Update applies a ROOMSTATE; Twitch sends every tag on join but only the changed ones afterwards.
+func (r *RoomModes) Update(channelName string, tags map[string]string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	channelName = strings.ToLower(channelName)
+	mode := r.modes[channelName]
+	if v, ok := tags[`emote-only`]; ok {
+		mode.EmoteOnly = v == `1`
+	}
+	if v, ok := tags[`slow`]; ok {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			mode.Slow = time.Duration(seconds) * time.Second
+		}
+	}
+	r.modes[channelName] = mode
+}
+
+func (r *RoomModes) Get(channelName string) RoomMode {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.modes[strings.ToLower(channelName)]
+}
+
+type sentAnswer struct {
+	user      *User
+	channel   *Channel
+	messageId string
+}
+
+// answerLedger remembers which answer was sent for which question message, so that the answer can be deleted
+// when a moderator deletes the question. Only the most recent answers are kept.
+type answerLedger struct {
+	lock    sync.Mutex
+	size    int
+	answers map[string]*sentAnswer
+	order   []string
+}
+
+func newAnswerLedger(size int) *answerLedger {
+	return &answerLedger{size: size, answers: make(map[string]*sentAnswer)}
+}
+
+func (l *answerLedger) record(questionIds []string, answer *sentAnswer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, id := range questionIds {
+		l.answers[id] = answer
+		l.order = append(l.order, id)
+	}
+	for len(l.order) > l.size {
+		delete(l.answers, l.order[0])
+		l.order = l.order[1:]
+	}
+}
+
+// take removes and returns the answer to the question, if it is still remembered.
+func (l *answerLedger) take(questionId string) *sentAnswer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	answer, ok := l.answers[questionId]
+	if !ok {
+		return nil
+	}
+	for id, other := range l.answers {
+		if other == answer {
+			delete(l.answers, id)
+		}
+	}
+	return answer
+}
@@ -0,0 +1,19 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoomModesMergesPartialUpdates(t *testing.T) {
+	modes := NewRoomModes()
+	if mode := modes.Get(`streamer`); mode.EmoteOnly || mode.Slow != 0 {
+		t.Fatalf("unexpected default mode %+v", mode)
+	}
+	modes.Update(`Streamer`, map[string]string{`emote-only`: `1`, `followers-only`: `10`, `slow`: `0`, `subs-only`: `0`})
+	modes.Update(`streamer`, map[string]string{`slow`: `30`})
+	mode := modes.Get(`streamer`)
+	if mode.Slow != 30*time.Second || !mode.EmoteOnly {
+		t.Fatalf("unexpected mode %+v", mode)
+	}
+}
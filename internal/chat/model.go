@@ -2,30 +2,54 @@ package chat
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
 type Message struct {
+	ID          string
 	Username    string
 	ChannelName string
 	Message     string
 	MessageType uint8
 	Time        time.Time
+	// Tags holds the raw IRC tags, e.g. target-msg-id for ClearMsg or slow for RoomState.
+	Tags map[string]string
 }
 
 type Channel struct {
-	ID        string
-	Name      string
-	UserId    string
-	CreatedAt time.Time
+	ID          string
+	Name        string
+	UserId      string
+	DropReason  string
+	DropMessage string
+	DroppedAt   time.Time
+	CreatedAt   time.Time
+	// RewardID is the channel points reward the bot created for paid questions, if any.
+	RewardID string
+	// AnswerWhen is one of AnswerAlways, AnswerLive or AnswerOffline; empty means always.
+	AnswerWhen string
+	// StreamContext tells the model the stream's title and game along with questions asked while live.
+	StreamContext bool
+	// Paused keeps the bot in the channel without answering questions, posting timers or responding to events.
+	Paused bool
 }
 
+const (
+	AnswerAlways  = "always"
+	AnswerLive    = "live"
+	AnswerOffline = "offline"
+)
+
 type User struct {
 	ID           string
 	Username     string
 	AccessToken  string
 	RefreshToken string
 	ExpiresAt    time.Time
+	NeedsReauth  bool
+	Scopes       []string
+	ValidatedAt  time.Time
 	CreatedAt    time.Time
 }
 
@@ -46,6 +70,26 @@ const (
 	Pong            uint8 = iota
 	ClearMsg        uint8 = iota
 	GlobalUserState uint8 = iota
+	// Redemption is a channel points redemption of the channel's paid-question reward; ID is the redemption id.
+	Redemption uint8 = iota
+)
+
+// Statuses a redemption can be moved to once it was handled.
+const (
+	RedemptionFulfilled = `FULFILLED`
+	RedemptionCanceled  = `CANCELED`
+)
+
+// Repositories return these, wrapping the driver's error where there is one, so callers don't depend on the database.
+var (
+	// ErrNotFound means the row to get, update or delete doesn't exist.
+	ErrNotFound = errors.New("chat: not found")
+	// ErrConflict means saving would break a unique index, like a second channel with the same name.
+	ErrConflict = errors.New("chat: already exists")
+	// ErrInvalid means the database refused a value, like a missing required column.
+	ErrInvalid = errors.New("chat: invalid value")
+	// ErrUnavailable means the database couldn't be reached or is busy; trying again later may work.
+	ErrUnavailable = errors.New("chat: database unavailable")
 )
 
 type Repository interface {
@@ -53,9 +97,107 @@ type Repository interface {
 	SaveChannel(ctx context.Context, channel *Channel) error
 	GetChannel(ctx context.Context, id string) (*Channel, error)
 	DeleteChannel(ctx context.Context, id string) error
+	UpdateChannel(ctx context.Context, channel *Channel) error
 	GetUsers(ctx context.Context) ([]*User, error)
 	SaveUser(ctx context.Context, username *User) error
 	DeleteUser(ctx context.Context, id string) error
 	GetUser(ctx context.Context, id string) (user *User, err error)
 	UpdateUser(ctx context.Context, user *User) error
+	GetEventRulesByChannel(ctx context.Context, channelId string) ([]*EventRule, error)
+	SaveEventRule(ctx context.Context, rule *EventRule) error
+	UpdateEventRule(ctx context.Context, rule *EventRule) error
+	GetQuestionTiersByChannel(ctx context.Context, channelId string) ([]*QuestionTier, error)
+	SaveQuestionTier(ctx context.Context, tier *QuestionTier) error
+	DeleteQuestionTier(ctx context.Context, id string) error
+	GetTimersByChannel(ctx context.Context, channelId string) ([]*Timer, error)
+	SaveTimer(ctx context.Context, timer *Timer) error
+	UpdateTimer(ctx context.Context, timer *Timer) error
+	DeleteTimer(ctx context.Context, id string) error
+	SaveAuditEntry(ctx context.Context, entry *AuditEntry) error
+	// ForgetUsername deletes the users and the channels named username, with the users' channels and the channels'
+	// settings, and saves entry; either all of it happens or none of it.
+	ForgetUsername(ctx context.Context, username string, entry *AuditEntry) error
+	// GetAuditEntries returns the newest limit entries, newest first.
+	GetAuditEntries(ctx context.Context, limit int) ([]*AuditEntry, error)
+	GetAPITokens(ctx context.Context) ([]*APIToken, error)
+	GetAPITokenByHash(ctx context.Context, hash string) (*APIToken, error)
+	SaveAPIToken(ctx context.Context, token *APIToken) error
+	SetAPITokenLastUsed(ctx context.Context, id string, lastUsedAt time.Time) error
+	DeleteAPIToken(ctx context.Context, id string) error
+}
+
+// Timer posts in a channel every Interval while it is live, once at least MinChatLines were sent since its last post.
+type Timer struct {
+	ID           string
+	ChannelID    string
+	Name         string
+	Enabled      bool
+	Interval     time.Duration
+	MinChatLines int
+	// Prompt has the model write each post; without one a random line of Lines is posted.
+	Prompt    string
+	Lines     []string
+	CreatedAt time.Time
+}
+
+// QuestionTier makes questions cheered with at least MinBits jump the queue and be answered with its own model and
+// length. The lowest tier of a channel is its bits threshold.
+type QuestionTier struct {
+	ID        string
+	ChannelID string
+	MinBits   int
+	// Model and MaxTokens fall back to the bot's defaults when empty.
+	Model     string
+	MaxTokens int
+	CreatedAt time.Time
+}
+
+// EventRule tells the bot how to respond in a channel to one kind of USERNOTICE, e.g. a raid.
+type EventRule struct {
+	ID        string
+	ChannelID string
+	Event     string
+	Enabled   bool
+	// Prompt is a text/template rendered with EventData and sent to the model.
+	Prompt   string
+	Cooldown time.Duration
+	// BatchWindow collects the events that arrive shortly after the first one into a single response, so that a
+	// gift bomb is thanked once instead of once per gifted sub.
+	BatchWindow time.Duration
+	CreatedAt   time.Time
+}
+
+// AuditEntry records an operation on stored data, like forgetting a chatter, and who asked for it.
+type AuditEntry struct {
+	ID     string
+	Action string
+	// Subject is what the action was about, e.g. the forgotten username.
+	Subject   string
+	Actor     string
+	Details   string
+	CreatedAt time.Time
+}
+
+// APIToken lets scripts call the JSON API. Only the hash of the token is stored; the token itself is shown once when
+// it is created.
+type APIToken struct {
+	ID     string
+	Name   string
+	Hash   string
+	Scopes []string
+	// ExpiresAt is zero for tokens that never expire, and LastUsedAt for tokens that were never used.
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	CreatedAt  time.Time
+}
+
+// ConnectionState reports the health of one chat connection.
+type ConnectionState struct {
+	Name        string
+	State       string
+	Since       time.Time
+	Reconnects  int
+	LastError   string
+	Channels    int
+	Unavailable map[string]string
 }
@@ -5,10 +5,26 @@ import (
 	"github.com/rs/zerolog/log"
 	"slices"
 	"strings"
+	"sync"
 )
 
 type GetMessageStream func(ctx context.Context, messageTypes []uint8) (<-chan *Message, error)
 
+// Transport delivers chat messages from Twitch for the channels that were joined.
+type Transport interface {
+	MessageStream(ctx context.Context, messageTypes []uint8) (<-chan *Message, error)
+	Join(user *User, channel *Channel)
+	Depart(user *User, channel *Channel)
+}
+
+// SupervisedTransport keeps its own connections alive and rejoins channels after reconnecting.
+type SupervisedTransport interface {
+	Transport
+	// Supervise sets where the wanted channel names come from and who is told when Twitch refuses a channel.
+	Supervise(channels func() []string, unavailable func(channelName, reason, message string))
+	Connections() []ConnectionState
+}
+
 func FilterMessageStream(ctx context.Context, messageStream <-chan *Message, allowedTypes []uint8) <-chan *Message {
 	filteredMessageStream := make(chan *Message)
 
@@ -22,7 +38,11 @@ func FilterMessageStream(ctx context.Context, messageStream <-chan *Message, all
 				if !ok {
 					return
 				}
-				if slices.Contains(allowedTypes, message.MessageType) && strings.HasPrefix(message.Message, `!!!`) {
+				if !slices.Contains(allowedTypes, message.MessageType) {
+					continue
+				}
+				// chat lines are only interesting when they ask the bot something or cheer, other events always are
+				if message.MessageType != PrivMsg || strings.HasPrefix(message.Message, `!!!`) || cheerBits(message) > 0 {
 					filteredMessageStream <- message
 				}
 			}
@@ -34,29 +54,216 @@ func FilterMessageStream(ctx context.Context, messageStream <-chan *Message, all
 
 type FindUser func(username string) *User
 type FindChannel func(user *User, channelName string) *Channel
-type SendMessage func(ctx context.Context, user *User, channel *Channel, message string) error
+
+// FindChannelOwner returns the bot user that added the channel, for events that don't come from a bot user.
+type FindChannelOwner func(channelName string) (*User, *Channel)
+
+// SendMessage sends a chat message and returns its id.
+type SendMessage func(ctx context.Context, user *User, channel *Channel, message string) (string, error)
+type DeleteMessage func(ctx context.Context, user *User, channel *Channel, messageId string) error
+type UpdateRedemption func(ctx context.Context, user *User, channel *Channel, rewardId, redemptionId, status string) error
 type GPT func(ctx context.Context, query string) (string, error)
 
-func ServeMessageStream(ctx context.Context, messagesStream <-chan *Message, findUser FindUser, findChannel FindChannel, sendMessage SendMessage, gpt GPT) {
+// MessageHandlers is what ServeMessageStream needs from the bot to look things up and act in chat.
+type MessageHandlers struct {
+	FindUser         FindUser
+	FindChannel      FindChannel
+	FindChannelOwner FindChannelOwner
+	FindEventRule    FindEventRule
+	SendMessage      SendMessage
+	DeleteMessage    DeleteMessage
+	UpdateRedemption UpdateRedemption
+	FindQuestionTier FindQuestionTier
+	FindStreamState  FindStreamState
+	GPT              GPT
+	TieredGPT        TieredGPT
+	// RoomModes is updated from the ROOMSTATE messages; one is made when the bot doesn't need to read it.
+	RoomModes *RoomModes
+}
+
+func ServeMessageStream(ctx context.Context, messagesStream <-chan *Message, handlers MessageHandlers) {
+	if handlers.RoomModes == nil {
+		handlers.RoomModes = NewRoomModes()
+	}
+	s := &messageServer{
+		MessageHandlers: handlers,
+		coalescer:       newQuestionCoalescer(),
+		modes:           handlers.RoomModes,
+		answers:         newAnswerLedger(1000),
+		events:          newEventResponder(),
+		queue:           newQuestionQueue(ctx, questionWorkers, questionWorkersPerChannel),
+	}
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case message := <-messagesStream:
-				user := findUser(message.Username)
-				channel := findChannel(user, message.ChannelName)
-				if user == nil || channel == nil {
-					continue
-				}
-				answer, err := gpt(ctx, strings.TrimPrefix(message.Message, "!!!"))
-				if err != nil {
-					log.Err(err).Msg("gpt query failed")
+			case message, ok := <-messagesStream:
+				if !ok {
+					return
 				}
-				if err := sendMessage(ctx, user, channel, answer); err != nil {
-					log.Err(err).Msg(`error while sending a twitch message`)
+				s.handle(ctx, message)
+			}
+		}
+	}()
+}
+
+// MergeMessageStreams forwards every message of the streams into one, which is closed once they all are.
+func MergeMessageStreams(ctx context.Context, streams ...<-chan *Message) <-chan *Message {
+	merged := make(chan *Message)
+	var wg sync.WaitGroup
+	for _, stream := range streams {
+		wg.Add(1)
+		go func(stream <-chan *Message) {
+			defer wg.Done()
+			for message := range stream {
+				select {
+				case <-ctx.Done():
+					return
+				case merged <- message:
 				}
 			}
+		}(stream)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged
+}
+
+type messageServer struct {
+	MessageHandlers
+	coalescer *questionCoalescer
+	modes     *RoomModes
+	answers   *answerLedger
+	events    *eventResponder
+	queue     *questionQueue
+}
+
+func (s *messageServer) handle(ctx context.Context, message *Message) {
+	switch message.MessageType {
+	case RoomState:
+		s.modes.Update(message.ChannelName, message.Tags)
+	case ClearChat:
+		// a timeout or ban (or /clear when there is no target) makes whatever they asked moot
+		s.coalescer.forget(message.ChannelName, message.Username)
+	case ClearMsg:
+		go s.questionDeleted(ctx, message)
+	case UserNotice:
+		go s.eventReceived(ctx, message)
+	case Redemption:
+		go s.answerRedemption(ctx, message)
+	case PrivMsg:
+		if bits := cheerBits(message); bits > 0 {
+			go s.cheered(ctx, message, bits)
+			return
+		}
+		s.questionAsked(ctx, message)
+	}
+}
+
+func (s *messageServer) questionAsked(ctx context.Context, message *Message) {
+	user := s.FindUser(message.Username)
+	if user == nil {
+		return
+	}
+	channel := s.FindChannel(user, message.ChannelName)
+	if channel == nil {
+		return
+	}
+	s.answerMessage(ctx, message, user, channel)
+}
+
+func (s *messageServer) answerMessage(ctx context.Context, message *Message, user *User, channel *Channel) {
+	if s.modes.Get(channel.Name).EmoteOnly {
+		log.Debug().Str(`channel`, channel.Name).Msg(`not answering in emote-only mode`)
+		return
+	}
+	if !AnswersNow(channel, s.streamState(channel)) {
+		log.Debug().Str(`channel`, channel.Name).Str(`answer_when`, channel.AnswerWhen).Msg(`not answering in this stream state`)
+		return
+	}
+	question := strings.TrimPrefix(message.Message, "!!!")
+	key := questionKey(channel.Name, question)
+	if !s.coalescer.join(key, message.Username, message.ID) {
+		return
+	}
+	// free questions wait behind every cheered one
+	s.queue.push(channel.Name, 0, func(ctx context.Context) {
+		s.answerQuestion(ctx, user, channel, key, question)
+	})
+}
+
+func (s *messageServer) answerQuestion(ctx context.Context, user *User, channel *Channel, key, question string) {
+	answer, err := s.GPT(ctx, withStreamContext(channel, s.streamState(channel), question))
+	askers, questionIds := s.coalescer.done(key)
+	if err != nil {
+		log.Err(err).Msg("gpt query failed")
+		return
+	}
+	if len(askers) == 0 {
+		log.Debug().Str(`channel`, channel.Name).Msg(`everyone who asked was timed out or had the question deleted`)
+		return
+	}
+	messageId, err := s.SendMessage(ctx, user, channel, mentionAskers(askers, answer))
+	if err != nil {
+		log.Err(err).Msg(`error while sending a twitch message`)
+		return
+	}
+	if messageId != "" {
+		s.answers.record(questionIds, &sentAnswer{user: user, channel: channel, messageId: messageId})
+	}
+}
+
+func (s *messageServer) questionDeleted(ctx context.Context, message *Message) {
+	questionId := message.Tags[`target-msg-id`]
+	if questionId == "" {
+		return
+	}
+	s.coalescer.forgetMessage(questionId)
+	answer := s.answers.take(questionId)
+	if answer == nil {
+		return
+	}
+	if err := s.DeleteMessage(ctx, answer.user, answer.channel, answer.messageId); err != nil {
+		log.Err(err).Str(`channel`, answer.channel.Name).Msg(`error while deleting the answer to a deleted question`)
+	}
+}
+
+// answerRedemption answers the question a viewer paid channel points for, refunding the points when that fails.
+func (s *messageServer) answerRedemption(ctx context.Context, message *Message) {
+	user, channel := s.FindChannelOwner(message.ChannelName)
+	if channel == nil {
+		return
+	}
+	status := RedemptionCanceled
+	defer func() {
+		if err := s.UpdateRedemption(context.WithoutCancel(ctx), user, channel, message.Tags[`reward-id`], message.ID, status); err != nil {
+			log.Err(err).Str(`channel`, channel.Name).Str(`status`, status).Msg(`error while updating the redemption`)
 		}
 	}()
+	question := strings.TrimSpace(message.Message)
+	if question == "" {
+		return
+	}
+	if s.modes.Get(channel.Name).EmoteOnly {
+		log.Debug().Str(`channel`, channel.Name).Msg(`refunding a redemption in emote-only mode`)
+		return
+	}
+	state := s.streamState(channel)
+	if !AnswersNow(channel, state) {
+		log.Debug().Str(`channel`, channel.Name).Str(`answer_when`, channel.AnswerWhen).Msg(`refunding a redemption in this stream state`)
+		return
+	}
+	answer, err := s.GPT(ctx, withStreamContext(channel, state, question))
+	if err != nil {
+		log.Err(err).Msg("gpt query failed")
+		return
+	}
+	if _, err = s.SendMessage(ctx, user, channel, mentionAskers([]string{message.Username}, answer)); err != nil {
+		log.Err(err).Msg(`error while sending a twitch message`)
+		return
+	}
+	status = RedemptionFulfilled
 }
@@ -0,0 +1,337 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type sentMessage struct {
+	user    *User
+	channel *Channel
+	message string
+}
+
+func TestServeMessageStreamCoalescesDuplicateQuestions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	users := map[string]*User{
+		`alice`: {ID: `1`, Username: `alice`},
+		`bob`:   {ID: `2`, Username: `bob`},
+		`carol`: {ID: `3`, Username: `carol`},
+	}
+	channel := &Channel{ID: `10`, Name: `streamer`}
+	findUser := func(username string) *User { return users[username] }
+	findChannel := func(user *User, channelName string) *Channel {
+		if channelName == channel.Name {
+			return channel
+		}
+		return nil
+	}
+
+	var gptCalls atomic.Int32
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	gpt := func(ctx context.Context, query string) (string, error) {
+		gptCalls.Add(1)
+		started <- struct{}{}
+		<-release
+		return `42`, nil
+	}
+
+	var lock sync.Mutex
+	var sent []sentMessage
+	sentDone := make(chan struct{}, 10)
+	sendMessage := func(ctx context.Context, user *User, channel *Channel, message string) (string, error) {
+		lock.Lock()
+		sent = append(sent, sentMessage{user: user, channel: channel, message: message})
+		lock.Unlock()
+		sentDone <- struct{}{}
+		return ``, nil
+	}
+
+	stream := make(chan *Message)
+	ServeMessageStream(ctx, stream, MessageHandlers{FindUser: findUser, FindChannel: findChannel, SendMessage: sendMessage, GPT: gpt})
+
+	stream <- &Message{Username: `alice`, ChannelName: `streamer`, Message: `!!!what is the answer?`, MessageType: PrivMsg}
+	<-started
+	stream <- &Message{Username: `bob`, ChannelName: `streamer`, Message: `!!!What is  the answer?`, MessageType: PrivMsg}
+	stream <- &Message{Username: `carol`, ChannelName: `streamer`, Message: `!!!what is the answer?`, MessageType: PrivMsg}
+	// the followers joined the in-flight question once their messages are handled
+	settle(stream)
+	close(release)
+
+	select {
+	case <-sentDone:
+	case <-time.After(time.Second):
+		t.Fatal(`answer was not sent`)
+	}
+	select {
+	case <-sentDone:
+		t.Fatal(`answer was sent more than once`)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if calls := gptCalls.Load(); calls != 1 {
+		t.Fatalf("expected 1 gpt call, got %d", calls)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 sent message, got %d", len(sent))
+	}
+	for _, mention := range []string{`@alice`, `@bob`, `@carol`} {
+		if !strings.Contains(sent[0].message, mention) {
+			t.Errorf("expected %q to mention %s", sent[0].message, mention)
+		}
+	}
+	if !strings.HasSuffix(sent[0].message, `42`) {
+		t.Errorf("expected %q to end with the answer", sent[0].message)
+	}
+	if sent[0].user != users[`alice`] {
+		t.Errorf("expected the answer to be sent as the first asker")
+	}
+}
+
+func TestServeMessageStreamDoesNotCoalesceAcrossChannels(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	user := &User{ID: `1`, Username: `alice`}
+	channels := map[string]*Channel{
+		`one`: {ID: `10`, Name: `one`},
+		`two`: {ID: `20`, Name: `two`},
+	}
+	findUser := func(username string) *User { return user }
+	findChannel := func(user *User, channelName string) *Channel { return channels[channelName] }
+
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	gpt := func(ctx context.Context, query string) (string, error) {
+		started <- struct{}{}
+		<-release
+		return `42`, nil
+	}
+	sentDone := make(chan string, 10)
+	sendMessage := func(ctx context.Context, user *User, channel *Channel, message string) (string, error) {
+		sentDone <- channel.Name
+		return ``, nil
+	}
+
+	stream := make(chan *Message)
+	ServeMessageStream(ctx, stream, MessageHandlers{FindUser: findUser, FindChannel: findChannel, SendMessage: sendMessage, GPT: gpt})
+	stream <- &Message{Username: `alice`, ChannelName: `one`, Message: `!!!same question`, MessageType: PrivMsg}
+	stream <- &Message{Username: `alice`, ChannelName: `two`, Message: `!!!same question`, MessageType: PrivMsg}
+	// both questions are asked before either is answered
+	<-started
+	<-started
+	close(release)
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-sentDone:
+			got[name] = true
+		case <-time.After(time.Second):
+			t.Fatal(`answer was not sent`)
+		}
+	}
+	if !got[`one`] || !got[`two`] {
+		t.Fatalf("expected an answer in both channels, got %v", got)
+	}
+}
+
+// settle returns once every message sent on the stream before it was handled: ServeMessageStream handles one message
+// at a time, and a ROOMSTATE without tags changes nothing.
+func settle(stream chan<- *Message) {
+	stream <- &Message{MessageType: RoomState}
+}
+
+type eventFixture struct {
+	stream  chan *Message
+	asked   chan string
+	release chan struct{}
+	sent    chan string
+	deleted chan string
+}
+
+func newEventFixture(t *testing.T) *eventFixture {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	f := &eventFixture{
+		stream:  make(chan *Message),
+		asked:   make(chan string, 10),
+		release: make(chan struct{}),
+		sent:    make(chan string, 10),
+		deleted: make(chan string, 10),
+	}
+	user := &User{ID: `1`, Username: `alice`}
+	channel := &Channel{ID: `10`, Name: `streamer`}
+	findUser := func(username string) *User { return user }
+	findChannel := func(user *User, channelName string) *Channel { return channel }
+	gpt := func(ctx context.Context, query string) (string, error) {
+		f.asked <- query
+		<-f.release
+		return `42`, nil
+	}
+	sendMessage := func(ctx context.Context, user *User, channel *Channel, message string) (string, error) {
+		f.sent <- message
+		return `answer-1`, nil
+	}
+	deleteMessage := func(ctx context.Context, user *User, channel *Channel, messageId string) error {
+		f.deleted <- messageId
+		return nil
+	}
+	ServeMessageStream(ctx, f.stream, MessageHandlers{FindUser: findUser, FindChannel: findChannel, SendMessage: sendMessage, DeleteMessage: deleteMessage, GPT: gpt})
+	return f
+}
+
+func TestServeMessageStreamForgetsTimedOutAskers(t *testing.T) {
+	f := newEventFixture(t)
+	f.stream <- &Message{ID: `q1`, Username: `alice`, ChannelName: `streamer`, Message: `!!!question`, MessageType: PrivMsg}
+	<-f.asked
+	f.stream <- &Message{ID: `q2`, Username: `bob`, ChannelName: `streamer`, Message: `!!!question`, MessageType: PrivMsg}
+	f.stream <- &Message{Username: `alice`, ChannelName: `streamer`, MessageType: ClearChat, Tags: map[string]string{`ban-duration`: `600`}}
+	settle(f.stream)
+	close(f.release)
+
+	select {
+	case message := <-f.sent:
+		if strings.Contains(message, `@alice`) || !strings.Contains(message, `@bob`) {
+			t.Fatalf("expected only bob to be answered, got %q", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`answer was not sent`)
+	}
+}
+
+func TestServeMessageStreamSkipsAnswerWhenChatIsCleared(t *testing.T) {
+	f := newEventFixture(t)
+	f.stream <- &Message{ID: `q1`, Username: `alice`, ChannelName: `streamer`, Message: `!!!question`, MessageType: PrivMsg}
+	<-f.asked
+	f.stream <- &Message{ChannelName: `streamer`, MessageType: ClearChat}
+	settle(f.stream)
+	close(f.release)
+
+	select {
+	case message := <-f.sent:
+		t.Fatalf("expected no answer after the chat was cleared, got %q", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServeMessageStreamDeletesAnswerOfDeletedQuestion(t *testing.T) {
+	f := newEventFixture(t)
+	close(f.release)
+	f.stream <- &Message{ID: `q1`, Username: `alice`, ChannelName: `streamer`, Message: `!!!question`, MessageType: PrivMsg}
+	select {
+	case <-f.sent:
+	case <-time.After(time.Second):
+		t.Fatal(`answer was not sent`)
+	}
+	f.stream <- &Message{Username: `alice`, ChannelName: `streamer`, Message: `!!!question`, MessageType: ClearMsg, Tags: map[string]string{`target-msg-id`: `q1`}}
+	select {
+	case id := <-f.deleted:
+		if id != `answer-1` {
+			t.Fatalf("expected answer-1 to be deleted, got %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`answer was not deleted`)
+	}
+}
+
+func TestServeMessageStreamRespectsEmoteOnlyMode(t *testing.T) {
+	f := newEventFixture(t)
+	close(f.release)
+	f.stream <- &Message{ChannelName: `streamer`, MessageType: RoomState, Tags: map[string]string{`emote-only`: `1`, `slow`: `0`}}
+	f.stream <- &Message{ID: `q1`, Username: `alice`, ChannelName: `streamer`, Message: `!!!first question`, MessageType: PrivMsg}
+
+	// later ROOMSTATEs only carry the changed tag
+	f.stream <- &Message{ChannelName: `streamer`, MessageType: RoomState, Tags: map[string]string{`emote-only`: `0`}}
+	f.stream <- &Message{ID: `q2`, Username: `alice`, ChannelName: `streamer`, Message: `!!!second question`, MessageType: PrivMsg}
+	select {
+	case <-f.sent:
+	case <-time.After(time.Second):
+		t.Fatal(`answer was not sent after emote-only mode ended`)
+	}
+	// a channel's questions are answered one at a time in order, so a queued first question would have come first
+	if question := <-f.asked; question != `second question` {
+		t.Fatalf("expected no completion in emote-only mode, got one for %q", question)
+	}
+}
+
+type redemptionUpdate struct {
+	rewardId     string
+	redemptionId string
+	status       string
+}
+
+func serveRedemptions(t *testing.T, gpt GPT, sendMessage SendMessage) (chan *Message, chan redemptionUpdate) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream := make(chan *Message)
+	updates := make(chan redemptionUpdate, 10)
+	user := &User{ID: `10`, Username: `streamer`}
+	channel := &Channel{ID: `10`, Name: `streamer`, RewardID: `reward-1`}
+	ServeMessageStream(ctx, stream, MessageHandlers{
+		FindChannelOwner: func(channelName string) (*User, *Channel) { return user, channel },
+		SendMessage:      sendMessage,
+		GPT:              gpt,
+		UpdateRedemption: func(ctx context.Context, user *User, channel *Channel, rewardId, redemptionId, status string) error {
+			updates <- redemptionUpdate{rewardId: rewardId, redemptionId: redemptionId, status: status}
+			return nil
+		},
+	})
+	return stream, updates
+}
+
+func expectRedemptionUpdate(t *testing.T, updates chan redemptionUpdate, want redemptionUpdate) {
+	t.Helper()
+	select {
+	case got := <-updates:
+		if got != want {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`redemption was not updated`)
+	}
+}
+
+func TestServeMessageStreamFulfilsAnsweredRedemptions(t *testing.T) {
+	sent := make(chan string, 1)
+	stream, updates := serveRedemptions(t, func(ctx context.Context, query string) (string, error) {
+		return `answer to ` + query, nil
+	}, func(ctx context.Context, user *User, channel *Channel, message string) (string, error) {
+		sent <- message
+		return `m1`, nil
+	})
+	stream <- &Message{ID: `r1`, Username: `viewer`, ChannelName: `streamer`, Message: ` why? `, MessageType: Redemption, Tags: map[string]string{`reward-id`: `reward-1`}}
+	expectRedemptionUpdate(t, updates, redemptionUpdate{rewardId: `reward-1`, redemptionId: `r1`, status: RedemptionFulfilled})
+	if message := <-sent; message != `@viewer answer to why?` {
+		t.Fatalf("unexpected answer %q", message)
+	}
+}
+
+func TestServeMessageStreamRefundsFailedRedemptions(t *testing.T) {
+	failingGPT := func(ctx context.Context, query string) (string, error) { return ``, errors.New(`model unavailable`) }
+	working := func(ctx context.Context, user *User, channel *Channel, message string) (string, error) {
+		return `m1`, nil
+	}
+	failingSend := func(ctx context.Context, user *User, channel *Channel, message string) (string, error) {
+		return ``, errors.New(`message dropped`)
+	}
+	workingGPT := func(ctx context.Context, query string) (string, error) { return `42`, nil }
+
+	stream, updates := serveRedemptions(t, failingGPT, working)
+	stream <- &Message{ID: `r1`, Username: `viewer`, ChannelName: `streamer`, Message: `why?`, MessageType: Redemption, Tags: map[string]string{`reward-id`: `reward-1`}}
+	expectRedemptionUpdate(t, updates, redemptionUpdate{rewardId: `reward-1`, redemptionId: `r1`, status: RedemptionCanceled})
+
+	stream, updates = serveRedemptions(t, workingGPT, failingSend)
+	stream <- &Message{ID: `r2`, Username: `viewer`, ChannelName: `streamer`, Message: `why?`, MessageType: Redemption, Tags: map[string]string{`reward-id`: `reward-1`}}
+	expectRedemptionUpdate(t, updates, redemptionUpdate{rewardId: `reward-1`, redemptionId: `r2`, status: RedemptionCanceled})
+}
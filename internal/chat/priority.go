@@ -0,0 +1,209 @@
+package chat
+
+import (
+	"container/heap"
+	"context"
+	"github.com/rs/zerolog/log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// questionWorkers is how many questions are answered at the same time, the rest wait in the queue.
+var questionWorkers = 4
+
+// questionWorkersPerChannel is how many of the workers one channel can hold. Sending waits out the channel's slow
+// mode, so without a cap a few slow channels would hold every worker and stall the questions of all the others.
+var questionWorkersPerChannel = 1
+
+type FindQuestionTier func(ctx context.Context, channel *Channel, bits int) (*QuestionTier, error)
+
+// TieredGPT answers with the tier's model and length.
+type TieredGPT func(ctx context.Context, query string, tier *QuestionTier) (string, error)
+
+type queuedQuestion struct {
+	channel  string
+	priority int
+	seq      uint64
+	answer   func(ctx context.Context)
+}
+
+type questionHeap []*queuedQuestion
+
+func (h questionHeap) Len() int { return len(h) }
+func (h questionHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h questionHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *questionHeap) Push(x any)   { *h = append(*h, x.(*queuedQuestion)) }
+func (h *questionHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// questionQueue answers questions with a fixed number of workers, highest priority first and in order of arrival
+// within the same priority, skipping the questions of channels that already hold perChannel workers.
+type questionQueue struct {
+	lock       sync.Mutex
+	cond       *sync.Cond
+	items      questionHeap
+	seq        uint64
+	perChannel int
+	busy       map[string]int
+}
+
+func newQuestionQueue(ctx context.Context, workers, perChannel int) *questionQueue {
+	q := &questionQueue{perChannel: perChannel, busy: make(map[string]int)}
+	q.cond = sync.NewCond(&q.lock)
+	context.AfterFunc(ctx, func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		q.cond.Broadcast()
+	})
+	for i := 0; i < workers; i++ {
+		go q.work(ctx)
+	}
+	return q
+}
+
+func (q *questionQueue) push(channelName string, priority int, answer func(ctx context.Context)) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.seq++
+	heap.Push(&q.items, &queuedQuestion{channel: channelName, priority: priority, seq: q.seq, answer: answer})
+	q.cond.Broadcast()
+}
+
+func (q *questionQueue) pop(ctx context.Context) *queuedQuestion {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for ctx.Err() == nil {
+		if question := q.nextLocked(); question != nil {
+			q.busy[question.channel]++
+			return question
+		}
+		q.cond.Wait()
+	}
+	return nil
+}
+
+// nextLocked takes the first question whose channel has a worker to spare.
+func (q *questionQueue) nextLocked() *queuedQuestion {
+	var skipped []*queuedQuestion
+	defer func() {
+		for _, question := range skipped {
+			heap.Push(&q.items, question)
+		}
+	}()
+	for len(q.items) > 0 {
+		question := heap.Pop(&q.items).(*queuedQuestion)
+		if q.busy[question.channel] < q.perChannel {
+			return question
+		}
+		skipped = append(skipped, question)
+	}
+	return nil
+}
+
+func (q *questionQueue) done(question *queuedQuestion) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.busy[question.channel]--; q.busy[question.channel] <= 0 {
+		delete(q.busy, question.channel)
+	}
+	// the channel's skipped questions can be answered now
+	q.cond.Broadcast()
+}
+
+func (q *questionQueue) work(ctx context.Context) {
+	for {
+		question := q.pop(ctx)
+		if question == nil {
+			return
+		}
+		question.answer(ctx)
+		q.done(question)
+	}
+}
+
+// cheerBits returns the bits cheered in the message, or 0 if it isn't a cheer.
+func cheerBits(message *Message) int {
+	bits, err := strconv.Atoi(message.Tags[`bits`])
+	if err != nil || bits < 0 {
+		return 0
+	}
+	return bits
+}
+
+var cheermote = regexp.MustCompile(`^[A-Za-z]+[0-9]+$`)
+
+// cheerQuestion strips the cheermotes and the prefix from a cheer.
+func cheerQuestion(text string) string {
+	words := strings.Fields(strings.TrimPrefix(text, `!!!`))
+	question := words[:0]
+	for _, word := range words {
+		if !cheermote.MatchString(word) {
+			question = append(question, word)
+		}
+	}
+	return strings.Join(question, " ")
+}
+
+func (s *messageServer) cheered(ctx context.Context, message *Message, bits int) {
+	user, channel := s.FindChannelOwner(message.ChannelName)
+	if channel == nil {
+		return
+	}
+	if !strings.HasPrefix(message.Message, `!!!`) {
+		// a cheer is only a question when it asks like a free one, whatever the bits
+		return
+	}
+	tier, err := s.FindQuestionTier(ctx, channel, bits)
+	if err != nil {
+		log.Err(err).Str(`channel`, channel.Name).Msg(`error while looking up the question tier`)
+		return
+	}
+	if tier == nil {
+		// below the channel's threshold, so it's an ordinary question
+		s.questionAsked(ctx, message)
+		return
+	}
+	question := cheerQuestion(message.Message)
+	if question == "" {
+		return
+	}
+	s.queue.push(channel.Name, tier.MinBits, func(ctx context.Context) {
+		s.answerPriorityQuestion(ctx, message, user, channel, tier, question)
+	})
+}
+
+func (s *messageServer) answerPriorityQuestion(ctx context.Context, message *Message, user *User, channel *Channel, tier *QuestionTier, question string) {
+	if s.modes.Get(channel.Name).EmoteOnly {
+		log.Debug().Str(`channel`, channel.Name).Msg(`not answering in emote-only mode`)
+		return
+	}
+	state := s.streamState(channel)
+	if !AnswersNow(channel, state) {
+		log.Debug().Str(`channel`, channel.Name).Str(`answer_when`, channel.AnswerWhen).Msg(`not answering in this stream state`)
+		return
+	}
+	answer, err := s.TieredGPT(ctx, withStreamContext(channel, state, question), tier)
+	if err != nil {
+		log.Err(err).Msg("gpt query failed")
+		return
+	}
+	messageId, err := s.SendMessage(ctx, user, channel, mentionAskers([]string{message.Username}, answer))
+	if err != nil {
+		log.Err(err).Msg(`error while sending a twitch message`)
+		return
+	}
+	if messageId != "" && message.ID != "" {
+		s.answers.record([]string{message.ID}, &sentAnswer{user: user, channel: channel, messageId: messageId})
+	}
+}
@@ -0,0 +1,169 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type priorityFixture struct {
+	stream  chan *Message
+	asked   chan string
+	release chan struct{}
+	sent    chan string
+}
+
+func newPriorityFixture(t *testing.T, tiers ...*QuestionTier) *priorityFixture {
+	t.Helper()
+	workers := questionWorkers
+	questionWorkers = 1
+	t.Cleanup(func() { questionWorkers = workers })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	f := &priorityFixture{stream: make(chan *Message), asked: make(chan string, 10), release: make(chan struct{}), sent: make(chan string, 10)}
+	user := &User{ID: `1`, Username: `bot`}
+	channel := &Channel{ID: `10`, Name: `streamer`}
+	findQuestionTier := func(ctx context.Context, channel *Channel, bits int) (*QuestionTier, error) {
+		var found *QuestionTier
+		for _, tier := range tiers {
+			if tier.MinBits <= bits && (found == nil || tier.MinBits > found.MinBits) {
+				found = tier
+			}
+		}
+		return found, nil
+	}
+	gpt := func(ctx context.Context, query string) (string, error) {
+		f.asked <- query
+		<-f.release
+		return query, nil
+	}
+	tieredGPT := func(ctx context.Context, query string, tier *QuestionTier) (string, error) {
+		return tier.Model + `: ` + query, nil
+	}
+	sendMessage := func(ctx context.Context, user *User, channel *Channel, message string) (string, error) {
+		f.sent <- message
+		return ``, nil
+	}
+	ServeMessageStream(ctx, f.stream, MessageHandlers{
+		FindUser:         func(username string) *User { return user },
+		FindChannel:      func(user *User, channelName string) *Channel { return channel },
+		FindChannelOwner: func(channelName string) (*User, *Channel) { return user, channel },
+		FindQuestionTier: findQuestionTier,
+		SendMessage:      sendMessage,
+		GPT:              gpt,
+		TieredGPT:        tieredGPT,
+	})
+	return f
+}
+
+func (f *priorityFixture) say(username, text string, bits string) {
+	message := &Message{Username: username, ChannelName: `streamer`, Message: text, MessageType: PrivMsg}
+	if bits != `` {
+		message.Tags = map[string]string{`bits`: bits}
+	}
+	f.stream <- message
+}
+
+func (f *priorityFixture) expectSent(t *testing.T) string {
+	t.Helper()
+	select {
+	case message := <-f.sent:
+		return message
+	case <-time.After(time.Second):
+		t.Fatal(`nothing was sent`)
+	}
+	return ``
+}
+
+func TestServeMessageStreamAnswersCheeredQuestionsFirst(t *testing.T) {
+	f := newPriorityFixture(t, &QuestionTier{MinBits: 100, Model: `small`}, &QuestionTier{MinBits: 1000, Model: `big`})
+	f.say(`alice`, `!!!first`, ``)
+	// the only worker is busy with the first question while the others are queued
+	<-f.asked
+	f.say(`bob`, `!!!second`, ``)
+	f.say(`carol`, `!!!Cheer100 cheered`, `100`)
+	f.say(`dave`, `!!!Cheer500 Cheer500 cheered more`, `1000`)
+	// the cheers are routed on their own goroutines, give them time to be queued
+	time.Sleep(50 * time.Millisecond)
+	close(f.release)
+
+	for _, want := range []string{`@alice first`, `@dave big: cheered more`, `@carol small: cheered`, `@bob second`} {
+		if message := f.expectSent(t); message != want {
+			t.Fatalf("expected %q, got %q", want, message)
+		}
+	}
+}
+
+func TestServeMessageStreamTreatsSmallCheersAsFreeQuestions(t *testing.T) {
+	f := newPriorityFixture(t, &QuestionTier{MinBits: 100, Model: `small`})
+	close(f.release)
+	f.say(`alice`, `Cheer10 not a question`, `10`)
+	f.say(`bob`, `!!!Cheer10 a question`, `10`)
+	if message := f.expectSent(t); message != `@bob Cheer10 a question` {
+		t.Fatalf("expected the small cheer to be answered as a free question, got %q", message)
+	}
+	select {
+	case message := <-f.sent:
+		t.Fatalf("expected a cheer without the prefix to be ignored, got %q", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServeMessageStreamIgnoresCheersWithoutPrefix(t *testing.T) {
+	f := newPriorityFixture(t, &QuestionTier{MinBits: 100, Model: `small`})
+	close(f.release)
+	f.say(`alice`, `Cheer500 hype!!`, `500`)
+	f.say(`bob`, `!!!Cheer500 a question`, `500`)
+	if message := f.expectSent(t); message != `@bob small: a question` {
+		t.Fatalf("expected only the cheer with the prefix to be answered, got %q", message)
+	}
+	select {
+	case message := <-f.sent:
+		t.Fatalf("expected a cheer without the prefix to be ignored, got %q", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestQuestionQueueCapsWorkersPerChannel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := newQuestionQueue(ctx, 2, 1)
+	release := make(chan struct{})
+	defer close(release)
+	answered := make(chan string, 3)
+	// the slow channel's first question holds its worker, as a send waiting out slow mode does
+	q.push(`slow`, 0, func(ctx context.Context) {
+		answered <- `slow 1`
+		<-release
+	})
+	if question := <-answered; question != `slow 1` {
+		t.Fatalf("unexpected answer %q", question)
+	}
+	q.push(`slow`, 0, func(ctx context.Context) { answered <- `slow 2` })
+	q.push(`other`, 0, func(ctx context.Context) { answered <- `other` })
+	select {
+	case question := <-answered:
+		if question != `other` {
+			t.Fatalf("expected the other channel to get the spare worker, got %q", question)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`the other channel's question was not answered`)
+	}
+	release <- struct{}{}
+	if question := <-answered; question != `slow 2` {
+		t.Fatalf("unexpected answer %q", question)
+	}
+}
+
+func TestCheerQuestion(t *testing.T) {
+	for text, want := range map[string]string{
+		`Cheer100 why is the sky blue?`: `why is the sky blue?`,
+		`!!!Kappa50 PogChamp100 hi`:     `hi`,
+		`Cheer100`:                      ``,
+		`is gpt-4 better than gpt-3`:    `is gpt-4 better than gpt-3`,
+	} {
+		if got := cheerQuestion(text); got != want {
+			t.Fatalf("cheerQuestion(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
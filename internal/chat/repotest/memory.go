@@ -0,0 +1,468 @@
+package repotest
+
+import (
+	"context"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryRepository is a chat.Repository that keeps everything in maps. It behaves like the database repositories,
+// including their unique indexes, and hands out copies so callers can't change what it stores.
+type MemoryRepository struct {
+	lock     sync.Mutex
+	users    map[string]*chat.User
+	channels map[string]*chat.Channel
+	rules    map[string]*chat.EventRule
+	tiers    map[string]*chat.QuestionTier
+	timers   map[string]*chat.Timer
+	audit    []*chat.AuditEntry
+	tokens   map[string]*chat.APIToken
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		users:    make(map[string]*chat.User),
+		channels: make(map[string]*chat.Channel),
+		rules:    make(map[string]*chat.EventRule),
+		tiers:    make(map[string]*chat.QuestionTier),
+		timers:   make(map[string]*chat.Timer),
+		tokens:   make(map[string]*chat.APIToken),
+	}
+}
+
+func copyUser(user *chat.User) *chat.User {
+	c := *user
+	c.Scopes = slices.Clone(user.Scopes)
+	if len(c.Scopes) == 0 {
+		c.Scopes = nil
+	}
+	return &c
+}
+
+func copyChannel(channel *chat.Channel) *chat.Channel {
+	c := *channel
+	if c.AnswerWhen == "" {
+		c.AnswerWhen = chat.AnswerAlways
+	}
+	return &c
+}
+
+func copyTimer(timer *chat.Timer) *chat.Timer {
+	c := *timer
+	c.Lines = storedLines(timer.Lines)
+	return &c
+}
+
+func copyAPIToken(token *chat.APIToken) *chat.APIToken {
+	c := *token
+	c.Scopes = slices.Clone(token.Scopes)
+	if len(c.Scopes) == 0 {
+		c.Scopes = nil
+	}
+	return &c
+}
+
+func (repo *MemoryRepository) GetChannelsByUser(ctx context.Context, userId string) ([]*chat.Channel, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	channels := make([]*chat.Channel, 0)
+	for _, channel := range repo.channels {
+		if channel.UserId == userId {
+			channels = append(channels, copyChannel(channel))
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].CreatedAt.Before(channels[j].CreatedAt) })
+	return channels, nil
+}
+
+func (repo *MemoryRepository) SaveChannel(ctx context.Context, channel *chat.Channel) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if _, ok := repo.channels[channel.ID]; ok {
+		return chat.ErrConflict
+	}
+	for _, existing := range repo.channels {
+		if existing.Name == channel.Name {
+			return chat.ErrConflict
+		}
+	}
+	repo.channels[channel.ID] = copyChannel(channel)
+	return nil
+}
+
+func (repo *MemoryRepository) GetChannel(ctx context.Context, id string) (*chat.Channel, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	channel, ok := repo.channels[id]
+	if !ok {
+		return nil, chat.ErrNotFound
+	}
+	return copyChannel(channel), nil
+}
+
+func (repo *MemoryRepository) DeleteChannel(ctx context.Context, id string) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if _, ok := repo.channels[id]; !ok {
+		return chat.ErrNotFound
+	}
+	repo.deleteChannel(id)
+	return nil
+}
+
+func (repo *MemoryRepository) deleteChannel(id string) {
+	for ruleId, rule := range repo.rules {
+		if rule.ChannelID == id {
+			delete(repo.rules, ruleId)
+		}
+	}
+	for tierId, tier := range repo.tiers {
+		if tier.ChannelID == id {
+			delete(repo.tiers, tierId)
+		}
+	}
+	for timerId, timer := range repo.timers {
+		if timer.ChannelID == id {
+			delete(repo.timers, timerId)
+		}
+	}
+	delete(repo.channels, id)
+}
+
+func (repo *MemoryRepository) UpdateChannel(ctx context.Context, channel *chat.Channel) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	existing, ok := repo.channels[channel.ID]
+	if !ok {
+		return chat.ErrNotFound
+	}
+	for _, other := range repo.channels {
+		if other.ID != channel.ID && other.Name == channel.Name {
+			return chat.ErrConflict
+		}
+	}
+	updated := copyChannel(channel)
+	updated.UserId = existing.UserId
+	updated.CreatedAt = existing.CreatedAt
+	repo.channels[channel.ID] = updated
+	return nil
+}
+
+func (repo *MemoryRepository) GetUsers(ctx context.Context) ([]*chat.User, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	users := make([]*chat.User, 0, len(repo.users))
+	for _, user := range repo.users {
+		users = append(users, copyUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].CreatedAt.Before(users[j].CreatedAt) })
+	return users, nil
+}
+
+func (repo *MemoryRepository) SaveUser(ctx context.Context, user *chat.User) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if _, ok := repo.users[user.ID]; ok {
+		return chat.ErrConflict
+	}
+	for _, existing := range repo.users {
+		if existing.Username == user.Username {
+			return chat.ErrConflict
+		}
+	}
+	repo.users[user.ID] = copyUser(user)
+	return nil
+}
+
+func (repo *MemoryRepository) DeleteUser(ctx context.Context, id string) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if _, ok := repo.users[id]; !ok {
+		return chat.ErrNotFound
+	}
+	for channelId, channel := range repo.channels {
+		if channel.UserId == id {
+			repo.deleteChannel(channelId)
+		}
+	}
+	delete(repo.users, id)
+	return nil
+}
+
+func (repo *MemoryRepository) GetUser(ctx context.Context, id string) (*chat.User, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	user, ok := repo.users[id]
+	if !ok {
+		return nil, chat.ErrNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (repo *MemoryRepository) UpdateUser(ctx context.Context, user *chat.User) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	existing, ok := repo.users[user.ID]
+	if !ok {
+		return chat.ErrNotFound
+	}
+	for _, other := range repo.users {
+		if other.ID != user.ID && other.Username == user.Username {
+			return chat.ErrConflict
+		}
+	}
+	updated := copyUser(user)
+	updated.CreatedAt = existing.CreatedAt
+	repo.users[user.ID] = updated
+	return nil
+}
+
+func (repo *MemoryRepository) GetEventRulesByChannel(ctx context.Context, channelId string) ([]*chat.EventRule, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	rules := make([]*chat.EventRule, 0)
+	for _, rule := range repo.rules {
+		if rule.ChannelID == channelId {
+			c := *rule
+			rules = append(rules, &c)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Event < rules[j].Event })
+	return rules, nil
+}
+
+func (repo *MemoryRepository) SaveEventRule(ctx context.Context, rule *chat.EventRule) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if _, ok := repo.rules[rule.ID]; ok {
+		return chat.ErrConflict
+	}
+	for _, existing := range repo.rules {
+		if existing.ChannelID == rule.ChannelID && existing.Event == rule.Event {
+			return chat.ErrConflict
+		}
+	}
+	c := *rule
+	repo.rules[rule.ID] = &c
+	return nil
+}
+
+func (repo *MemoryRepository) UpdateEventRule(ctx context.Context, rule *chat.EventRule) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	existing, ok := repo.rules[rule.ID]
+	if !ok {
+		return chat.ErrNotFound
+	}
+	existing.Enabled = rule.Enabled
+	existing.Prompt = rule.Prompt
+	existing.Cooldown = rule.Cooldown
+	existing.BatchWindow = rule.BatchWindow
+	return nil
+}
+
+func (repo *MemoryRepository) GetQuestionTiersByChannel(ctx context.Context, channelId string) ([]*chat.QuestionTier, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	tiers := make([]*chat.QuestionTier, 0)
+	for _, tier := range repo.tiers {
+		if tier.ChannelID == channelId {
+			c := *tier
+			tiers = append(tiers, &c)
+		}
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinBits < tiers[j].MinBits })
+	return tiers, nil
+}
+
+func (repo *MemoryRepository) SaveQuestionTier(ctx context.Context, tier *chat.QuestionTier) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if _, ok := repo.tiers[tier.ID]; ok {
+		return chat.ErrConflict
+	}
+	for _, existing := range repo.tiers {
+		if existing.ChannelID == tier.ChannelID && existing.MinBits == tier.MinBits {
+			return chat.ErrConflict
+		}
+	}
+	c := *tier
+	repo.tiers[tier.ID] = &c
+	return nil
+}
+
+func (repo *MemoryRepository) DeleteQuestionTier(ctx context.Context, id string) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if _, ok := repo.tiers[id]; !ok {
+		return chat.ErrNotFound
+	}
+	delete(repo.tiers, id)
+	return nil
+}
+
+func (repo *MemoryRepository) GetTimersByChannel(ctx context.Context, channelId string) ([]*chat.Timer, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	timers := make([]*chat.Timer, 0)
+	for _, timer := range repo.timers {
+		if timer.ChannelID == channelId {
+			timers = append(timers, copyTimer(timer))
+		}
+	}
+	sort.Slice(timers, func(i, j int) bool { return timers[i].CreatedAt.Before(timers[j].CreatedAt) })
+	return timers, nil
+}
+
+func (repo *MemoryRepository) SaveTimer(ctx context.Context, timer *chat.Timer) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if _, ok := repo.timers[timer.ID]; ok {
+		return chat.ErrConflict
+	}
+	repo.timers[timer.ID] = copyTimer(timer)
+	return nil
+}
+
+func (repo *MemoryRepository) UpdateTimer(ctx context.Context, timer *chat.Timer) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	existing, ok := repo.timers[timer.ID]
+	if !ok {
+		return chat.ErrNotFound
+	}
+	updated := copyTimer(timer)
+	updated.ChannelID = existing.ChannelID
+	updated.CreatedAt = existing.CreatedAt
+	repo.timers[timer.ID] = updated
+	return nil
+}
+
+func (repo *MemoryRepository) DeleteTimer(ctx context.Context, id string) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if _, ok := repo.timers[id]; !ok {
+		return chat.ErrNotFound
+	}
+	delete(repo.timers, id)
+	return nil
+}
+
+func (repo *MemoryRepository) SaveAuditEntry(ctx context.Context, entry *chat.AuditEntry) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	for _, existing := range repo.audit {
+		if existing.ID == entry.ID {
+			return chat.ErrConflict
+		}
+	}
+	c := *entry
+	repo.audit = append(repo.audit, &c)
+	return nil
+}
+
+func (repo *MemoryRepository) ForgetUsername(ctx context.Context, username string, entry *chat.AuditEntry) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	for _, existing := range repo.audit {
+		if existing.ID == entry.ID {
+			return chat.ErrConflict
+		}
+	}
+	for channelId, channel := range repo.channels {
+		owner, ok := repo.users[channel.UserId]
+		if strings.EqualFold(channel.Name, username) || ok && strings.EqualFold(owner.Username, username) {
+			repo.deleteChannel(channelId)
+		}
+	}
+	for id, user := range repo.users {
+		if strings.EqualFold(user.Username, username) {
+			delete(repo.users, id)
+		}
+	}
+	c := *entry
+	repo.audit = append(repo.audit, &c)
+	return nil
+}
+
+func (repo *MemoryRepository) GetAuditEntries(ctx context.Context, limit int) ([]*chat.AuditEntry, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	entries := make([]*chat.AuditEntry, 0, len(repo.audit))
+	for _, entry := range repo.audit {
+		c := *entry
+		entries = append(entries, &c)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].CreatedAt.After(entries[j].CreatedAt) })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (repo *MemoryRepository) GetAPITokens(ctx context.Context) ([]*chat.APIToken, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	tokens := make([]*chat.APIToken, 0, len(repo.tokens))
+	for _, token := range repo.tokens {
+		tokens = append(tokens, copyAPIToken(token))
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+func (repo *MemoryRepository) GetAPITokenByHash(ctx context.Context, hash string) (*chat.APIToken, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	for _, token := range repo.tokens {
+		if token.Hash == hash {
+			return copyAPIToken(token), nil
+		}
+	}
+	return nil, chat.ErrNotFound
+}
+
+func (repo *MemoryRepository) SaveAPIToken(ctx context.Context, token *chat.APIToken) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	for _, existing := range repo.tokens {
+		if existing.ID == token.ID || existing.Hash == token.Hash {
+			return chat.ErrConflict
+		}
+	}
+	repo.tokens[token.ID] = copyAPIToken(token)
+	return nil
+}
+
+func (repo *MemoryRepository) SetAPITokenLastUsed(ctx context.Context, id string, lastUsedAt time.Time) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	token, ok := repo.tokens[id]
+	if !ok {
+		return chat.ErrNotFound
+	}
+	token.LastUsedAt = lastUsedAt
+	return nil
+}
+
+func (repo *MemoryRepository) DeleteAPIToken(ctx context.Context, id string) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if _, ok := repo.tokens[id]; !ok {
+		return chat.ErrNotFound
+	}
+	delete(repo.tokens, id)
+	return nil
+}
+
+// storedLines mirrors how the database repositories keep a timer's lines in one newline separated column.
+func storedLines(lines []string) []string {
+	if len(lines) == 0 {
+		return nil
+	}
+	return strings.Split(strings.Join(lines, "\n"), "\n")
+}
@@ -0,0 +1,59 @@
+package repotest
+
+import (
+	"context"
+	"fmt"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	Run(t, func(t *testing.T) chat.Repository {
+		return NewMemoryRepository()
+	})
+}
+
+func TestMemoryRepositoryConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := newUser(fmt.Sprintf(`user%d`, i), now)
+			if err := repo.SaveUser(ctx, user); err != nil {
+				t.Error(err)
+				return
+			}
+			channel := newChannel(fmt.Sprintf(`channel%d`, i), user.ID, now)
+			if err := repo.SaveChannel(ctx, channel); err != nil {
+				t.Error(err)
+				return
+			}
+			user.NeedsReauth = true
+			if err := repo.UpdateUser(ctx, user); err != nil {
+				t.Error(err)
+			}
+			if _, err := repo.GetUsers(ctx); err != nil {
+				t.Error(err)
+			}
+			if i%2 == 0 {
+				if err := repo.DeleteUser(ctx, user.ID); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	users, err := repo.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 10 {
+		t.Fatalf("expected 10 users left, got %d", len(users))
+	}
+}
@@ -0,0 +1,619 @@
+// Package repotest checks that a chat.Repository behaves like the others, and provides one that lives in memory for
+// tests.
+package repotest
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Run checks the behaviour every chat.Repository has to share, whatever stores it. newRepository returns an empty
+// repository; it is called once per subtest.
+func Run(t *testing.T, newRepository func(t *testing.T) chat.Repository) {
+	// the database repositories keep times to the second
+	now := time.Now().Truncate(time.Second)
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, repo chat.Repository, now time.Time)
+	}{
+		{`users`, testUsers},
+		{`missing users`, testMissingUsers},
+		{`unique usernames`, testUniqueUsernames},
+		{`channels`, testChannels},
+		{`unique channel names`, testUniqueChannelNames},
+		{`copies`, testCopies},
+		{`event rules`, testEventRules},
+		{`question tiers`, testQuestionTiers},
+		{`timers`, testTimers},
+		{`delete channel`, testDeleteChannel},
+		{`delete user`, testDeleteUser},
+		{`audit log`, testAuditLog},
+		{`forget username`, testForgetUsername},
+		{`api tokens`, testAPITokens},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newRepository(t), now)
+		})
+	}
+}
+
+func newUser(username string, now time.Time) *chat.User {
+	return &chat.User{ID: uuid.New().String(), Username: username, AccessToken: username + `-access`, RefreshToken: username + `-refresh`, ExpiresAt: now.Add(time.Hour), CreatedAt: now}
+}
+
+func newChannel(name, userId string, now time.Time) *chat.Channel {
+	return &chat.Channel{ID: uuid.New().String(), Name: name, UserId: userId, CreatedAt: now}
+}
+
+func saveUser(t *testing.T, repo chat.Repository, user *chat.User) {
+	t.Helper()
+	if err := repo.SaveUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func saveChannel(t *testing.T, repo chat.Repository, channel *chat.Channel) {
+	t.Helper()
+	if err := repo.SaveChannel(context.Background(), channel); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// saveChannelFeatures gives the channel a rule, a tier and a timer.
+func saveChannelFeatures(t *testing.T, repo chat.Repository, channelId string, now time.Time) {
+	t.Helper()
+	ctx := context.Background()
+	if err := repo.SaveEventRule(ctx, &chat.EventRule{ID: uuid.New().String(), ChannelID: channelId, Event: chat.EventRaid, Prompt: `welcome the raiders`, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveQuestionTier(ctx, &chat.QuestionTier{ID: uuid.New().String(), ChannelID: channelId, MinBits: 100, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveTimer(ctx, &chat.Timer{ID: uuid.New().String(), ChannelID: channelId, Name: `socials`, Interval: time.Minute, Lines: []string{`follow`}, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countChannelFeatures returns how many rules, tiers and timers the channel has.
+func countChannelFeatures(t *testing.T, repo chat.Repository, channelId string) int {
+	t.Helper()
+	ctx := context.Background()
+	rules, err := repo.GetEventRulesByChannel(ctx, channelId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiers, err := repo.GetQuestionTiersByChannel(ctx, channelId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timers, err := repo.GetTimersByChannel(ctx, channelId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(rules) + len(tiers) + len(timers)
+}
+
+func testUsers(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	user := newUser(`bot`, now)
+	user.Scopes = []string{`chat:read`, `chat:edit`}
+	saveUser(t, repo, user)
+	saveUser(t, repo, newUser(`other`, now))
+
+	stored, err := repo.GetUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ID != user.ID || stored.Username != `bot` || stored.AccessToken != `bot-access` || stored.RefreshToken != `bot-refresh` || !stored.ExpiresAt.Equal(user.ExpiresAt) || !stored.CreatedAt.Equal(now) || !slices.Equal(stored.Scopes, user.Scopes) || stored.NeedsReauth || !stored.ValidatedAt.IsZero() {
+		t.Fatalf("expected the saved user back, got %+v", stored)
+	}
+
+	stored.Username = `renamed`
+	stored.AccessToken = `new-access`
+	stored.RefreshToken = `new-refresh`
+	stored.ExpiresAt = now.Add(2 * time.Hour)
+	stored.NeedsReauth = true
+	stored.Scopes = nil
+	stored.ValidatedAt = now
+	if err := repo.UpdateUser(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := repo.GetUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Username != `renamed` || updated.AccessToken != `new-access` || updated.RefreshToken != `new-refresh` || !updated.ExpiresAt.Equal(now.Add(2*time.Hour)) || !updated.NeedsReauth || len(updated.Scopes) != 0 || !updated.ValidatedAt.Equal(now) || !updated.CreatedAt.Equal(now) {
+		t.Fatalf("expected every field to be updated, got %+v", updated)
+	}
+
+	users, err := repo.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users, got %+v", users)
+	}
+	i := slices.IndexFunc(users, func(u *chat.User) bool { return u.ID == user.ID })
+	if i < 0 || users[i].AccessToken != `new-access` || users[i].Username != `renamed` {
+		t.Fatalf("expected the updated user in the list, got %+v", users)
+	}
+}
+
+func testMissingUsers(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	if user, err := repo.GetUser(ctx, `missing`); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected chat.ErrNotFound for a missing user, got %+v, %v", user, err)
+	}
+	if err := repo.UpdateUser(ctx, newUser(`ghost`, now)); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected chat.ErrNotFound updating a missing user, got %v", err)
+	}
+	if err := repo.DeleteUser(ctx, `missing`); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected chat.ErrNotFound deleting a missing user, got %v", err)
+	}
+	if users, _ := repo.GetUsers(ctx); len(users) != 0 {
+		t.Fatalf("expected no users, got %+v", users)
+	}
+}
+
+func testUniqueUsernames(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	user := newUser(`bot`, now)
+	saveUser(t, repo, user)
+	if err := repo.SaveUser(ctx, newUser(`bot`, now)); !errors.Is(err, chat.ErrConflict) {
+		t.Fatalf("expected usernames to be unique, got %v", err)
+	}
+	duplicate := newUser(`other`, now)
+	duplicate.ID = user.ID
+	if err := repo.SaveUser(ctx, duplicate); !errors.Is(err, chat.ErrConflict) {
+		t.Fatalf("expected ids to be unique, got %v", err)
+	}
+	other := newUser(`other`, now)
+	saveUser(t, repo, other)
+	other.Username = `bot`
+	if err := repo.UpdateUser(ctx, other); !errors.Is(err, chat.ErrConflict) {
+		t.Fatalf("expected renaming to a taken username to fail, got %v", err)
+	}
+}
+
+func testChannels(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	channel := newChannel(`streamer`, `1`, now)
+	saveChannel(t, repo, channel)
+	saveChannel(t, repo, newChannel(`elsewhere`, `2`, now))
+
+	stored, err := repo.GetChannel(ctx, channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || stored.Name != `streamer` || stored.UserId != `1` || stored.AnswerWhen != chat.AnswerAlways || stored.StreamContext || stored.Paused || !stored.CreatedAt.Equal(now) || !stored.DroppedAt.IsZero() || stored.RewardID != `` {
+		t.Fatalf("expected the saved channel back, got %+v", stored)
+	}
+
+	stored.DropReason = `banned`
+	stored.DropMessage = `you were banned`
+	stored.DroppedAt = now
+	stored.RewardID = `reward`
+	stored.AnswerWhen = chat.AnswerLive
+	stored.StreamContext = true
+	stored.Paused = true
+	if err := repo.UpdateChannel(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+	channels, err := repo.GetChannelsByUser(ctx, `1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 {
+		t.Fatalf("expected only the user's channel, got %+v", channels)
+	}
+	if c := channels[0]; c.ID != channel.ID || c.DropReason != `banned` || c.DropMessage != `you were banned` || !c.DroppedAt.Equal(now) || c.RewardID != `reward` || c.AnswerWhen != chat.AnswerLive || !c.StreamContext || !c.Paused || c.UserId != `1` {
+		t.Fatalf("expected the updated channel, got %+v", c)
+	}
+
+	if missing, err := repo.GetChannel(ctx, `missing`); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected chat.ErrNotFound for a missing channel, got %+v, %v", missing, err)
+	}
+	if err := repo.UpdateChannel(ctx, newChannel(`ghost`, `1`, now)); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected chat.ErrNotFound updating a missing channel, got %v", err)
+	}
+	if channels, err := repo.GetChannelsByUser(ctx, `nobody`); err != nil || channels == nil || len(channels) != 0 {
+		t.Fatalf("expected an empty list, got %+v, %v", channels, err)
+	}
+}
+
+func testUniqueChannelNames(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	saveChannel(t, repo, newChannel(`streamer`, `1`, now))
+	if err := repo.SaveChannel(ctx, newChannel(`streamer`, `2`, now)); !errors.Is(err, chat.ErrConflict) {
+		t.Fatalf("expected channel names to be unique, got %v", err)
+	}
+	other := newChannel(`other`, `1`, now)
+	saveChannel(t, repo, other)
+	other.Name = `streamer`
+	if err := repo.UpdateChannel(ctx, other); !errors.Is(err, chat.ErrConflict) {
+		t.Fatalf("expected renaming to a taken channel name to fail, got %v", err)
+	}
+}
+
+// testCopies makes sure changing what a repository returned doesn't change what it stores.
+func testCopies(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	user := newUser(`bot`, now)
+	user.Scopes = []string{`chat:read`}
+	saveUser(t, repo, user)
+	user.Scopes[0] = `changed`
+	user.AccessToken = `changed`
+	stored, err := repo.GetUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Scopes[0] = `changed`
+	stored.Username = `changed`
+	again, err := repo.GetUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Username != `bot` || again.AccessToken != `bot-access` || again.Scopes[0] != `chat:read` {
+		t.Fatalf("expected the stored user to stay as saved, got %+v", again)
+	}
+
+	timer := &chat.Timer{ID: uuid.New().String(), ChannelID: `10`, Name: `socials`, Interval: time.Minute, Lines: []string{`follow`}, CreatedAt: now}
+	if err := repo.SaveTimer(ctx, timer); err != nil {
+		t.Fatal(err)
+	}
+	timer.Lines[0] = `changed`
+	timers, err := repo.GetTimersByChannel(ctx, `10`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timers[0].Lines[0] = `changed too`
+	if timers, _ = repo.GetTimersByChannel(ctx, `10`); timers[0].Lines[0] != `follow` {
+		t.Fatalf("expected the stored timer to stay as saved, got %+v", timers[0])
+	}
+}
+
+func testEventRules(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	rule := &chat.EventRule{ID: uuid.New().String(), ChannelID: `10`, Event: chat.EventRaid, Prompt: `thank {{.User}}`, Cooldown: time.Minute, CreatedAt: now}
+	if err := repo.SaveEventRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveEventRule(ctx, &chat.EventRule{ID: uuid.New().String(), ChannelID: `10`, Event: chat.EventRaid, Prompt: `again`, CreatedAt: now}); !errors.Is(err, chat.ErrConflict) {
+		t.Fatalf("expected one rule per channel and event, got %v", err)
+	}
+	if err := repo.SaveEventRule(ctx, &chat.EventRule{ID: uuid.New().String(), ChannelID: `11`, Event: chat.EventRaid, Prompt: `other channel`, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	rule.Enabled = true
+	rule.Prompt = `welcome {{.User}}`
+	rule.Cooldown = 2 * time.Minute
+	rule.BatchWindow = 10 * time.Second
+	if err := repo.UpdateEventRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := repo.GetEventRulesByChannel(ctx, `10`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("expected only the channel's rule, got %+v", rules)
+	}
+	if r := rules[0]; r.ID != rule.ID || r.ChannelID != `10` || r.Event != chat.EventRaid || !r.Enabled || r.Prompt != `welcome {{.User}}` || r.Cooldown != 2*time.Minute || r.BatchWindow != 10*time.Second || !r.CreatedAt.Equal(now) {
+		t.Fatalf("expected the updated rule, got %+v", r)
+	}
+}
+
+func testQuestionTiers(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	for _, bits := range []int{500, 100, 1000} {
+		if err := repo.SaveQuestionTier(ctx, &chat.QuestionTier{ID: uuid.New().String(), ChannelID: `10`, MinBits: bits, Model: `gpt-4`, MaxTokens: bits / 2, CreatedAt: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.SaveQuestionTier(ctx, &chat.QuestionTier{ID: uuid.New().String(), ChannelID: `10`, MinBits: 100, CreatedAt: now}); !errors.Is(err, chat.ErrConflict) {
+		t.Fatalf("expected one tier per amount of bits, got %v", err)
+	}
+	if err := repo.SaveQuestionTier(ctx, &chat.QuestionTier{ID: uuid.New().String(), ChannelID: `11`, MinBits: 100, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	tiers, err := repo.GetQuestionTiersByChannel(ctx, `10`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiers) != 3 || tiers[0].MinBits != 100 || tiers[1].MinBits != 500 || tiers[2].MinBits != 1000 {
+		t.Fatalf("expected the channel's tiers ordered by bits, got %+v", tiers)
+	}
+	if tiers[1].Model != `gpt-4` || tiers[1].MaxTokens != 250 || tiers[1].ChannelID != `10` || !tiers[1].CreatedAt.Equal(now) {
+		t.Fatalf("expected the saved tier back, got %+v", tiers[1])
+	}
+	if err := repo.DeleteQuestionTier(ctx, tiers[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if tiers, _ = repo.GetQuestionTiersByChannel(ctx, `10`); len(tiers) != 2 || tiers[0].MinBits != 500 {
+		t.Fatalf("expected the tier to be deleted, got %+v", tiers)
+	}
+	if err := repo.DeleteQuestionTier(ctx, `missing`); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected chat.ErrNotFound deleting a missing tier, got %v", err)
+	}
+}
+
+func testTimers(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	timer := &chat.Timer{ID: uuid.New().String(), ChannelID: `10`, Name: `socials`, Interval: 15 * time.Minute, Lines: []string{`one`, `two`}, CreatedAt: now}
+	if err := repo.SaveTimer(ctx, timer); err != nil {
+		t.Fatal(err)
+	}
+	later := &chat.Timer{ID: uuid.New().String(), ChannelID: `10`, Name: `later`, Interval: time.Minute, Prompt: `say hi`, CreatedAt: now.Add(time.Second)}
+	if err := repo.SaveTimer(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	timers, err := repo.GetTimersByChannel(ctx, `10`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timers) != 2 || timers[0].ID != timer.ID || timers[1].ID != later.ID {
+		t.Fatalf("expected the timers in the order they were created, got %+v", timers)
+	}
+	if !slices.Equal(timers[0].Lines, []string{`one`, `two`}) || len(timers[1].Lines) != 0 {
+		t.Fatalf("expected the static lines back, got %+v", timers)
+	}
+
+	timer.Name = `renamed`
+	timer.Enabled = true
+	timer.Interval = 30 * time.Minute
+	timer.MinChatLines = 5
+	timer.Lines = nil
+	timer.Prompt = `remind chat to follow`
+	if err := repo.UpdateTimer(ctx, timer); err != nil {
+		t.Fatal(err)
+	}
+	timers, err = repo.GetTimersByChannel(ctx, `10`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := timers[0]; u.Name != `renamed` || !u.Enabled || u.Interval != 30*time.Minute || u.MinChatLines != 5 || u.Prompt != `remind chat to follow` || len(u.Lines) != 0 || !u.CreatedAt.Equal(now) {
+		t.Fatalf("expected the updated timer, got %+v", u)
+	}
+	if err := repo.DeleteTimer(ctx, timer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if timers, _ = repo.GetTimersByChannel(ctx, `10`); len(timers) != 1 || timers[0].ID != later.ID {
+		t.Fatalf("expected only the deleted timer to be gone, got %+v", timers)
+	}
+	if err := repo.UpdateTimer(ctx, timer); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected chat.ErrNotFound updating a deleted timer, got %v", err)
+	}
+	if err := repo.DeleteTimer(ctx, timer.ID); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected chat.ErrNotFound deleting a deleted timer, got %v", err)
+	}
+}
+
+func testDeleteChannel(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	deleted := newChannel(`deleted`, `1`, now)
+	kept := newChannel(`kept`, `1`, now)
+	for _, channel := range []*chat.Channel{deleted, kept} {
+		saveChannel(t, repo, channel)
+		saveChannelFeatures(t, repo, channel.ID, now)
+	}
+	if err := repo.DeleteChannel(ctx, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	if channel, err := repo.GetChannel(ctx, deleted.ID); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected the channel to be deleted, got %+v, %v", channel, err)
+	}
+	if n := countChannelFeatures(t, repo, deleted.ID); n != 0 {
+		t.Fatalf("expected the channel's rules, tiers and timers to be deleted with it, %d are left", n)
+	}
+	if n := countChannelFeatures(t, repo, kept.ID); n != 3 {
+		t.Fatalf("expected the other channel to keep its rules, tiers and timers, it has %d", n)
+	}
+	if err := repo.DeleteChannel(ctx, `missing`); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected chat.ErrNotFound deleting a missing channel, got %v", err)
+	}
+}
+
+func testDeleteUser(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	user := newUser(`bot`, now)
+	other := newUser(`other`, now)
+	saveUser(t, repo, user)
+	saveUser(t, repo, other)
+	var deleted []string
+	for _, name := range []string{`first`, `second`} {
+		channel := newChannel(name, user.ID, now)
+		saveChannel(t, repo, channel)
+		saveChannelFeatures(t, repo, channel.ID, now)
+		deleted = append(deleted, channel.ID)
+	}
+	kept := newChannel(`kept`, other.ID, now)
+	saveChannel(t, repo, kept)
+	saveChannelFeatures(t, repo, kept.ID, now)
+
+	if err := repo.DeleteUser(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetUser(ctx, user.ID); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected the user to be deleted, got %v", err)
+	}
+	if channels, _ := repo.GetChannelsByUser(ctx, user.ID); len(channels) != 0 {
+		t.Fatalf("expected the user's channels to be deleted with them, got %+v", channels)
+	}
+	for _, id := range deleted {
+		if channel, err := repo.GetChannel(ctx, id); !errors.Is(err, chat.ErrNotFound) {
+			t.Fatalf("expected the user's channel to be deleted, got %+v", channel)
+		}
+		if n := countChannelFeatures(t, repo, id); n != 0 {
+			t.Fatalf("expected the rules, tiers and timers of the user's channels to be deleted, %d are left", n)
+		}
+	}
+	users, err := repo.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].ID != other.ID {
+		t.Fatalf("expected only the other user to be left, got %+v", users)
+	}
+	if channel, _ := repo.GetChannel(ctx, kept.ID); channel == nil {
+		t.Fatal(`expected the other user's channel to stay`)
+	}
+	if n := countChannelFeatures(t, repo, kept.ID); n != 3 {
+		t.Fatalf("expected the other user's channel to keep its rules, tiers and timers, it has %d", n)
+	}
+}
+
+func testAuditLog(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	if entries, err := repo.GetAuditEntries(ctx, 10); err != nil || entries == nil || len(entries) != 0 {
+		t.Fatalf("expected an empty list, got %+v, %v", entries, err)
+	}
+	first := &chat.AuditEntry{ID: uuid.New().String(), Action: `forget_chatter`, Subject: `viewer`, Actor: `admin`, Details: `deleted 1 channel`, CreatedAt: now.Add(-time.Minute)}
+	for _, entry := range []*chat.AuditEntry{
+		first,
+		{ID: uuid.New().String(), Action: `forget_chatter`, Subject: `latest`, Actor: `cli`, CreatedAt: now.Add(time.Millisecond)},
+		{ID: uuid.New().String(), Action: `forget_chatter`, Subject: `second`, Actor: `cli`, CreatedAt: now},
+	} {
+		if err := repo.SaveAuditEntry(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.SaveAuditEntry(ctx, first); !errors.Is(err, chat.ErrConflict) {
+		t.Fatalf("expected ids to be unique, got %v", err)
+	}
+	entries, err := repo.GetAuditEntries(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Subject != `latest` || entries[1].Subject != `second` {
+		t.Fatalf("expected the two newest entries, newest first, got %+v", entries)
+	}
+	entries, _ = repo.GetAuditEntries(ctx, 10)
+	if e := entries[2]; len(entries) != 3 || e.ID != first.ID || e.Action != `forget_chatter` || e.Actor != `admin` || e.Details != `deleted 1 channel` || !e.CreatedAt.Equal(first.CreatedAt) {
+		t.Fatalf("expected the saved entry back, got %+v", entries)
+	}
+}
+
+func testForgetUsername(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	bot := newUser(`bot`, now)
+	viewer := newUser(`Viewer`, now)
+	saveUser(t, repo, bot)
+	saveUser(t, repo, viewer)
+	named := newChannel(`viewer`, bot.ID, now)
+	owned := newChannel(`owned`, viewer.ID, now)
+	kept := newChannel(`kept`, bot.ID, now)
+	for _, channel := range []*chat.Channel{named, owned, kept} {
+		saveChannel(t, repo, channel)
+		saveChannelFeatures(t, repo, channel.ID, now)
+	}
+	existing := &chat.AuditEntry{ID: uuid.New().String(), Action: `forget_chatter`, Subject: `other`, Actor: `cli`, CreatedAt: now}
+	if err := repo.SaveAuditEntry(ctx, existing); err != nil {
+		t.Fatal(err)
+	}
+
+	// an audit entry that can't be saved leaves everything in place
+	failing := &chat.AuditEntry{ID: existing.ID, Action: `forget_chatter`, Subject: `viewer`, Actor: `admin`, CreatedAt: now}
+	if err := repo.ForgetUsername(ctx, `viewer`, failing); !errors.Is(err, chat.ErrConflict) {
+		t.Fatalf("expected the duplicate audit entry to fail, got %v", err)
+	}
+	if _, err := repo.GetUser(ctx, viewer.ID); err != nil {
+		t.Fatalf("expected the user to be kept after the failed forget, got %v", err)
+	}
+	for _, channel := range []*chat.Channel{named, owned} {
+		if n := countChannelFeatures(t, repo, channel.ID); n != 3 {
+			t.Fatalf("expected the channel to keep its settings after the failed forget, it has %d", n)
+		}
+	}
+
+	entry := &chat.AuditEntry{ID: uuid.New().String(), Action: `forget_chatter`, Subject: `viewer`, Actor: `admin`, Details: `deleted 1 users and 1 channels`, CreatedAt: now.Add(time.Second)}
+	if err := repo.ForgetUsername(ctx, `viewer`, entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetUser(ctx, viewer.ID); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected the user named viewer to be deleted, got %v", err)
+	}
+	for _, channel := range []*chat.Channel{named, owned} {
+		if _, err := repo.GetChannel(ctx, channel.ID); !errors.Is(err, chat.ErrNotFound) {
+			t.Fatalf("expected channel %s to be deleted, got %v", channel.Name, err)
+		}
+		if n := countChannelFeatures(t, repo, channel.ID); n != 0 {
+			t.Fatalf("expected the settings of channel %s to be deleted, %d are left", channel.Name, n)
+		}
+	}
+	if _, err := repo.GetUser(ctx, bot.ID); err != nil {
+		t.Fatalf("expected the other user to be kept, got %v", err)
+	}
+	if n := countChannelFeatures(t, repo, kept.ID); n != 3 {
+		t.Fatalf("expected the other channel to keep its settings, it has %d", n)
+	}
+	entries, err := repo.GetAuditEntries(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ID != entry.ID || entries[0].Details != entry.Details {
+		t.Fatalf("expected the forget to be audited, got %+v", entries)
+	}
+}
+
+func testAPITokens(t *testing.T, repo chat.Repository, now time.Time) {
+	ctx := context.Background()
+	if tokens, err := repo.GetAPITokens(ctx); err != nil || tokens == nil || len(tokens) != 0 {
+		t.Fatalf("expected an empty list, got %+v, %v", tokens, err)
+	}
+	first := &chat.APIToken{ID: uuid.New().String(), Name: `deploy`, Hash: `hash-1`, Scopes: []string{`read-only`, `manage-channels`}, ExpiresAt: now.Add(time.Hour), CreatedAt: now.Add(-time.Minute)}
+	second := &chat.APIToken{ID: uuid.New().String(), Name: `monitoring`, Hash: `hash-2`, CreatedAt: now}
+	for _, token := range []*chat.APIToken{second, first} {
+		if err := repo.SaveAPIToken(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.SaveAPIToken(ctx, &chat.APIToken{ID: uuid.New().String(), Name: `copy`, Hash: `hash-1`, CreatedAt: now}); !errors.Is(err, chat.ErrConflict) {
+		t.Fatalf("expected hashes to be unique, got %v", err)
+	}
+
+	tokens, err := repo.GetAPITokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].ID != first.ID || tokens[1].ID != second.ID {
+		t.Fatalf("expected the tokens, oldest first, got %+v", tokens)
+	}
+	token, err := repo.GetAPITokenByHash(ctx, `hash-1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Name != `deploy` || !slices.Equal(token.Scopes, first.Scopes) || !token.ExpiresAt.Equal(first.ExpiresAt) || !token.LastUsedAt.IsZero() || !token.CreatedAt.Equal(first.CreatedAt) {
+		t.Fatalf("expected the saved token back, got %+v", token)
+	}
+	if token, err = repo.GetAPITokenByHash(ctx, `hash-2`); err != nil || !token.ExpiresAt.IsZero() || len(token.Scopes) != 0 {
+		t.Fatalf("expected a token without expiry or scopes, got %+v, %v", token, err)
+	}
+	if _, err = repo.GetAPITokenByHash(ctx, `unknown`); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if err = repo.SetAPITokenLastUsed(ctx, first.ID, now); err != nil {
+		t.Fatal(err)
+	}
+	if token, _ = repo.GetAPITokenByHash(ctx, `hash-1`); !token.LastUsedAt.Equal(now) {
+		t.Fatalf("expected the last use to be stored, got %+v", token)
+	}
+	if err = repo.SetAPITokenLastUsed(ctx, `unknown`, now); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if err = repo.DeleteAPIToken(ctx, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = repo.DeleteAPIToken(ctx, first.ID); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err = repo.GetAPITokenByHash(ctx, `hash-1`); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected the token to be deleted, got %v", err)
+	}
+}
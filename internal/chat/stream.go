@@ -0,0 +1,58 @@
+package chat
+
+import (
+	"fmt"
+	"time"
+)
+
+// StreamState is what the bot knows about a channel's stream; a zero CheckedAt means it is unknown, because it wasn't
+// checked yet or not recently enough.
+type StreamState struct {
+	Live      bool
+	Title     string
+	Game      string
+	StartedAt time.Time
+	CheckedAt time.Time
+}
+
+type FindStreamState func(channel *Channel) StreamState
+
+// AnswersNow tells whether the channel wants questions answered while its stream is in the given state. Paused
+// channels are never answered; channels whose state is unknown are, so a failing Twitch API doesn't silence the bot.
+func AnswersNow(channel *Channel, state StreamState) bool {
+	if channel.Paused {
+		return false
+	}
+	if state.CheckedAt.IsZero() {
+		return true
+	}
+	switch channel.AnswerWhen {
+	case AnswerLive:
+		return state.Live
+	case AnswerOffline:
+		return !state.Live
+	}
+	return true
+}
+
+// withStreamContext tells the model what is being streamed, for channels that want it.
+func withStreamContext(channel *Channel, state StreamState, question string) string {
+	if !channel.StreamContext || !state.Live || (state.Title == "" && state.Game == "") {
+		return question
+	}
+	context := fmt.Sprintf("%s is live", channel.Name)
+	if state.Title != "" {
+		context += fmt.Sprintf(" with the title %q", state.Title)
+	}
+	if state.Game != "" {
+		context += fmt.Sprintf(", streaming %s", state.Game)
+	}
+	return context + ".\n\n" + question
+}
+
+func (s *messageServer) streamState(channel *Channel) StreamState {
+	if s.FindStreamState == nil {
+		return StreamState{}
+	}
+	return s.FindStreamState(channel)
+}
@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAnswersNow(t *testing.T) {
+	live := StreamState{Live: true, CheckedAt: time.Now()}
+	offline := StreamState{CheckedAt: time.Now()}
+	for _, test := range []struct {
+		answerWhen string
+		state      StreamState
+		want       bool
+	}{
+		{``, offline, true},
+		{AnswerAlways, live, true},
+		{AnswerLive, live, true},
+		{AnswerLive, offline, false},
+		{AnswerOffline, live, false},
+		{AnswerOffline, offline, true},
+		// the state isn't known before the first poll
+		{AnswerLive, StreamState{}, true},
+	} {
+		if got := AnswersNow(&Channel{AnswerWhen: test.answerWhen}, test.state); got != test.want {
+			t.Fatalf("AnswersNow(%q, %+v) = %v, want %v", test.answerWhen, test.state, got, test.want)
+		}
+	}
+	for _, state := range []StreamState{live, offline, {}} {
+		if AnswersNow(&Channel{Paused: true}, state) {
+			t.Fatalf("expected a paused channel not to be answered in %+v", state)
+		}
+	}
+}
+
+func TestServeMessageStreamAnswersOnlyWhileLive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	user := &User{ID: `1`, Username: `bot`}
+	channel := &Channel{ID: `10`, Name: `streamer`, AnswerWhen: AnswerLive, StreamContext: true}
+	var live atomic.Bool
+	queries := make(chan string, 10)
+	stream := make(chan *Message)
+	ServeMessageStream(ctx, stream, MessageHandlers{
+		FindUser:    func(username string) *User { return user },
+		FindChannel: func(user *User, channelName string) *Channel { return channel },
+		FindStreamState: func(channel *Channel) StreamState {
+			return StreamState{Live: live.Load(), Title: `speedruns`, Game: `Celeste`, CheckedAt: time.Now()}
+		},
+		SendMessage: func(ctx context.Context, user *User, channel *Channel, message string) (string, error) {
+			return ``, nil
+		},
+		GPT: func(ctx context.Context, query string) (string, error) {
+			queries <- query
+			return `answer`, nil
+		},
+	})
+
+	stream <- &Message{Username: `viewer`, ChannelName: `streamer`, Message: `!!!offline question`, MessageType: PrivMsg}
+	select {
+	case query := <-queries:
+		t.Fatalf("expected no answer while offline, got a query for %q", query)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	live.Store(true)
+	stream <- &Message{Username: `viewer`, ChannelName: `streamer`, Message: `!!!live question`, MessageType: PrivMsg}
+	select {
+	case query := <-queries:
+		if want := "streamer is live with the title \"speedruns\", streaming Celeste.\n\nlive question"; query != want {
+			t.Fatalf("expected the stream as context, got %q", query)
+		}
+	case <-time.After(time.Second):
+		t.Fatal(`no answer while live`)
+	}
+}
@@ -0,0 +1,198 @@
+package chat
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ChatActivity counts the chat lines of each channel, so timers don't post into a quiet chat.
+type ChatActivity struct {
+	lock  sync.Mutex
+	lines map[string]uint64
+	// ignore leaves out lines that shouldn't count, like the bot's own.
+	ignore func(username string) bool
+}
+
+func NewChatActivity(ignore func(username string) bool) *ChatActivity {
+	return &ChatActivity{lines: make(map[string]uint64), ignore: ignore}
+}
+
+func (a *ChatActivity) count(message *Message) {
+	if message.MessageType != PrivMsg || (a.ignore != nil && a.ignore(message.Username)) {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.lines[message.ChannelName]++
+}
+
+// Lines returns how many chat lines the channel has seen so far.
+func (a *ChatActivity) Lines(channelName string) uint64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.lines[channelName]
+}
+
+// CountChatLines counts every chat line of the stream before passing the messages on, since most are filtered out
+// later.
+func CountChatLines(ctx context.Context, messageStream <-chan *Message, activity *ChatActivity) <-chan *Message {
+	countedMessageStream := make(chan *Message)
+	go func() {
+		defer close(countedMessageStream)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messageStream:
+				if !ok {
+					return
+				}
+				activity.count(message)
+				select {
+				case <-ctx.Done():
+					return
+				case countedMessageStream <- message:
+				}
+			}
+		}
+	}()
+	return countedMessageStream
+}
+
+type JoinedChannel struct {
+	User    *User
+	Channel *Channel
+}
+
+type ListChannels func() []JoinedChannel
+type FindTimers func(ctx context.Context, channel *Channel) ([]*Timer, error)
+type IsLive func(ctx context.Context, user *User, channel *Channel) (bool, error)
+
+type TimerHandlers struct {
+	ListChannels ListChannels
+	FindTimers   FindTimers
+	IsLive       IsLive
+	SendMessage  SendMessage
+	GPT          GPT
+}
+
+type timerState struct {
+	postedAt time.Time
+	lines    uint64
+	lastLine int
+}
+
+type timerRunner struct {
+	TimerHandlers
+	activity *ChatActivity
+	states   map[string]*timerState
+}
+
+// RunTimers checks which timers are due every tick until the context is done.
+func RunTimers(ctx context.Context, activity *ChatActivity, handlers TimerHandlers, tick time.Duration) {
+	r := newTimerRunner(activity, handlers)
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				r.run(ctx, now)
+			}
+		}
+	}()
+}
+
+func newTimerRunner(activity *ChatActivity, handlers TimerHandlers) *timerRunner {
+	return &timerRunner{TimerHandlers: handlers, activity: activity, states: make(map[string]*timerState)}
+}
+
+func (r *timerRunner) run(ctx context.Context, now time.Time) {
+	seen := make(map[string]bool)
+	for _, joined := range r.ListChannels() {
+		if joined.Channel.Paused {
+			continue
+		}
+		timers, err := r.FindTimers(ctx, joined.Channel)
+		if err != nil {
+			log.Err(err).Str(`channel`, joined.Channel.Name).Msg(`error while loading timers`)
+			continue
+		}
+		lines := r.activity.Lines(joined.Channel.Name)
+		due := make([]*Timer, 0)
+		for _, timer := range timers {
+			if !timer.Enabled {
+				continue
+			}
+			seen[timer.ID] = true
+			state, ok := r.states[timer.ID]
+			if !ok {
+				// a new timer waits a whole interval before its first post
+				r.states[timer.ID] = &timerState{postedAt: now, lines: lines, lastLine: -1}
+				continue
+			}
+			if now.Sub(state.postedAt) >= timer.Interval && lines-state.lines >= uint64(timer.MinChatLines) {
+				due = append(due, timer)
+			}
+		}
+		if len(due) == 0 {
+			continue
+		}
+		live, err := r.IsLive(ctx, joined.User, joined.Channel)
+		if err != nil {
+			log.Err(err).Str(`channel`, joined.Channel.Name).Msg(`error while checking whether the channel is live`)
+			continue
+		}
+		for _, timer := range due {
+			state := r.states[timer.ID]
+			// offline time doesn't count, so timers start over when the stream does
+			if live {
+				r.post(ctx, joined, timer, state)
+			}
+			state.postedAt = now
+			state.lines = r.activity.Lines(joined.Channel.Name)
+		}
+	}
+	for id := range r.states {
+		if !seen[id] {
+			delete(r.states, id)
+		}
+	}
+}
+
+func (r *timerRunner) post(ctx context.Context, joined JoinedChannel, timer *Timer, state *timerState) {
+	var message string
+	if timer.Prompt != "" {
+		answer, err := r.GPT(ctx, timer.Prompt)
+		if err != nil {
+			log.Err(err).Str(`timer`, timer.Name).Msg("gpt query failed")
+			return
+		}
+		message = answer
+	} else if len(timer.Lines) > 0 {
+		state.lastLine = pickLine(len(timer.Lines), state.lastLine)
+		message = timer.Lines[state.lastLine]
+	} else {
+		return
+	}
+	if _, err := r.SendMessage(ctx, joined.User, joined.Channel, message); err != nil {
+		log.Err(err).Str(`channel`, joined.Channel.Name).Str(`timer`, timer.Name).Msg(`error while sending a timer message`)
+	}
+}
+
+// pickLine picks a random line, never the previous one when there is a choice.
+func pickLine(count, previous int) int {
+	if previous < 0 || count == 1 {
+		return rand.Intn(count)
+	}
+	line := rand.Intn(count - 1)
+	if line >= previous {
+		line++
+	}
+	return line
+}
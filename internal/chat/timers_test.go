@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type timerFixture struct {
+	activity *ChatActivity
+	runner   *timerRunner
+	channel  *Channel
+	live     bool
+	sent     []string
+}
+
+func newTimerFixture(timers ...*Timer) *timerFixture {
+	f := &timerFixture{activity: NewChatActivity(func(username string) bool { return username == `bot` })}
+	user := &User{ID: `1`, Username: `bot`}
+	channel := &Channel{ID: `10`, Name: `streamer`}
+	f.channel = channel
+	f.runner = newTimerRunner(f.activity, TimerHandlers{
+		ListChannels: func() []JoinedChannel { return []JoinedChannel{{User: user, Channel: channel}} },
+		FindTimers:   func(ctx context.Context, channel *Channel) ([]*Timer, error) { return timers, nil },
+		IsLive:       func(ctx context.Context, user *User, channel *Channel) (bool, error) { return f.live, nil },
+		SendMessage: func(ctx context.Context, user *User, channel *Channel, message string) (string, error) {
+			f.sent = append(f.sent, message)
+			return ``, nil
+		},
+		GPT: func(ctx context.Context, query string) (string, error) { return `generated: ` + query, nil },
+	})
+	return f
+}
+
+func (f *timerFixture) chat(username string, lines int) {
+	for i := 0; i < lines; i++ {
+		f.activity.count(&Message{Username: username, ChannelName: `streamer`, MessageType: PrivMsg})
+	}
+}
+
+func TestTimersPostOnlyWhileLiveAndChatIsActive(t *testing.T) {
+	f := newTimerFixture(&Timer{ID: `t`, Name: `socials`, Enabled: true, Interval: 15 * time.Minute, MinChatLines: 3, Prompt: `remind chat to follow`})
+	start := time.Now()
+	f.runner.run(context.Background(), start)
+	f.chat(`viewer`, 5)
+	f.runner.run(context.Background(), start.Add(15*time.Minute))
+	if len(f.sent) != 0 {
+		t.Fatalf("expected nothing to be posted while offline, got %v", f.sent)
+	}
+
+	f.live = true
+	f.chat(`viewer`, 3)
+	f.runner.run(context.Background(), start.Add(20*time.Minute))
+	if len(f.sent) != 0 {
+		t.Fatalf("expected the timer to start over once live, got %v", f.sent)
+	}
+	f.runner.run(context.Background(), start.Add(30*time.Minute))
+	if len(f.sent) != 1 || f.sent[0] != `generated: remind chat to follow` {
+		t.Fatalf("expected one generated post, got %v", f.sent)
+	}
+
+	// the bot's own lines don't keep the timer going
+	f.chat(`bot`, 5)
+	f.chat(`viewer`, 2)
+	f.runner.run(context.Background(), start.Add(45*time.Minute))
+	if len(f.sent) != 1 {
+		t.Fatalf("expected no post without enough chat lines, got %v", f.sent)
+	}
+	f.chat(`viewer`, 1)
+	f.runner.run(context.Background(), start.Add(46*time.Minute))
+	if len(f.sent) != 2 {
+		t.Fatalf("expected a post once chat caught up, got %v", f.sent)
+	}
+}
+
+func TestTimersSkipPausedChannels(t *testing.T) {
+	f := newTimerFixture(&Timer{ID: `t`, Name: `rules`, Enabled: true, Interval: time.Minute, Lines: []string{`a`}})
+	f.live = true
+	start := time.Now()
+	f.runner.run(context.Background(), start)
+	f.channel.Paused = true
+	f.runner.run(context.Background(), start.Add(time.Minute))
+	if len(f.sent) != 0 {
+		t.Fatalf("expected nothing to be posted while paused, got %v", f.sent)
+	}
+	// the timer starts over after resuming
+	f.channel.Paused = false
+	f.runner.run(context.Background(), start.Add(2*time.Minute))
+	f.runner.run(context.Background(), start.Add(3*time.Minute))
+	if len(f.sent) != 1 {
+		t.Fatalf("expected one post a whole interval after resuming, got %v", f.sent)
+	}
+}
+
+func TestTimersRotateStaticLines(t *testing.T) {
+	f := newTimerFixture(&Timer{ID: `t`, Name: `rules`, Enabled: true, Interval: time.Minute, Lines: []string{`a`, `b`, `c`}})
+	f.live = true
+	start := time.Now()
+	f.runner.run(context.Background(), start)
+	for i := 1; i <= 20; i++ {
+		f.runner.run(context.Background(), start.Add(time.Duration(i)*time.Minute))
+	}
+	if len(f.sent) != 20 {
+		t.Fatalf("expected a post every interval, got %d", len(f.sent))
+	}
+	for i := 1; i < len(f.sent); i++ {
+		if f.sent[i] == f.sent[i-1] {
+			t.Fatalf("expected consecutive posts to differ, got %v", f.sent)
+		}
+	}
+}
+
+func TestTimersSkipDisabledTimers(t *testing.T) {
+	f := newTimerFixture(&Timer{ID: `t`, Name: `off`, Enabled: false, Interval: time.Minute, Lines: []string{`a`}})
+	f.live = true
+	start := time.Now()
+	f.runner.run(context.Background(), start)
+	f.runner.run(context.Background(), start.Add(time.Hour))
+	if len(f.sent) != 0 {
+		t.Fatalf("expected a disabled timer not to post, got %v", f.sent)
+	}
+}
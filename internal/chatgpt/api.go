@@ -26,8 +26,9 @@ type message struct {
 }
 
 type completion struct {
-	Model    string     `json:"model"`
-	Messages []*message `json:"messages"`
+	Model     string     `json:"model"`
+	Messages  []*message `json:"messages"`
+	MaxTokens int        `json:"max_tokens,omitempty"`
 }
 
 type choice struct {
@@ -40,11 +41,19 @@ type completionObject struct {
 }
 
 func (a *API) Completions(ctx context.Context, q string) (answer string, err error) {
+	return a.CompletionsWith(ctx, q, "", 0)
+}
+
+// CompletionsWith overrides the configured model when model is set, and caps the answer when maxTokens is positive.
+func (a *API) CompletionsWith(ctx context.Context, q, model string, maxTokens int) (answer string, err error) {
 	messages := []*message{
 		{Role: "system", Content: a.systemMessage},
 		{Role: "user", Content: q},
 	}
-	completion := &completion{Model: a.model, Messages: messages}
+	if model == "" {
+		model = a.model
+	}
+	completion := &completion{Model: model, Messages: messages, MaxTokens: maxTokens}
 	bodyBytes, err := json.Marshal(completion)
 	if err != nil {
 		return "", err
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"os"
+	"time"
+)
+
+// ErrBackupUnsupported is returned by PostgresRepository.Backup; back Postgres up with its own tools, like pg_dump.
+var ErrBackupUnsupported = errors.New("db: online backups are only supported for sqlite")
+
+const (
+	// backupStepPages is how many pages each backup step copies. Between steps other connections can write.
+	backupStepPages = 256
+	backupStepPause = 10 * time.Millisecond
+)
+
+// Backup copies the database to path with SQLite's online backup API while the bot keeps using it. It writes a
+// temporary file next to path first and renames it, so path always holds a complete backup.
+func (repo *SqliteRepository) Backup(ctx context.Context, path string) error {
+	tmp := path + `.tmp`
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := repo.backup(ctx, tmp); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf(`db: backing up to %s: %w`, path, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func (repo *SqliteRepository) backup(ctx context.Context, path string) error {
+	dest, err := sql.Open(`sqlite3`, path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := repo.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return destConn.Raw(func(destDriverConn any) error {
+		return srcConn.Raw(func(srcDriverConn any) error {
+			destSqlite, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			srcSqlite, ok2 := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New(`not a sqlite3 connection`)
+			}
+			backup, err := destSqlite.Backup(`main`, srcSqlite, `main`)
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := backup.Step(backupStepPages)
+				if err != nil {
+					_ = backup.Finish()
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				select {
+				case <-ctx.Done():
+					_ = backup.Finish()
+					return ctx.Err()
+				case <-time.After(backupStepPause):
+				}
+			}
+		})
+	})
+}
+
+func (repo *PostgresRepository) Backup(ctx context.Context, path string) error {
+	return ErrBackupUnsupported
+}
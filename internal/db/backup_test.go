@@ -0,0 +1,60 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSqliteBackup(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	database, err := sql.Open("sqlite3", path.Join(dir, "sqlite.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	repo := NewRepository(database)
+	if err := repo.PrepareDatabase(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SaveUser(ctx, &chat.User{ID: `1`, Username: `bot`, AccessToken: `access`, RefreshToken: `refresh`, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	backupPath := path.Join(dir, "backup.db")
+	if err := repo.Backup(ctx, backupPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backupPath + `.tmp`); !os.IsNotExist(err) {
+		t.Fatalf("expected the temporary file to be renamed, got %v", err)
+	}
+	// a second backup replaces the first
+	if err := repo.SaveUser(ctx, &chat.User{ID: `2`, Username: `other`, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Backup(ctx, backupPath); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := sql.Open("sqlite3", backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	restoredRepo := NewRepository(restored)
+	if err := restoredRepo.CheckMigrations(ctx); err != nil {
+		t.Fatalf("expected the backup to have the schema, got %v", err)
+	}
+	users, err := restoredRepo.GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].AccessToken != `access` {
+		t.Fatalf("expected the users in the backup, got %+v", users)
+	}
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+)
+
+// sqliteError replaces *err with the chat error it stands for, wrapping the original. Repository methods defer it.
+func sqliteError(err *error) {
+	if *err == nil {
+		return
+	}
+	var sqliteErr sqlite3.Error
+	switch {
+	case errors.Is(*err, sql.ErrNoRows):
+		*err = fmt.Errorf(`%w: %w`, chat.ErrNotFound, *err)
+	case errors.Is(*err, driver.ErrBadConn):
+		*err = fmt.Errorf(`%w: %w`, chat.ErrUnavailable, *err)
+	case errors.As(*err, &sqliteErr):
+		switch {
+		case sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey:
+			*err = fmt.Errorf(`%w: %w`, chat.ErrConflict, *err)
+		case sqliteErr.Code == sqlite3.ErrConstraint:
+			*err = fmt.Errorf(`%w: %w`, chat.ErrInvalid, *err)
+		case sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked || sqliteErr.Code == sqlite3.ErrCantOpen:
+			*err = fmt.Errorf(`%w: %w`, chat.ErrUnavailable, *err)
+		}
+	}
+}
+
+// postgresError is sqliteError for Postgres, going by the SQLSTATE codes.
+func postgresError(err *error) {
+	if *err == nil {
+		return
+	}
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(*err, sql.ErrNoRows):
+		*err = fmt.Errorf(`%w: %w`, chat.ErrNotFound, *err)
+	case errors.Is(*err, driver.ErrBadConn):
+		*err = fmt.Errorf(`%w: %w`, chat.ErrUnavailable, *err)
+	case errors.As(*err, &pqErr):
+		switch {
+		case pqErr.Code.Name() == `unique_violation`:
+			*err = fmt.Errorf(`%w: %w`, chat.ErrConflict, *err)
+		case pqErr.Code.Class() == `23` || pqErr.Code.Class() == `22`:
+			// integrity constraints and data exceptions
+			*err = fmt.Errorf(`%w: %w`, chat.ErrInvalid, *err)
+		case pqErr.Code.Class() == `08` || pqErr.Code.Class() == `53` || pqErr.Code.Class() == `57`:
+			// connection exceptions, insufficient resources and operator intervention like a shutdown
+			*err = fmt.Errorf(`%w: %w`, chat.ErrUnavailable, *err)
+		}
+	}
+}
+
+// affected returns chat.ErrNotFound when an update or delete matched no row.
+func affected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return chat.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+var (
+	ErrPendingMigrations = errors.New(`db: the database has pending migrations`)
+	ErrUnknownMigrations = errors.New(`db: the database was migrated by a newer version`)
+)
+
+// Migration is one step of the schema. Most are numbered SQL files in migrations/<database>/, the rest are Go
+// functions for steps SQL can't express; either runs in a transaction together with its schema_migrations row.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+	apply   func(ctx context.Context, s *store, tx *sql.Tx) error
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type column struct {
+	name       string
+	definition string
+}
+
+// store is what the SQLite and Postgres repositories share: the schema migrations and the stored tokens. Its queries
+// are written in the SQL both databases understand.
+type store struct {
+	db     *sql.DB
+	tokens *TokenCipher
+	// dir is the directory under migrations/ with the database's SQL migrations
+	dir          string
+	goMigrations func() []*Migration
+	// lock, when set, keeps other processes from migrating at the same time
+	lock func(ctx context.Context) (unlock func(), err error)
+}
+
+// goMigrations are the SQLite migrations that aren't SQL files.
+var goMigrations = []*Migration{
+	{
+		// databases that ran before migrations existed already have some of these columns
+		Version: 2,
+		Name:    `add_missing_columns`,
+		apply: func(ctx context.Context, s *store, tx *sql.Tx) error {
+			if err := addMissingColumns(ctx, tx, `user`, []column{
+				{name: `needs_reauth`, definition: `INTEGER NOT NULL DEFAULT 0`},
+				{name: `scopes`, definition: `TEXT NOT NULL DEFAULT ''`},
+				{name: `validated_at`, definition: `TEXT NOT NULL DEFAULT ''`},
+			}); err != nil {
+				return err
+			}
+			return addMissingColumns(ctx, tx, `channel`, []column{
+				{name: `drop_reason`, definition: `TEXT NOT NULL DEFAULT ''`},
+				{name: `drop_message`, definition: `TEXT NOT NULL DEFAULT ''`},
+				{name: `dropped_at`, definition: `TEXT NOT NULL DEFAULT ''`},
+				{name: `reward_id`, definition: `TEXT NOT NULL DEFAULT ''`},
+				{name: `answer_when`, definition: `TEXT NOT NULL DEFAULT 'always'`},
+				{name: `stream_context`, definition: `INTEGER NOT NULL DEFAULT 0`},
+			})
+		},
+	},
+	{
+		// without keys, as in tests, tokens stay in plaintext until ReencryptTokens runs
+		Version: 4,
+		Name:    `encrypt_tokens`,
+		apply: func(ctx context.Context, s *store, tx *sql.Tx) error {
+			if s.tokens == nil {
+				return nil
+			}
+			_, err := reencryptTokens(ctx, tx, s.tokens)
+			return err
+		},
+	},
+}
+
+// Migrations returns every migration this build knows for the database, in order.
+func (s *store) Migrations() ([]*Migration, error) {
+	dir := path.Join(`migrations`, s.dir)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []*Migration
+	if s.goMigrations != nil {
+		migrations = append(migrations, s.goMigrations()...)
+	}
+	for _, entry := range entries {
+		version, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), `.sql`), `_`)
+		number, err := strconv.Atoi(version)
+		if !ok || err != nil {
+			return nil, fmt.Errorf(`db: migration %s isn't named <version>_<name>.sql`, entry.Name())
+		}
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, &Migration{Version: number, Name: name, SQL: string(content)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf(`db: expected migration %d, found %d_%s`, i+1, m.Version, m.Name)
+		}
+	}
+	return migrations, nil
+}
+
+func (s *store) ensureMigrationsTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `create table if not exists schema_migrations
+(
+    version    INTEGER NOT NULL,
+    name       TEXT    NOT NULL,
+    applied_at TEXT    NOT NULL,
+    PRIMARY KEY (version)
+)`)
+	return err
+}
+
+func (s *store) appliedMigrations(ctx context.Context) (applied map[int]MigrationStatus, err error) {
+	if err = s.ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `select version, name, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	applied = make(map[int]MigrationStatus)
+	for rows.Next() {
+		var version int
+		var name string
+		var appliedAtStr string
+		if err = rows.Scan(&version, &name, &appliedAtStr); err != nil {
+			return nil, err
+		}
+		appliedAt, err := time.Parse(time.RFC3339, appliedAtStr)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = MigrationStatus{Version: version, Name: name, Applied: true, AppliedAt: appliedAt}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// MigrationStatus lists every known migration and whether it was applied, followed by any applied migration this
+// build doesn't know.
+func (s *store) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := s.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status, ok := applied[m.Version]
+		if !ok {
+			status = MigrationStatus{Version: m.Version, Name: m.Name}
+		}
+		statuses = append(statuses, status)
+		delete(applied, m.Version)
+	}
+	unknown := make([]MigrationStatus, 0, len(applied))
+	for _, status := range applied {
+		unknown = append(unknown, status)
+	}
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i].Version < unknown[j].Version })
+	return append(statuses, unknown...), nil
+}
+
+// CheckMigrations returns ErrUnknownMigrations when a newer version migrated the database, and ErrPendingMigrations
+// when this one has migrations left to apply.
+func (s *store) CheckMigrations(ctx context.Context) error {
+	pending, err := s.pendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf(`%w: %d of them, starting with %d_%s`, ErrPendingMigrations, len(pending), pending[0].Version, pending[0].Name)
+	}
+	return nil
+}
+
+func (s *store) pendingMigrations(ctx context.Context) ([]*Migration, error) {
+	migrations, err := s.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for version := range applied {
+		if version > len(migrations) {
+			return nil, fmt.Errorf(`%w: it has migration %d, this build knows up to %d`, ErrUnknownMigrations, version, len(migrations))
+		}
+	}
+	pending := make([]*Migration, 0)
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order, each in its own transaction, and returns the ones it applied.
+func (s *store) Migrate(ctx context.Context) ([]*Migration, error) {
+	if s.lock != nil {
+		unlock, err := s.lock(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+	pending, err := s.pendingMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range pending {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return pending[:i], err
+		}
+		if err = s.applyMigration(ctx, tx, m); err != nil {
+			_ = tx.Rollback()
+			return pending[:i], err
+		}
+		if err = tx.Commit(); err != nil {
+			return pending[:i], err
+		}
+	}
+	return pending, nil
+}
+
+// DryRunMigrations applies the pending migrations in one transaction that is rolled back, so they are checked
+// against the actual database without changing it.
+func (s *store) DryRunMigrations(ctx context.Context) ([]*Migration, error) {
+	pending, err := s.pendingMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, m := range pending {
+		if err = s.applyMigration(ctx, tx, m); err != nil {
+			return pending, err
+		}
+	}
+	return pending, nil
+}
+
+// PrepareDatabase brings the database up to date.
+func (s *store) PrepareDatabase(ctx context.Context) error {
+	_, err := s.Migrate(ctx)
+	return err
+}
+
+func (s *store) applyMigration(ctx context.Context, tx *sql.Tx, m *Migration) error {
+	if m.SQL != "" {
+		if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+			return fmt.Errorf(`db: migration %d_%s: %w`, m.Version, m.Name, err)
+		}
+	}
+	if m.apply != nil {
+		if err := m.apply(ctx, s, tx); err != nil {
+			return fmt.Errorf(`db: migration %d_%s: %w`, m.Version, m.Name, err)
+		}
+	}
+	_, err := tx.ExecContext(ctx, `insert into schema_migrations (version, name, applied_at) values ($1, $2, $3)`, m.Version, m.Name, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func addMissingColumns(ctx context.Context, tx *sql.Tx, table string, columns []column) (err error) {
+	rows, err := tx.QueryContext(ctx, `select name from pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if existing[c.name] {
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, `alter table `+table+` add column `+c.name+` `+c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// openBaselineDatabase creates a database the way releases before migrations did, with a user and a channel in it.
+func openBaselineDatabase(t *testing.T) (*sql.DB, *SqliteRepository) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path.Join(t.TempDir(), "sqlite.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := os.ReadFile(`testdata/baseline.sql`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(string(baseline)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`insert into user (id, username, access_token, refresh_token, expires_at, created_at) values ('1', 'bot', 'access', 'refresh', ?, ?)`, time.Now().Format(time.RFC3339), time.Now().Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`insert into channel (id, username, createdAt, user_id) values ('2', 'streamer', ?, '1')`, time.Now().Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, NewRepository(db)
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	ctx := context.Background()
+	db, repo := openBaselineDatabase(t)
+	migrations, err := repo.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CheckMigrations(ctx); !errors.Is(err, ErrPendingMigrations) {
+		t.Fatalf("expected pending migrations, got %v", err)
+	}
+
+	pending, err := repo.DryRunMigrations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(migrations) {
+		t.Fatalf("expected every migration to be pending, got %d", len(pending))
+	}
+	var columns int
+	if err := db.QueryRow(`select count(*) from pragma_table_info('channel') where name = 'reward_id'`).Scan(&columns); err != nil {
+		t.Fatal(err)
+	}
+	if columns != 0 {
+		t.Fatal(`expected the dry run not to change the schema`)
+	}
+
+	applied, err := repo.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("expected %d migrations to be applied, got %d", len(migrations), len(applied))
+	}
+	channel, err := repo.GetChannel(ctx, `2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel == nil || channel.Name != `streamer` || channel.AnswerWhen != chat.AnswerAlways {
+		t.Fatalf("expected the channel to survive the migration, got %+v", channel)
+	}
+	user, err := repo.GetUser(ctx, `1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.AccessToken != `access` || user.NeedsReauth {
+		t.Fatalf("expected the user to survive the migration, got %+v", user)
+	}
+	timer := &chat.Timer{ID: uuid.New().String(), ChannelID: channel.ID, Name: `socials`, Interval: time.Minute, Lines: []string{`hi`}, CreatedAt: time.Now()}
+	if err := repo.SaveTimer(ctx, timer); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := repo.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied || status.AppliedAt.IsZero() {
+			t.Fatalf("expected every migration to be applied, got %+v", statuses)
+		}
+	}
+	if err := repo.CheckMigrations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if applied, err = repo.Migrate(ctx); err != nil || len(applied) != 0 {
+		t.Fatalf("expected nothing left to migrate, got %d, %v", len(applied), err)
+	}
+}
+
+func TestMigrateRefusesDatabaseOfNewerVersion(t *testing.T) {
+	ctx := context.Background()
+	db, repo := openBaselineDatabase(t)
+	if err := repo.PrepareDatabase(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`insert into schema_migrations (version, name, applied_at) values (999, 'from_the_future', ?)`, time.Now().Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CheckMigrations(ctx); !errors.Is(err, ErrUnknownMigrations) {
+		t.Fatalf("expected ErrUnknownMigrations, got %v", err)
+	}
+	if _, err := repo.Migrate(ctx); !errors.Is(err, ErrUnknownMigrations) {
+		t.Fatalf("expected Migrate to refuse, got %v", err)
+	}
+	statuses, err := repo.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := statuses[len(statuses)-1]; last.Version != 999 || !last.Applied {
+		t.Fatalf("expected the unknown migration to be listed, got %+v", last)
+	}
+}
+
+func TestMigrateRollsBackFailedMigrations(t *testing.T) {
+	ctx := context.Background()
+	_, repo := openBaselineDatabase(t)
+	defer func(migrations []*Migration) { goMigrations = migrations }(goMigrations)
+	goMigrations = append(goMigrations, &Migration{Version: 8, Name: `broken`, apply: func(ctx context.Context, s *store, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `create table half_done (id TEXT)`); err != nil {
+			return err
+		}
+		return errors.New(`broken`)
+	}})
+	applied, err := repo.Migrate(ctx)
+	if err == nil {
+		t.Fatal(`expected the broken migration to fail`)
+	}
+	if len(applied) != 7 {
+		t.Fatalf("expected the migrations before it to be applied, got %d", len(applied))
+	}
+	var tables int
+	if err := repo.db.QueryRow(`select count(*) from sqlite_master where name = 'half_done'`).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Fatal(`expected the failed migration to be rolled back`)
+	}
+	if err := repo.CheckMigrations(ctx); !errors.Is(err, ErrPendingMigrations) {
+		t.Fatalf("expected the failed migration to stay pending, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+create table if not exists "user"
+(
+    id            TEXT        NOT NULL,
+    username      TEXT        NOT NULL,
+    access_token  TEXT        NOT NULL,
+    refresh_token TEXT        NOT NULL,
+    expires_at    TIMESTAMPTZ NOT NULL,
+    needs_reauth  BOOLEAN     NOT NULL DEFAULT FALSE,
+    scopes        TEXT        NOT NULL DEFAULT '',
+    validated_at  TIMESTAMPTZ,
+    created_at    TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (id)
+);
+
+create unique index if not exists user_username_index on "user" (username);
+
+create table if not exists channel
+(
+    id             TEXT        NOT NULL,
+    username       TEXT        NOT NULL,
+    user_id        TEXT        NOT NULL,
+    drop_reason    TEXT        NOT NULL DEFAULT '',
+    drop_message   TEXT        NOT NULL DEFAULT '',
+    dropped_at     TIMESTAMPTZ,
+    reward_id      TEXT        NOT NULL DEFAULT '',
+    answer_when    TEXT        NOT NULL DEFAULT 'always',
+    stream_context BOOLEAN     NOT NULL DEFAULT FALSE,
+    created_at     TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (id)
+);
+
+create unique index if not exists channel_name_index on channel (username);
+create index if not exists channel_user_index on channel (user_id);
+
+create table if not exists event_rule
+(
+    id                   TEXT        NOT NULL,
+    channel_id           TEXT        NOT NULL,
+    event                TEXT        NOT NULL,
+    enabled              BOOLEAN     NOT NULL DEFAULT FALSE,
+    prompt               TEXT        NOT NULL,
+    cooldown_seconds     BIGINT      NOT NULL DEFAULT 0,
+    batch_window_seconds BIGINT      NOT NULL DEFAULT 0,
+    created_at           TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (id)
+);
+
+create unique index if not exists event_rule_channel_event_index on event_rule (channel_id, event);
+
+create table if not exists question_tier
+(
+    id         TEXT        NOT NULL,
+    channel_id TEXT        NOT NULL,
+    min_bits   INTEGER     NOT NULL,
+    model      TEXT        NOT NULL DEFAULT '',
+    max_tokens INTEGER     NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (id)
+);
+
+create unique index if not exists question_tier_channel_bits_index on question_tier (channel_id, min_bits);
+
+create table if not exists timer
+(
+    id               TEXT        NOT NULL,
+    channel_id       TEXT        NOT NULL,
+    name             TEXT        NOT NULL,
+    enabled          BOOLEAN     NOT NULL DEFAULT FALSE,
+    interval_seconds BIGINT      NOT NULL,
+    min_chat_lines   INTEGER     NOT NULL DEFAULT 0,
+    prompt           TEXT        NOT NULL DEFAULT '',
+    lines            TEXT        NOT NULL DEFAULT '',
+    created_at       TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (id)
+);
+
+create index if not exists timer_channel_index on timer (channel_id);
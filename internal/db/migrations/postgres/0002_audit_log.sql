@@ -0,0 +1,12 @@
+create table if not exists audit_log
+(
+    id         TEXT        NOT NULL,
+    action     TEXT        NOT NULL,
+    subject    TEXT        NOT NULL,
+    actor      TEXT        NOT NULL,
+    details    TEXT        NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (id)
+);
+
+create index if not exists audit_log_created_at_index on audit_log (created_at);
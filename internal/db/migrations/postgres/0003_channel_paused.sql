@@ -0,0 +1 @@
+alter table channel add column if not exists paused BOOLEAN NOT NULL DEFAULT FALSE;
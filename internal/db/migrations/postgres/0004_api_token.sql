@@ -0,0 +1,13 @@
+create table if not exists api_token
+(
+    id           TEXT        NOT NULL,
+    name         TEXT        NOT NULL,
+    hash         TEXT        NOT NULL,
+    scopes       TEXT        NOT NULL DEFAULT '',
+    expires_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (id)
+);
+
+create unique index if not exists api_token_hash_index on api_token (hash);
@@ -19,4 +19,4 @@ create table if not exists user
 );
 
 create unique index if not exists CHANNEL_NAME_INDEX on channel (username);
-create unique index if not exists USER_USERNAME_INDEX on user (username);
\ No newline at end of file
+create unique index if not exists USER_USERNAME_INDEX on user (username);
@@ -0,0 +1,42 @@
+create table if not exists event_rule
+(
+    id                   TEXT    NOT NULL,
+    channel_id           TEXT    NOT NULL,
+    event                TEXT    NOT NULL,
+    enabled              INTEGER NOT NULL DEFAULT 0,
+    prompt               TEXT    NOT NULL,
+    cooldown_seconds     INTEGER NOT NULL DEFAULT 0,
+    batch_window_seconds INTEGER NOT NULL DEFAULT 0,
+    created_at           TEXT    NOT NULL,
+    PRIMARY KEY (id),
+    foreign key (channel_id) references channel (id)
+);
+
+create unique index if not exists EVENT_RULE_CHANNEL_EVENT_INDEX on event_rule (channel_id, event);
+create table if not exists question_tier
+(
+    id         TEXT    NOT NULL,
+    channel_id TEXT    NOT NULL,
+    min_bits   INTEGER NOT NULL,
+    model      TEXT    NOT NULL DEFAULT '',
+    max_tokens INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT    NOT NULL,
+    PRIMARY KEY (id),
+    foreign key (channel_id) references channel (id)
+);
+
+create unique index if not exists QUESTION_TIER_CHANNEL_BITS_INDEX on question_tier (channel_id, min_bits);
+create table if not exists timer
+(
+    id               TEXT    NOT NULL,
+    channel_id       TEXT    NOT NULL,
+    name             TEXT    NOT NULL,
+    enabled          INTEGER NOT NULL DEFAULT 0,
+    interval_seconds INTEGER NOT NULL,
+    min_chat_lines   INTEGER NOT NULL DEFAULT 0,
+    prompt           TEXT    NOT NULL DEFAULT '',
+    lines            TEXT    NOT NULL DEFAULT '',
+    created_at       TEXT    NOT NULL,
+    PRIMARY KEY (id),
+    foreign key (channel_id) references channel (id)
+);
@@ -0,0 +1,12 @@
+create table if not exists audit_log
+(
+    id         TEXT NOT NULL,
+    action     TEXT NOT NULL,
+    subject    TEXT NOT NULL,
+    actor      TEXT NOT NULL,
+    details    TEXT NOT NULL DEFAULT '',
+    created_at TEXT NOT NULL,
+    PRIMARY KEY (id)
+);
+
+create index if not exists AUDIT_LOG_CREATED_AT_INDEX on audit_log (created_at);
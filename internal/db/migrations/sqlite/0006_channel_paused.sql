@@ -0,0 +1 @@
+alter table channel add column paused INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,13 @@
+create table if not exists api_token
+(
+    id           TEXT NOT NULL,
+    name         TEXT NOT NULL,
+    hash         TEXT NOT NULL,
+    scopes       TEXT NOT NULL DEFAULT '',
+    expires_at   TEXT NOT NULL DEFAULT '',
+    last_used_at TEXT NOT NULL DEFAULT '',
+    created_at   TEXT NOT NULL,
+    PRIMARY KEY (id)
+);
+
+create unique index if not exists API_TOKEN_HASH_INDEX on api_token (hash);
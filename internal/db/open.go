@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"time"
+)
+
+const (
+	DriverSqlite   = `sqlite`
+	DriverPostgres = `postgres`
+)
+
+// Database is a repository together with the schema and the stored tokens of the database behind it.
+type Database interface {
+	chat.Repository
+	Migrations() ([]*Migration, error)
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+	CheckMigrations(ctx context.Context) error
+	Migrate(ctx context.Context) ([]*Migration, error)
+	DryRunMigrations(ctx context.Context) ([]*Migration, error)
+	ReencryptTokens(ctx context.Context) (int, error)
+	// Backup writes a copy of the live database to path, or returns ErrBackupUnsupported.
+	Backup(ctx context.Context, path string) error
+}
+
+type Options struct {
+	// Driver is DriverSqlite or DriverPostgres
+	Driver string
+	// DSN is the SQLite file or the Postgres connection URL
+	DSN string
+	// the pool settings apply to Postgres; SQLite keeps the database/sql defaults
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	Tokens          *TokenCipher
+}
+
+// Open connects to the database the options select. The returned *sql.DB is for closing it.
+func Open(options Options) (*sql.DB, Database, error) {
+	switch options.Driver {
+	case DriverSqlite:
+		database, err := sql.Open("sqlite3", options.DSN)
+		if err != nil {
+			return nil, nil, err
+		}
+		return database, NewEncryptedRepository(database, options.Tokens), nil
+	case DriverPostgres:
+		database, err := sql.Open("postgres", options.DSN)
+		if err != nil {
+			return nil, nil, err
+		}
+		database.SetMaxOpenConns(options.MaxOpenConns)
+		database.SetMaxIdleConns(options.MaxIdleConns)
+		database.SetConnMaxLifetime(options.ConnMaxLifetime)
+		return database, NewPostgresRepository(database, options.Tokens), nil
+	default:
+		return nil, nil, fmt.Errorf(`db: unknown driver %q, expected %s or %s`, options.Driver, DriverSqlite, DriverPostgres)
+	}
+}
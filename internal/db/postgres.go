@@ -0,0 +1,524 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/lib/pq"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"strings"
+	"time"
+)
+
+// postgresMigrationLock is the advisory lock replicas take while migrating, so only one of them applies migrations.
+const postgresMigrationLock = 7_265_386_110
+
+// PostgresRepository keeps the same data as SqliteRepository in a Postgres database that several replicas can share.
+type PostgresRepository struct {
+	*store
+}
+
+func NewPostgresRepository(db *sql.DB, tokens *TokenCipher) *PostgresRepository {
+	repo := &PostgresRepository{
+		store: &store{
+			db:     db,
+			tokens: tokens,
+			dir:    `postgres`,
+		},
+	}
+	repo.lock = repo.lockMigrations
+	return repo
+}
+
+func (repo *PostgresRepository) lockMigrations(ctx context.Context) (func(), error) {
+	conn, err := repo.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.ExecContext(ctx, `select pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		_, _ = conn.ExecContext(context.WithoutCancel(ctx), `select pg_advisory_unlock($1)`, postgresMigrationLock)
+		conn.Close()
+	}, nil
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (repo *PostgresRepository) GetChannelsByUser(ctx context.Context, userId string) (channels []*chat.Channel, err error) {
+	defer postgresError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, username, drop_reason, drop_message, dropped_at, reward_id, answer_when, stream_context, paused, created_at from channel where user_id = $1`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	channels = make([]*chat.Channel, 0)
+	for rows.Next() {
+		channel := &chat.Channel{UserId: userId}
+		var droppedAt sql.NullTime
+		err = rows.Scan(&channel.ID, &channel.Name, &channel.DropReason, &channel.DropMessage, &droppedAt, &channel.RewardID, &channel.AnswerWhen, &channel.StreamContext, &channel.Paused, &channel.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		channel.DroppedAt = droppedAt.Time
+		channels = append(channels, channel)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+func (repo *PostgresRepository) SaveChannel(ctx context.Context, channel *chat.Channel) (err error) {
+	defer postgresError(&err)
+	_, err = repo.db.ExecContext(ctx, `insert into channel (id, username, user_id, drop_reason, drop_message, dropped_at, reward_id, answer_when, stream_context, paused, created_at) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		channel.ID, channel.Name, channel.UserId, channel.DropReason, channel.DropMessage, nullTime(channel.DroppedAt), channel.RewardID, answerWhen(channel), channel.StreamContext, channel.Paused, channel.CreatedAt)
+	return err
+}
+
+func (repo *PostgresRepository) DeleteChannel(ctx context.Context, id string) (err error) {
+	defer postgresError(&err)
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		`delete from event_rule where channel_id = $1`,
+		`delete from question_tier where channel_id = $1`,
+		`delete from timer where channel_id = $1`,
+	} {
+		if _, err = tx.ExecContext(ctx, query, id); err != nil {
+			return err
+		}
+	}
+	result, err := tx.ExecContext(ctx, `delete from channel where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if err = affected(result); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) UpdateChannel(ctx context.Context, channel *chat.Channel) (err error) {
+	defer postgresError(&err)
+	result, err := repo.db.ExecContext(ctx, `update channel set username=$1, drop_reason=$2, drop_message=$3, dropped_at=$4, reward_id=$5, answer_when=$6, stream_context=$7, paused=$8 where id = $9`,
+		channel.Name, channel.DropReason, channel.DropMessage, nullTime(channel.DroppedAt), channel.RewardID, answerWhen(channel), channel.StreamContext, channel.Paused, channel.ID)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *PostgresRepository) GetChannel(ctx context.Context, id string) (channel *chat.Channel, err error) {
+	defer postgresError(&err)
+	channel = &chat.Channel{ID: id}
+	var droppedAt sql.NullTime
+	err = repo.db.QueryRowContext(ctx, `select username, user_id, drop_reason, drop_message, dropped_at, reward_id, answer_when, stream_context, paused, created_at from channel where id = $1`, id).
+		Scan(&channel.Name, &channel.UserId, &channel.DropReason, &channel.DropMessage, &droppedAt, &channel.RewardID, &channel.AnswerWhen, &channel.StreamContext, &channel.Paused, &channel.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	channel.DroppedAt = droppedAt.Time
+	return channel, nil
+}
+
+func (repo *PostgresRepository) GetUsers(ctx context.Context) (users []*chat.User, err error) {
+	defer postgresError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, username, access_token, refresh_token, expires_at, needs_reauth, scopes, validated_at, created_at from "user"`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	users = make([]*chat.User, 0)
+	for rows.Next() {
+		user := &chat.User{}
+		var scopes string
+		var validatedAt sql.NullTime
+		err = rows.Scan(&user.ID, &user.Username, &user.AccessToken, &user.RefreshToken, &user.ExpiresAt, &user.NeedsReauth, &scopes, &validatedAt, &user.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if user.AccessToken, user.RefreshToken, err = repo.openTokens(user.AccessToken, user.RefreshToken); err != nil {
+			return nil, err
+		}
+		user.Scopes = splitScopes(scopes)
+		user.ValidatedAt = validatedAt.Time
+		users = append(users, user)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (repo *PostgresRepository) SaveUser(ctx context.Context, user *chat.User) (err error) {
+	defer postgresError(&err)
+	accessToken, refreshToken, err := repo.sealTokens(user)
+	if err != nil {
+		return err
+	}
+	_, err = repo.db.ExecContext(ctx, `insert into "user" (id, username, access_token, refresh_token, expires_at, needs_reauth, scopes, validated_at, created_at) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		user.ID, user.Username, accessToken, refreshToken, user.ExpiresAt, user.NeedsReauth, joinScopes(user.Scopes), nullTime(user.ValidatedAt), user.CreatedAt)
+	return err
+}
+
+func (repo *PostgresRepository) DeleteUser(ctx context.Context, id string) (err error) {
+	defer postgresError(&err)
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		`delete from event_rule where channel_id in (select id from channel where user_id = $1)`,
+		`delete from question_tier where channel_id in (select id from channel where user_id = $1)`,
+		`delete from timer where channel_id in (select id from channel where user_id = $1)`,
+		`delete from channel where user_id = $1`,
+	} {
+		if _, err = tx.ExecContext(ctx, query, id); err != nil {
+			return err
+		}
+	}
+	result, err := tx.ExecContext(ctx, `delete from "user" where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if err = affected(result); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) GetUser(ctx context.Context, id string) (user *chat.User, err error) {
+	defer postgresError(&err)
+	user = &chat.User{ID: id}
+	var scopes string
+	var validatedAt sql.NullTime
+	err = repo.db.QueryRowContext(ctx, `select username, access_token, refresh_token, expires_at, needs_reauth, scopes, validated_at, created_at from "user" where id = $1`, id).
+		Scan(&user.Username, &user.AccessToken, &user.RefreshToken, &user.ExpiresAt, &user.NeedsReauth, &scopes, &validatedAt, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if user.AccessToken, user.RefreshToken, err = repo.openTokens(user.AccessToken, user.RefreshToken); err != nil {
+		return nil, err
+	}
+	user.Scopes = splitScopes(scopes)
+	user.ValidatedAt = validatedAt.Time
+	return user, nil
+}
+
+func (repo *PostgresRepository) UpdateUser(ctx context.Context, user *chat.User) (err error) {
+	defer postgresError(&err)
+	accessToken, refreshToken, err := repo.sealTokens(user)
+	if err != nil {
+		return err
+	}
+	result, err := repo.db.ExecContext(ctx, `update "user" set username=$1, access_token=$2, refresh_token=$3, expires_at=$4, needs_reauth=$5, scopes=$6, validated_at=$7 where id = $8`,
+		user.Username, accessToken, refreshToken, user.ExpiresAt, user.NeedsReauth, joinScopes(user.Scopes), nullTime(user.ValidatedAt), user.ID)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *PostgresRepository) GetEventRulesByChannel(ctx context.Context, channelId string) (rules []*chat.EventRule, err error) {
+	defer postgresError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, event, enabled, prompt, cooldown_seconds, batch_window_seconds, created_at from event_rule where channel_id = $1`, channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	rules = make([]*chat.EventRule, 0)
+	for rows.Next() {
+		rule := &chat.EventRule{ChannelID: channelId}
+		var cooldownSeconds int64
+		var batchWindowSeconds int64
+		err = rows.Scan(&rule.ID, &rule.Event, &rule.Enabled, &rule.Prompt, &cooldownSeconds, &batchWindowSeconds, &rule.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		rule.Cooldown = time.Duration(cooldownSeconds) * time.Second
+		rule.BatchWindow = time.Duration(batchWindowSeconds) * time.Second
+		rules = append(rules, rule)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (repo *PostgresRepository) SaveEventRule(ctx context.Context, rule *chat.EventRule) (err error) {
+	defer postgresError(&err)
+	_, err = repo.db.ExecContext(ctx, `insert into event_rule (id, channel_id, event, enabled, prompt, cooldown_seconds, batch_window_seconds, created_at) values ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		rule.ID, rule.ChannelID, rule.Event, rule.Enabled, rule.Prompt, int64(rule.Cooldown/time.Second), int64(rule.BatchWindow/time.Second), rule.CreatedAt)
+	return err
+}
+
+func (repo *PostgresRepository) UpdateEventRule(ctx context.Context, rule *chat.EventRule) (err error) {
+	defer postgresError(&err)
+	result, err := repo.db.ExecContext(ctx, `update event_rule set enabled=$1, prompt=$2, cooldown_seconds=$3, batch_window_seconds=$4 where id = $5`,
+		rule.Enabled, rule.Prompt, int64(rule.Cooldown/time.Second), int64(rule.BatchWindow/time.Second), rule.ID)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *PostgresRepository) GetQuestionTiersByChannel(ctx context.Context, channelId string) (tiers []*chat.QuestionTier, err error) {
+	defer postgresError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, min_bits, model, max_tokens, created_at from question_tier where channel_id = $1 order by min_bits`, channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	tiers = make([]*chat.QuestionTier, 0)
+	for rows.Next() {
+		tier := &chat.QuestionTier{ChannelID: channelId}
+		err = rows.Scan(&tier.ID, &tier.MinBits, &tier.Model, &tier.MaxTokens, &tier.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, tier)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return tiers, nil
+}
+
+func (repo *PostgresRepository) SaveQuestionTier(ctx context.Context, tier *chat.QuestionTier) (err error) {
+	defer postgresError(&err)
+	_, err = repo.db.ExecContext(ctx, `insert into question_tier (id, channel_id, min_bits, model, max_tokens, created_at) values ($1, $2, $3, $4, $5, $6)`,
+		tier.ID, tier.ChannelID, tier.MinBits, tier.Model, tier.MaxTokens, tier.CreatedAt)
+	return err
+}
+
+func (repo *PostgresRepository) DeleteQuestionTier(ctx context.Context, id string) (err error) {
+	defer postgresError(&err)
+	result, err := repo.db.ExecContext(ctx, `delete from question_tier where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *PostgresRepository) GetTimersByChannel(ctx context.Context, channelId string) (timers []*chat.Timer, err error) {
+	defer postgresError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, name, enabled, interval_seconds, min_chat_lines, prompt, lines, created_at from timer where channel_id = $1 order by created_at`, channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	timers = make([]*chat.Timer, 0)
+	for rows.Next() {
+		timer := &chat.Timer{ChannelID: channelId}
+		var intervalSeconds int64
+		var lines string
+		err = rows.Scan(&timer.ID, &timer.Name, &timer.Enabled, &intervalSeconds, &timer.MinChatLines, &timer.Prompt, &lines, &timer.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		timer.Interval = time.Duration(intervalSeconds) * time.Second
+		timer.Lines = splitLines(lines)
+		timers = append(timers, timer)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return timers, nil
+}
+
+func (repo *PostgresRepository) SaveTimer(ctx context.Context, timer *chat.Timer) (err error) {
+	defer postgresError(&err)
+	_, err = repo.db.ExecContext(ctx, `insert into timer (id, channel_id, name, enabled, interval_seconds, min_chat_lines, prompt, lines, created_at) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		timer.ID, timer.ChannelID, timer.Name, timer.Enabled, int64(timer.Interval/time.Second), timer.MinChatLines, timer.Prompt, strings.Join(timer.Lines, "\n"), timer.CreatedAt)
+	return err
+}
+
+func (repo *PostgresRepository) UpdateTimer(ctx context.Context, timer *chat.Timer) (err error) {
+	defer postgresError(&err)
+	result, err := repo.db.ExecContext(ctx, `update timer set name=$1, enabled=$2, interval_seconds=$3, min_chat_lines=$4, prompt=$5, lines=$6 where id = $7`,
+		timer.Name, timer.Enabled, int64(timer.Interval/time.Second), timer.MinChatLines, timer.Prompt, strings.Join(timer.Lines, "\n"), timer.ID)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *PostgresRepository) DeleteTimer(ctx context.Context, id string) (err error) {
+	defer postgresError(&err)
+	result, err := repo.db.ExecContext(ctx, `delete from timer where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *PostgresRepository) SaveAuditEntry(ctx context.Context, entry *chat.AuditEntry) (err error) {
+	defer postgresError(&err)
+	_, err = repo.db.ExecContext(ctx, `insert into audit_log (id, action, subject, actor, details, created_at) values ($1, $2, $3, $4, $5, $6)`,
+		entry.ID, entry.Action, entry.Subject, entry.Actor, entry.Details, entry.CreatedAt)
+	return err
+}
+
+func (repo *PostgresRepository) ForgetUsername(ctx context.Context, username string, entry *chat.AuditEntry) (err error) {
+	defer postgresError(&err)
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	channels := `select id from channel where lower(username) = lower($1) or user_id in (select id from "user" where lower(username) = lower($1))`
+	for _, query := range []string{
+		`delete from event_rule where channel_id in (` + channels + `)`,
+		`delete from question_tier where channel_id in (` + channels + `)`,
+		`delete from timer where channel_id in (` + channels + `)`,
+		`delete from channel where id in (` + channels + `)`,
+		`delete from "user" where lower(username) = lower($1)`,
+	} {
+		if _, err = tx.ExecContext(ctx, query, username); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `insert into audit_log (id, action, subject, actor, details, created_at) values ($1, $2, $3, $4, $5, $6)`,
+		entry.ID, entry.Action, entry.Subject, entry.Actor, entry.Details, entry.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) GetAuditEntries(ctx context.Context, limit int) (entries []*chat.AuditEntry, err error) {
+	defer postgresError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, action, subject, actor, details, created_at from audit_log order by created_at desc limit $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	entries = make([]*chat.AuditEntry, 0)
+	for rows.Next() {
+		entry := &chat.AuditEntry{}
+		err = rows.Scan(&entry.ID, &entry.Action, &entry.Subject, &entry.Actor, &entry.Details, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (repo *PostgresRepository) GetAPITokens(ctx context.Context) (tokens []*chat.APIToken, err error) {
+	defer postgresError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, name, hash, scopes, expires_at, last_used_at, created_at from api_token order by created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	tokens = make([]*chat.APIToken, 0)
+	for rows.Next() {
+		token, err := scanPostgresAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (repo *PostgresRepository) GetAPITokenByHash(ctx context.Context, hash string) (token *chat.APIToken, err error) {
+	defer postgresError(&err)
+	return scanPostgresAPIToken(repo.db.QueryRowContext(ctx, `select id, name, hash, scopes, expires_at, last_used_at, created_at from api_token where hash = $1`, hash))
+}
+
+func scanPostgresAPIToken(row interface{ Scan(dest ...any) error }) (*chat.APIToken, error) {
+	token := &chat.APIToken{}
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.Name, &token.Hash, &scopes, &expiresAt, &lastUsedAt, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = splitScopes(scopes)
+	token.ExpiresAt = expiresAt.Time
+	token.LastUsedAt = lastUsedAt.Time
+	return token, nil
+}
+
+func (repo *PostgresRepository) SaveAPIToken(ctx context.Context, token *chat.APIToken) (err error) {
+	defer postgresError(&err)
+	_, err = repo.db.ExecContext(ctx, `insert into api_token (id, name, hash, scopes, expires_at, last_used_at, created_at) values ($1, $2, $3, $4, $5, $6, $7)`,
+		token.ID, token.Name, token.Hash, joinScopes(token.Scopes), nullTime(token.ExpiresAt), nullTime(token.LastUsedAt), token.CreatedAt)
+	return err
+}
+
+func (repo *PostgresRepository) SetAPITokenLastUsed(ctx context.Context, id string, lastUsedAt time.Time) (err error) {
+	defer postgresError(&err)
+	result, err := repo.db.ExecContext(ctx, `update api_token set last_used_at = $1 where id = $2`, nullTime(lastUsedAt), id)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *PostgresRepository) DeleteAPIToken(ctx context.Context, id string) (err error) {
+	defer postgresError(&err)
+	result, err := repo.db.ExecContext(ctx, `delete from api_token where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
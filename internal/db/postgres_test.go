@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat/repotest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openPostgres connects to the instance at POSTGRES_TEST_URL, in a schema of its own that is dropped after the
+// test, and skips the test when there's no instance.
+func openPostgres(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv(`POSTGRES_TEST_URL`)
+	if dsn == "" {
+		t.Skip(`POSTGRES_TEST_URL is not set`)
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := `test_` + strings.ReplaceAll(uuid.New().String(), `-`, ``)
+	if _, err = admin.Exec(`create schema ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(`drop schema ` + schema + ` cascade`) })
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set(`search_path`, schema)
+	u.RawQuery = query.Encode()
+	database, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+func newPostgresRepository(t *testing.T) *PostgresRepository {
+	tokens, err := ParseTokenKeys(`test:a secret that is long enough`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewPostgresRepository(openPostgres(t), tokens)
+	if err := repo.PrepareDatabase(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestPostgresRepositoryConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) chat.Repository {
+		return newPostgresRepository(t)
+	})
+}
+
+func TestPostgresRepositoryEncryptsTokens(t *testing.T) {
+	ctx := context.Background()
+	repo := newPostgresRepository(t)
+	if err := repo.SaveUser(ctx, &chat.User{ID: `1`, Username: `bot`, AccessToken: `access`, RefreshToken: `refresh`, ExpiresAt: time.Now(), CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	var accessToken string
+	if err := repo.db.QueryRow(`select access_token from "user" where id = '1'`).Scan(&accessToken); err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(accessToken) {
+		t.Fatalf("expected the token to be encrypted, got %q", accessToken)
+	}
+	if updated, err := repo.ReencryptTokens(ctx); err != nil || updated != 0 {
+		t.Fatalf("expected nothing to reencrypt, got %d, %v", updated, err)
+	}
+}
+
+func TestPostgresMigrateConcurrently(t *testing.T) {
+	database := openPostgres(t)
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := NewPostgresRepository(database, nil).Migrate(context.Background())
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(fmt.Errorf(`expected replicas to migrate one after the other: %w`, err))
+		}
+	}
+}
@@ -3,36 +3,72 @@ package db
 import (
 	"context"
 	"database/sql"
-	_ "embed"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/pkg/errors"
 	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"strings"
 	"time"
 )
 
-//go:embed init.sql
-var initSql string
-
 type SqliteRepository struct {
-	db *sql.DB
+	*store
 }
 
+// NewRepository stores OAuth tokens in plaintext; use NewEncryptedRepository outside of tests.
 func NewRepository(db *sql.DB) *SqliteRepository {
+	return NewEncryptedRepository(db, nil)
+}
+
+func NewEncryptedRepository(db *sql.DB, tokens *TokenCipher) *SqliteRepository {
 	return &SqliteRepository{
-		db: db,
+		store: &store{
+			db:           db,
+			tokens:       tokens,
+			dir:          `sqlite`,
+			goMigrations: func() []*Migration { return goMigrations },
+		},
 	}
 }
 
-func (repo *SqliteRepository) PrepareDatabase(ctx context.Context) error {
-	_, err := repo.db.ExecContext(ctx, initSql)
-	if err != nil {
-		return err
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
 	}
-	return nil
+	return t.Format(time.RFC3339)
+}
+
+func parseOptionalTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func splitScopes(s string) []string {
+	return strings.Fields(s)
+}
+
+func joinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+func answerWhen(channel *chat.Channel) string {
+	if channel.AnswerWhen == "" {
+		return chat.AnswerAlways
+	}
+	return channel.AnswerWhen
+}
+
+// splitLines reads the static lines of a timer, which are stored one per line.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
 }
 
 func (repo *SqliteRepository) GetChannelsByUser(ctx context.Context, userId string) (channels []*chat.Channel, err error) {
-	rows, err := repo.db.QueryContext(ctx, `select id, username, createdAt from channel where user_id = ?`, userId)
+	defer sqliteError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, username, drop_reason, drop_message, dropped_at, reward_id, answer_when, stream_context, paused, createdAt from channel where user_id = ?`, userId)
 	if err != nil {
 		return nil, err
 	}
@@ -46,8 +82,15 @@ func (repo *SqliteRepository) GetChannelsByUser(ctx context.Context, userId stri
 	for rows.Next() {
 		var id string
 		var name string
+		var dropReason string
+		var dropMessage string
+		var droppedAtStr string
+		var rewardId string
+		var answerWhen string
+		var streamContext bool
+		var paused bool
 		var createdAtStr string
-		err = rows.Scan(&id, &name, &createdAtStr)
+		err = rows.Scan(&id, &name, &dropReason, &dropMessage, &droppedAtStr, &rewardId, &answerWhen, &streamContext, &paused, &createdAtStr)
 		if err != nil {
 			return nil, err
 		}
@@ -55,7 +98,11 @@ func (repo *SqliteRepository) GetChannelsByUser(ctx context.Context, userId stri
 		if err != nil {
 			return nil, err
 		}
-		channels = append(channels, &chat.Channel{ID: id, Name: name, UserId: userId, CreatedAt: createdAt})
+		droppedAt, err := parseOptionalTime(droppedAtStr)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, &chat.Channel{ID: id, Name: name, UserId: userId, DropReason: dropReason, DropMessage: dropMessage, DroppedAt: droppedAt, RewardID: rewardId, AnswerWhen: answerWhen, StreamContext: streamContext, Paused: paused, CreatedAt: createdAt})
 	}
 	err = rows.Err()
 	if err != nil {
@@ -64,8 +111,9 @@ func (repo *SqliteRepository) GetChannelsByUser(ctx context.Context, userId stri
 	return channels, nil
 }
 
-func (repo *SqliteRepository) SaveChannel(ctx context.Context, channel *chat.Channel) error {
-	stmt, err := repo.db.PrepareContext(ctx, `insert into channel (id, username, user_id, createdAt) values (?, ?, ?, ?)`)
+func (repo *SqliteRepository) SaveChannel(ctx context.Context, channel *chat.Channel) (err error) {
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `insert into channel (id, username, user_id, drop_reason, drop_message, dropped_at, reward_id, answer_when, stream_context, paused, createdAt) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return err
 	}
@@ -75,15 +123,48 @@ func (repo *SqliteRepository) SaveChannel(ctx context.Context, channel *chat.Cha
 			err = _err
 		}
 	}(stmt)
-	_, err = stmt.Exec(channel.ID, channel.Name, channel.UserId, channel.CreatedAt.Format(time.RFC3339))
+	_, err = stmt.Exec(channel.ID, channel.Name, channel.UserId, channel.DropReason, channel.DropMessage, formatOptionalTime(channel.DroppedAt), channel.RewardID, answerWhen(channel), channel.StreamContext, channel.Paused, channel.CreatedAt.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (repo *SqliteRepository) DeleteChannel(ctx context.Context, id string) (err error) {
+	defer sqliteError(&err)
+	tx, err := repo.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `delete from event_rule where channel_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `delete from question_tier where channel_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `delete from timer where channel_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `delete from channel where id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if err = affected(result); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (repo *SqliteRepository) DeleteChannel(ctx context.Context, id string) error {
-	stmt, err := repo.db.PrepareContext(ctx, `delete from channel where id = ?`)
+func (repo *SqliteRepository) UpdateChannel(ctx context.Context, channel *chat.Channel) (err error) {
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `update channel set username=?, drop_reason=?, drop_message=?, dropped_at=?, reward_id=?, answer_when=?, stream_context=?, paused=? where id = ?`)
 	if err != nil {
 		return err
 	}
@@ -93,15 +174,16 @@ func (repo *SqliteRepository) DeleteChannel(ctx context.Context, id string) erro
 			err = _err
 		}
 	}(stmt)
-	_, err = stmt.Exec(id)
+	result, err := stmt.Exec(channel.Name, channel.DropReason, channel.DropMessage, formatOptionalTime(channel.DroppedAt), channel.RewardID, answerWhen(channel), channel.StreamContext, channel.Paused, channel.ID)
 	if err != nil {
 		return err
 	}
-	return nil
+	return affected(result)
 }
 
 func (repo *SqliteRepository) GetChannel(ctx context.Context, id string) (channel *chat.Channel, err error) {
-	stmt, err := repo.db.PrepareContext(ctx, `select username, user_id, createdAt from channel where id = ?`)
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `select username, user_id, drop_reason, drop_message, dropped_at, reward_id, answer_when, stream_context, paused, createdAt from channel where id = ?`)
 	if err != nil {
 		return nil, err
 	}
@@ -117,24 +199,33 @@ func (repo *SqliteRepository) GetChannel(ctx context.Context, id string) (channe
 	}
 	var name string
 	var userId string
+	var dropReason string
+	var dropMessage string
+	var droppedAtStr string
+	var rewardId string
+	var answerWhen string
+	var streamContext bool
+	var paused bool
 	var createdAtStr string
-	err = row.Scan(&name, &userId, &createdAtStr)
+	err = row.Scan(&name, &userId, &dropReason, &dropMessage, &droppedAtStr, &rewardId, &answerWhen, &streamContext, &paused, &createdAtStr)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
 		return nil, err
 	}
 	createdAt, err := time.Parse(time.RFC3339, createdAtStr)
 	if err != nil {
 		return nil, err
 	}
-	channel = &chat.Channel{ID: id, Name: name, UserId: userId, CreatedAt: createdAt}
+	droppedAt, err := parseOptionalTime(droppedAtStr)
+	if err != nil {
+		return nil, err
+	}
+	channel = &chat.Channel{ID: id, Name: name, UserId: userId, DropReason: dropReason, DropMessage: dropMessage, DroppedAt: droppedAt, RewardID: rewardId, AnswerWhen: answerWhen, StreamContext: streamContext, Paused: paused, CreatedAt: createdAt}
 	return channel, nil
 }
 
 func (repo *SqliteRepository) GetUsers(ctx context.Context) (users []*chat.User, err error) {
-	rows, err := repo.db.QueryContext(ctx, `select id, username, access_token, refresh_token, expires_at, created_at from user`)
+	defer sqliteError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, username, access_token, refresh_token, expires_at, needs_reauth, scopes, validated_at, created_at from user`)
 	if err != nil {
 		return nil, err
 	}
@@ -151,8 +242,11 @@ func (repo *SqliteRepository) GetUsers(ctx context.Context) (users []*chat.User,
 		var accessToken string
 		var refreshToken string
 		var expiresAtStr string
+		var needsReauth bool
+		var scopes string
+		var validatedAtStr string
 		var createdAtStr string
-		err = rows.Scan(&id, &username, &accessToken, &refreshToken, &expiresAtStr, &createdAtStr)
+		err = rows.Scan(&id, &username, &accessToken, &refreshToken, &expiresAtStr, &needsReauth, &scopes, &validatedAtStr, &createdAtStr)
 		if err != nil {
 			return nil, err
 		}
@@ -164,13 +258,25 @@ func (repo *SqliteRepository) GetUsers(ctx context.Context) (users []*chat.User,
 		if err != nil {
 			return nil, err
 		}
-		users = append(users, &chat.User{ID: id, Username: username, AccessToken: accessToken, RefreshToken: refreshToken, ExpiresAt: expiresAt, CreatedAt: createdAt})
+		validatedAt, err := parseOptionalTime(validatedAtStr)
+		if err != nil {
+			return nil, err
+		}
+		if accessToken, refreshToken, err = repo.openTokens(accessToken, refreshToken); err != nil {
+			return nil, err
+		}
+		users = append(users, &chat.User{ID: id, Username: username, AccessToken: accessToken, RefreshToken: refreshToken, ExpiresAt: expiresAt, NeedsReauth: needsReauth, Scopes: splitScopes(scopes), ValidatedAt: validatedAt, CreatedAt: createdAt})
 	}
 	return
 }
 
-func (repo *SqliteRepository) SaveUser(ctx context.Context, user *chat.User) error {
-	stmt, err := repo.db.PrepareContext(ctx, `insert into user (id, username, access_token, refresh_token, expires_at, created_at) values (?, ?, ?, ?, ?, ?)`)
+func (repo *SqliteRepository) SaveUser(ctx context.Context, user *chat.User) (err error) {
+	defer sqliteError(&err)
+	accessToken, refreshToken, err := repo.sealTokens(user)
+	if err != nil {
+		return err
+	}
+	stmt, err := repo.db.PrepareContext(ctx, `insert into user (id, username, access_token, refresh_token, expires_at, needs_reauth, scopes, validated_at, created_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return err
 	}
@@ -180,27 +286,43 @@ func (repo *SqliteRepository) SaveUser(ctx context.Context, user *chat.User) err
 			err = _err
 		}
 	}(stmt)
-	_, err = stmt.Exec(user.ID, user.Username, user.AccessToken, user.RefreshToken, user.ExpiresAt.Format(time.RFC3339), user.CreatedAt.Format(time.RFC3339))
+	_, err = stmt.Exec(user.ID, user.Username, accessToken, refreshToken, user.ExpiresAt.Format(time.RFC3339), user.NeedsReauth, joinScopes(user.Scopes), formatOptionalTime(user.ValidatedAt), user.CreatedAt.Format(time.RFC3339))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (repo *SqliteRepository) DeleteUser(ctx context.Context, id string) error {
+func (repo *SqliteRepository) DeleteUser(ctx context.Context, id string) (err error) {
+	defer sqliteError(&err)
 	tx, err := repo.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `delete from event_rule where channel_id in (select id from channel where user_id = ?)`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `delete from question_tier where channel_id in (select id from channel where user_id = ?)`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `delete from timer where channel_id in (select id from channel where user_id = ?)`, id)
+	if err != nil {
+		return err
+	}
 	_, err = tx.ExecContext(ctx, `delete from channel where user_id = ?`, id)
 	if err != nil {
 		return err
 	}
-	_, err = tx.ExecContext(ctx, `delete from user where id = ?`, id)
+	result, err := tx.ExecContext(ctx, `delete from user where id = ?`, id)
 	if err != nil {
 		return err
 	}
+	if err = affected(result); err != nil {
+		return err
+	}
 	if err = tx.Commit(); err != nil {
 		return err
 	}
@@ -208,7 +330,8 @@ func (repo *SqliteRepository) DeleteUser(ctx context.Context, id string) error {
 }
 
 func (repo *SqliteRepository) GetUser(ctx context.Context, id string) (user *chat.User, err error) {
-	stmt, err := repo.db.PrepareContext(ctx, `select username, access_token, refresh_token, expires_at, created_at from user where id = ?`)
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `select username, access_token, refresh_token, expires_at, needs_reauth, scopes, validated_at, created_at from user where id = ?`)
 	if err != nil {
 		return nil, err
 	}
@@ -226,8 +349,11 @@ func (repo *SqliteRepository) GetUser(ctx context.Context, id string) (user *cha
 	var accessToken string
 	var refreshToken string
 	var expiresAtStr string
+	var needsReauth bool
+	var scopes string
+	var validatedAtStr string
 	var createdAtStr string
-	err = row.Scan(&username, &accessToken, &refreshToken, &expiresAtStr, &createdAtStr)
+	err = row.Scan(&username, &accessToken, &refreshToken, &expiresAtStr, &needsReauth, &scopes, &validatedAtStr, &createdAtStr)
 	if err != nil {
 		return nil, err
 	}
@@ -239,12 +365,251 @@ func (repo *SqliteRepository) GetUser(ctx context.Context, id string) (user *cha
 	if err != nil {
 		return nil, err
 	}
-	user = &chat.User{ID: id, Username: username, AccessToken: accessToken, RefreshToken: refreshToken, ExpiresAt: expiresAt, CreatedAt: createdAt}
+	validatedAt, err := parseOptionalTime(validatedAtStr)
+	if err != nil {
+		return nil, err
+	}
+	if accessToken, refreshToken, err = repo.openTokens(accessToken, refreshToken); err != nil {
+		return nil, err
+	}
+	user = &chat.User{ID: id, Username: username, AccessToken: accessToken, RefreshToken: refreshToken, ExpiresAt: expiresAt, NeedsReauth: needsReauth, Scopes: splitScopes(scopes), ValidatedAt: validatedAt, CreatedAt: createdAt}
 	return user, nil
 }
 
-func (repo *SqliteRepository) UpdateUser(ctx context.Context, user *chat.User) error {
-	stmt, err := repo.db.PrepareContext(ctx, `update user set username=?, access_token=?, refresh_token=?, expires_at=? where id = ?`)
+func (repo *SqliteRepository) UpdateUser(ctx context.Context, user *chat.User) (err error) {
+	defer sqliteError(&err)
+	accessToken, refreshToken, err := repo.sealTokens(user)
+	if err != nil {
+		return err
+	}
+	stmt, err := repo.db.PrepareContext(ctx, `update user set username=?, access_token=?, refresh_token=?, expires_at=?, needs_reauth=?, scopes=?, validated_at=? where id = ?`)
+	if err != nil {
+		return err
+	}
+	defer func(stmt *sql.Stmt) {
+		_err := stmt.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(stmt)
+	result, err := stmt.Exec(user.Username, accessToken, refreshToken, user.ExpiresAt.Format(time.RFC3339), user.NeedsReauth, joinScopes(user.Scopes), formatOptionalTime(user.ValidatedAt), user.ID)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *SqliteRepository) GetEventRulesByChannel(ctx context.Context, channelId string) (rules []*chat.EventRule, err error) {
+	defer sqliteError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, event, enabled, prompt, cooldown_seconds, batch_window_seconds, created_at from event_rule where channel_id = ?`, channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	rules = make([]*chat.EventRule, 0)
+	for rows.Next() {
+		var id string
+		var event string
+		var enabled bool
+		var prompt string
+		var cooldownSeconds int64
+		var batchWindowSeconds int64
+		var createdAtStr string
+		err = rows.Scan(&id, &event, &enabled, &prompt, &cooldownSeconds, &batchWindowSeconds, &createdAtStr)
+		if err != nil {
+			return nil, err
+		}
+		createdAt, err := time.Parse(time.RFC3339, createdAtStr)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &chat.EventRule{
+			ID:          id,
+			ChannelID:   channelId,
+			Event:       event,
+			Enabled:     enabled,
+			Prompt:      prompt,
+			Cooldown:    time.Duration(cooldownSeconds) * time.Second,
+			BatchWindow: time.Duration(batchWindowSeconds) * time.Second,
+			CreatedAt:   createdAt,
+		})
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (repo *SqliteRepository) SaveEventRule(ctx context.Context, rule *chat.EventRule) (err error) {
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `insert into event_rule (id, channel_id, event, enabled, prompt, cooldown_seconds, batch_window_seconds, created_at) values (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer func(stmt *sql.Stmt) {
+		_err := stmt.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(stmt)
+	_, err = stmt.Exec(rule.ID, rule.ChannelID, rule.Event, rule.Enabled, rule.Prompt, int64(rule.Cooldown/time.Second), int64(rule.BatchWindow/time.Second), rule.CreatedAt.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (repo *SqliteRepository) UpdateEventRule(ctx context.Context, rule *chat.EventRule) (err error) {
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `update event_rule set enabled=?, prompt=?, cooldown_seconds=?, batch_window_seconds=? where id = ?`)
+	if err != nil {
+		return err
+	}
+	defer func(stmt *sql.Stmt) {
+		_err := stmt.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(stmt)
+	result, err := stmt.Exec(rule.Enabled, rule.Prompt, int64(rule.Cooldown/time.Second), int64(rule.BatchWindow/time.Second), rule.ID)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *SqliteRepository) GetQuestionTiersByChannel(ctx context.Context, channelId string) (tiers []*chat.QuestionTier, err error) {
+	defer sqliteError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, min_bits, model, max_tokens, created_at from question_tier where channel_id = ? order by min_bits`, channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	tiers = make([]*chat.QuestionTier, 0)
+	for rows.Next() {
+		var id string
+		var minBits int
+		var model string
+		var maxTokens int
+		var createdAtStr string
+		err = rows.Scan(&id, &minBits, &model, &maxTokens, &createdAtStr)
+		if err != nil {
+			return nil, err
+		}
+		createdAt, err := time.Parse(time.RFC3339, createdAtStr)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, &chat.QuestionTier{ID: id, ChannelID: channelId, MinBits: minBits, Model: model, MaxTokens: maxTokens, CreatedAt: createdAt})
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return tiers, nil
+}
+
+func (repo *SqliteRepository) SaveQuestionTier(ctx context.Context, tier *chat.QuestionTier) (err error) {
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `insert into question_tier (id, channel_id, min_bits, model, max_tokens, created_at) values (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer func(stmt *sql.Stmt) {
+		_err := stmt.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(stmt)
+	_, err = stmt.Exec(tier.ID, tier.ChannelID, tier.MinBits, tier.Model, tier.MaxTokens, tier.CreatedAt.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (repo *SqliteRepository) DeleteQuestionTier(ctx context.Context, id string) (err error) {
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `delete from question_tier where id = ?`)
+	if err != nil {
+		return err
+	}
+	defer func(stmt *sql.Stmt) {
+		_err := stmt.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(stmt)
+	result, err := stmt.Exec(id)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *SqliteRepository) GetTimersByChannel(ctx context.Context, channelId string) (timers []*chat.Timer, err error) {
+	defer sqliteError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, name, enabled, interval_seconds, min_chat_lines, prompt, lines, created_at from timer where channel_id = ? order by created_at`, channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	timers = make([]*chat.Timer, 0)
+	for rows.Next() {
+		var id string
+		var name string
+		var enabled bool
+		var intervalSeconds int64
+		var minChatLines int
+		var prompt string
+		var lines string
+		var createdAtStr string
+		err = rows.Scan(&id, &name, &enabled, &intervalSeconds, &minChatLines, &prompt, &lines, &createdAtStr)
+		if err != nil {
+			return nil, err
+		}
+		createdAt, err := time.Parse(time.RFC3339, createdAtStr)
+		if err != nil {
+			return nil, err
+		}
+		timers = append(timers, &chat.Timer{
+			ID:           id,
+			ChannelID:    channelId,
+			Name:         name,
+			Enabled:      enabled,
+			Interval:     time.Duration(intervalSeconds) * time.Second,
+			MinChatLines: minChatLines,
+			Prompt:       prompt,
+			Lines:        splitLines(lines),
+			CreatedAt:    createdAt,
+		})
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return timers, nil
+}
+
+func (repo *SqliteRepository) SaveTimer(ctx context.Context, timer *chat.Timer) (err error) {
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `insert into timer (id, channel_id, name, enabled, interval_seconds, min_chat_lines, prompt, lines, created_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return err
 	}
@@ -254,9 +619,217 @@ func (repo *SqliteRepository) UpdateUser(ctx context.Context, user *chat.User) e
 			err = _err
 		}
 	}(stmt)
-	_, err = stmt.Exec(user.Username, user.AccessToken, user.RefreshToken, user.ExpiresAt.Format(time.RFC3339), user.ID)
+	_, err = stmt.Exec(timer.ID, timer.ChannelID, timer.Name, timer.Enabled, int64(timer.Interval/time.Second), timer.MinChatLines, timer.Prompt, strings.Join(timer.Lines, "\n"), timer.CreatedAt.Format(time.RFC3339))
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+func (repo *SqliteRepository) UpdateTimer(ctx context.Context, timer *chat.Timer) (err error) {
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `update timer set name=?, enabled=?, interval_seconds=?, min_chat_lines=?, prompt=?, lines=? where id = ?`)
+	if err != nil {
+		return err
+	}
+	defer func(stmt *sql.Stmt) {
+		_err := stmt.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(stmt)
+	result, err := stmt.Exec(timer.Name, timer.Enabled, int64(timer.Interval/time.Second), timer.MinChatLines, timer.Prompt, strings.Join(timer.Lines, "\n"), timer.ID)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *SqliteRepository) DeleteTimer(ctx context.Context, id string) (err error) {
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `delete from timer where id = ?`)
+	if err != nil {
+		return err
+	}
+	defer func(stmt *sql.Stmt) {
+		_err := stmt.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(stmt)
+	result, err := stmt.Exec(id)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+// auditTimeLayout keeps the fractional seconds at a fixed width, so that audit entries sort by their text.
+const auditTimeLayout = `2006-01-02T15:04:05.000000000Z`
+
+func (repo *SqliteRepository) SaveAuditEntry(ctx context.Context, entry *chat.AuditEntry) (err error) {
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `insert into audit_log (id, action, subject, actor, details, created_at) values (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer func(stmt *sql.Stmt) {
+		_err := stmt.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(stmt)
+	_, err = stmt.Exec(entry.ID, entry.Action, entry.Subject, entry.Actor, entry.Details, entry.CreatedAt.UTC().Format(auditTimeLayout))
+	return err
+}
+
+func (repo *SqliteRepository) ForgetUsername(ctx context.Context, username string, entry *chat.AuditEntry) (err error) {
+	defer sqliteError(&err)
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	channels := `select id from channel where lower(username) = lower(?) or user_id in (select id from user where lower(username) = lower(?))`
+	for _, query := range []string{
+		`delete from event_rule where channel_id in (` + channels + `)`,
+		`delete from question_tier where channel_id in (` + channels + `)`,
+		`delete from timer where channel_id in (` + channels + `)`,
+		`delete from channel where id in (` + channels + `)`,
+	} {
+		if _, err = tx.ExecContext(ctx, query, username, username); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `delete from user where lower(username) = lower(?)`, username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `insert into audit_log (id, action, subject, actor, details, created_at) values (?, ?, ?, ?, ?, ?)`,
+		entry.ID, entry.Action, entry.Subject, entry.Actor, entry.Details, entry.CreatedAt.UTC().Format(auditTimeLayout))
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (repo *SqliteRepository) GetAuditEntries(ctx context.Context, limit int) (entries []*chat.AuditEntry, err error) {
+	defer sqliteError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, action, subject, actor, details, created_at from audit_log order by created_at desc limit ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	entries = make([]*chat.AuditEntry, 0)
+	for rows.Next() {
+		entry := &chat.AuditEntry{}
+		var createdAtStr string
+		err = rows.Scan(&entry.ID, &entry.Action, &entry.Subject, &entry.Actor, &entry.Details, &createdAtStr)
+		if err != nil {
+			return nil, err
+		}
+		if entry.CreatedAt, err = time.Parse(auditTimeLayout, createdAtStr); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (repo *SqliteRepository) GetAPITokens(ctx context.Context) (tokens []*chat.APIToken, err error) {
+	defer sqliteError(&err)
+	rows, err := repo.db.QueryContext(ctx, `select id, name, hash, scopes, expires_at, last_used_at, created_at from api_token order by created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		_err := rows.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(rows)
+	tokens = make([]*chat.APIToken, 0)
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (repo *SqliteRepository) GetAPITokenByHash(ctx context.Context, hash string) (token *chat.APIToken, err error) {
+	defer sqliteError(&err)
+	return scanAPIToken(repo.db.QueryRowContext(ctx, `select id, name, hash, scopes, expires_at, last_used_at, created_at from api_token where hash = ?`, hash))
+}
+
+func scanAPIToken(row interface{ Scan(dest ...any) error }) (*chat.APIToken, error) {
+	token := &chat.APIToken{}
+	var scopes, expiresAtStr, lastUsedAtStr, createdAtStr string
+	err := row.Scan(&token.ID, &token.Name, &token.Hash, &scopes, &expiresAtStr, &lastUsedAtStr, &createdAtStr)
+	if err != nil {
+		return nil, err
+	}
+	token.Scopes = splitScopes(scopes)
+	if token.ExpiresAt, err = parseOptionalTime(expiresAtStr); err != nil {
+		return nil, err
+	}
+	if token.LastUsedAt, err = parseOptionalTime(lastUsedAtStr); err != nil {
+		return nil, err
+	}
+	if token.CreatedAt, err = time.Parse(time.RFC3339, createdAtStr); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (repo *SqliteRepository) SaveAPIToken(ctx context.Context, token *chat.APIToken) (err error) {
+	defer sqliteError(&err)
+	stmt, err := repo.db.PrepareContext(ctx, `insert into api_token (id, name, hash, scopes, expires_at, last_used_at, created_at) values (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer func(stmt *sql.Stmt) {
+		_err := stmt.Close()
+		if _err != nil {
+			err = _err
+		}
+	}(stmt)
+	_, err = stmt.Exec(token.ID, token.Name, token.Hash, joinScopes(token.Scopes), formatOptionalTime(token.ExpiresAt.UTC()), formatOptionalTime(token.LastUsedAt.UTC()), token.CreatedAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+func (repo *SqliteRepository) SetAPITokenLastUsed(ctx context.Context, id string, lastUsedAt time.Time) (err error) {
+	defer sqliteError(&err)
+	result, err := repo.db.ExecContext(ctx, `update api_token set last_used_at = ? where id = ?`, formatOptionalTime(lastUsedAt.UTC()), id)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+func (repo *SqliteRepository) DeleteAPIToken(ctx context.Context, id string) (err error) {
+	defer sqliteError(&err)
+	result, err := repo.db.ExecContext(ctx, `delete from api_token where id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
@@ -3,9 +3,11 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat/repotest"
 	"path"
 	"testing"
 	"time"
@@ -67,11 +69,8 @@ func TestSqliteRepository(t *testing.T) {
 			t.Fatal(err)
 		}
 		channel2, err = repo.GetChannel(context.Background(), channel.ID)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if channel2 != nil {
-			t.Fatal("Expected channel got nil")
+		if !errors.Is(err, chat.ErrNotFound) {
+			t.Fatal("Expected chat.ErrNotFound got ", channel2, err)
 		}
 		channels, err := repo.GetChannelsByUser(context.Background(), user.ID)
 		if err != nil {
@@ -100,3 +99,260 @@ func TestSqliteRepository(t *testing.T) {
 		}
 	})
 }
+
+func TestPrepareDatabaseAddsMissingUserColumns(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "sqlite.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`create table user (id TEXT NOT NULL, username TEXT NOT NULL, access_token TEXT NOT NULL, refresh_token TEXT NOT NULL, expires_at TEXT NOT NULL, created_at TEXT NOT NULL, PRIMARY KEY (id))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepository(db)
+	if err := repo.PrepareDatabase(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	user := &chat.User{ID: uuid.New().String(), Username: `Username`, ExpiresAt: time.Now(), CreatedAt: time.Now()}
+	if err := repo.SaveUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	user.NeedsReauth = true
+	if err := repo.UpdateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	user2, err := repo.GetUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user2.NeedsReauth {
+		t.Fatal("Expected user to need re-authorisation")
+	}
+}
+
+func TestSqliteRepositoryEventRules(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "sqlite.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepository(db)
+	if err := repo.PrepareDatabase(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	channel := &chat.Channel{ID: uuid.New().String(), Name: `streamer`, UserId: uuid.New().String(), CreatedAt: time.Now()}
+	if err := repo.SaveChannel(context.Background(), channel); err != nil {
+		t.Fatal(err)
+	}
+	rule := &chat.EventRule{ID: uuid.New().String(), ChannelID: channel.ID, Event: chat.EventSubGift, Enabled: true, Prompt: `thanks`, Cooldown: time.Minute, BatchWindow: 10 * time.Second, CreatedAt: time.Now()}
+	if err := repo.SaveEventRule(context.Background(), rule); err != nil {
+		t.Fatal(err)
+	}
+	duplicate := *rule
+	duplicate.ID = uuid.New().String()
+	if err := repo.SaveEventRule(context.Background(), &duplicate); err == nil {
+		t.Fatal("Expected a second rule for the same event to be rejected")
+	}
+	rule.Enabled = false
+	rule.Cooldown = 2 * time.Minute
+	if err := repo.UpdateEventRule(context.Background(), rule); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := repo.GetEventRulesByChannel(context.Background(), channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Enabled || rules[0].Cooldown != 2*time.Minute || rules[0].BatchWindow != 10*time.Second {
+		t.Fatalf("Unexpected rules %+v", rules)
+	}
+	if err := repo.DeleteChannel(context.Background(), channel.ID); err != nil {
+		t.Fatal(err)
+	}
+	rules, err = repo.GetEventRulesByChannel(context.Background(), channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 0 {
+		t.Fatal("Expected the channel's rules to be deleted with it, got ", len(rules))
+	}
+}
+
+func TestSqliteRepositoryChannelReward(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "sqlite.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepository(db)
+	if err := repo.PrepareDatabase(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	channel := &chat.Channel{ID: uuid.New().String(), Name: `streamer`, UserId: uuid.New().String(), CreatedAt: time.Now()}
+	if err := repo.SaveChannel(context.Background(), channel); err != nil {
+		t.Fatal(err)
+	}
+	channel.RewardID = `reward-1`
+	if err := repo.UpdateChannel(context.Background(), channel); err != nil {
+		t.Fatal(err)
+	}
+	channel2, err := repo.GetChannel(context.Background(), channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel2.RewardID != `reward-1` {
+		t.Fatal("Expected reward id reward-1, got ", channel2.RewardID)
+	}
+	channels, err := repo.GetChannelsByUser(context.Background(), channel.UserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].RewardID != `reward-1` {
+		t.Fatalf("Unexpected channels %+v", channels)
+	}
+}
+
+func TestSqliteRepositoryChannelAnswerWhen(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "sqlite.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepository(db)
+	if err := repo.PrepareDatabase(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	channel := &chat.Channel{ID: uuid.New().String(), Name: `streamer`, UserId: uuid.New().String(), CreatedAt: time.Now()}
+	if err := repo.SaveChannel(context.Background(), channel); err != nil {
+		t.Fatal(err)
+	}
+	channel2, err := repo.GetChannel(context.Background(), channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel2.AnswerWhen != chat.AnswerAlways || channel2.StreamContext {
+		t.Fatalf("Expected new channels to always answer without stream context, got %+v", channel2)
+	}
+	channel.AnswerWhen = chat.AnswerLive
+	channel.StreamContext = true
+	if err := repo.UpdateChannel(context.Background(), channel); err != nil {
+		t.Fatal(err)
+	}
+	channels, err := repo.GetChannelsByUser(context.Background(), channel.UserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].AnswerWhen != chat.AnswerLive || !channels[0].StreamContext {
+		t.Fatalf("Unexpected channels %+v", channels)
+	}
+}
+
+func TestSqliteRepositoryQuestionTiers(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "sqlite.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepository(db)
+	if err := repo.PrepareDatabase(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	channel := &chat.Channel{ID: uuid.New().String(), Name: `streamer`, UserId: uuid.New().String(), CreatedAt: time.Now()}
+	if err := repo.SaveChannel(context.Background(), channel); err != nil {
+		t.Fatal(err)
+	}
+	big := &chat.QuestionTier{ID: uuid.New().String(), ChannelID: channel.ID, MinBits: 1000, Model: `gpt-4`, MaxTokens: 500, CreatedAt: time.Now()}
+	small := &chat.QuestionTier{ID: uuid.New().String(), ChannelID: channel.ID, MinBits: 100, CreatedAt: time.Now()}
+	for _, tier := range []*chat.QuestionTier{big, small} {
+		if err := repo.SaveQuestionTier(context.Background(), tier); err != nil {
+			t.Fatal(err)
+		}
+	}
+	duplicate := *small
+	duplicate.ID = uuid.New().String()
+	if err := repo.SaveQuestionTier(context.Background(), &duplicate); err == nil {
+		t.Fatal("Expected a second tier with the same bits to be rejected")
+	}
+	tiers, err := repo.GetQuestionTiersByChannel(context.Background(), channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiers) != 2 || tiers[0].ID != small.ID || tiers[1].Model != `gpt-4` || tiers[1].MaxTokens != 500 {
+		t.Fatalf("Unexpected tiers %+v", tiers)
+	}
+	if err := repo.DeleteQuestionTier(context.Background(), small.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeleteChannel(context.Background(), channel.ID); err != nil {
+		t.Fatal(err)
+	}
+	tiers, err = repo.GetQuestionTiersByChannel(context.Background(), channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiers) != 0 {
+		t.Fatal("Expected the channel's tiers to be deleted with it, got ", len(tiers))
+	}
+}
+
+func TestSqliteRepositoryTimers(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "sqlite.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepository(db)
+	if err := repo.PrepareDatabase(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	channel := &chat.Channel{ID: uuid.New().String(), Name: `streamer`, UserId: uuid.New().String(), CreatedAt: time.Now()}
+	if err := repo.SaveChannel(context.Background(), channel); err != nil {
+		t.Fatal(err)
+	}
+	timer := &chat.Timer{ID: uuid.New().String(), ChannelID: channel.ID, Name: `socials`, Enabled: true, Interval: 15 * time.Minute, MinChatLines: 5, Lines: []string{`follow me`, `join the discord`}, CreatedAt: time.Now()}
+	if err := repo.SaveTimer(context.Background(), timer); err != nil {
+		t.Fatal(err)
+	}
+	timer.Enabled = false
+	timer.Prompt = `remind chat to follow`
+	timer.Lines = nil
+	if err := repo.UpdateTimer(context.Background(), timer); err != nil {
+		t.Fatal(err)
+	}
+	timers, err := repo.GetTimersByChannel(context.Background(), channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timers) != 1 || timers[0].Enabled || timers[0].Interval != 15*time.Minute || timers[0].MinChatLines != 5 || timers[0].Prompt != `remind chat to follow` || len(timers[0].Lines) != 0 {
+		t.Fatalf("Unexpected timers %+v", timers)
+	}
+	if err := repo.DeleteTimer(context.Background(), timer.ID); err != nil {
+		t.Fatal(err)
+	}
+	timers, err = repo.GetTimersByChannel(context.Background(), channel.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timers) != 0 {
+		t.Fatal("Expected the timer to be deleted, got ", len(timers))
+	}
+}
+
+func TestSqliteRepositoryConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) chat.Repository {
+		database, err := sql.Open("sqlite3", path.Join(t.TempDir(), "sqlite.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { database.Close() })
+		tokens, err := ParseTokenKeys(`test:a secret that is long enough`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo := NewEncryptedRepository(database, tokens)
+		if err := repo.PrepareDatabase(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	})
+}
@@ -0,0 +1,289 @@
+package db
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"strings"
+)
+
+// encryptedPrefix marks encrypted tokens; anything without it is a token stored before encryption.
+const encryptedPrefix = `enc:v1:`
+
+var (
+	ErrUnknownTokenKey = errors.New(`db: token was encrypted with a key that isn't configured`)
+	ErrInvalidTokenKey = errors.New(`db: token encryption keys must look like id:secret[,id:secret...]`)
+)
+
+// TokenCipher encrypts OAuth tokens with envelope encryption: every token gets its own random data key, which is
+// stored next to it wrapped by a key derived from the configured secret. Stored tokens look like
+// enc:v1:<key id>:<wrapped data key>:<sealed token>, so rotating keys only has to rewrap the data keys.
+type TokenCipher struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseTokenKeys reads keys in the id:secret[,id:secret...] form; the first one encrypts, all of them decrypt.
+func ParseTokenKeys(s string) (*TokenCipher, error) {
+	c := &TokenCipher{keys: make(map[string]cipher.AEAD)}
+	for _, pair := range strings.Split(s, `,`) {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), `:`)
+		if !ok || id == "" || len(secret) < 16 || strings.Contains(id, `:`) {
+			return nil, ErrInvalidTokenKey
+		}
+		if _, exists := c.keys[id]; exists {
+			return nil, fmt.Errorf(`%w: key %s is configured twice`, ErrInvalidTokenKey, id)
+		}
+		aead, err := newAEAD(deriveKey(id, secret))
+		if err != nil {
+			return nil, err
+		}
+		c.keys[id] = aead
+		if c.current == "" {
+			c.current = id
+		}
+	}
+	return c, nil
+}
+
+// CurrentKeyID is the key new tokens are encrypted with.
+func (c *TokenCipher) CurrentKeyID() string {
+	return c.current
+}
+
+// deriveKey turns a configured secret into an AES-256 key; the key id is mixed in so one secret can't be reused
+// under two ids by mistake.
+func deriveKey(id, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(`twitch-chatgpt token key ` + id))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New(`db: encrypted token is too short`)
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+// Encrypt encrypts a token with the current key. Empty tokens stay empty.
+func (c *TokenCipher) Encrypt(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealedToken, err := seal(dataAEAD, []byte(token), nil)
+	if err != nil {
+		return "", err
+	}
+	return c.wrap(dataKey, sealedToken)
+}
+
+func (c *TokenCipher) wrap(dataKey, sealedToken []byte) (string, error) {
+	wrappedKey, err := seal(c.keys[c.current], dataKey, []byte(c.current))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + c.current + `:` + base64.RawStdEncoding.EncodeToString(wrappedKey) + `:` + base64.RawStdEncoding.EncodeToString(sealedToken), nil
+}
+
+// unwrap returns the key id, data key and sealed token of an encrypted token.
+func (c *TokenCipher) unwrap(stored string) (string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(stored, encryptedPrefix), `:`)
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New(`db: malformed encrypted token`)
+	}
+	kek, ok := c.keys[parts[0]]
+	if !ok {
+		return "", nil, nil, fmt.Errorf(`%w: %s`, ErrUnknownTokenKey, parts[0])
+	}
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	sealedToken, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	dataKey, err := open(kek, wrappedKey, []byte(parts[0]))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return parts[0], dataKey, sealedToken, nil
+}
+
+// Decrypt decrypts a stored token; tokens stored before encryption are returned as they are.
+func (c *TokenCipher) Decrypt(stored string) (string, error) {
+	if !IsEncrypted(stored) {
+		return stored, nil
+	}
+	_, dataKey, sealedToken, err := c.unwrap(stored)
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	token, err := open(dataAEAD, sealedToken, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// Reencrypt moves a stored token to the current key, rewrapping only its data key, and encrypts plaintext tokens. It
+// reports whether anything changed.
+func (c *TokenCipher) Reencrypt(stored string) (string, bool, error) {
+	if stored == "" {
+		return "", false, nil
+	}
+	if !IsEncrypted(stored) {
+		encrypted, err := c.Encrypt(stored)
+		return encrypted, err == nil, err
+	}
+	keyId, dataKey, sealedToken, err := c.unwrap(stored)
+	if err != nil {
+		return "", false, err
+	}
+	if keyId == c.current {
+		return stored, false, nil
+	}
+	rewrapped, err := c.wrap(dataKey, sealedToken)
+	return rewrapped, err == nil, err
+}
+
+func IsEncrypted(stored string) bool {
+	return strings.HasPrefix(stored, encryptedPrefix)
+}
+
+func (s *store) sealTokens(user *chat.User) (string, string, error) {
+	if s.tokens == nil {
+		return user.AccessToken, user.RefreshToken, nil
+	}
+	accessToken, err := s.tokens.Encrypt(user.AccessToken)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := s.tokens.Encrypt(user.RefreshToken)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+func (s *store) openTokens(accessToken, refreshToken string) (string, string, error) {
+	if s.tokens == nil {
+		if IsEncrypted(accessToken) || IsEncrypted(refreshToken) {
+			return "", "", fmt.Errorf(`%w: no keys are configured`, ErrUnknownTokenKey)
+		}
+		return accessToken, refreshToken, nil
+	}
+	accessToken, err := s.tokens.Decrypt(accessToken)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err = s.tokens.Decrypt(refreshToken)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+// ReencryptTokens moves every stored token to the current key and encrypts any still in plaintext, returning how many
+// users it updated. Run it after adding a new key in front of the old one; the old key can go once it's done.
+func (s *store) ReencryptTokens(ctx context.Context) (int, error) {
+	if s.tokens == nil {
+		return 0, fmt.Errorf(`%w: no keys are configured`, ErrUnknownTokenKey)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	updated, err := reencryptTokens(ctx, tx, s.tokens)
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return updated, nil
+}
+
+func reencryptTokens(ctx context.Context, tx *sql.Tx, tokens *TokenCipher) (int, error) {
+	rows, err := tx.QueryContext(ctx, `select id, access_token, refresh_token from "user"`)
+	if err != nil {
+		return 0, err
+	}
+	type storedTokens struct {
+		id           string
+		accessToken  string
+		refreshToken string
+	}
+	users := make([]storedTokens, 0)
+	for rows.Next() {
+		var u storedTokens
+		if err = rows.Scan(&u.id, &u.accessToken, &u.refreshToken); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		users = append(users, u)
+	}
+	if err = rows.Close(); err != nil {
+		return 0, err
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, u := range users {
+		accessToken, accessChanged, err := tokens.Reencrypt(u.accessToken)
+		if err != nil {
+			return 0, fmt.Errorf(`user %s: %w`, u.id, err)
+		}
+		refreshToken, refreshChanged, err := tokens.Reencrypt(u.refreshToken)
+		if err != nil {
+			return 0, fmt.Errorf(`user %s: %w`, u.id, err)
+		}
+		if !accessChanged && !refreshChanged {
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, `update "user" set access_token = $1, refresh_token = $2 where id = $3`, accessToken, refreshToken, u.id); err != nil {
+			return 0, err
+		}
+		updated++
+	}
+	return updated, nil
+}
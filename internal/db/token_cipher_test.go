@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTokenCipherRotation(t *testing.T) {
+	old, err := ParseTokenKeys(`2023:an old secret that is long enough`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := old.Encrypt(`access`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(stored) || strings.Contains(stored, `access`) {
+		t.Fatalf("expected the token to be encrypted, got %q", stored)
+	}
+	if again, _ := old.Encrypt(`access`); again == stored {
+		t.Fatal(`expected every encryption to use a fresh data key`)
+	}
+
+	rotated, err := ParseTokenKeys(`2024:a new secret that is long enough, 2023:an old secret that is long enough`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, err := rotated.Decrypt(stored); err != nil || token != `access` {
+		t.Fatalf("expected the old key to still decrypt, got %q, %v", token, err)
+	}
+	rewrapped, changed, err := rotated.Reencrypt(stored)
+	if err != nil || !changed || !strings.HasPrefix(rewrapped, encryptedPrefix+`2024:`) {
+		t.Fatalf("expected the token to move to the new key, got %q, %v, %v", rewrapped, changed, err)
+	}
+	if _, changed, _ := rotated.Reencrypt(rewrapped); changed {
+		t.Fatal(`expected a token under the current key to stay as it is`)
+	}
+
+	current, err := ParseTokenKeys(`2024:a new secret that is long enough`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, err := current.Decrypt(rewrapped); err != nil || token != `access` {
+		t.Fatalf("expected the new key to decrypt, got %q, %v", token, err)
+	}
+	if _, err := current.Decrypt(stored); !errors.Is(err, ErrUnknownTokenKey) {
+		t.Fatalf("expected ErrUnknownTokenKey, got %v", err)
+	}
+	wrongSecret, err := ParseTokenKeys(`2024:not the secret it was encrypted with`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrongSecret.Decrypt(rewrapped); err == nil {
+		t.Fatal(`expected a wrong secret to fail`)
+	}
+	if token, err := current.Decrypt(`plaintext`); err != nil || token != `plaintext` {
+		t.Fatalf("expected tokens from before encryption to be read as they are, got %q, %v", token, err)
+	}
+}
+
+func TestParseTokenKeys(t *testing.T) {
+	for _, keys := range []string{``, `no-secret`, `short:secret`, `a:a secret that is long enough,a:a secret that is long enough`} {
+		if _, err := ParseTokenKeys(keys); !errors.Is(err, ErrInvalidTokenKey) {
+			t.Fatalf("expected %q to be refused, got %v", keys, err)
+		}
+	}
+}
+
+func TestMigrateEncryptsTokens(t *testing.T) {
+	ctx := context.Background()
+	database, _ := openBaselineDatabase(t)
+	tokens, err := ParseTokenKeys(`k1:the first secret of this test`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewEncryptedRepository(database, tokens)
+	if err := repo.PrepareDatabase(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var accessToken, refreshToken string
+	if err := database.QueryRow(`select access_token, refresh_token from user where id = '1'`).Scan(&accessToken, &refreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(accessToken) || !IsEncrypted(refreshToken) {
+		t.Fatalf("expected the existing tokens to be encrypted, got %q and %q", accessToken, refreshToken)
+	}
+	user, err := repo.GetUser(ctx, `1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.AccessToken != `access` || user.RefreshToken != `refresh` {
+		t.Fatalf("expected the tokens to be decrypted, got %+v", user)
+	}
+	user.AccessToken = `new access`
+	if err := repo.UpdateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRepository(database).GetUser(ctx, `1`); !errors.Is(err, ErrUnknownTokenKey) {
+		t.Fatalf("expected a repository without keys to refuse encrypted tokens, got %v", err)
+	}
+
+	rotated, err := ParseTokenKeys(`k2:the second secret of this test,k1:the first secret of this test`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := NewEncryptedRepository(database, rotated).ReencryptTokens(ctx)
+	if err != nil || updated != 1 {
+		t.Fatalf("expected one user to be reencrypted, got %d, %v", updated, err)
+	}
+	current, err := ParseTokenKeys(`k2:the second secret of this test`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewEncryptedRepository(database, current).GetUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].AccessToken != `new access` || users[0].RefreshToken != `refresh` {
+		t.Fatalf("expected the new key alone to decrypt the tokens, got %+v", users)
+	}
+}
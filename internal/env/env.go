@@ -5,6 +5,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/rs/zerolog/log"
 	"os"
+	"strconv"
 )
 
 var ErrNotExist = errors.New(`environment variable don't exist'`)
@@ -25,3 +26,24 @@ func MustGetEnv(name string) string {
 	}
 	return val
 }
+
+func GetEnvOrDefault(name, defaultValue string) string {
+	val, err := GetEnv(name)
+	if err != nil || val == "" {
+		return defaultValue
+	}
+	return val
+}
+
+func MustGetIntEnvOrDefault(name string, defaultValue int) int {
+	val := GetEnvOrDefault(name, "")
+	if val == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Fatal().Err(err).Msgf(`env var %s must be an integer`, name)
+	}
+	return i
+}
@@ -0,0 +1,75 @@
+// Package privacy deletes what the bot stores about a person on request, and records every such deletion in the
+// audit log.
+package privacy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"strings"
+	"time"
+)
+
+// ActionForget is the audit log action of Forget.
+const ActionForget = `forget_chatter`
+
+var ErrInvalidUsername = errors.New("privacy: invalid username")
+
+// OwnedChannel is a deleted channel together with the user that had added it, so a running bot can leave it.
+type OwnedChannel struct {
+	User    *chat.User
+	Channel *chat.Channel
+}
+
+// Forgotten is what Forget deleted.
+type Forgotten struct {
+	// Users are the bot accounts with the username; their channels were deleted with them.
+	Users []*chat.User
+	// Channels are the channels with the username that other users had added.
+	Channels []OwnedChannel
+	Entry    *chat.AuditEntry
+}
+
+// Forget deletes everything stored under the Twitch username: bot accounts of that name with their channels, and the
+// channels of that name with their settings. It records the deletion in the audit log, with actor as who asked for
+// it, even when nothing was stored. The deletion and its audit entry are saved together or not at all.
+func Forget(ctx context.Context, repo chat.Repository, username, actor string) (*Forgotten, error) {
+	username = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(username), `@`))
+	if username == `` || strings.ContainsAny(username, " \t\n") {
+		return nil, ErrInvalidUsername
+	}
+	users, err := repo.GetUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	forgotten := &Forgotten{}
+	for _, user := range users {
+		if strings.EqualFold(user.Username, username) {
+			forgotten.Users = append(forgotten.Users, user)
+			continue
+		}
+		channels, err := repo.GetChannelsByUser(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, channel := range channels {
+			if strings.EqualFold(channel.Name, username) {
+				forgotten.Channels = append(forgotten.Channels, OwnedChannel{User: user, Channel: channel})
+			}
+		}
+	}
+	forgotten.Entry = &chat.AuditEntry{
+		ID:        uuid.New().String(),
+		Action:    ActionForget,
+		Subject:   username,
+		Actor:     actor,
+		Details:   fmt.Sprintf(`deleted %d users and %d channels`, len(forgotten.Users), len(forgotten.Channels)),
+		CreatedAt: time.Now(),
+	}
+	if err := repo.ForgetUsername(ctx, username, forgotten.Entry); err != nil {
+		return nil, err
+	}
+	return forgotten, nil
+}
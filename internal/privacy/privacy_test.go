@@ -0,0 +1,166 @@
+package privacy
+
+import (
+	"context"
+	"errors"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat/repotest"
+	"testing"
+	"time"
+)
+
+func TestForget(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	repo := repotest.NewMemoryRepository()
+	for _, user := range []*chat.User{{ID: `1`, Username: `bot`, CreatedAt: now}, {ID: `2`, Username: `viewer`, CreatedAt: now}} {
+		if err := repo.SaveUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, channel := range []*chat.Channel{
+		{ID: `10`, Name: `viewer`, UserId: `1`, CreatedAt: now},
+		{ID: `11`, Name: `streamer`, UserId: `1`, CreatedAt: now},
+		{ID: `12`, Name: `other`, UserId: `2`, CreatedAt: now},
+	} {
+		if err := repo.SaveChannel(ctx, channel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.SaveTimer(ctx, &chat.Timer{ID: `t1`, ChannelID: `10`, Name: `socials`, Interval: time.Minute, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	forgotten, err := Forget(ctx, repo, ` @Viewer `, `admin`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forgotten.Users) != 1 || forgotten.Users[0].ID != `2` || len(forgotten.Channels) != 1 || forgotten.Channels[0].Channel.ID != `10` || forgotten.Channels[0].User.ID != `1` {
+		t.Fatalf("expected the user and the channel named viewer, got %+v", forgotten)
+	}
+	if _, err := repo.GetUser(ctx, `2`); !errors.Is(err, chat.ErrNotFound) {
+		t.Fatalf("expected the user to be deleted, got %v", err)
+	}
+	for _, id := range []string{`10`, `12`} {
+		if _, err := repo.GetChannel(ctx, id); !errors.Is(err, chat.ErrNotFound) {
+			t.Fatalf("expected channel %s to be deleted, got %v", id, err)
+		}
+	}
+	if timers, _ := repo.GetTimersByChannel(ctx, `10`); len(timers) != 0 {
+		t.Fatalf("expected the channel's settings to be deleted, got %+v", timers)
+	}
+	if _, err := repo.GetChannel(ctx, `11`); err != nil {
+		t.Fatalf("expected the other channel to be kept, got %v", err)
+	}
+
+	if _, err := Forget(ctx, repo, `nobody`, `cli`); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := repo.GetAuditEntries(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Action != ActionForget || entries[1].Subject != `viewer` || entries[1].Actor != `admin` || entries[1].Details != `deleted 1 users and 1 channels` || entries[0].Subject != `nobody` {
+		t.Fatalf("expected every forget to be audited, got %+v", entries)
+	}
+}
+
+func TestForgetInvalidUsername(t *testing.T) {
+	repo := repotest.NewMemoryRepository()
+	for _, username := range []string{``, `@`, `two words`} {
+		if _, err := Forget(context.Background(), repo, username, `cli`); !errors.Is(err, ErrInvalidUsername) {
+			t.Fatalf("expected ErrInvalidUsername for %q, got %v", username, err)
+		}
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	repo := repotest.NewMemoryRepository()
+	cutoffs := map[string]time.Time{}
+	purgers := map[string]Purger{}
+	for _, dataType := range DataTypes {
+		dataType := dataType
+		purgers[dataType] = func(ctx context.Context, before time.Time) (int, error) {
+			cutoffs[dataType] = before
+			return 3, nil
+		}
+	}
+	retention := Retention{DataInteractions: 30 * 24 * time.Hour, DataChatBuffer: 12 * time.Hour}
+
+	entries, err := Purge(ctx, repo, retention, purgers, ActorScheduler, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cutoffs) != 2 || !cutoffs[DataInteractions].Equal(now.AddDate(0, 0, -30)) || !cutoffs[DataChatBuffer].Equal(now.Add(-12*time.Hour)) {
+		t.Fatalf("expected the data types with a retention period to be purged before their cutoff, got %+v", cutoffs)
+	}
+	if len(entries) != 2 || entries[0].Subject != DataInteractions || entries[0].Details != `deleted 3 records older than 30 days` || entries[1].Details != `deleted 3 records older than 12 hours` {
+		t.Fatalf("unexpected audit entries %+v", entries)
+	}
+	stored, err := repo.GetAuditEntries(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 || stored[0].Action != ActionPurge || stored[0].Actor != `scheduler` {
+		t.Fatalf("expected the purges to be audited, got %+v", stored)
+	}
+}
+
+func TestPurgeWithoutStoredData(t *testing.T) {
+	repo := repotest.NewMemoryRepository()
+	retention := Retention{DataInteractions: time.Hour, DataConversationMemory: time.Hour, DataChatBuffer: time.Hour}
+	entries, err := Purge(context.Background(), repo, retention, Purgers(), `cli`, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected nothing to be purged before any data type is stored, got %+v", entries)
+	}
+}
+
+func TestPurgeAuditsScheduledPurgesThatDeleted(t *testing.T) {
+	ctx := context.Background()
+	repo := repotest.NewMemoryRepository()
+	deleted := map[string]int{DataInteractions: 2, DataChatBuffer: 0}
+	purgers := map[string]Purger{}
+	for dataType, n := range deleted {
+		n := n
+		purgers[dataType] = func(ctx context.Context, before time.Time) (int, error) { return n, nil }
+	}
+	retention := Retention{DataInteractions: time.Hour, DataChatBuffer: time.Hour}
+
+	entries, err := Purge(ctx, repo, retention, purgers, ActorScheduler, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Subject != DataInteractions {
+		t.Fatalf("expected only the scheduled purge that deleted records to be audited, got %+v", entries)
+	}
+	entries, err = Purge(ctx, repo, retention, purgers, `admin`, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Details != `deleted 0 records older than 1 hour` {
+		t.Fatalf("expected a purge someone asked for to be audited even when it deleted nothing, got %+v", entries)
+	}
+}
+
+func TestPurgeStopsAtFailure(t *testing.T) {
+	repo := repotest.NewMemoryRepository()
+	failure := errors.New("disk full")
+	purgers := map[string]Purger{
+		DataInteractions:       func(ctx context.Context, before time.Time) (int, error) { return 1, nil },
+		DataConversationMemory: func(ctx context.Context, before time.Time) (int, error) { return 0, failure },
+		DataChatBuffer:         func(ctx context.Context, before time.Time) (int, error) { return 1, nil },
+	}
+	retention := Retention{DataInteractions: time.Hour, DataConversationMemory: time.Hour, DataChatBuffer: time.Hour}
+	entries, err := Purge(context.Background(), repo, retention, purgers, `cli`, time.Now())
+	if !errors.Is(err, failure) {
+		t.Fatalf("expected the purger's error, got %v", err)
+	}
+	if len(entries) != 1 || entries[0].Subject != DataInteractions {
+		t.Fatalf("expected only the purge before the failure to be audited, got %+v", entries)
+	}
+}
@@ -0,0 +1,84 @@
+package privacy
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"time"
+)
+
+// ActionPurge is the audit log action of Purge.
+const ActionPurge = `purge`
+
+// ActorScheduler is the actor of the periodic purges, which are only audited when they delete something.
+const ActorScheduler = `scheduler`
+
+// The data types a retention period can be set for.
+const (
+	DataInteractions       = `interactions`
+	DataConversationMemory = `conversation_memory`
+	DataChatBuffer         = `chat_buffer`
+)
+
+var DataTypes = []string{DataInteractions, DataConversationMemory, DataChatBuffer}
+
+// Retention is how long each data type is kept. A data type without a period, or with a zero one, is kept forever.
+type Retention map[string]time.Duration
+
+// Purger deletes the records of one data type created before the cutoff, and returns how many it deleted.
+type Purger func(ctx context.Context, before time.Time) (int, error)
+
+// Purgers returns the purger of every data type the bot stores. It doesn't store interactions, conversation memory
+// or a chat buffer yet, so there are none; a data type registers its purger here once it is stored.
+func Purgers() map[string]Purger {
+	return map[string]Purger{}
+}
+
+// Purge deletes the records older than the retention period of their data type, and records every data type it
+// purged in the audit log with actor as who asked for it. Data types kept forever or without a purger are skipped, and
+// the scheduler's purges that delete nothing aren't audited.
+func Purge(ctx context.Context, repo chat.Repository, retention Retention, purgers map[string]Purger, actor string, now time.Time) ([]*chat.AuditEntry, error) {
+	entries := make([]*chat.AuditEntry, 0)
+	for _, dataType := range DataTypes {
+		period, purge := retention[dataType], purgers[dataType]
+		if period <= 0 || purge == nil {
+			continue
+		}
+		deleted, err := purge(ctx, now.Add(-period))
+		if err != nil {
+			return entries, fmt.Errorf(`privacy: purging %s: %w`, dataType, err)
+		}
+		if deleted == 0 && actor == ActorScheduler {
+			continue
+		}
+		entry := &chat.AuditEntry{
+			ID:        uuid.New().String(),
+			Action:    ActionPurge,
+			Subject:   dataType,
+			Actor:     actor,
+			Details:   fmt.Sprintf(`deleted %d records older than %s`, deleted, FormatPeriod(period)),
+			CreatedAt: now,
+		}
+		if err := repo.SaveAuditEntry(ctx, entry); err != nil {
+			return entries, fmt.Errorf(`privacy: %s was purged but the audit log failed: %w`, dataType, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// FormatPeriod shows a retention period in days, or in hours when it is shorter than a day.
+func FormatPeriod(period time.Duration) string {
+	n, unit := int(period/(24*time.Hour)), `day`
+	switch {
+	case period <= 0:
+		return `forever`
+	case period < 24*time.Hour:
+		n, unit = int(period/time.Hour), `hour`
+	}
+	if n != 1 {
+		unit += `s`
+	}
+	return fmt.Sprintf(`%d %s`, n, unit)
+}
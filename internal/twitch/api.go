@@ -6,14 +6,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
-var ErrUnauthorized = errors.New("invalid credentials")
+var (
+	ErrUnauthorized        = errors.New("invalid credentials")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRateLimited         = errors.New("twitch: rate limit exceeded")
+	ErrForbidden           = errors.New("twitch: forbidden")
+	ErrUserNotFound        = errors.New("twitch: no users found")
+)
 
 type User struct {
 	ID              string `json:"id"`
@@ -23,41 +30,103 @@ type User struct {
 }
 
 type RefreshAccessTokenResponse struct {
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
-	ExpiresIn    int    `json:"expires_in"`
+	AccessToken  string   `json:"access_token"`
+	RefreshToken string   `json:"refresh_token"`
+	ExpiresIn    int      `json:"expires_in"`
+	Scope        []string `json:"scope"`
+}
+
+type Endpoints struct {
+	Helix  string
+	OAuth2 string
+}
+
+var DefaultEndpoints = Endpoints{
+	Helix:  "https://api.twitch.tv/helix",
+	OAuth2: "https://id.twitch.tv/oauth2",
 }
 
 type API struct {
-	clientId string
-	client   *http.Client
+	clientId     string
+	clientSecret string
+	client       *http.Client
+	endpoints    Endpoints
+	limiter      *RateLimiter
+
+	appTokenLock      sync.Mutex
+	appToken          string
+	appTokenExpiresAt time.Time
 }
 
-func NewApi(clientId string, client *http.Client) *API {
-	return &API{clientId: clientId, client: client}
+func NewApi(clientId, clientSecret string, client *http.Client) *API {
+	return NewApiWithEndpoints(clientId, clientSecret, client, DefaultEndpoints)
 }
 
-func (api *API) RefreshAccessToken(refreshToken string) (*RefreshAccessTokenResponse, error) {
+func NewApiWithEndpoints(clientId, clientSecret string, client *http.Client, endpoints Endpoints) *API {
+	endpoints.Helix = strings.TrimSuffix(endpoints.Helix, "/")
+	endpoints.OAuth2 = strings.TrimSuffix(endpoints.OAuth2, "/")
+	return &API{clientId: clientId, clientSecret: clientSecret, client: client, endpoints: endpoints, limiter: NewRateLimiter()}
+}
+
+func (api *API) Limiter() *RateLimiter {
+	return api.limiter
+}
+
+const maxRateLimitRetries = 3
+
+// doHelix sends an authenticated Helix request, waiting for the token's rate limit bucket and retrying 429 responses.
+func (api *API) doHelix(ctx context.Context, req *http.Request, accessToken string) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Client-Id", api.clientId)
+	for attempt := 0; ; attempt++ {
+		if err := api.limiter.Wait(ctx, accessToken); err != nil {
+			return nil, err
+		}
+		resp, err := api.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		api.limiter.Update(accessToken, resp.Header)
+		if resp.StatusCode != http.StatusTooManyRequests || attempt == maxRateLimitRetries {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if err := sleep(ctx, api.limiter.RetryAfter(accessToken)); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (api *API) RefreshAccessToken(ctx context.Context, refreshToken string) (*RefreshAccessTokenResponse, error) {
 	data := url.Values{}
 	data.Set("client_id", api.clientId)
-	data.Set("client_secret", refreshToken)
+	data.Set("client_secret", api.clientSecret)
 	data.Set("grant_type", "refresh_token")
 	data.Set("refresh_token", refreshToken)
-	req, err := http.NewRequest("POST", "https://id.twitch.tv/oauth2/token", strings.NewReader(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", api.endpoints.OAuth2+"/token", strings.NewReader(data.Encode()))
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	resp, err := api.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 401 {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		return nil, ErrInvalidRefreshToken
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
 		return nil, ErrUnauthorized
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("refresh access token: non ok response " + resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("twitch: refresh access token: invalid status code: %d", resp.StatusCode)
 	}
-	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -70,12 +139,97 @@ func (api *API) RefreshAccessToken(refreshToken string) (*RefreshAccessTokenResp
 	return res, nil
 }
 
+type ValidateTokenResponse struct {
+	ClientId  string   `json:"client_id"`
+	Login     string   `json:"login"`
+	Scopes    []string `json:"scopes"`
+	UserId    string   `json:"user_id"`
+	ExpiresIn int      `json:"expires_in"`
+}
+
+func (api *API) ValidateToken(ctx context.Context, accessToken string) (*ValidateTokenResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", api.endpoints.OAuth2+"/validate", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "OAuth "+accessToken)
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("twitch: validate token: invalid status code: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	res := &ValidateTokenResponse{}
+	err = json.Unmarshal(body, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// AppAccessToken returns a cached app access token from the client credentials grant, as required by webhook subscriptions.
+func (api *API) AppAccessToken(ctx context.Context) (string, error) {
+	api.appTokenLock.Lock()
+	defer api.appTokenLock.Unlock()
+	if api.appToken != "" && time.Until(api.appTokenExpiresAt) > time.Minute {
+		return api.appToken, nil
+	}
+	data := url.Values{}
+	data.Set("client_id", api.clientId)
+	data.Set("client_secret", api.clientSecret)
+	data.Set("grant_type", "client_credentials")
+	req, err := http.NewRequestWithContext(ctx, "POST", api.endpoints.OAuth2+"/token", strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusForbidden {
+		return "", ErrUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("twitch: app access token: invalid status code: %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	api.appToken = token.AccessToken
+	api.appTokenExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return api.appToken, nil
+}
+
+// InvalidateAppAccessToken drops the cached app access token if it is still the rejected one.
+func (api *API) InvalidateAppAccessToken(accessToken string) {
+	api.appTokenLock.Lock()
+	defer api.appTokenLock.Unlock()
+	if api.appToken == accessToken {
+		api.appToken = ""
+	}
+}
+
 func (api *API) GetCurrentUser(ctx context.Context, accessToken string) (*User, error) {
 	return api.GetUser(ctx, accessToken, "")
 }
 
 func (api *API) GetUser(ctx context.Context, accessToken, username string) (*User, error) {
-	endpointUrl, err := url.ParseRequestURI("https://api.twitch.tv/helix/users")
+	endpointUrl, err := url.ParseRequestURI(api.endpoints.Helix + "/users")
 	if err != nil {
 		return nil, err
 	}
@@ -88,9 +242,7 @@ func (api *API) GetUser(ctx context.Context, accessToken, username string) (*Use
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("Client-Id", api.clientId)
-	resp, err := api.client.Do(req)
+	resp, err := api.doHelix(ctx, req, accessToken)
 	if err != nil {
 		return nil, err
 	}
@@ -98,6 +250,9 @@ func (api *API) GetUser(ctx context.Context, accessToken, username string) (*Use
 	if resp.StatusCode == http.StatusUnauthorized {
 		return nil, ErrUnauthorized
 	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, ErrRateLimited
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("twitch: invalid status code: %d", resp.StatusCode)
 	}
@@ -110,11 +265,79 @@ func (api *API) GetUser(ctx context.Context, accessToken, username string) (*Use
 		return nil, err
 	}
 	if len(users.Data) == 0 {
-		return nil, fmt.Errorf("twitch: no users found")
+		return nil, ErrUserNotFound
 	}
 	return users.Data[0], nil
 }
 
+type ModeratedChannel struct {
+	BroadcasterId    string `json:"broadcaster_id"`
+	BroadcasterLogin string `json:"broadcaster_login"`
+	BroadcasterName  string `json:"broadcaster_name"`
+}
+
+// GetModeratedChannels lists the channels the user moderates; it needs the user:read:moderated_channels scope.
+func (api *API) GetModeratedChannels(ctx context.Context, accessToken, userId string) ([]*ModeratedChannel, error) {
+	channels := make([]*ModeratedChannel, 0)
+	cursor := ""
+	for {
+		endpointUrl, err := url.ParseRequestURI(api.endpoints.Helix + "/moderation/channels")
+		if err != nil {
+			return nil, err
+		}
+		q := endpointUrl.Query()
+		q.Set("user_id", userId)
+		q.Set("first", "100")
+		if cursor != "" {
+			q.Set("after", cursor)
+		}
+		endpointUrl.RawQuery = q.Encode()
+		req, err := http.NewRequestWithContext(ctx, "GET", endpointUrl.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := api.doHelix(ctx, req, accessToken)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Data       []*ModeratedChannel `json:"data"`
+			Pagination struct {
+				Cursor string `json:"cursor"`
+			} `json:"pagination"`
+		}
+		err = decodeHelixResponse(resp, &page)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, page.Data...)
+		if page.Pagination.Cursor == "" {
+			return channels, nil
+		}
+		cursor = page.Pagination.Cursor
+	}
+}
+
+func decodeHelixResponse(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return ErrRateLimited
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return ErrForbidden
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("twitch: invalid status code: %d", resp.StatusCode)
+	}
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
 type sendMessageRequest struct {
 	BroadcasterId string `json:"broadcaster_id"`
 	SenderId      string `json:"sender_id"`
@@ -122,14 +345,17 @@ type sendMessageRequest struct {
 }
 
 type SendMessageResponse struct {
-	MessageId string `json:"message_id"`
-	IsSent    bool   `json:"is_sent"`
+	MessageId  string      `json:"message_id"`
+	IsSent     bool        `json:"is_sent"`
+	DropReason *DropReason `json:"drop_reason"`
 }
 
-func (api *API) SendMessage(ctx context.Context, user *chat.User, broadcasterId string, message string) (*SendMessageResponse, error) {
+// SendMessage posts a chat message. The caller waits for a chat slot with Limiter().WaitChat first, once per
+// message rather than once per attempt.
+func (api *API) SendMessage(ctx context.Context, accessToken, senderId, broadcasterId, message string) (*SendMessageResponse, error) {
 	sendMessageReq := &sendMessageRequest{
 		BroadcasterId: broadcasterId,
-		SenderId:      user.ID,
+		SenderId:      senderId,
 		Message:       message,
 	}
 	reqBodyStr, err := json.Marshal(sendMessageReq)
@@ -137,14 +363,12 @@ func (api *API) SendMessage(ctx context.Context, user *chat.User, broadcasterId
 		return nil, err
 	}
 	reqBody := bytes.NewReader(reqBodyStr)
-	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.twitch.tv/helix/chat/messages", reqBody)
+	req, err := http.NewRequestWithContext(ctx, "POST", api.endpoints.Helix+"/chat/messages", reqBody)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+user.AccessToken)
-	req.Header.Set("Client-Id", api.clientId)
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := api.client.Do(req)
+	resp, err := api.doHelix(ctx, req, accessToken)
 	if err != nil {
 		return nil, err
 	}
@@ -152,6 +376,9 @@ func (api *API) SendMessage(ctx context.Context, user *chat.User, broadcasterId
 	if resp.StatusCode == http.StatusUnauthorized {
 		return nil, ErrUnauthorized
 	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, ErrRateLimited
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("twitch: invalid status code: %d", resp.StatusCode)
 	}
@@ -164,7 +391,38 @@ func (api *API) SendMessage(ctx context.Context, user *chat.User, broadcasterId
 		return nil, err
 	}
 	if len(sendMessageResponse.Data) == 0 {
-		return nil, fmt.Errorf("twitch: no users found")
+		return nil, fmt.Errorf("twitch: empty send message response")
+	}
+	response := sendMessageResponse.Data[0]
+	if !response.IsSent {
+		dropErr := &DropError{Code: "unknown"}
+		if response.DropReason != nil {
+			dropErr.Code = response.DropReason.Code
+			dropErr.Message = response.DropReason.Message
+		}
+		return response, dropErr
+	}
+	return response, nil
+}
+
+// DeleteChatMessage removes a message from the channel's chat; the moderator must be the broadcaster or one of their moderators.
+func (api *API) DeleteChatMessage(ctx context.Context, accessToken, broadcasterId, moderatorId, messageId string) error {
+	endpointUrl, err := url.ParseRequestURI(api.endpoints.Helix + "/moderation/chat")
+	if err != nil {
+		return err
+	}
+	q := endpointUrl.Query()
+	q.Set("broadcaster_id", broadcasterId)
+	q.Set("moderator_id", moderatorId)
+	q.Set("message_id", messageId)
+	endpointUrl.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "DELETE", endpointUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := api.doHelix(ctx, req, accessToken)
+	if err != nil {
+		return err
 	}
-	return sendMessageResponse.Data[0], nil
+	return decodeHelixResponse(resp, nil)
 }
@@ -0,0 +1,161 @@
+package twitch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	EventSubChannelPointsRedemptionAdd = "channel.channel_points_custom_reward_redemption.add"
+
+	redemptionStatusUnfulfilled = "unfulfilled"
+)
+
+// CustomReward is a channel points reward. Only rewards created with our client id can have their redemptions updated.
+type CustomReward struct {
+	ID                  string `json:"id,omitempty"`
+	Title               string `json:"title"`
+	Cost                int    `json:"cost"`
+	Prompt              string `json:"prompt,omitempty"`
+	IsEnabled           bool   `json:"is_enabled"`
+	IsUserInputRequired bool   `json:"is_user_input_required"`
+}
+
+type ChannelPointsRedemptionEvent struct {
+	ID                   string `json:"id"`
+	BroadcasterUserId    string `json:"broadcaster_user_id"`
+	BroadcasterUserLogin string `json:"broadcaster_user_login"`
+	UserId               string `json:"user_id"`
+	UserLogin            string `json:"user_login"`
+	UserInput            string `json:"user_input"`
+	Status               string `json:"status"`
+	Reward               struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+		Cost  int    `json:"cost"`
+	} `json:"reward"`
+}
+
+// channelPointsRedemptionSubscription listens to redemptions of the channel's paid-question reward; it has to be
+// created with the broadcaster's own token.
+func channelPointsRedemptionSubscription(userId string, channel *chat.Channel, transport EventSubTransport) *EventSubSubscription {
+	if channel.RewardID == "" || userId != channel.ID {
+		return nil
+	}
+	return &EventSubSubscription{
+		Type:      EventSubChannelPointsRedemptionAdd,
+		Version:   "1",
+		Condition: map[string]string{"broadcaster_user_id": channel.ID, "reward_id": channel.RewardID},
+		Transport: transport,
+	}
+}
+
+func redemptionToMessage(event json.RawMessage, at time.Time) (*chat.Message, error) {
+	var e ChannelPointsRedemptionEvent
+	if err := json.Unmarshal(event, &e); err != nil {
+		return nil, err
+	}
+	// redemptions that skip the request queue are fulfilled already and can't be refunded
+	if e.Status != redemptionStatusUnfulfilled {
+		return nil, nil
+	}
+	return &chat.Message{
+		ID:          e.ID,
+		Username:    e.UserLogin,
+		ChannelName: e.BroadcasterUserLogin,
+		Message:     e.UserInput,
+		MessageType: chat.Redemption,
+		Time:        at,
+		Tags:        map[string]string{"reward-id": e.Reward.ID},
+	}, nil
+}
+
+func (api *API) CreateCustomReward(ctx context.Context, accessToken, broadcasterId string, reward *CustomReward) (*CustomReward, error) {
+	endpointUrl, err := url.ParseRequestURI(api.endpoints.Helix + "/channel_points/custom_rewards")
+	if err != nil {
+		return nil, err
+	}
+	q := endpointUrl.Query()
+	q.Set("broadcaster_id", broadcasterId)
+	endpointUrl.RawQuery = q.Encode()
+	body, err := json.Marshal(reward)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpointUrl.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := api.doHelix(ctx, req, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	var created struct {
+		Data []*CustomReward `json:"data"`
+	}
+	if err := decodeHelixResponse(resp, &created); err != nil {
+		return nil, err
+	}
+	if len(created.Data) == 0 {
+		return nil, errors.New("twitch: empty create custom reward response")
+	}
+	return created.Data[0], nil
+}
+
+func (api *API) DeleteCustomReward(ctx context.Context, accessToken, broadcasterId, rewardId string) error {
+	endpointUrl, err := url.ParseRequestURI(api.endpoints.Helix + "/channel_points/custom_rewards")
+	if err != nil {
+		return err
+	}
+	q := endpointUrl.Query()
+	q.Set("broadcaster_id", broadcasterId)
+	q.Set("id", rewardId)
+	endpointUrl.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "DELETE", endpointUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := api.doHelix(ctx, req, accessToken)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil
+	}
+	return decodeHelixResponse(resp, nil)
+}
+
+// UpdateRedemptionStatus fulfills or cancels an unfulfilled redemption; cancelling refunds the points.
+func (api *API) UpdateRedemptionStatus(ctx context.Context, accessToken, broadcasterId, rewardId, redemptionId, status string) error {
+	endpointUrl, err := url.ParseRequestURI(api.endpoints.Helix + "/channel_points/custom_rewards/redemptions")
+	if err != nil {
+		return err
+	}
+	q := endpointUrl.Query()
+	q.Set("broadcaster_id", broadcasterId)
+	q.Set("reward_id", rewardId)
+	q.Set("id", redemptionId)
+	endpointUrl.RawQuery = q.Encode()
+	body, err := json.Marshal(map[string]string{"status": status})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PATCH", endpointUrl.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := api.doHelix(ctx, req, accessToken)
+	if err != nil {
+		return err
+	}
+	return decodeHelixResponse(resp, nil)
+}
@@ -0,0 +1,105 @@
+package twitch_test
+
+import (
+	"context"
+	"errors"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch/twitchtest"
+	"testing"
+	"time"
+)
+
+func TestCustomRewardLifecycle(t *testing.T) {
+	helix := twitchtest.NewServer()
+	defer helix.Close()
+	broadcasterToken, _ := helix.AddUser(`2`, `streamer`)
+	botToken, _ := helix.AddUser(`1`, `bot`)
+	api := helix.API()
+	ctx := context.Background()
+
+	if _, err := api.CreateCustomReward(ctx, botToken, `2`, &twitch.CustomReward{Title: `Ask the AI`, Cost: 500}); !errors.Is(err, twitch.ErrForbidden) {
+		t.Fatalf("expected only the broadcaster to create rewards, got %v", err)
+	}
+	reward, err := api.CreateCustomReward(ctx, broadcasterToken, `2`, &twitch.CustomReward{Title: `Ask the AI`, Cost: 500, IsEnabled: true, IsUserInputRequired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reward.ID == `` || reward.Cost != 500 || !reward.IsUserInputRequired {
+		t.Fatalf("unexpected reward %+v", reward)
+	}
+	if err := api.UpdateRedemptionStatus(ctx, broadcasterToken, `2`, reward.ID, `redemption-1`, chat.RedemptionCanceled); err != nil {
+		t.Fatal(err)
+	}
+	if status := helix.RedemptionStatus(`redemption-1`); status != chat.RedemptionCanceled {
+		t.Fatalf("expected the redemption to be cancelled, got %q", status)
+	}
+	if err := api.DeleteCustomReward(ctx, broadcasterToken, `2`, reward.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.DeleteCustomReward(ctx, broadcasterToken, `2`, reward.ID); err != nil {
+		t.Fatalf("expected deleting a missing reward to succeed, got %v", err)
+	}
+	if rewards := helix.Rewards(); len(rewards) != 0 {
+		t.Fatalf("expected no rewards, got %v", rewards)
+	}
+}
+
+func TestEventSubRedemptionTransportDeliversRedemptions(t *testing.T) {
+	helix := twitchtest.NewServer()
+	t.Cleanup(helix.Close)
+	eventSub := twitchtest.NewEventSubServer()
+	t.Cleanup(eventSub.Close)
+	accessToken, _ := helix.AddUser(`2`, `streamer`, `channel:manage:redemptions`)
+	broadcaster := &chat.User{ID: `2`, Username: `streamer`, AccessToken: accessToken}
+	channel := &chat.Channel{ID: `2`, Name: `streamer`, UserId: `2`, RewardID: `reward-1`}
+
+	transport := twitch.NewEventSubRedemptionTransport(eventSub.WebSocketURL(), &tokenSubscriber{api: helix.API()})
+	// a bot user can't listen to another broadcaster's redemptions, so nothing is subscribed for it
+	transport.Join(&chat.User{ID: `1`, Username: `bot`}, &chat.Channel{ID: `3`, Name: `other`, UserId: `1`, RewardID: `reward-2`})
+	transport.Join(broadcaster, channel)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := transport.MessageStream(ctx, []uint8{chat.Redemption})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &eventSubFixture{helix: helix, eventSub: eventSub, stream: stream}
+	f.waitForSession(t)
+	f.waitForSession(t)
+	var subscription *twitch.EventSubSubscription
+	deadline := time.Now().Add(2 * time.Second)
+	for subscription == nil {
+		if time.Now().After(deadline) {
+			t.Fatal(`no redemption subscription was created`)
+		}
+		if subscriptions := helix.Subscriptions(); len(subscriptions) > 0 {
+			subscription = subscriptions[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	sessionId := subscription.Transport.SessionId
+	if subscription.Type != twitch.EventSubChannelPointsRedemptionAdd || subscription.Condition["reward_id"] != `reward-1` || len(helix.Subscriptions()) != 1 {
+		t.Fatalf("unexpected subscriptions %+v", helix.Subscriptions())
+	}
+
+	for _, redemption := range []struct{ id, status string }{{`r1`, `fulfilled`}, {`r2`, `unfulfilled`}} {
+		err = eventSub.SendNotification(sessionId, redemption.id, twitch.EventSubChannelPointsRedemptionAdd, map[string]any{}, map[string]any{
+			"id":                     redemption.id,
+			"broadcaster_user_id":    `2`,
+			"broadcaster_user_login": `streamer`,
+			"user_login":             `viewer`,
+			"user_input":             `why?`,
+			"status":                 redemption.status,
+			"reward":                 map[string]any{"id": `reward-1`, "title": `Ask the AI`, "cost": 500},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the fulfilled redemption skipped the queue and can't be refunded, so only the other one is delivered
+	message := f.receive(t)
+	if message.ID != `r2` || message.MessageType != chat.Redemption || message.Username != `viewer` || message.ChannelName != `streamer` || message.Message != `why?` || message.Tags[`reward-id`] != `reward-1` {
+		t.Fatalf("unexpected message %+v", message)
+	}
+}
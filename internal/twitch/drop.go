@@ -0,0 +1,70 @@
+package twitch
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrMessageDropped   = errors.New("twitch: message dropped")
+	ErrSlowMode         = errors.New("twitch: channel is in slow mode")
+	ErrDuplicateMessage = errors.New("twitch: duplicate message")
+	ErrAutoMod          = errors.New("twitch: message held by automod")
+	ErrChatRestricted   = errors.New("twitch: chat is restricted")
+	ErrSenderBanned     = errors.New("twitch: sender is banned or timed out")
+	ErrChannelSuspended = errors.New("twitch: channel is suspended")
+	ErrChatRateLimited  = errors.New("twitch: chat rate limit exceeded")
+)
+
+type DropReason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// DropError is returned when Twitch accepted the send-chat-message request but did not deliver the message.
+type DropError struct {
+	Code    string
+	Message string
+}
+
+func (e *DropError) Error() string {
+	return fmt.Sprintf("twitch: message dropped: %s: %s", e.Code, e.Message)
+}
+
+func (e *DropError) Is(target error) bool {
+	if target == ErrMessageDropped {
+		return true
+	}
+	kind := dropKind(e.Code)
+	return kind != nil && target == kind
+}
+
+// Persistent reports whether resending will keep failing until someone changes the channel or account settings.
+func (e *DropError) Persistent() bool {
+	switch dropKind(e.Code) {
+	case ErrChatRestricted, ErrSenderBanned, ErrChannelSuspended:
+		return true
+	}
+	return false
+}
+
+func dropKind(code string) error {
+	switch code {
+	case "msg_slowmode":
+		return ErrSlowMode
+	case "msg_duplicate", "msg_r9k":
+		return ErrDuplicateMessage
+	case "msg_rejected", "msg_rejected_mandatory", "automod_held":
+		return ErrAutoMod
+	case "msg_followersonly", "msg_followersonly_followed", "msg_followersonly_zero", "msg_subsonly",
+		"msg_emoteonly", "msg_verified_email", "msg_requires_verified_phone_number":
+		return ErrChatRestricted
+	case "msg_banned", "msg_timedout", "msg_suspended", "msg_banned_email_alias":
+		return ErrSenderBanned
+	case "msg_channel_suspended", "msg_channel_blocked":
+		return ErrChannelSuspended
+	case "msg_ratelimit":
+		return ErrChatRateLimited
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package twitch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	EventSubChannelChatMessage = "channel.chat.message"
+
+	EventSubMessageTypeNotification = "notification"
+	EventSubMessageTypeRevocation   = "revocation"
+)
+
+var ErrSubscriptionExists = errors.New("twitch: eventsub subscription already exists")
+
+type EventSubTransport struct {
+	Method    string `json:"method"`
+	SessionId string `json:"session_id,omitempty"`
+	Callback  string `json:"callback,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+}
+
+type EventSubSubscription struct {
+	ID        string            `json:"id,omitempty"`
+	Status    string            `json:"status,omitempty"`
+	Type      string            `json:"type"`
+	Version   string            `json:"version"`
+	Condition map[string]string `json:"condition"`
+	Transport EventSubTransport `json:"transport"`
+	CreatedAt time.Time         `json:"created_at,omitempty"`
+}
+
+// EventSubSubscriber creates and deletes EventSub subscriptions on behalf of a bot user.
+type EventSubSubscriber interface {
+	CreateEventSubSubscription(ctx context.Context, user *chat.User, subscription *EventSubSubscription) (*EventSubSubscription, error)
+	DeleteEventSubSubscription(ctx context.Context, user *chat.User, id string) error
+}
+
+type ChannelChatMessageEvent struct {
+	BroadcasterUserId    string `json:"broadcaster_user_id"`
+	BroadcasterUserLogin string `json:"broadcaster_user_login"`
+	ChatterUserId        string `json:"chatter_user_id"`
+	ChatterUserLogin     string `json:"chatter_user_login"`
+	MessageId            string `json:"message_id"`
+	Message              struct {
+		Text string `json:"text"`
+	} `json:"message"`
+	Cheer *struct {
+		Bits int `json:"bits"`
+	} `json:"cheer"`
+}
+
+// subscriptionBuilder returns the subscription a session needs for the channel, or nil when it needs none.
+type subscriptionBuilder func(userId string, channel *chat.Channel, transport EventSubTransport) *EventSubSubscription
+
+func chatMessageSubscription(userId string, channel *chat.Channel, transport EventSubTransport) *EventSubSubscription {
+	return channelChatMessageSubscription(userId, channel.ID, transport)
+}
+
+func channelChatMessageSubscription(userId, broadcasterId string, transport EventSubTransport) *EventSubSubscription {
+	return &EventSubSubscription{
+		Type:      EventSubChannelChatMessage,
+		Version:   "1",
+		Condition: map[string]string{"broadcaster_user_id": broadcasterId, "user_id": userId},
+		Transport: transport,
+	}
+}
+
+// eventToMessage maps EventSub notifications onto the chat.Message stream the IRC pipeline produces.
+func eventToMessage(subscriptionType string, event json.RawMessage, at time.Time) (*chat.Message, error) {
+	switch subscriptionType {
+	case EventSubChannelPointsRedemptionAdd:
+		return redemptionToMessage(event, at)
+	case EventSubChannelChatMessage:
+		var e ChannelChatMessageEvent
+		if err := json.Unmarshal(event, &e); err != nil {
+			return nil, err
+		}
+		message := &chat.Message{
+			ID:          e.MessageId,
+			Username:    e.ChatterUserLogin,
+			ChannelName: e.BroadcasterUserLogin,
+			Message:     e.Message.Text,
+			MessageType: chat.PrivMsg,
+			Time:        at,
+		}
+		// the same tag IRC uses, so cheers look alike whichever transport delivered them
+		if e.Cheer != nil {
+			message.Tags = map[string]string{"bits": strconv.Itoa(e.Cheer.Bits)}
+		}
+		return message, nil
+	}
+	return nil, nil
+}
+
+func (api *API) CreateEventSubSubscription(ctx context.Context, accessToken string, subscription *EventSubSubscription) (*EventSubSubscription, error) {
+	body, err := json.Marshal(subscription)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", api.endpoints.Helix+"/eventsub/subscriptions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := api.doHelix(ctx, req, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		resp.Body.Close()
+		return nil, ErrSubscriptionExists
+	}
+	var created struct {
+		Data []*EventSubSubscription `json:"data"`
+	}
+	if err := decodeHelixResponse(resp, &created); err != nil {
+		return nil, err
+	}
+	if len(created.Data) == 0 {
+		return nil, errors.New("twitch: empty create subscription response")
+	}
+	return created.Data[0], nil
+}
+
+func (api *API) GetEventSubSubscriptions(ctx context.Context, accessToken, subscriptionType string) ([]*EventSubSubscription, error) {
+	subscriptions := make([]*EventSubSubscription, 0)
+	cursor := ""
+	for {
+		endpointUrl, err := url.ParseRequestURI(api.endpoints.Helix + "/eventsub/subscriptions")
+		if err != nil {
+			return nil, err
+		}
+		q := endpointUrl.Query()
+		if subscriptionType != "" {
+			q.Set("type", subscriptionType)
+		}
+		if cursor != "" {
+			q.Set("after", cursor)
+		}
+		endpointUrl.RawQuery = q.Encode()
+		req, err := http.NewRequestWithContext(ctx, "GET", endpointUrl.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := api.doHelix(ctx, req, accessToken)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Data       []*EventSubSubscription `json:"data"`
+			Pagination struct {
+				Cursor string `json:"cursor"`
+			} `json:"pagination"`
+		}
+		if err := decodeHelixResponse(resp, &page); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, page.Data...)
+		if page.Pagination.Cursor == "" {
+			return subscriptions, nil
+		}
+		cursor = page.Pagination.Cursor
+	}
+}
+
+func (api *API) DeleteEventSubSubscription(ctx context.Context, accessToken, id string) error {
+	endpointUrl, err := url.ParseRequestURI(api.endpoints.Helix + "/eventsub/subscriptions")
+	if err != nil {
+		return err
+	}
+	q := endpointUrl.Query()
+	q.Set("id", id)
+	endpointUrl.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "DELETE", endpointUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := api.doHelix(ctx, req, accessToken)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil
+	}
+	return decodeHelixResponse(resp, nil)
+}
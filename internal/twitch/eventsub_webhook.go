@@ -0,0 +1,365 @@
+package twitch
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	EventSubMessageTypeVerification = "webhook_callback_verification"
+
+	eventSubWebhookMaxAge  = 10 * time.Minute
+	eventSubWebhookMaxBody = 1 << 20
+)
+
+var (
+	ErrInvalidSignature = errors.New("twitch: invalid eventsub signature")
+	ErrStaleMessage     = errors.New("twitch: eventsub message is too old")
+)
+
+// EventSubWebhookTransport reads chat through EventSub channel.chat.message subscriptions delivered to an HTTPS callback.
+// It is an http.Handler that has to be mounted at the callback URL.
+type EventSubWebhookTransport struct {
+	api      *API
+	callback string
+	secret   string
+	now      func() time.Time
+
+	lock          sync.Mutex
+	ctx           context.Context
+	stream        chan *chat.Message
+	messageTypes  []uint8
+	subscriptions map[string]*webhookSubscription
+	wg            sync.WaitGroup
+	dedup         *messageDeduplicator
+}
+
+type webhookSubscription struct {
+	user    *chat.User
+	channel *chat.Channel
+	id      string
+}
+
+func NewEventSubWebhookTransport(api *API, callback, secret string) *EventSubWebhookTransport {
+	return &EventSubWebhookTransport{
+		api:           api,
+		callback:      callback,
+		secret:        secret,
+		now:           time.Now,
+		subscriptions: make(map[string]*webhookSubscription),
+		dedup:         newMessageDeduplicator(1000),
+	}
+}
+
+func webhookSubscriptionKey(userId, broadcasterId string) string {
+	return userId + "/" + broadcasterId
+}
+
+func (t *EventSubWebhookTransport) MessageStream(ctx context.Context, messageTypes []uint8) (<-chan *chat.Message, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.ctx != nil {
+		return nil, errors.New("twitch: eventsub message stream already started")
+	}
+	t.ctx = ctx
+	t.messageTypes = messageTypes
+	t.stream = make(chan *chat.Message)
+	go t.reconcile(ctx)
+	go func() {
+		<-ctx.Done()
+		// deliveries only register while holding the lock and the context is alive
+		t.lock.Lock()
+		t.lock.Unlock()
+		t.wg.Wait()
+		close(t.stream)
+	}()
+	return t.stream, nil
+}
+
+func (t *EventSubWebhookTransport) Join(user *chat.User, channel *chat.Channel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := webhookSubscriptionKey(user.ID, channel.ID)
+	if _, ok := t.subscriptions[key]; ok {
+		return
+	}
+	subscription := &webhookSubscription{user: user, channel: channel}
+	t.subscriptions[key] = subscription
+	if t.ctx != nil && t.ctx.Err() == nil {
+		go t.subscribe(t.ctx, key, subscription)
+	}
+}
+
+func (t *EventSubWebhookTransport) Depart(user *chat.User, channel *chat.Channel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := webhookSubscriptionKey(user.ID, channel.ID)
+	subscription, ok := t.subscriptions[key]
+	if !ok {
+		return
+	}
+	delete(t.subscriptions, key)
+	if subscription.id != "" {
+		go t.unsubscribe(subscription.id)
+	}
+}
+
+// reconcile adopts the subscriptions left over from a previous run, deletes the ones for departed channels and creates the missing ones.
+func (t *EventSubWebhookTransport) reconcile(ctx context.Context) {
+	existing, err := t.existingSubscriptions(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Err(err).Msg(`error while listing eventsub webhook subscriptions`)
+		existing = map[string]*EventSubSubscription{}
+	}
+	t.lock.Lock()
+	missing := make(map[string]*webhookSubscription)
+	for key, subscription := range t.subscriptions {
+		if found, ok := existing[key]; ok {
+			subscription.id = found.ID
+			delete(existing, key)
+		} else {
+			missing[key] = subscription
+		}
+	}
+	t.lock.Unlock()
+	for _, stale := range existing {
+		t.unsubscribe(stale.ID)
+	}
+	for key, subscription := range missing {
+		t.subscribe(ctx, key, subscription)
+	}
+}
+
+// existingSubscriptions returns the usable chat subscriptions pointing at our callback, keyed like t.subscriptions.
+// Failed subscriptions are deleted so they can be created again.
+func (t *EventSubWebhookTransport) existingSubscriptions(ctx context.Context) (map[string]*EventSubSubscription, error) {
+	var subscriptions []*EventSubSubscription
+	err := t.withAppToken(ctx, func(accessToken string) (err error) {
+		subscriptions, err = t.api.GetEventSubSubscriptions(ctx, accessToken, EventSubChannelChatMessage)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*EventSubSubscription)
+	for _, subscription := range subscriptions {
+		if subscription.Transport.Method != "webhook" || subscription.Transport.Callback != t.callback {
+			continue
+		}
+		if subscription.Status != "enabled" && subscription.Status != "webhook_callback_verification_pending" {
+			t.unsubscribe(subscription.ID)
+			continue
+		}
+		existing[webhookSubscriptionKey(subscription.Condition["user_id"], subscription.Condition["broadcaster_user_id"])] = subscription
+	}
+	return existing, nil
+}
+
+func (t *EventSubWebhookTransport) subscribe(ctx context.Context, key string, subscription *webhookSubscription) {
+	request := channelChatMessageSubscription(subscription.user.ID, subscription.channel.ID, EventSubTransport{
+		Method:   "webhook",
+		Callback: t.callback,
+		Secret:   t.secret,
+	})
+	var created *EventSubSubscription
+	err := t.withAppToken(ctx, func(accessToken string) (err error) {
+		created, err = t.api.CreateEventSubSubscription(ctx, accessToken, request)
+		return err
+	})
+	if errors.Is(err, ErrSubscriptionExists) {
+		var existing map[string]*EventSubSubscription
+		if existing, err = t.existingSubscriptions(ctx); err == nil {
+			created = existing[key]
+		}
+	}
+	if err != nil || created == nil {
+		if ctx.Err() == nil {
+			sentry.CaptureException(err)
+			log.Err(err).
+				Str(`user`, subscription.user.Username).
+				Str(`channel`, subscription.channel.Name).
+				Msg(`error while subscribing to channel chat messages`)
+		}
+		return
+	}
+	t.lock.Lock()
+	if t.subscriptions[key] == subscription {
+		subscription.id = created.ID
+		t.lock.Unlock()
+		return
+	}
+	t.lock.Unlock()
+	// the channel was departed while the subscription was being created
+	t.unsubscribe(created.ID)
+}
+
+func (t *EventSubWebhookTransport) unsubscribe(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := t.withAppToken(ctx, func(accessToken string) error {
+		return t.api.DeleteEventSubSubscription(ctx, accessToken, id)
+	})
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Err(err).Str(`subscription`, id).Msg(`error while deleting eventsub subscription`)
+	}
+}
+
+// withAppToken calls fn with the app access token, fetching a new one once if it was rejected.
+func (t *EventSubWebhookTransport) withAppToken(ctx context.Context, fn func(accessToken string) error) error {
+	accessToken, err := t.api.AppAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(accessToken)
+	if !errors.Is(err, ErrUnauthorized) {
+		return err
+	}
+	t.api.InvalidateAppAccessToken(accessToken)
+	if accessToken, err = t.api.AppAccessToken(ctx); err != nil {
+		return err
+	}
+	return fn(accessToken)
+}
+
+type eventSubWebhookBody struct {
+	Challenge    string                `json:"challenge"`
+	Subscription *EventSubSubscription `json:"subscription"`
+	Event        json.RawMessage       `json:"event"`
+}
+
+func (t *EventSubWebhookTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, eventSubWebhookMaxBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timestamp, err := t.verify(r.Header, body)
+	if err != nil {
+		log.Warn().Err(err).Str(`message_id`, r.Header.Get(`Twitch-Eventsub-Message-Id`)).Msg(`rejected eventsub webhook request`)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	var message eventSubWebhookBody
+	if err := json.Unmarshal(body, &message); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Header.Get(`Twitch-Eventsub-Message-Type`) {
+	case EventSubMessageTypeVerification:
+		w.Header().Set(`Content-Type`, `text/plain`)
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, message.Challenge)
+	case EventSubMessageTypeRevocation:
+		t.revocation(message.Subscription)
+		w.WriteHeader(http.StatusNoContent)
+	case EventSubMessageTypeNotification:
+		t.notification(w, r, timestamp, &message)
+	default:
+		http.Error(w, `unknown message type`, http.StatusBadRequest)
+	}
+}
+
+// verify checks the HMAC signature and rejects messages outside of the replay window.
+func (t *EventSubWebhookTransport) verify(header http.Header, body []byte) (time.Time, error) {
+	id := header.Get(`Twitch-Eventsub-Message-Id`)
+	rawTimestamp := header.Get(`Twitch-Eventsub-Message-Timestamp`)
+	mac := hmac.New(sha256.New, []byte(t.secret))
+	mac.Write([]byte(id + rawTimestamp))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if id == "" || !hmac.Equal([]byte(expected), []byte(header.Get(`Twitch-Eventsub-Message-Signature`))) {
+		return time.Time{}, ErrInvalidSignature
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, rawTimestamp)
+	if err != nil {
+		return time.Time{}, ErrStaleMessage
+	}
+	if age := t.now().Sub(timestamp); age > eventSubWebhookMaxAge || age < -eventSubWebhookMaxAge {
+		return time.Time{}, ErrStaleMessage
+	}
+	return timestamp, nil
+}
+
+func (t *EventSubWebhookTransport) notification(w http.ResponseWriter, r *http.Request, timestamp time.Time, message *eventSubWebhookBody) {
+	t.lock.Lock()
+	if t.ctx == nil || t.ctx.Err() != nil {
+		t.lock.Unlock()
+		// let Twitch retry once the stream is running
+		http.Error(w, `message stream is not running`, http.StatusServiceUnavailable)
+		return
+	}
+	ctx := t.ctx
+	t.wg.Add(1)
+	t.lock.Unlock()
+	defer t.wg.Done()
+
+	messageId := r.Header.Get(`Twitch-Eventsub-Message-Id`)
+	if !t.dedup.claim(messageId) {
+		if t.dedup.has(messageId) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// an earlier delivery of this message is still waiting on the stream; if it is abandoned, the next retry
+		// delivers it
+		http.Error(w, `message is being delivered`, http.StatusServiceUnavailable)
+		return
+	}
+	chatMessage, err := eventToMessage(r.Header.Get(`Twitch-Eventsub-Subscription-Type`), message.Event, timestamp)
+	if err != nil {
+		t.dedup.release(messageId)
+		log.Err(err).Str(`type`, r.Header.Get(`Twitch-Eventsub-Subscription-Type`)).Msg(`error while decoding eventsub notification`)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if chatMessage != nil && slices.Contains(t.messageTypes, chatMessage.MessageType) {
+		select {
+		case <-ctx.Done():
+			// only a delivered message counts as seen, so Twitch's retry of an abandoned one gets through
+			t.dedup.release(messageId)
+			http.Error(w, `message stream stopped`, http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			t.dedup.release(messageId)
+			http.Error(w, `message was not delivered`, http.StatusServiceUnavailable)
+			return
+		case t.stream <- chatMessage:
+		}
+	}
+	t.dedup.delivered(messageId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *EventSubWebhookTransport) revocation(subscription *EventSubSubscription) {
+	if subscription == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for key, s := range t.subscriptions {
+		if s.id == subscription.ID {
+			s.id = ""
+			log.Warn().
+				Str(`subscription`, key).
+				Str(`channel`, s.channel.Name).
+				Str(`status`, subscription.Status).
+				Msg(`eventsub subscription revoked`)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package twitch_test
+
+import (
+	"context"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch/twitchtest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	webhookCallback = `https://bot.example.com/eventsub/callback`
+	webhookSecret   = `0123456789abcdef`
+)
+
+type webhookFixture struct {
+	helix   *twitchtest.Server
+	t       *twitch.EventSubWebhookTransport
+	stream  <-chan *chat.Message
+	user    *chat.User
+	channel *chat.Channel
+}
+
+func newWebhookFixture(t *testing.T, start bool) *webhookFixture {
+	t.Helper()
+	helix := twitchtest.NewServer()
+	t.Cleanup(helix.Close)
+	helix.AddUser(`1`, `bot`, `user:read:chat`, `user:bot`)
+	helix.AddUser(`2`, `streamer`, `channel:bot`)
+	f := &webhookFixture{
+		helix:   helix,
+		t:       twitch.NewEventSubWebhookTransport(helix.API(), webhookCallback, webhookSecret),
+		user:    &chat.User{ID: `1`, Username: `bot`},
+		channel: &chat.Channel{ID: `2`, Name: `streamer`, UserId: `1`},
+	}
+	f.t.Join(f.user, f.channel)
+	if start {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		stream, err := f.t.MessageStream(ctx, []uint8{chat.PrivMsg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.stream = stream
+	}
+	return f
+}
+
+func (f *webhookFixture) deliver(t *testing.T, secret, messageId, messageType string, timestamp time.Time, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := twitchtest.WebhookRequest(webhookCallback, secret, messageId, messageType, twitch.EventSubChannelChatMessage, timestamp, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	f.t.ServeHTTP(rec, req)
+	return rec
+}
+
+func (f *webhookFixture) deliverChat(t *testing.T, messageId, text string) *httptest.ResponseRecorder {
+	t.Helper()
+	return f.deliver(t, webhookSecret, messageId, twitch.EventSubMessageTypeNotification, time.Now(), chatNotification(messageId, text))
+}
+
+func chatNotification(messageId, text string) map[string]any {
+	return map[string]any{
+		"subscription": map[string]any{"type": twitch.EventSubChannelChatMessage},
+		"event": map[string]any{
+			"broadcaster_user_id":    `2`,
+			"broadcaster_user_login": `streamer`,
+			"chatter_user_id":        `1`,
+			"chatter_user_login":     `bot`,
+			"message_id":             messageId,
+			"message":                map[string]string{"text": text},
+		},
+	}
+}
+
+func waitForSubscriptions(t *testing.T, helix *twitchtest.Server, n int) []*twitch.EventSubSubscription {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if subscriptions := helix.Subscriptions(); len(subscriptions) == n {
+			return subscriptions
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d subscriptions, got %d", n, len(helix.Subscriptions()))
+	return nil
+}
+
+func TestEventSubWebhookTransportAnswersChallenge(t *testing.T) {
+	f := newWebhookFixture(t, false)
+	rec := f.deliver(t, webhookSecret, `v1`, twitch.EventSubMessageTypeVerification, time.Now(), map[string]any{"challenge": `pogchamp-kappa`})
+	if rec.Code != http.StatusOK || rec.Body.String() != `pogchamp-kappa` {
+		t.Fatalf("unexpected challenge response %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEventSubWebhookTransportRejectsBadSignaturesAndReplays(t *testing.T) {
+	f := newWebhookFixture(t, true)
+	body := map[string]any{"challenge": `x`}
+	if rec := f.deliver(t, `wrong-secret-value`, `v1`, twitch.EventSubMessageTypeVerification, time.Now(), body); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a bad signature to be rejected, got %d", rec.Code)
+	}
+	if rec := f.deliver(t, webhookSecret, `v2`, twitch.EventSubMessageTypeVerification, time.Now().Add(-11*time.Minute), body); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected an old message to be rejected, got %d", rec.Code)
+	}
+
+	req, err := twitchtest.WebhookRequest(webhookCallback, webhookSecret, `v3`, twitch.EventSubMessageTypeVerification, twitch.EventSubChannelChatMessage, time.Now(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(`Twitch-Eventsub-Message-Timestamp`, time.Now().Add(time.Second).UTC().Format(time.RFC3339Nano))
+	rec := httptest.NewRecorder()
+	f.t.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a tampered timestamp to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestEventSubWebhookTransportDeliversChatMessages(t *testing.T) {
+	f := newWebhookFixture(t, true)
+	subscriptions := waitForSubscriptions(t, f.helix, 1)
+	subscription := subscriptions[0]
+	if subscription.Transport.Method != `webhook` || subscription.Transport.Callback != webhookCallback || subscription.Condition["broadcaster_user_id"] != `2` || subscription.Condition["user_id"] != `1` {
+		t.Fatalf("unexpected subscription %+v", subscription)
+	}
+
+	received := make(chan *chat.Message, 10)
+	go func() {
+		for message := range f.stream {
+			received <- message
+		}
+	}()
+	for _, id := range []string{`m1`, `m1`, `m2`} {
+		if rec := f.deliverChat(t, id, `!!!`+id); rec.Code != http.StatusNoContent {
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+	message := <-received
+	if message.Username != `bot` || message.ChannelName != `streamer` || message.Message != `!!!m1` || message.MessageType != chat.PrivMsg {
+		t.Fatalf("unexpected message %+v", message)
+	}
+	if message := <-received; message.Message != `!!!m2` {
+		t.Fatalf("expected the redelivery to be dropped, got %+v", message)
+	}
+}
+
+func TestEventSubWebhookTransportAcceptsRetryOfAbandonedDelivery(t *testing.T) {
+	f := newWebhookFixture(t, true)
+	// nobody reads the stream, so the first delivery waits until Twitch gives up on the request
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := twitchtest.WebhookRequest(webhookCallback, webhookSecret, `m1`, twitch.EventSubMessageTypeNotification, twitch.EventSubChannelChatMessage, time.Now(), chatNotification(`m1`, `!!!m1`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	f.t.ServeHTTP(rec, req.WithContext(ctx))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected an abandoned delivery to be retried, got %d", rec.Code)
+	}
+
+	received := make(chan *chat.Message, 1)
+	go func() { received <- <-f.stream }()
+	if rec := f.deliverChat(t, `m1`, `!!!m1`); rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	select {
+	case message := <-received:
+		if message.Message != `!!!m1` {
+			t.Fatalf("unexpected message %+v", message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal(`the retry was dropped as a redelivery`)
+	}
+}
+
+func TestEventSubWebhookTransportDeliversConcurrentRetryOnce(t *testing.T) {
+	f := newWebhookFixture(t, true)
+	// nobody reads the stream yet, so whichever delivery claims the message waits on it
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { codes <- f.deliverChat(t, `m1`, `!!!m1`).Code }()
+	}
+	select {
+	case code := <-codes:
+		if code != http.StatusServiceUnavailable {
+			t.Fatalf("expected the retry to be refused while the message is being delivered, got %d", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal(`both deliveries wait to send the message`)
+	}
+
+	if message := <-f.stream; message.Message != `!!!m1` {
+		t.Fatalf("unexpected message %+v", message)
+	}
+	if code := <-codes; code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", code)
+	}
+	received := make(chan *chat.Message, 1)
+	go func() { received <- <-f.stream }()
+	for _, id := range []string{`m1`, `m2`} {
+		if rec := f.deliverChat(t, id, `!!!`+id); rec.Code != http.StatusNoContent {
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+	if message := <-received; message.Message != `!!!m2` {
+		t.Fatalf("expected the message to be delivered once, got %+v", message)
+	}
+}
+
+func TestEventSubWebhookTransportRetriesBeforeStart(t *testing.T) {
+	f := newWebhookFixture(t, false)
+	if rec := f.deliverChat(t, `m1`, `!!!hello`); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected notifications to be refused before the stream starts, got %d", rec.Code)
+	}
+}
+
+func TestEventSubWebhookTransportReconcilesAndDeparts(t *testing.T) {
+	helix := twitchtest.NewServer()
+	t.Cleanup(helix.Close)
+	webhook := twitch.EventSubTransport{Method: `webhook`, Callback: webhookCallback}
+	kept := helix.AddSubscription(&twitch.EventSubSubscription{
+		Type:      twitch.EventSubChannelChatMessage,
+		Version:   `1`,
+		Condition: map[string]string{"broadcaster_user_id": `2`, "user_id": `1`},
+		Transport: webhook,
+	})
+	stale := helix.AddSubscription(&twitch.EventSubSubscription{
+		Type:      twitch.EventSubChannelChatMessage,
+		Version:   `1`,
+		Condition: map[string]string{"broadcaster_user_id": `9`, "user_id": `1`},
+		Transport: webhook,
+	})
+	foreign := helix.AddSubscription(&twitch.EventSubSubscription{
+		Type:      twitch.EventSubChannelChatMessage,
+		Version:   `1`,
+		Condition: map[string]string{"broadcaster_user_id": `9`, "user_id": `1`},
+		Transport: twitch.EventSubTransport{Method: `webhook`, Callback: `https://other.example.com/callback`},
+	})
+
+	transport := twitch.NewEventSubWebhookTransport(helix.API(), webhookCallback, webhookSecret)
+	user := &chat.User{ID: `1`, Username: `bot`}
+	channel := &chat.Channel{ID: `2`, Name: `streamer`, UserId: `1`}
+	other := &chat.Channel{ID: `3`, Name: `other`, UserId: `1`}
+	transport.Join(user, channel)
+	transport.Join(user, other)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if _, err := transport.MessageStream(ctx, []uint8{chat.PrivMsg}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids map[string]string
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		ids = map[string]string{}
+		for _, subscription := range helix.Subscriptions() {
+			ids[subscription.ID] = subscription.Condition["broadcaster_user_id"]
+		}
+		if len(ids) == 3 && len(helix.DeletedSubscriptions()) == 1 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := ids[kept]; !ok {
+		t.Fatal(`expected the existing subscription to be adopted`)
+	}
+	if _, ok := ids[stale]; ok {
+		t.Fatal(`expected the stale subscription to be deleted`)
+	}
+	if _, ok := ids[foreign]; !ok {
+		t.Fatal(`expected subscriptions for other callbacks to be left alone`)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("expected a subscription to be created for the other channel, got %v", ids)
+	}
+
+	transport.Depart(user, channel)
+	waitForSubscriptions(t, helix, 2)
+	deleted := helix.DeletedSubscriptions()
+	if len(deleted) != 2 || deleted[1] != kept {
+		t.Fatalf("expected %s to be deleted on depart, got %v", kept, deleted)
+	}
+}
@@ -0,0 +1,486 @@
+package twitch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultEventSubWebSocketURL = "wss://eventsub.wss.twitch.tv/ws"
+
+	eventSubMessageTypeWelcome   = "session_welcome"
+	eventSubMessageTypeKeepalive = "session_keepalive"
+	eventSubMessageTypeReconnect = "session_reconnect"
+
+	keepaliveGrace      = 5 * time.Second
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 2 * time.Minute
+)
+
+type eventSubMetadata struct {
+	MessageId           string    `json:"message_id"`
+	MessageType         string    `json:"message_type"`
+	MessageTimestamp    time.Time `json:"message_timestamp"`
+	SubscriptionType    string    `json:"subscription_type"`
+	SubscriptionVersion string    `json:"subscription_version"`
+}
+
+type eventSubSessionPayload struct {
+	ID                      string  `json:"id"`
+	Status                  string  `json:"status"`
+	KeepaliveTimeoutSeconds int     `json:"keepalive_timeout_seconds"`
+	ReconnectUrl            *string `json:"reconnect_url"`
+}
+
+type eventSubWebSocketMessage struct {
+	Metadata eventSubMetadata `json:"metadata"`
+	Payload  struct {
+		Session      *eventSubSessionPayload `json:"session"`
+		Subscription *EventSubSubscription   `json:"subscription"`
+		Event        json.RawMessage         `json:"event"`
+	} `json:"payload"`
+}
+
+// EventSubWebSocketTransport reads chat through EventSub channel.chat.message subscriptions, one WebSocket session per bot user.
+// The same sessions can carry other per-channel subscriptions instead, see NewEventSubRedemptionTransport.
+type EventSubWebSocketTransport struct {
+	url          string
+	subscriber   EventSubSubscriber
+	subscription subscriptionBuilder
+	dialer       *websocket.Dialer
+
+	lock         sync.Mutex
+	ctx          context.Context
+	stream       chan *chat.Message
+	messageTypes []uint8
+	sessions     map[string]*eventSubSession
+	wg           sync.WaitGroup
+	dedup        *messageDeduplicator
+
+	keepaliveGrace   time.Duration
+	reconnectBackoff time.Duration
+}
+
+func NewEventSubWebSocketTransport(url string, subscriber EventSubSubscriber) *EventSubWebSocketTransport {
+	return newEventSubWebSocketTransport(url, subscriber, chatMessageSubscription)
+}
+
+// NewEventSubRedemptionTransport streams redemptions of the paid-question reward of channels joined by their own
+// broadcaster, independently of how chat is read.
+func NewEventSubRedemptionTransport(url string, subscriber EventSubSubscriber) *EventSubWebSocketTransport {
+	return newEventSubWebSocketTransport(url, subscriber, channelPointsRedemptionSubscription)
+}
+
+func newEventSubWebSocketTransport(url string, subscriber EventSubSubscriber, subscription subscriptionBuilder) *EventSubWebSocketTransport {
+	return &EventSubWebSocketTransport{
+		url:          url,
+		subscriber:   subscriber,
+		subscription: subscription,
+		dialer:       websocket.DefaultDialer,
+		sessions:     make(map[string]*eventSubSession),
+		dedup:        newMessageDeduplicator(1000),
+
+		keepaliveGrace:   keepaliveGrace,
+		reconnectBackoff: minReconnectBackoff,
+	}
+}
+
+func (t *EventSubWebSocketTransport) MessageStream(ctx context.Context, messageTypes []uint8) (<-chan *chat.Message, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.ctx != nil {
+		return nil, errors.New("twitch: eventsub message stream already started")
+	}
+	t.ctx = ctx
+	t.messageTypes = messageTypes
+	t.stream = make(chan *chat.Message)
+	for _, session := range t.sessions {
+		t.startLocked(session)
+	}
+	go func() {
+		<-ctx.Done()
+		// sessions only start while holding the lock and the context is alive
+		t.lock.Lock()
+		t.lock.Unlock()
+		t.wg.Wait()
+		close(t.stream)
+	}()
+	return t.stream, nil
+}
+
+func (t *EventSubWebSocketTransport) Join(user *chat.User, channel *chat.Channel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	session, ok := t.sessions[user.ID]
+	if !ok {
+		session = newEventSubSession(t, user)
+		t.sessions[user.ID] = session
+	}
+	session.addChannel(channel)
+	if t.ctx != nil {
+		t.startLocked(session)
+	}
+}
+
+func (t *EventSubWebSocketTransport) Depart(user *chat.User, channel *chat.Channel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	session, ok := t.sessions[user.ID]
+	if !ok {
+		return
+	}
+	if session.removeChannel(channel) == 0 {
+		session.stop()
+		delete(t.sessions, user.ID)
+	}
+}
+
+func (t *EventSubWebSocketTransport) startLocked(session *eventSubSession) {
+	if t.ctx.Err() != nil || session.running() {
+		return
+	}
+	t.wg.Add(1)
+	session.start(t.ctx, func() { t.wg.Done() })
+}
+
+func (t *EventSubWebSocketTransport) emit(ctx context.Context, message *chat.Message) {
+	if !slices.Contains(t.messageTypes, message.MessageType) {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case t.stream <- message:
+	}
+}
+
+type eventSubSession struct {
+	transport *EventSubWebSocketTransport
+	user      *chat.User
+
+	lock          sync.Mutex
+	channels      map[string]*chat.Channel
+	subscriptions map[string]string
+	sessionId     string
+	cancel        context.CancelFunc
+}
+
+func newEventSubSession(transport *EventSubWebSocketTransport, user *chat.User) *eventSubSession {
+	return &eventSubSession{
+		transport:     transport,
+		user:          user,
+		channels:      make(map[string]*chat.Channel),
+		subscriptions: make(map[string]string),
+	}
+}
+
+func (s *eventSubSession) running() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cancel != nil
+}
+
+func (s *eventSubSession) start(ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.lock.Lock()
+	s.cancel = cancel
+	s.lock.Unlock()
+	go func() {
+		defer done()
+		s.run(ctx)
+	}()
+}
+
+func (s *eventSubSession) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
+
+func (s *eventSubSession) addChannel(channel *chat.Channel) {
+	s.lock.Lock()
+	s.channels[channel.ID] = channel
+	sessionId := s.sessionId
+	ctx := s.currentContext()
+	s.lock.Unlock()
+	if sessionId != "" && ctx != nil {
+		go s.subscribe(ctx, sessionId, channel)
+	}
+}
+
+func (s *eventSubSession) removeChannel(channel *chat.Channel) int {
+	s.lock.Lock()
+	delete(s.channels, channel.ID)
+	subscriptionId, subscribed := s.subscriptions[channel.ID]
+	delete(s.subscriptions, channel.ID)
+	remaining := len(s.channels)
+	ctx := s.currentContext()
+	s.lock.Unlock()
+	if subscribed && ctx != nil {
+		go func() {
+			if err := s.transport.subscriber.DeleteEventSubSubscription(context.WithoutCancel(ctx), s.user, subscriptionId); err != nil {
+				log.Err(err).Str(`channel`, channel.Name).Msg(`error while deleting eventsub subscription`)
+			}
+		}()
+	}
+	return remaining
+}
+
+// currentContext must be called with the lock held.
+func (s *eventSubSession) currentContext() context.Context {
+	if s.cancel == nil {
+		return nil
+	}
+	return s.transport.ctx
+}
+
+func (s *eventSubSession) run(ctx context.Context) {
+	backoff := s.transport.reconnectBackoff
+	for ctx.Err() == nil {
+		conn, welcome, err := s.dial(ctx, s.transport.url)
+		if err != nil {
+			log.Err(err).Str(`user`, s.user.Username).Dur(`backoff`, backoff).Msg(`error while connecting to eventsub`)
+			if sleep(ctx, backoff) != nil {
+				return
+			}
+			backoff = min(backoff*2, maxReconnectBackoff)
+			continue
+		}
+		backoff = s.transport.reconnectBackoff
+		s.welcomed(ctx, welcome, true)
+		err = s.read(ctx, conn, welcome)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn().Err(err).Str(`user`, s.user.Username).Msg(`eventsub websocket disconnected, reconnecting`)
+	}
+}
+
+func (s *eventSubSession) dial(ctx context.Context, url string) (*websocket.Conn, *eventSubSessionPayload, error) {
+	conn, _, err := s.transport.dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var message eventSubWebSocketMessage
+	if err := conn.ReadJSON(&message); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if message.Metadata.MessageType != eventSubMessageTypeWelcome || message.Payload.Session == nil {
+		conn.Close()
+		return nil, nil, errors.New("twitch: expected eventsub session_welcome, got " + message.Metadata.MessageType)
+	}
+	return conn, message.Payload.Session, nil
+}
+
+// welcomed records the new session; a fresh session starts without subscriptions while a reconnected one keeps them.
+func (s *eventSubSession) welcomed(ctx context.Context, welcome *eventSubSessionPayload, fresh bool) {
+	s.lock.Lock()
+	s.sessionId = welcome.ID
+	var channels []*chat.Channel
+	if fresh {
+		s.subscriptions = make(map[string]string)
+		for _, channel := range s.channels {
+			channels = append(channels, channel)
+		}
+	}
+	s.lock.Unlock()
+	for _, channel := range channels {
+		s.subscribe(ctx, welcome.ID, channel)
+	}
+}
+
+func (s *eventSubSession) subscribe(ctx context.Context, sessionId string, channel *chat.Channel) {
+	subscription := s.transport.subscription(s.user.ID, channel, EventSubTransport{Method: "websocket", SessionId: sessionId})
+	if subscription == nil {
+		return
+	}
+	created, err := s.transport.subscriber.CreateEventSubSubscription(ctx, s.user, subscription)
+	if errors.Is(err, ErrSubscriptionExists) {
+		return
+	}
+	if err != nil {
+		sentry.CaptureException(err)
+		log.Err(err).Str(`user`, s.user.Username).Str(`channel`, channel.Name).Msg(`error while creating eventsub subscription`)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.channels[channel.ID]; ok && s.sessionId == sessionId {
+		s.subscriptions[channel.ID] = created.ID
+	}
+}
+
+func (s *eventSubSession) read(ctx context.Context, conn *websocket.Conn, welcome *eventSubSessionPayload) error {
+	var current struct {
+		sync.Mutex
+		conn *websocket.Conn
+	}
+	current.conn = conn
+	stopWatch := context.AfterFunc(ctx, func() {
+		current.Lock()
+		defer current.Unlock()
+		current.conn.Close()
+	})
+	defer stopWatch()
+	defer func() {
+		current.Lock()
+		defer current.Unlock()
+		current.conn.Close()
+	}()
+	keepalive := time.Duration(welcome.KeepaliveTimeoutSeconds) * time.Second
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(keepalive + s.transport.keepaliveGrace))
+		var message eventSubWebSocketMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			return err
+		}
+		switch message.Metadata.MessageType {
+		case eventSubMessageTypeKeepalive:
+		case eventSubMessageTypeReconnect:
+			if message.Payload.Session == nil || message.Payload.Session.ReconnectUrl == nil {
+				return errors.New("twitch: eventsub session_reconnect without a reconnect url")
+			}
+			newConn, newWelcome, err := s.dial(ctx, *message.Payload.Session.ReconnectUrl)
+			if err != nil {
+				return err
+			}
+			s.welcomed(ctx, newWelcome, false)
+			current.Lock()
+			current.conn.Close()
+			current.conn = newConn
+			current.Unlock()
+			conn = newConn
+			keepalive = time.Duration(newWelcome.KeepaliveTimeoutSeconds) * time.Second
+		case EventSubMessageTypeNotification:
+			s.notification(ctx, &message)
+		case EventSubMessageTypeRevocation:
+			s.revocation(message.Payload.Subscription)
+		}
+	}
+}
+
+func (s *eventSubSession) notification(ctx context.Context, message *eventSubWebSocketMessage) {
+	if s.transport.dedup.seen(message.Metadata.MessageId) {
+		return
+	}
+	chatMessage, err := eventToMessage(message.Metadata.SubscriptionType, message.Payload.Event, message.Metadata.MessageTimestamp)
+	if err != nil {
+		log.Err(err).Str(`type`, message.Metadata.SubscriptionType).Msg(`error while decoding eventsub notification`)
+		return
+	}
+	if chatMessage != nil {
+		s.transport.emit(ctx, chatMessage)
+	}
+}
+
+func (s *eventSubSession) revocation(subscription *EventSubSubscription) {
+	if subscription == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for channelId, id := range s.subscriptions {
+		if id == subscription.ID {
+			delete(s.subscriptions, channelId)
+			log.Warn().
+				Str(`user`, s.user.Username).
+				Str(`broadcaster_id`, channelId).
+				Str(`status`, subscription.Status).
+				Msg(`eventsub subscription revoked`)
+		}
+	}
+}
+
+type messageDeduplicator struct {
+	lock     sync.Mutex
+	size     int
+	ids      map[string]struct{}
+	order    []string
+	inFlight map[string]struct{}
+}
+
+func newMessageDeduplicator(size int) *messageDeduplicator {
+	return &messageDeduplicator{size: size, ids: make(map[string]struct{}, size), inFlight: make(map[string]struct{})}
+}
+
+// has reports whether the id was recorded, without recording it.
+func (d *messageDeduplicator) has(id string) bool {
+	if id == "" {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, ok := d.ids[id]
+	return ok
+}
+
+// claim reserves the id for one delivery, and reports false when it was recorded or another delivery holds it.
+// The claim ends with either delivered or release.
+func (d *messageDeduplicator) claim(id string) bool {
+	if id == "" {
+		return true
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.ids[id]; ok {
+		return false
+	}
+	if _, ok := d.inFlight[id]; ok {
+		return false
+	}
+	d.inFlight[id] = struct{}{}
+	return true
+}
+
+// delivered records a claimed id.
+func (d *messageDeduplicator) delivered(id string) {
+	if id == "" {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.inFlight, id)
+	d.recordLocked(id)
+}
+
+// release gives up a claim without recording the id, so a retry can deliver it.
+func (d *messageDeduplicator) release(id string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.inFlight, id)
+}
+
+// seen records the id and reports whether it was recorded before.
+func (d *messageDeduplicator) seen(id string) bool {
+	if id == "" {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.ids[id]; ok {
+		return true
+	}
+	d.recordLocked(id)
+	return false
+}
+
+func (d *messageDeduplicator) recordLocked(id string) {
+	d.ids[id] = struct{}{}
+	d.order = append(d.order, id)
+	if len(d.order) > d.size {
+		delete(d.ids, d.order[0])
+		d.order = d.order[1:]
+	}
+}
@@ -0,0 +1,197 @@
+package twitch_test
+
+import (
+	"context"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch/twitchtest"
+	"testing"
+	"time"
+)
+
+type tokenSubscriber struct {
+	api *twitch.API
+}
+
+func (s *tokenSubscriber) CreateEventSubSubscription(ctx context.Context, user *chat.User, subscription *twitch.EventSubSubscription) (*twitch.EventSubSubscription, error) {
+	return s.api.CreateEventSubSubscription(ctx, user.AccessToken, subscription)
+}
+
+func (s *tokenSubscriber) DeleteEventSubSubscription(ctx context.Context, user *chat.User, id string) error {
+	return s.api.DeleteEventSubSubscription(ctx, user.AccessToken, id)
+}
+
+type eventSubFixture struct {
+	helix    *twitchtest.Server
+	eventSub *twitchtest.EventSubServer
+	stream   <-chan *chat.Message
+	user     *chat.User
+	channel  *chat.Channel
+	t        *twitch.EventSubWebSocketTransport
+}
+
+func newEventSubFixture(t *testing.T, keepalive time.Duration) *eventSubFixture {
+	t.Helper()
+	helix := twitchtest.NewServer()
+	t.Cleanup(helix.Close)
+	eventSub := twitchtest.NewEventSubServer()
+	eventSub.SetKeepaliveTimeout(keepalive)
+	t.Cleanup(eventSub.Close)
+	accessToken, _ := helix.AddUser(`1`, `bot`, `user:read:chat`)
+	helix.AddUser(`2`, `streamer`)
+	user := &chat.User{ID: `1`, Username: `bot`, AccessToken: accessToken}
+	channel := &chat.Channel{ID: `2`, Name: `streamer`, UserId: `1`}
+
+	transport := twitch.NewEventSubWebSocketTransport(eventSub.WebSocketURL(), &tokenSubscriber{api: helix.API()})
+	twitch.SetEventSubTimings(transport, 200*time.Millisecond, 10*time.Millisecond)
+	transport.Join(user, channel)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := transport.MessageStream(ctx, []uint8{chat.PrivMsg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &eventSubFixture{helix: helix, eventSub: eventSub, stream: stream, user: user, channel: channel, t: transport}
+}
+
+func (f *eventSubFixture) waitForSession(t *testing.T) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sessionId, err := f.eventSub.WaitForSession(ctx)
+	if err != nil {
+		t.Fatal(`no eventsub session was opened`)
+	}
+	return sessionId
+}
+
+func (f *eventSubFixture) waitForSubscription(t *testing.T, sessionId string) *twitch.EventSubSubscription {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, subscription := range f.helix.Subscriptions() {
+			if subscription.Transport.SessionId == sessionId {
+				return subscription
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no subscription was created for session %s", sessionId)
+	return nil
+}
+
+func (f *eventSubFixture) sendChatMessage(t *testing.T, sessionId, messageId, text string) {
+	t.Helper()
+	err := f.eventSub.SendNotification(sessionId, messageId, twitch.EventSubChannelChatMessage, map[string]any{}, map[string]any{
+		"broadcaster_user_id":    `2`,
+		"broadcaster_user_login": `streamer`,
+		"chatter_user_id":        `1`,
+		"chatter_user_login":     `bot`,
+		"message_id":             messageId,
+		"message":                map[string]string{"text": text},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *eventSubFixture) receive(t *testing.T) *chat.Message {
+	t.Helper()
+	select {
+	case message := <-f.stream:
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatal(`no message received`)
+	}
+	return nil
+}
+
+func TestEventSubWebSocketTransportDeliversChatMessages(t *testing.T) {
+	f := newEventSubFixture(t, 10*time.Second)
+	sessionId := f.waitForSession(t)
+	subscription := f.waitForSubscription(t, sessionId)
+	if subscription.Type != twitch.EventSubChannelChatMessage || subscription.Condition["broadcaster_user_id"] != `2` || subscription.Condition["user_id"] != `1` {
+		t.Fatalf("unexpected subscription %+v", subscription)
+	}
+
+	f.sendChatMessage(t, sessionId, `m1`, `!!!hello`)
+	f.sendChatMessage(t, sessionId, `m1`, `!!!hello`)
+	f.sendChatMessage(t, sessionId, `m2`, `!!!again`)
+	message := f.receive(t)
+	if message.Username != `bot` || message.ChannelName != `streamer` || message.Message != `!!!hello` || message.MessageType != chat.PrivMsg {
+		t.Fatalf("unexpected message %+v", message)
+	}
+	if message := f.receive(t); message.Message != `!!!again` {
+		t.Fatalf("expected the duplicate to be dropped, got %+v", message)
+	}
+}
+
+func TestEventSubWebSocketTransportReconnectsAfterKeepaliveTimeout(t *testing.T) {
+	f := newEventSubFixture(t, 0)
+	first := f.waitForSession(t)
+	f.waitForSubscription(t, first)
+
+	// no keepalive arrives, so the client must open a fresh session and subscribe again
+	second := f.waitForSession(t)
+	if second == first {
+		t.Fatal(`expected a new session`)
+	}
+	f.eventSub.SetKeepaliveTimeout(10 * time.Second)
+	f.waitForSubscription(t, second)
+}
+
+func TestEventSubWebSocketTransportFollowsReconnect(t *testing.T) {
+	f := newEventSubFixture(t, 10*time.Second)
+	first := f.waitForSession(t)
+	f.waitForSubscription(t, first)
+	created := len(f.helix.Subscriptions())
+
+	if err := f.eventSub.SendReconnect(first); err != nil {
+		t.Fatal(err)
+	}
+	second := f.waitForSession(t)
+	f.sendChatMessage(t, second, `m1`, `!!!after reconnect`)
+	if message := f.receive(t); message.Message != `!!!after reconnect` {
+		t.Fatalf("unexpected message %+v", message)
+	}
+	if got := len(f.helix.Subscriptions()); got != created {
+		t.Fatalf("expected subscriptions to carry over, got %d instead of %d", got, created)
+	}
+}
+
+func TestEventSubWebSocketTransportDepartAndRevocation(t *testing.T) {
+	f := newEventSubFixture(t, 10*time.Second)
+	sessionId := f.waitForSession(t)
+	subscription := f.waitForSubscription(t, sessionId)
+
+	if err := f.eventSub.SendRevocation(sessionId, subscription.ID, twitch.EventSubChannelChatMessage, `authorization_revoked`); err != nil {
+		t.Fatal(err)
+	}
+	// a keepalive after the revocation proves it was processed
+	if err := f.eventSub.SendKeepalive(sessionId); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	f.t.Depart(f.user, f.channel)
+	time.Sleep(50 * time.Millisecond)
+	if deleted := f.helix.DeletedSubscriptions(); len(deleted) != 0 {
+		t.Fatalf("expected revoked subscriptions not to be deleted again, got %v", deleted)
+	}
+
+	other := &chat.Channel{ID: `3`, Name: `other`, UserId: `1`}
+	f.helix.AddUser(`3`, `other`)
+	f.t.Join(f.user, other)
+	sessionId = f.waitForSession(t)
+	subscription = f.waitForSubscription(t, sessionId)
+	f.t.Depart(f.user, other)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(f.helix.DeletedSubscriptions()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal(`expected the subscription to be deleted on depart`)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if deleted := f.helix.DeletedSubscriptions(); deleted[0] != subscription.ID {
+		t.Fatalf("expected %s to be deleted, got %v", subscription.ID, deleted)
+	}
+}
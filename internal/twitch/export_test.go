@@ -0,0 +1,20 @@
+package twitch
+
+import "time"
+
+func SetEventSubTimings(t *EventSubWebSocketTransport, grace, backoff time.Duration) {
+	t.keepaliveGrace = grace
+	t.reconnectBackoff = backoff
+}
+
+func SetIRCBackoff(t *IRCTransport, minBackoff, maxBackoff time.Duration) {
+	t.minBackoff = minBackoff
+	t.maxBackoff = maxBackoff
+}
+
+// FireIRCConnected runs what a connection does once it is up, on every connection, with clients that never dial.
+func FireIRCConnected(t *IRCTransport) {
+	for _, shard := range t.shards {
+		t.connected(shard, t.newClient())
+	}
+}
@@ -2,53 +2,425 @@ package twitch
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/gempir/go-twitch-irc/v4"
 	"github.com/getsentry/sentry-go"
 	"github.com/rs/zerolog/log"
 	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"slices"
+	"sync"
+	"time"
 )
 
-func NewMessagePipeline(client *twitch.Client) chat.GetMessageStream {
-	return func(ctx context.Context, messageTypes []uint8) (<-chan *chat.Message, error) {
-		messageStream := make(chan *chat.Message)
-		clientDone := make(chan any)
-		go func() {
-			err := client.Connect()
-			if err != nil {
-				sentry.CaptureException(err)
-				log.Err(err).Msg(`error while connect twitch twitch client`)
+const (
+	IRCStateConnecting   = "connecting"
+	IRCStateConnected    = "connected"
+	IRCStateReconnecting = "reconnecting"
+	IRCStateStopped      = "stopped"
+
+	minIRCBackoff = time.Second
+	maxIRCBackoff = 2 * time.Minute
+)
+
+// unavailableNotices are the NOTICE msg-ids Twitch sends when a channel cannot be joined.
+var unavailableNotices = map[string]bool{
+	"msg_channel_suspended": true,
+	"msg_banned":            true,
+	"msg_channel_blocked":   true,
+	"tos_ban":               true,
+}
+
+// IRCTransport reads chat over a pool of anonymous IRC connections. Channels are spread evenly across the
+// connections, and each connection is re-established with backoff whenever it drops.
+type IRCTransport struct {
+	newClient   func() *twitch.Client
+	joinLimiter twitch.RateLimiter
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	lock          sync.Mutex
+	shards        []*ircShard
+	joined        map[string]int
+	assigned      map[string]*ircShard
+	wanted        func() []string
+	onUnavailable func(channelName, reason, message string)
+	unavailable   map[string]string
+	messageTypes  []uint8
+	started       bool
+}
+
+type ircShard struct {
+	client        *twitch.Client
+	state         chat.ConnectionState
+	connectedOnce bool
+}
+
+// NewIRCTransport opens the given number of connections; they share one JOIN rate limiter because Twitch
+// counts joins per account rather than per connection.
+func NewIRCTransport(newClient func() *twitch.Client, connections int) *IRCTransport {
+	t := &IRCTransport{
+		newClient:   newClient,
+		joinLimiter: twitch.CreateDefaultRateLimiter(),
+		minBackoff:  minIRCBackoff,
+		maxBackoff:  maxIRCBackoff,
+		joined:      make(map[string]int),
+		assigned:    make(map[string]*ircShard),
+		unavailable: make(map[string]string),
+	}
+	for i := 0; i < max(connections, 1); i++ {
+		t.shards = append(t.shards, &ircShard{
+			state: chat.ConnectionState{Name: fmt.Sprintf("irc #%d", i+1), State: IRCStateConnecting, Since: time.Now()},
+		})
+	}
+	return t
+}
+
+func (t *IRCTransport) Supervise(channels func() []string, unavailable func(channelName, reason, message string)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.wanted = channels
+	t.onUnavailable = unavailable
+}
+
+func (t *IRCTransport) Connections() []chat.ConnectionState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	states := make([]chat.ConnectionState, 0, len(t.shards))
+	for _, shard := range t.shards {
+		state := shard.state
+		state.Unavailable = make(map[string]string)
+		for channel, assigned := range t.assigned {
+			if assigned != shard {
+				continue
 			}
-			clientDone <- struct{}{}
-		}()
-		client.OnPrivateMessage(func(message twitch.PrivateMessage) {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				privateMessage := &chat.Message{
-					Username:    message.User.Name,
-					ChannelName: message.Channel,
-					Message:     message.Message,
-					MessageType: mapToOurMessageType(message.Type),
-					Time:        message.Time,
-				}
-				select {
-				case <-ctx.Done():
-					return
-				case messageStream <- privateMessage:
-				}
+			if reason, ok := t.unavailable[channel]; ok {
+				state.Unavailable[channel] = reason
+			} else {
+				state.Channels++
 			}
-		})
-		go func() {
-			defer close(messageStream)
-			select {
-			case <-ctx.Done():
-			case <-clientDone:
-				client.OnPrivateMessage(nil)
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+func (t *IRCTransport) MessageStream(ctx context.Context, messageTypes []uint8) (<-chan *chat.Message, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.started {
+		return nil, errors.New("twitch: irc message stream already started")
+	}
+	t.started = true
+	t.messageTypes = messageTypes
+	messageStream := make(chan *chat.Message)
+	var wg sync.WaitGroup
+	for _, shard := range t.shards {
+		wg.Add(1)
+		go func(shard *ircShard) {
+			defer wg.Done()
+			t.supervise(ctx, shard, messageStream)
+		}(shard)
+	}
+	go func() {
+		wg.Wait()
+		close(messageStream)
+	}()
+	return messageStream, nil
+}
+
+func (t *IRCTransport) Join(_ *chat.User, channel *chat.Channel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.joined[channel.Name]++
+	delete(t.unavailable, channel.Name)
+	shard, ok := t.assigned[channel.Name]
+	if !ok {
+		shard = t.assignLocked(channel.Name)
+	}
+	if shard.client != nil {
+		shard.client.Join(channel.Name)
+	}
+}
+
+func (t *IRCTransport) Depart(_ *chat.User, channel *chat.Channel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.joined[channel.Name] == 0 {
+		return
+	}
+	// another bot user may still need the channel
+	if t.joined[channel.Name]--; t.joined[channel.Name] > 0 {
+		return
+	}
+	delete(t.joined, channel.Name)
+	delete(t.unavailable, channel.Name)
+	if shard, ok := t.assigned[channel.Name]; ok {
+		delete(t.assigned, channel.Name)
+		if shard.client != nil {
+			shard.client.Depart(channel.Name)
+		}
+	}
+	t.rebalanceLocked()
+}
+
+// assignLocked puts the channel on the connection with the fewest channels.
+func (t *IRCTransport) assignLocked(channel string) *ircShard {
+	loads := t.loadsLocked()
+	least := t.shards[0]
+	for _, shard := range t.shards[1:] {
+		if loads[shard] < loads[least] {
+			least = shard
+		}
+	}
+	t.assigned[channel] = least
+	return least
+}
+
+func (t *IRCTransport) loadsLocked() map[*ircShard]int {
+	loads := make(map[*ircShard]int, len(t.shards))
+	for _, shard := range t.assigned {
+		loads[shard]++
+	}
+	return loads
+}
+
+// rebalanceLocked moves channels from the busiest to the idlest connection until they differ by at most one.
+func (t *IRCTransport) rebalanceLocked() {
+	for {
+		loads := t.loadsLocked()
+		busiest, idlest := t.shards[0], t.shards[0]
+		for _, shard := range t.shards {
+			if loads[shard] > loads[busiest] {
+				busiest = shard
+			}
+			if loads[shard] < loads[idlest] {
+				idlest = shard
+			}
+		}
+		if loads[busiest]-loads[idlest] <= 1 {
+			return
+		}
+		channels := make([]string, 0, loads[busiest])
+		for channel, shard := range t.assigned {
+			if shard == busiest {
+				channels = append(channels, channel)
 			}
-		}()
+		}
+		slices.Sort(channels)
+		channel := channels[0]
+		t.assigned[channel] = idlest
+		if busiest.client != nil {
+			busiest.client.Depart(channel)
+		}
+		if _, ok := t.unavailable[channel]; !ok && idlest.client != nil {
+			idlest.client.Join(channel)
+		}
+	}
+}
+
+// wantedChannels asks the supervisor for the channels it wants, or returns nil when nothing supervises the
+// transport. It must be called without holding the lock, since the supervisor takes its own lock to answer.
+func (t *IRCTransport) wantedChannels() []string {
+	t.lock.Lock()
+	wanted := t.wanted
+	t.lock.Unlock()
+	if wanted == nil {
+		return nil
+	}
+	return wanted()
+}
+
+// channelsLocked returns the channels the shard should have joined, leaving out the ones Twitch refused.
+// Wanted channels that no connection owns yet are assigned on the way. A nil wanted falls back to the joined ones.
+func (t *IRCTransport) channelsLocked(shard *ircShard, wanted []string) []string {
+	if wanted == nil {
+		for channel := range t.joined {
+			wanted = append(wanted, channel)
+		}
+	}
+	channels := make([]string, 0)
+	for _, channel := range wanted {
+		if _, ok := t.unavailable[channel]; ok {
+			continue
+		}
+		owner, ok := t.assigned[channel]
+		if !ok {
+			owner = t.assignLocked(channel)
+			if owner != shard && owner.client != nil {
+				owner.client.Join(channel)
+			}
+		}
+		if owner == shard {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// supervise runs one client after another until ctx is done; go-twitch-irc reconnects by itself after RECONNECT
+// and read errors, but gives up when dialing or logging in fails.
+func (t *IRCTransport) supervise(ctx context.Context, shard *ircShard, messageStream chan<- *chat.Message) {
+	backoff := t.minBackoff
+	for ctx.Err() == nil {
+		client := t.newClient()
+		client.SetJoinRateLimiter(t.joinLimiter)
+		t.register(ctx, shard, client, messageStream)
+		wanted := t.wantedChannels()
+		t.lock.Lock()
+		shard.client = client
+		client.Join(t.channelsLocked(shard, wanted)...)
+		t.lock.Unlock()
+
+		stop := context.AfterFunc(ctx, func() { _ = client.Disconnect() })
+		startedAt := time.Now()
+		err := client.Connect()
+		stop()
+		if ctx.Err() != nil {
+			break
+		}
+		if time.Since(startedAt) > t.maxBackoff {
+			backoff = t.minBackoff
+		}
+		t.setState(shard, IRCStateReconnecting, err)
+		sentry.CaptureException(err)
+		log.Err(err).Str(`connection`, shard.state.Name).Dur(`backoff`, backoff).Msg(`twitch irc connection lost, reconnecting`)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, t.maxBackoff)
+	}
+	t.lock.Lock()
+	shard.client = nil
+	t.lock.Unlock()
+	t.setState(shard, IRCStateStopped, nil)
+}
+
+func (t *IRCTransport) setState(shard *ircShard, state string, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	shard.state.State = state
+	shard.state.Since = time.Now()
+	if err != nil {
+		shard.state.LastError = err.Error()
+	}
+}
+
+func (t *IRCTransport) register(ctx context.Context, shard *ircShard, client *twitch.Client, messageStream chan<- *chat.Message) {
+	client.OnConnect(func() {
+		if ctx.Err() != nil {
+			_ = client.Disconnect()
+			return
+		}
+		t.connected(shard, client)
+	})
+	client.OnReconnectMessage(func(message twitch.ReconnectMessage) {
+		log.Info().Str(`connection`, shard.state.Name).Msg(`twitch irc server asked to reconnect`)
+		t.setState(shard, IRCStateReconnecting, nil)
+	})
+	client.OnNoticeMessage(func(message twitch.NoticeMessage) {
+		if !unavailableNotices[message.MsgID] {
+			return
+		}
+		t.channelUnavailable(client, message)
+	})
+	client.OnPrivateMessage(func(message twitch.PrivateMessage) {
+		t.emit(ctx, messageStream, &chat.Message{
+			ID:          message.ID,
+			Username:    message.User.Name,
+			ChannelName: message.Channel,
+			Message:     message.Message,
+			MessageType: mapToOurMessageType(message.Type),
+			Time:        message.Time,
+			Tags:        message.Tags,
+		})
+	})
+	client.OnClearChatMessage(func(message twitch.ClearChatMessage) {
+		// TargetUsername is empty when the whole chat was cleared
+		t.emit(ctx, messageStream, &chat.Message{
+			Username:    message.TargetUsername,
+			ChannelName: message.Channel,
+			MessageType: mapToOurMessageType(message.Type),
+			Time:        message.Time,
+			Tags:        message.Tags,
+		})
+	})
+	client.OnClearMessage(func(message twitch.ClearMessage) {
+		t.emit(ctx, messageStream, &chat.Message{
+			Username:    message.Login,
+			ChannelName: message.Channel,
+			Message:     message.Message,
+			MessageType: mapToOurMessageType(message.Type),
+			Time:        time.Now(),
+			Tags:        message.Tags,
+		})
+	})
+	client.OnRoomStateMessage(func(message twitch.RoomStateMessage) {
+		t.emit(ctx, messageStream, &chat.Message{
+			ChannelName: message.Channel,
+			MessageType: mapToOurMessageType(message.Type),
+			Time:        time.Now(),
+			Tags:        message.Tags,
+		})
+	})
+	client.OnUserNoticeMessage(func(message twitch.UserNoticeMessage) {
+		t.emit(ctx, messageStream, &chat.Message{
+			ID:          message.ID,
+			Username:    message.User.Name,
+			ChannelName: message.Channel,
+			Message:     message.Message,
+			MessageType: mapToOurMessageType(message.Type),
+			Time:        message.Time,
+			Tags:        message.Tags,
+		})
+	})
+}
+
+func (t *IRCTransport) emit(ctx context.Context, messageStream chan<- *chat.Message, message *chat.Message) {
+	if !slices.Contains(t.messageTypes, message.MessageType) {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case messageStream <- message:
+	}
+}
+
+// connected counts reconnects and brings the client's channels in line with the wanted ones; the client
+// itself only rejoins what it had joined before the connection dropped.
+func (t *IRCTransport) connected(shard *ircShard, client *twitch.Client) {
+	wanted := t.wantedChannels()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if shard.connectedOnce {
+		shard.state.Reconnects++
+	}
+	shard.connectedOnce = true
+	shard.state.State = IRCStateConnected
+	shard.state.Since = time.Now()
+	channels := t.channelsLocked(shard, wanted)
+	client.Join(channels...)
+	for channel, owner := range t.assigned {
+		if owner == shard && !slices.Contains(channels, channel) {
+			client.Depart(channel)
+		}
+	}
+}
 
-		return messageStream, nil
+func (t *IRCTransport) channelUnavailable(client *twitch.Client, message twitch.NoticeMessage) {
+	log.Warn().
+		Str(`channel`, message.Channel).
+		Str(`msg_id`, message.MsgID).
+		Str(`message`, message.Message).
+		Msg(`twitch refused the channel`)
+	t.lock.Lock()
+	t.unavailable[message.Channel] = message.MsgID
+	onUnavailable := t.onUnavailable
+	t.lock.Unlock()
+	client.Depart(message.Channel)
+	if onUnavailable != nil {
+		onUnavailable(message.Channel, message.MsgID, message.Message)
 	}
 }
 
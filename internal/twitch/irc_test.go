@@ -0,0 +1,320 @@
+package twitch_test
+
+import (
+	"context"
+	gotwitch "github.com/gempir/go-twitch-irc/v4"
+	"github.com/zain-saqer/twitch-chatgpt/internal/chat"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch/twitchtest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type ircFixture struct {
+	server    *twitchtest.IRCServer
+	transport *twitch.IRCTransport
+	stream    <-chan *chat.Message
+
+	lock        sync.Mutex
+	wanted      []string
+	unavailable []string
+}
+
+func newIRCFixture(t *testing.T, connections int, channels ...string) *ircFixture {
+	t.Helper()
+	server := twitchtest.NewIRCServer()
+	t.Cleanup(server.Close)
+	f := &ircFixture{server: server, wanted: channels}
+	f.transport = twitch.NewIRCTransport(func() *gotwitch.Client {
+		client := gotwitch.NewAnonymousClient()
+		client.IrcAddress = server.Addr()
+		client.TLS = false
+		return client
+	}, connections)
+	twitch.SetIRCBackoff(f.transport, 10*time.Millisecond, 50*time.Millisecond)
+	f.transport.Supervise(f.channels, func(channelName, reason, message string) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.unavailable = append(f.unavailable, channelName+`:`+reason)
+	})
+	for _, channel := range channels {
+		f.transport.Join(&chat.User{}, &chat.Channel{Name: channel})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := f.transport.MessageStream(ctx, []uint8{chat.PrivMsg, chat.ClearChat, chat.ClearMsg, chat.RoomState, chat.UserNotice})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.stream = stream
+	return f
+}
+
+func (f *ircFixture) channels() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return slices.Clone(f.wanted)
+}
+
+func (f *ircFixture) setChannels(channels ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.wanted = channels
+}
+
+func (f *ircFixture) unavailableChannels() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return slices.Clone(f.unavailable)
+}
+
+func (f *ircFixture) waitForConnection(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := f.server.WaitForConnection(ctx); err != nil {
+		t.Fatal(`no irc connection was opened`)
+	}
+}
+
+func (f *ircFixture) waitForChannels(t *testing.T, channels ...string) {
+	t.Helper()
+	slices.Sort(channels)
+	var joined []string
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		joined = f.server.Channels()
+		slices.Sort(joined)
+		if slices.Equal(joined, channels) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected channels %v to be joined, got %v", channels, joined)
+}
+
+func (f *ircFixture) waitForState(t *testing.T, state string, reconnects int) chat.ConnectionState {
+	t.Helper()
+	var connection chat.ConnectionState
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		connection = f.transport.Connections()[0]
+		if connection.State == state && connection.Reconnects == reconnects {
+			return connection
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected state %s with %d reconnects, got %+v", state, reconnects, connection)
+	return connection
+}
+
+func TestIRCTransportConnectsWhileSupervisorJoins(t *testing.T) {
+	transport := twitch.NewIRCTransport(gotwitch.NewAnonymousClient, 2)
+	var lock sync.Mutex
+	asked := make(chan struct{}, 1)
+	transport.Supervise(func() []string {
+		select {
+		case asked <- struct{}{}:
+		default:
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		return []string{`streamer`}
+	}, nil)
+
+	// a connection comes up while the supervisor joins a channel under its own lock
+	lock.Lock()
+	connected := make(chan struct{})
+	go func() {
+		defer close(connected)
+		twitch.FireIRCConnected(transport)
+	}()
+	<-asked
+	joined := make(chan struct{})
+	go func() {
+		defer close(joined)
+		transport.Join(&chat.User{}, &chat.Channel{Name: `streamer`})
+	}()
+	select {
+	case <-joined:
+	case <-time.After(2 * time.Second):
+		t.Fatal(`joining deadlocked with the connection asking for channels`)
+	}
+	lock.Unlock()
+	<-connected
+}
+
+func TestIRCTransportDeliversMessages(t *testing.T) {
+	f := newIRCFixture(t, 1, `streamer`)
+	f.waitForConnection(t)
+	f.waitForChannels(t, `streamer`)
+	f.waitForState(t, twitch.IRCStateConnected, 0)
+
+	f.server.SendPrivateMessage(`streamer`, `viewer`, `!!!hello`)
+	select {
+	case message := <-f.stream:
+		if message.Username != `viewer` || message.ChannelName != `streamer` || message.Message != `!!!hello` || message.MessageType != chat.PrivMsg {
+			t.Fatalf("unexpected message %+v", message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal(`no message received`)
+	}
+}
+
+func TestIRCTransportRejoinsWantedChannelsAfterReconnectMessage(t *testing.T) {
+	f := newIRCFixture(t, 1, `streamer`)
+	f.waitForConnection(t)
+	f.waitForChannels(t, `streamer`)
+
+	// channels added and removed elsewhere are picked up from the channel source on reconnect
+	f.setChannels(`streamer`, `other`)
+	f.server.SendReconnect()
+	f.waitForConnection(t)
+	f.waitForChannels(t, `streamer`, `other`)
+	f.waitForState(t, twitch.IRCStateConnected, 1)
+}
+
+func TestIRCTransportRedialsWithBackoff(t *testing.T) {
+	f := newIRCFixture(t, 1, `streamer`)
+	f.waitForConnection(t)
+	f.waitForChannels(t, `streamer`)
+
+	f.server.Stop()
+	connection := f.waitForState(t, twitch.IRCStateReconnecting, 0)
+	if connection.LastError == `` {
+		t.Fatal(`expected the dial error to be reported`)
+	}
+	if err := f.server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.waitForConnection(t)
+	f.waitForChannels(t, `streamer`)
+	f.waitForState(t, twitch.IRCStateConnected, 1)
+}
+
+func TestIRCTransportStopsJoiningSuspendedChannels(t *testing.T) {
+	f := newIRCFixture(t, 1)
+	f.server.SuspendChannel(`banned`, `msg_channel_suspended`)
+	f.setChannels(`streamer`, `banned`)
+	f.transport.Join(&chat.User{}, &chat.Channel{Name: `streamer`})
+	f.transport.Join(&chat.User{}, &chat.Channel{Name: `banned`})
+	f.waitForConnection(t)
+	f.waitForChannels(t, `streamer`)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(f.unavailableChannels()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := f.unavailableChannels(); !slices.Equal(got, []string{`banned:msg_channel_suspended`}) {
+		t.Fatalf("expected the suspension to be reported, got %v", got)
+	}
+	if reason := f.transport.Connections()[0].Unavailable[`banned`]; reason != `msg_channel_suspended` {
+		t.Fatalf("expected the channel to be reported as unavailable, got %q", reason)
+	}
+
+	f.server.SendReconnect()
+	f.waitForConnection(t)
+	f.waitForState(t, twitch.IRCStateConnected, 1)
+	f.waitForChannels(t, `streamer`)
+	time.Sleep(50 * time.Millisecond)
+	if got := f.unavailableChannels(); len(got) != 1 {
+		t.Fatalf("expected the suspended channel not to be joined again, got %v", got)
+	}
+}
+
+func TestIRCTransportShardsChannelsAcrossConnections(t *testing.T) {
+	channels := []string{`a`, `b`, `c`, `d`, `e`, `f`}
+	f := newIRCFixture(t, 3, channels...)
+	for i := 0; i < 3; i++ {
+		f.waitForConnection(t)
+	}
+	f.waitForChannels(t, channels...)
+	for _, connection := range f.transport.Connections() {
+		if connection.Channels != 2 {
+			t.Fatalf("expected channels to be spread evenly, got %+v", f.transport.Connections())
+		}
+	}
+	perConnection := f.server.ChannelsByConnection()
+	if len(perConnection) != 3 {
+		t.Fatalf("expected 3 connections, got %v", perConnection)
+	}
+
+	// empty one connection so that the rest has to be rebalanced onto it
+	var drained []string
+	for _, joined := range perConnection {
+		drained = joined
+		break
+	}
+	for _, channel := range drained {
+		f.transport.Depart(&chat.User{}, &chat.Channel{Name: channel})
+	}
+	remaining := slices.DeleteFunc(slices.Clone(channels), func(channel string) bool { return slices.Contains(drained, channel) })
+	f.setChannels(remaining...)
+	f.waitForChannels(t, remaining...)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		loads := make([]int, 0)
+		for _, joined := range f.server.ChannelsByConnection() {
+			loads = append(loads, len(joined))
+		}
+		for len(loads) < 3 {
+			loads = append(loads, 0)
+		}
+		if slices.Max(loads)-slices.Min(loads) <= 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected connections to be rebalanced, got %v", f.server.ChannelsByConnection())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	seen := map[string]bool{}
+	for _, channel := range remaining {
+		f.server.SendPrivateMessage(channel, `viewer`, `!!!hello `+channel)
+	}
+	for range remaining {
+		select {
+		case message := <-f.stream:
+			seen[message.ChannelName] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected messages from every connection, got %v", seen)
+		}
+	}
+	if len(seen) != len(remaining) {
+		t.Fatalf("expected one message per channel, got %v", seen)
+	}
+}
+
+func TestIRCTransportDeliversChatEvents(t *testing.T) {
+	f := newIRCFixture(t, 1, `streamer`)
+	f.waitForConnection(t)
+	f.waitForChannels(t, `streamer`)
+
+	f.server.Broadcast(`@ban-duration=600;room-id=2;target-user-id=3;tmi-sent-ts=1700000000000 :tmi.twitch.tv CLEARCHAT #streamer :viewer`)
+	f.server.Broadcast(`@login=viewer;room-id=;target-msg-id=q1;tmi-sent-ts=1700000000000 :tmi.twitch.tv CLEARMSG #streamer :!!!question`)
+	f.server.Broadcast(`@emote-only=1;followers-only=-1;r9k=0;room-id=2;slow=30;subs-only=0 :tmi.twitch.tv ROOMSTATE #streamer`)
+	f.server.Broadcast(`@id=n1;login=raider;msg-id=raid;msg-param-viewerCount=42;display-name=raider;tmi-sent-ts=1700000000000 :tmi.twitch.tv USERNOTICE #streamer`)
+	expected := []struct {
+		messageType uint8
+		username    string
+		tag, value  string
+	}{
+		{chat.ClearChat, `viewer`, `ban-duration`, `600`},
+		{chat.ClearMsg, `viewer`, `target-msg-id`, `q1`},
+		{chat.RoomState, ``, `slow`, `30`},
+		{chat.UserNotice, `raider`, `msg-param-viewerCount`, `42`},
+	}
+	for _, want := range expected {
+		select {
+		case message := <-f.stream:
+			if message.MessageType != want.messageType || message.Username != want.username || message.ChannelName != `streamer` || message.Tags[want.tag] != want.value {
+				t.Fatalf("unexpected message %+v, wanted %+v", message, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no message of type %d received", want.messageType)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package twitch
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	chatWindow         = 30 * time.Second
+	chatLimit          = 20
+	chatModeratorLimit = 100
+)
+
+type bucket struct {
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+// RateLimiter queues Helix calls so they stay within the per-token buckets Twitch reports and the per-user chat limits.
+type RateLimiter struct {
+	lock       sync.Mutex
+	buckets    map[string]*bucket
+	sent       map[string][]time.Time
+	moderators map[string]map[string]bool
+
+	chatWindow         time.Duration
+	chatLimit          int
+	chatModeratorLimit int
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets:            make(map[string]*bucket),
+		sent:               make(map[string][]time.Time),
+		moderators:         make(map[string]map[string]bool),
+		chatWindow:         chatWindow,
+		chatLimit:          chatLimit,
+		chatModeratorLimit: chatModeratorLimit,
+	}
+}
+
+// Wait blocks until the token's bucket has a point left, then takes it.
+func (l *RateLimiter) Wait(ctx context.Context, accessToken string) error {
+	for {
+		l.lock.Lock()
+		b, ok := l.buckets[accessToken]
+		now := time.Now()
+		if !ok || b.remaining > 0 || !now.Before(b.reset) {
+			if ok {
+				if !now.Before(b.reset) {
+					b.remaining = b.limit
+				}
+				b.remaining--
+			}
+			l.lock.Unlock()
+			return nil
+		}
+		wait := b.reset.Sub(now)
+		l.lock.Unlock()
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// Update records the bucket state from the Ratelimit-* headers of a Helix response.
+func (l *RateLimiter) Update(accessToken string, header http.Header) {
+	limit, err := strconv.Atoi(header.Get("Ratelimit-Limit"))
+	if err != nil {
+		return
+	}
+	remaining, err := strconv.Atoi(header.Get("Ratelimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("Ratelimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.buckets[accessToken] = &bucket{limit: limit, remaining: remaining, reset: time.Unix(reset, 0)}
+}
+
+// RetryAfter is how long to wait before retrying a 429 response.
+func (l *RateLimiter) RetryAfter(accessToken string) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.buckets[accessToken]
+	if !ok {
+		return time.Second
+	}
+	wait := time.Until(b.reset)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// SetModerator records whether the sender is a moderator (or the broadcaster) in the channel, which raises its chat limit.
+func (l *RateLimiter) SetModerator(senderId, broadcasterId string, isModerator bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.moderators[senderId] == nil {
+		l.moderators[senderId] = make(map[string]bool)
+	}
+	l.moderators[senderId][broadcasterId] = isModerator
+}
+
+func (l *RateLimiter) ResetModerator(senderId string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.moderators, senderId)
+}
+
+func (l *RateLimiter) IsModerator(senderId, broadcasterId string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.isModerator(senderId, broadcasterId)
+}
+
+func (l *RateLimiter) isModerator(senderId, broadcasterId string) bool {
+	return senderId == broadcasterId || l.moderators[senderId][broadcasterId]
+}
+
+// WaitChat blocks until the sender may post another chat message in the channel, then records the message.
+func (l *RateLimiter) WaitChat(ctx context.Context, senderId, broadcasterId string) error {
+	for {
+		l.lock.Lock()
+		limit := l.chatLimit
+		if l.isModerator(senderId, broadcasterId) {
+			limit = l.chatModeratorLimit
+		}
+		now := time.Now()
+		sent := l.sent[senderId]
+		for len(sent) > 0 && now.Sub(sent[0]) >= l.chatWindow {
+			sent = sent[1:]
+		}
+		if len(sent) < limit {
+			l.sent[senderId] = append(sent, now)
+			l.lock.Unlock()
+			return nil
+		}
+		l.sent[senderId] = sent
+		wait := l.chatWindow - now.Sub(sent[len(sent)-limit])
+		l.lock.Unlock()
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
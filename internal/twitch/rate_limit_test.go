@@ -0,0 +1,78 @@
+package twitch
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWaitChat(t *testing.T) {
+	limiter := NewRateLimiter()
+	limiter.chatWindow = 100 * time.Millisecond
+	limiter.chatLimit = 2
+	limiter.chatModeratorLimit = 4
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := limiter.WaitChat(context.Background(), `bot`, `channel`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("expected sends within the limit not to wait, took %s", elapsed)
+	}
+	if err := limiter.WaitChat(context.Background(), `bot`, `channel`); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("expected the third send to wait for the window, took %s", elapsed)
+	}
+}
+
+func TestRateLimiterWaitChatModerator(t *testing.T) {
+	limiter := NewRateLimiter()
+	limiter.chatWindow = time.Hour
+	limiter.chatLimit = 1
+	limiter.chatModeratorLimit = 3
+	limiter.SetModerator(`bot`, `modded`, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if err := limiter.WaitChat(ctx, `bot`, `modded`); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	if err := limiter.WaitChat(ctx, `bot`, `other`); err == nil {
+		t.Fatal(`expected the non-moderator channel to be over its limit`)
+	}
+	if !limiter.IsModerator(`bot`, `bot`) {
+		t.Fatal(`expected the broadcaster to count as a moderator in its own channel`)
+	}
+}
+
+func TestRateLimiterWaitsForBucketReset(t *testing.T) {
+	limiter := NewRateLimiter()
+	header := http.Header{}
+	header.Set("Ratelimit-Limit", "800")
+	header.Set("Ratelimit-Remaining", "0")
+	header.Set("Ratelimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	limiter.Update(`token`, header)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx, `token`); err == nil {
+		t.Fatal(`expected the exhausted bucket to block`)
+	}
+	if err := limiter.Wait(context.Background(), `other-token`); err != nil {
+		t.Fatal(err)
+	}
+
+	header.Set("Ratelimit-Reset", strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10))
+	limiter.Update(`token`, header)
+	if err := limiter.Wait(context.Background(), `token`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,47 @@
+package twitch
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type Stream struct {
+	ID        string    `json:"id"`
+	UserId    string    `json:"user_id"`
+	UserLogin string    `json:"user_login"`
+	Type      string    `json:"type"`
+	Title     string    `json:"title"`
+	GameName  string    `json:"game_name"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// GetStreams returns the streams of the broadcasters that are live; offline broadcasters are left out.
+func (api *API) GetStreams(ctx context.Context, accessToken string, broadcasterIds []string) ([]*Stream, error) {
+	endpointUrl, err := url.ParseRequestURI(api.endpoints.Helix + "/streams")
+	if err != nil {
+		return nil, err
+	}
+	q := endpointUrl.Query()
+	for _, id := range broadcasterIds {
+		q.Add("user_id", id)
+	}
+	q.Set("first", "100")
+	endpointUrl.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", endpointUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := api.doHelix(ctx, req, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	var streams struct {
+		Data []*Stream `json:"data"`
+	}
+	if err := decodeHelixResponse(resp, &streams); err != nil {
+		return nil, err
+	}
+	return streams.Data, nil
+}
@@ -0,0 +1,32 @@
+package twitch_test
+
+import (
+	"context"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch/twitchtest"
+	"testing"
+)
+
+func TestGetStreamsReturnsOnlyLiveBroadcasters(t *testing.T) {
+	helix := twitchtest.NewServer()
+	defer helix.Close()
+	accessToken, _ := helix.AddUser(`1`, `bot`)
+	helix.AddUser(`2`, `live`)
+	helix.AddUser(`3`, `offline`)
+	helix.SetLive(`2`, true)
+
+	streams, err := helix.API().GetStreams(context.Background(), accessToken, []string{`2`, `3`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || streams[0].UserId != `2` || streams[0].UserLogin != `live` || streams[0].StartedAt.IsZero() {
+		t.Fatalf("unexpected streams %+v", streams)
+	}
+	helix.SetLive(`2`, false)
+	streams, err = helix.API().GetStreams(context.Background(), accessToken, []string{`2`, `3`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 0 {
+		t.Fatalf("expected no live streams, got %+v", streams)
+	}
+}
@@ -0,0 +1,151 @@
+package twitchtest
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventSubServer is a local stand-in for wss://eventsub.wss.twitch.tv/ws.
+type EventSubServer struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	keepalive time.Duration
+	sessions  map[string]*websocket.Conn
+	connected chan string
+	counter   int
+}
+
+func NewEventSubServer() *EventSubServer {
+	s := &EventSubServer{
+		keepalive: 10 * time.Second,
+		sessions:  make(map[string]*websocket.Conn),
+		connected: make(chan string, 100),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// SetKeepaliveTimeout changes the keepalive_timeout_seconds announced to new sessions; no keepalives are actually sent.
+func (s *EventSubServer) SetKeepaliveTimeout(keepalive time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keepalive = keepalive
+}
+
+// WebSocketURL returns the URL clients connect to.
+func (s *EventSubServer) WebSocketURL() string {
+	return "ws" + strings.TrimPrefix(s.Server.URL, "http")
+}
+
+var upgrader = websocket.Upgrader{}
+
+func (s *EventSubServer) handle(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.counter++
+	sessionId := fmt.Sprintf("session-%d", s.counter)
+	s.sessions[sessionId] = conn
+	keepalive := int(s.keepalive.Seconds())
+	s.lock.Unlock()
+	_ = s.write(sessionId, "session_welcome", map[string]any{"session": map[string]any{
+		"id":                        sessionId,
+		"status":                    "connected",
+		"keepalive_timeout_seconds": keepalive,
+		"reconnect_url":             nil,
+	}}, nil)
+	s.connected <- sessionId
+	// drain until the client goes away
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			s.lock.Lock()
+			if s.sessions[sessionId] == conn {
+				delete(s.sessions, sessionId)
+			}
+			s.lock.Unlock()
+			return
+		}
+	}
+}
+
+// WaitForSession returns the id of the next session that received its welcome message.
+func (s *EventSubServer) WaitForSession(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case id := <-s.connected:
+		return id, nil
+	}
+}
+
+func (s *EventSubServer) write(sessionId, messageType string, payload any, extraMetadata map[string]string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	conn, ok := s.sessions[sessionId]
+	if !ok {
+		return fmt.Errorf("twitchtest: unknown session %s", sessionId)
+	}
+	s.counter++
+	metadata := map[string]string{
+		"message_id":        fmt.Sprintf("message-%d", s.counter),
+		"message_type":      messageType,
+		"message_timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	for k, v := range extraMetadata {
+		metadata[k] = v
+	}
+	return conn.WriteJSON(map[string]any{"metadata": metadata, "payload": payload})
+}
+
+func (s *EventSubServer) SendKeepalive(sessionId string) error {
+	return s.write(sessionId, "session_keepalive", map[string]any{}, nil)
+}
+
+// SendNotification delivers an event; messageId may be set to test deduplication.
+func (s *EventSubServer) SendNotification(sessionId, messageId, subscriptionType string, subscription map[string]any, event any) error {
+	metadata := map[string]string{"subscription_type": subscriptionType, "subscription_version": "1"}
+	if messageId != "" {
+		metadata["message_id"] = messageId
+	}
+	return s.write(sessionId, "notification", map[string]any{"subscription": subscription, "event": event}, metadata)
+}
+
+func (s *EventSubServer) SendRevocation(sessionId, subscriptionId, subscriptionType, status string) error {
+	return s.write(sessionId, "revocation", map[string]any{"subscription": map[string]any{
+		"id":        subscriptionId,
+		"status":    status,
+		"type":      subscriptionType,
+		"version":   "1",
+		"condition": map[string]string{},
+		"transport": map[string]string{"method": "websocket", "session_id": sessionId},
+	}}, map[string]string{"subscription_type": subscriptionType, "subscription_version": "1"})
+}
+
+// SendReconnect asks the client to move to a new connection on the same server.
+func (s *EventSubServer) SendReconnect(sessionId string) error {
+	return s.write(sessionId, "session_reconnect", map[string]any{"session": map[string]any{
+		"id":                        sessionId,
+		"status":                    "reconnecting",
+		"keepalive_timeout_seconds": nil,
+		"reconnect_url":             s.WebSocketURL() + "?reconnect=" + sessionId,
+	}}, nil)
+}
+
+// CloseSession drops the connection without a close handshake.
+func (s *EventSubServer) CloseSession(sessionId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if conn, ok := s.sessions[sessionId]; ok {
+		conn.Close()
+		delete(s.sessions, sessionId)
+	}
+}
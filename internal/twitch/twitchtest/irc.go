@@ -0,0 +1,228 @@
+package twitchtest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// IRCServer is a plain-text stand-in for irc.chat.twitch.tv; clients connect with TLS disabled.
+type IRCServer struct {
+	addr string
+
+	lock      sync.Mutex
+	listener  net.Listener
+	conns     map[net.Conn]*ircConn
+	suspended map[string]string
+	connected chan string
+	counter   int
+}
+
+type ircConn struct {
+	id       string
+	nick     string
+	channels map[string]bool
+}
+
+func NewIRCServer() *IRCServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("twitchtest: failed to listen: %v", err))
+	}
+	s := &IRCServer{
+		addr:      listener.Addr().String(),
+		conns:     make(map[net.Conn]*ircConn),
+		suspended: make(map[string]string),
+		connected: make(chan string, 100),
+	}
+	s.serve(listener)
+	return s
+}
+
+// Addr is the address to put in twitch.Client.IrcAddress.
+func (s *IRCServer) Addr() string {
+	return s.addr
+}
+
+func (s *IRCServer) serve(listener net.Listener) {
+	s.lock.Lock()
+	s.listener = listener
+	s.lock.Unlock()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+}
+
+// Stop closes the listener and every connection so that clients fail to dial until Start is called.
+func (s *IRCServer) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// Start listens again on the original address after Stop.
+func (s *IRCServer) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.serve(listener)
+	return nil
+}
+
+func (s *IRCServer) Close() {
+	s.Stop()
+}
+
+// SuspendChannel makes joins to the channel answer with the given NOTICE msg-id, e.g. msg_channel_suspended.
+func (s *IRCServer) SuspendChannel(channel, msgId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.suspended[channel] = msgId
+}
+
+func (s *IRCServer) handle(conn net.Conn) {
+	s.lock.Lock()
+	if s.listener == nil {
+		s.lock.Unlock()
+		conn.Close()
+		return
+	}
+	s.counter++
+	c := &ircConn{id: fmt.Sprintf("conn-%d", s.counter), channels: make(map[string]bool)}
+	s.conns[conn] = c
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command, rest, _ := strings.Cut(line, " ")
+		switch command {
+		case "NICK":
+			s.lock.Lock()
+			c.nick = rest
+			s.lock.Unlock()
+			s.write(conn, fmt.Sprintf(":tmi.twitch.tv 001 %s :Welcome, GLHF!", rest))
+			s.connected <- c.id
+		case "PING":
+			s.write(conn, "PONG "+rest)
+		case "JOIN":
+			for _, channel := range strings.Split(rest, ",") {
+				channel = strings.TrimPrefix(strings.TrimSpace(channel), "#")
+				if channel == "" {
+					continue
+				}
+				s.lock.Lock()
+				msgId, suspended := s.suspended[channel]
+				if !suspended {
+					c.channels[channel] = true
+				}
+				nick := c.nick
+				s.lock.Unlock()
+				if suspended {
+					s.write(conn, fmt.Sprintf("@msg-id=%s :tmi.twitch.tv NOTICE #%s :This channel has been suspended.", msgId, channel))
+				} else {
+					s.write(conn, fmt.Sprintf(":%s!%s@%s.tmi.twitch.tv JOIN #%s", nick, nick, nick, channel))
+				}
+			}
+		case "PART":
+			channel := strings.TrimPrefix(strings.TrimSpace(rest), "#")
+			s.lock.Lock()
+			delete(c.channels, channel)
+			s.lock.Unlock()
+		}
+	}
+}
+
+func (s *IRCServer) write(conn net.Conn, line string) {
+	_, _ = conn.Write([]byte(line + "\r\n"))
+}
+
+// WaitForConnection returns the id of the next connection that completed registration.
+func (s *IRCServer) WaitForConnection(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case id := <-s.connected:
+		return id, nil
+	}
+}
+
+// Channels returns the channels joined on all open connections.
+func (s *IRCServer) Channels() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	channels := make([]string, 0)
+	for _, c := range s.conns {
+		for channel := range c.channels {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// ChannelsByConnection returns the channels joined per open connection, leaving out connections without channels.
+func (s *IRCServer) ChannelsByConnection() map[string][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	channels := make(map[string][]string)
+	for _, c := range s.conns {
+		for channel := range c.channels {
+			channels[c.id] = append(channels[c.id], channel)
+		}
+	}
+	return channels
+}
+
+// Broadcast writes a raw line to every open connection.
+func (s *IRCServer) Broadcast(line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		s.write(conn, line)
+	}
+}
+
+// SendPrivateMessage delivers a chat line to the connections that joined the channel.
+func (s *IRCServer) SendPrivateMessage(channel, username, text string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.counter++
+	line := fmt.Sprintf("@id=msg-%d;display-name=%s;tmi-sent-ts=0 :%s!%s@%s.tmi.twitch.tv PRIVMSG #%s :%s", s.counter, username, username, username, username, channel, text)
+	for conn, c := range s.conns {
+		if c.channels[channel] {
+			s.write(conn, line)
+		}
+	}
+}
+
+// SendReconnect asks every client to reconnect, as Twitch does before restarting a chat server.
+func (s *IRCServer) SendReconnect() {
+	s.Broadcast(":tmi.twitch.tv RECONNECT")
+}
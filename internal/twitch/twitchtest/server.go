@@ -0,0 +1,746 @@
+// Package twitchtest provides an in-process fake of the Twitch Helix and OAuth2 endpoints for tests.
+package twitchtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/zain-saqer/twitch-chatgpt/internal/twitch"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EndpointUsers       = "/helix/users"
+	EndpointSendMessage = "/helix/chat/messages"
+	EndpointToken       = "/oauth2/token"
+	EndpointValidate    = "/oauth2/validate"
+	EndpointModerated   = "/helix/moderation/channels"
+	EndpointEventSub    = "/helix/eventsub/subscriptions"
+	EndpointDeleteChat  = "/helix/moderation/chat"
+	EndpointRewards     = "/helix/channel_points/custom_rewards"
+	EndpointRedemptions = "/helix/channel_points/custom_rewards/redemptions"
+	EndpointStreams     = "/helix/streams"
+)
+
+// Failure is a scripted response returned instead of the normal one.
+type Failure struct {
+	Status int
+	// RetryAfter sets the Ratelimit-Reset header on 429 responses.
+	RetryAfter time.Duration
+	// DropCode and DropMessage make a send-chat-message call succeed with is_sent=false.
+	DropCode    string
+	DropMessage string
+}
+
+func Unauthorized() Failure {
+	return Failure{Status: http.StatusUnauthorized}
+}
+
+func RateLimited(retryAfter time.Duration) Failure {
+	return Failure{Status: http.StatusTooManyRequests, RetryAfter: retryAfter}
+}
+
+func Dropped(code, message string) Failure {
+	return Failure{Status: http.StatusOK, DropCode: code, DropMessage: message}
+}
+
+type SentMessage struct {
+	BroadcasterId string
+	SenderId      string
+	Message       string
+	AccessToken   string
+}
+
+type user struct {
+	twitch.User
+	scopes []string
+}
+
+type Server struct {
+	*httptest.Server
+	ClientId     string
+	ClientSecret string
+	TokenTTL     time.Duration
+	// RateLimit is the number of Helix points per token per minute reported in the Ratelimit-* headers.
+	RateLimit int
+
+	lock          sync.Mutex
+	users         map[string]*user
+	accessTokens  map[string]string
+	refreshTokens map[string]string
+	failures      map[string][]Failure
+	messages      []SentMessage
+	calls         map[string]int
+	tokenCounter  int
+	moderators    map[string][]string
+	buckets       map[string]*bucket
+	subscriptions map[string]*twitch.EventSubSubscription
+	deleted       []string
+	deletedChat   []string
+	rewards       map[string]*reward
+	redemptions   map[string]string
+	live          map[string]time.Time
+	streamInfo    map[string][2]string
+}
+
+type reward struct {
+	twitch.CustomReward
+	broadcasterId string
+}
+
+type bucket struct {
+	remaining int
+	reset     time.Time
+}
+
+func NewServer() *Server {
+	s := &Server{
+		ClientId:      "test-client-id",
+		ClientSecret:  "test-client-secret",
+		TokenTTL:      4 * time.Hour,
+		RateLimit:     800,
+		users:         make(map[string]*user),
+		accessTokens:  make(map[string]string),
+		refreshTokens: make(map[string]string),
+		failures:      make(map[string][]Failure),
+		calls:         make(map[string]int),
+		moderators:    make(map[string][]string),
+		buckets:       make(map[string]*bucket),
+		subscriptions: make(map[string]*twitch.EventSubSubscription),
+		rewards:       make(map[string]*reward),
+		redemptions:   make(map[string]string),
+		live:          make(map[string]time.Time),
+		streamInfo:    make(map[string][2]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(EndpointUsers, method(http.MethodGet, s.handleUsers))
+	mux.HandleFunc(EndpointSendMessage, method(http.MethodPost, s.handleSendMessage))
+	mux.HandleFunc(EndpointToken, method(http.MethodPost, s.handleToken))
+	mux.HandleFunc(EndpointValidate, method(http.MethodGet, s.handleValidate))
+	mux.HandleFunc(EndpointModerated, method(http.MethodGet, s.handleModeratedChannels))
+	mux.HandleFunc(EndpointEventSub, s.handleEventSub)
+	mux.HandleFunc(EndpointDeleteChat, method(http.MethodDelete, s.handleDeleteChat))
+	mux.HandleFunc(EndpointRewards, s.handleRewards)
+	mux.HandleFunc(EndpointRedemptions, method(http.MethodPatch, s.handleRedemptions))
+	mux.HandleFunc(EndpointStreams, method(http.MethodGet, s.handleStreams))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *Server) Endpoints() twitch.Endpoints {
+	return twitch.Endpoints{Helix: s.URL + "/helix", OAuth2: s.URL + "/oauth2"}
+}
+
+// API returns a client configured with the server's credentials and endpoints.
+func (s *Server) API() *twitch.API {
+	return twitch.NewApiWithEndpoints(s.ClientId, s.ClientSecret, s.Client(), s.Endpoints())
+}
+
+// AddUser registers a Twitch user and issues it a token pair.
+func (s *Server) AddUser(id, login string, scopes ...string) (accessToken, refreshToken string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users[id] = &user{User: twitch.User{ID: id, Login: login, DisplayName: login}, scopes: scopes}
+	return s.issueTokens(id)
+}
+
+func (s *Server) issueTokens(userId string) (accessToken, refreshToken string) {
+	s.tokenCounter++
+	accessToken = fmt.Sprintf("access-%s-%d", userId, s.tokenCounter)
+	refreshToken = fmt.Sprintf("refresh-%s-%d", userId, s.tokenCounter)
+	s.accessTokens[accessToken] = userId
+	s.refreshTokens[refreshToken] = userId
+	return accessToken, refreshToken
+}
+
+// ExpireAccessToken makes Helix reject the token with a 401.
+func (s *Server) ExpireAccessToken(accessToken string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.accessTokens, accessToken)
+}
+
+// RevokeRefreshToken makes the token endpoint reject the refresh token with a 400.
+func (s *Server) RevokeRefreshToken(refreshToken string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.refreshTokens, refreshToken)
+}
+
+// AddModerator makes the user a moderator in the broadcaster's channel.
+func (s *Server) AddModerator(userId, broadcasterId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.moderators[userId] = append(s.moderators[userId], broadcasterId)
+}
+
+// AddSubscription registers a subscription as if it had been created by an earlier run.
+func (s *Server) AddSubscription(subscription *twitch.EventSubSubscription) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokenCounter++
+	copied := *subscription
+	copied.ID = fmt.Sprintf("subscription-%d", s.tokenCounter)
+	copied.Status = "enabled"
+	copied.CreatedAt = time.Now()
+	s.subscriptions[copied.ID] = &copied
+	return copied.ID
+}
+
+// DeletedChatMessages returns the ids of chat messages deleted through the API.
+func (s *Server) DeletedChatMessages() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.deletedChat...)
+}
+
+// Rewards returns the custom rewards that exist, keyed by id.
+func (s *Server) Rewards() map[string]twitch.CustomReward {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rewards := make(map[string]twitch.CustomReward, len(s.rewards))
+	for id, r := range s.rewards {
+		rewards[id] = r.CustomReward
+	}
+	return rewards
+}
+
+// RedemptionStatus returns the status a redemption was last set to, or "" if it never was.
+func (s *Server) RedemptionStatus(redemptionId string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.redemptions[redemptionId]
+}
+
+// SetLive starts or ends the user's stream.
+func (s *Server) SetLive(userId string, live bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if live {
+		s.live[userId] = time.Now()
+	} else {
+		delete(s.live, userId)
+	}
+}
+
+// SetStreamInfo sets the title and game the user's stream reports while live.
+func (s *Server) SetStreamInfo(userId, title, game string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.streamInfo[userId] = [2]string{title, game}
+}
+
+// Subscriptions returns the active EventSub subscriptions.
+func (s *Server) Subscriptions() []*twitch.EventSubSubscription {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	subscriptions := make([]*twitch.EventSubSubscription, 0, len(s.subscriptions))
+	for _, subscription := range s.subscriptions {
+		copied := *subscription
+		subscriptions = append(subscriptions, &copied)
+	}
+	return subscriptions
+}
+
+// DeletedSubscriptions returns the ids of subscriptions deleted through the API.
+func (s *Server) DeletedSubscriptions() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.deleted...)
+}
+
+// FailNext queues failures returned by the next calls to the endpoint, in order.
+func (s *Server) FailNext(endpoint string, failures ...Failure) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures[endpoint] = append(s.failures[endpoint], failures...)
+}
+
+func (s *Server) Messages() []SentMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]SentMessage(nil), s.messages...)
+}
+
+// Calls returns how many requests the endpoint received, including failed ones.
+func (s *Server) Calls(endpoint string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls[endpoint]
+}
+
+func (s *Server) begin(endpoint string) (Failure, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calls[endpoint]++
+	queue := s.failures[endpoint]
+	if len(queue) == 0 {
+		return Failure{}, false
+	}
+	s.failures[endpoint] = queue[1:]
+	return queue[0], true
+}
+
+func (s *Server) writeFailure(w http.ResponseWriter, failure Failure) {
+	if failure.Status == http.StatusTooManyRequests {
+		w.Header().Set("Ratelimit-Limit", "800")
+		w.Header().Set("Ratelimit-Remaining", "0")
+		w.Header().Set("Ratelimit-Reset", strconv.FormatInt(time.Now().Add(failure.RetryAfter).Unix(), 10))
+	}
+	writeError(w, failure.Status, http.StatusText(failure.Status))
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) (*user, bool) {
+	if r.Header.Get("Client-Id") != s.ClientId {
+		writeError(w, http.StatusUnauthorized, "Client ID and OAuth token do not match")
+		return nil, false
+	}
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	userId, ok := s.accessTokens[accessToken]
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Invalid OAuth token")
+		return nil, false
+	}
+	b, ok := s.buckets[accessToken]
+	if !ok || !time.Now().Before(b.reset) {
+		b = &bucket{remaining: s.RateLimit, reset: time.Now().Add(time.Minute)}
+		s.buckets[accessToken] = b
+	}
+	if b.remaining > 0 {
+		b.remaining--
+	}
+	w.Header().Set("Ratelimit-Limit", strconv.Itoa(s.RateLimit))
+	w.Header().Set("Ratelimit-Remaining", strconv.Itoa(b.remaining))
+	w.Header().Set("Ratelimit-Reset", strconv.FormatInt(b.reset.Unix(), 10))
+	return s.users[userId], true
+}
+
+// authorizeUser rejects app access tokens for endpoints that act on behalf of a user.
+func (s *Server) authorizeUser(w http.ResponseWriter, r *http.Request) (*user, bool) {
+	u, ok := s.authorize(w, r)
+	if ok && u == nil {
+		writeError(w, http.StatusUnauthorized, "User access token required")
+		return nil, false
+	}
+	return u, ok
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointUsers); ok {
+		s.writeFailure(w, failure)
+		return
+	}
+	current, ok := s.authorizeUser(w, r)
+	if !ok {
+		return
+	}
+	data := make([]twitch.User, 0)
+	login := r.URL.Query().Get("login")
+	s.lock.Lock()
+	if login == "" {
+		data = append(data, current.User)
+	}
+	for _, u := range s.users {
+		if login != "" && u.Login == login {
+			data = append(data, u.User)
+		}
+	}
+	s.lock.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"data": data})
+}
+
+func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	failure, failed := s.begin(EndpointSendMessage)
+	if failed && failure.DropCode == "" {
+		s.writeFailure(w, failure)
+		return
+	}
+	sender, ok := s.authorizeUser(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		BroadcasterId string `json:"broadcaster_id"`
+		SenderId      string `json:"sender_id"`
+		Message       string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if request.SenderId != sender.ID {
+		writeError(w, http.StatusForbidden, "The sender must be the user in the access token")
+		return
+	}
+	if failed {
+		writeJSON(w, http.StatusOK, map[string]any{"data": []map[string]any{{
+			"message_id":  "",
+			"is_sent":     false,
+			"drop_reason": map[string]string{"code": failure.DropCode, "message": failure.DropMessage},
+		}}})
+		return
+	}
+	s.lock.Lock()
+	s.messages = append(s.messages, SentMessage{
+		BroadcasterId: request.BroadcasterId,
+		SenderId:      request.SenderId,
+		Message:       request.Message,
+		AccessToken:   strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "),
+	})
+	messageId := fmt.Sprintf("message-%d", len(s.messages))
+	s.lock.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"data": []map[string]any{{"message_id": messageId, "is_sent": true}}})
+}
+
+func (s *Server) handleDeleteChat(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointDeleteChat); ok {
+		s.writeFailure(w, failure)
+		return
+	}
+	moderator, ok := s.authorizeUser(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("moderator_id") != moderator.ID {
+		writeError(w, http.StatusForbidden, "The moderator must be the user in the access token")
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if q.Get("broadcaster_id") != moderator.ID && !slices.Contains(s.moderators[moderator.ID], q.Get("broadcaster_id")) {
+		writeError(w, http.StatusForbidden, "The user is not one of the broadcaster's moderators")
+		return
+	}
+	s.deletedChat = append(s.deletedChat, q.Get("message_id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRewards only lets broadcasters manage rewards in their own channel, like Twitch does.
+func (s *Server) handleRewards(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointRewards); ok {
+		s.writeFailure(w, failure)
+		return
+	}
+	broadcaster, ok := s.authorizeUser(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("broadcaster_id") != broadcaster.ID {
+		writeError(w, http.StatusForbidden, "The broadcaster must be the user in the access token")
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		created := &reward{broadcasterId: broadcaster.ID}
+		if err := json.NewDecoder(r.Body).Decode(&created.CustomReward); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if created.Title == "" || created.Cost < 1 {
+			writeError(w, http.StatusBadRequest, "title and cost are required")
+			return
+		}
+		s.lock.Lock()
+		s.tokenCounter++
+		created.ID = fmt.Sprintf("reward-%d", s.tokenCounter)
+		s.rewards[created.ID] = created
+		s.lock.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{"data": []twitch.CustomReward{created.CustomReward}})
+	case http.MethodDelete:
+		s.lock.Lock()
+		existing, ok := s.rewards[q.Get("id")]
+		if ok && existing.broadcasterId == broadcaster.ID {
+			delete(s.rewards, q.Get("id"))
+		}
+		s.lock.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "reward not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) handleRedemptions(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointRedemptions); ok {
+		s.writeFailure(w, failure)
+		return
+	}
+	broadcaster, ok := s.authorizeUser(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("broadcaster_id") != broadcaster.ID {
+		writeError(w, http.StatusForbidden, "The broadcaster must be the user in the access token")
+		return
+	}
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || (body.Status != "FULFILLED" && body.Status != "CANCELED") {
+		writeError(w, http.StatusBadRequest, "status must be FULFILLED or CANCELED")
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.rewards[q.Get("reward_id")]; !ok {
+		writeError(w, http.StatusNotFound, "reward not found")
+		return
+	}
+	s.redemptions[q.Get("id")] = body.Status
+	writeJSON(w, http.StatusOK, map[string]any{"data": []map[string]string{{"id": q.Get("id"), "status": body.Status}}})
+}
+
+func (s *Server) handleStreams(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointStreams); ok {
+		s.writeFailure(w, failure)
+		return
+	}
+	if _, ok := s.authorize(w, r); !ok {
+		return
+	}
+	data := make([]map[string]any, 0)
+	s.lock.Lock()
+	for _, userId := range r.URL.Query()["user_id"] {
+		startedAt, live := s.live[userId]
+		u, ok := s.users[userId]
+		if !live || !ok {
+			continue
+		}
+		data = append(data, map[string]any{
+			"id":         "stream-" + userId,
+			"user_id":    userId,
+			"user_login": u.Login,
+			"type":       "live",
+			"title":      s.streamInfo[userId][0],
+			"game_name":  s.streamInfo[userId][1],
+			"started_at": startedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	s.lock.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"data": data, "pagination": map[string]any{}})
+}
+
+func (s *Server) handleModeratedChannels(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointModerated); ok {
+		s.writeFailure(w, failure)
+		return
+	}
+	current, ok := s.authorizeUser(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("user_id") != current.ID {
+		writeError(w, http.StatusBadRequest, "user_id must match the user in the access token")
+		return
+	}
+	data := make([]map[string]string, 0)
+	s.lock.Lock()
+	for _, broadcasterId := range s.moderators[current.ID] {
+		broadcaster, ok := s.users[broadcasterId]
+		if !ok {
+			continue
+		}
+		data = append(data, map[string]string{
+			"broadcaster_id":    broadcaster.ID,
+			"broadcaster_login": broadcaster.Login,
+			"broadcaster_name":  broadcaster.DisplayName,
+		})
+	}
+	s.lock.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"data": data, "pagination": map[string]any{}})
+}
+
+func (s *Server) handleEventSub(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointEventSub); ok {
+		s.writeFailure(w, failure)
+		return
+	}
+	if _, ok := s.authorize(w, r); !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		subscriptionType := r.URL.Query().Get("type")
+		s.lock.Lock()
+		data := make([]*twitch.EventSubSubscription, 0, len(s.subscriptions))
+		for _, subscription := range s.subscriptions {
+			if subscriptionType == "" || subscription.Type == subscriptionType {
+				copied := *subscription
+				data = append(data, &copied)
+			}
+		}
+		s.lock.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{"data": data, "total": len(data), "pagination": map[string]any{}})
+	case http.MethodPost:
+		subscription := &twitch.EventSubSubscription{}
+		if err := json.NewDecoder(r.Body).Decode(subscription); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.lock.Lock()
+		for _, existing := range s.subscriptions {
+			if existing.Type == subscription.Type && sameCondition(existing.Condition, subscription.Condition) && existing.Transport.Method == subscription.Transport.Method &&
+				existing.Transport.SessionId == subscription.Transport.SessionId && existing.Transport.Callback == subscription.Transport.Callback {
+				s.lock.Unlock()
+				writeError(w, http.StatusConflict, "subscription already exists")
+				return
+			}
+		}
+		s.tokenCounter++
+		subscription.ID = fmt.Sprintf("subscription-%d", s.tokenCounter)
+		subscription.Status = "enabled"
+		if subscription.Transport.Method == "webhook" {
+			subscription.Status = "webhook_callback_verification_pending"
+		}
+		subscription.CreatedAt = time.Now()
+		subscription.Transport.Secret = ""
+		s.subscriptions[subscription.ID] = subscription
+		s.lock.Unlock()
+		writeJSON(w, http.StatusAccepted, map[string]any{"data": []*twitch.EventSubSubscription{subscription}})
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		s.lock.Lock()
+		_, ok := s.subscriptions[id]
+		delete(s.subscriptions, id)
+		if ok {
+			s.deleted = append(s.deleted, id)
+		}
+		s.lock.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "subscription not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func sameCondition(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointToken); ok {
+		s.writeFailure(w, failure)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.PostForm.Get("client_id") != s.ClientId || r.PostForm.Get("client_secret") != s.ClientSecret {
+		writeError(w, http.StatusUnauthorized, "invalid client")
+		return
+	}
+	if r.PostForm.Get("grant_type") == "client_credentials" {
+		s.lock.Lock()
+		s.tokenCounter++
+		accessToken := fmt.Sprintf("app-%d", s.tokenCounter)
+		s.accessTokens[accessToken] = ""
+		s.lock.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token": accessToken,
+			"expires_in":   int(s.TokenTTL.Seconds()),
+			"token_type":   "bearer",
+		})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "refresh_token" {
+		writeError(w, http.StatusBadRequest, "unsupported grant type")
+		return
+	}
+	s.lock.Lock()
+	userId, ok := s.refreshTokens[r.PostForm.Get("refresh_token")]
+	if !ok {
+		s.lock.Unlock()
+		writeError(w, http.StatusBadRequest, "Invalid refresh token")
+		return
+	}
+	delete(s.refreshTokens, r.PostForm.Get("refresh_token"))
+	accessToken, refreshToken := s.issueTokens(userId)
+	scopes := s.users[userId].scopes
+	s.lock.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    int(s.TokenTTL.Seconds()),
+		"scope":         scopes,
+		"token_type":    "bearer",
+	})
+}
+
+func (s *Server) handleValidate(w http.ResponseWriter, r *http.Request) {
+	if failure, ok := s.begin(EndpointValidate); ok {
+		s.writeFailure(w, failure)
+		return
+	}
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "OAuth ")
+	s.lock.Lock()
+	userId, ok := s.accessTokens[accessToken]
+	var u *user
+	if ok {
+		u = s.users[userId]
+	}
+	s.lock.Unlock()
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid access token")
+		return
+	}
+	if u == nil {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"client_id":  s.ClientId,
+			"scopes":     []string{},
+			"expires_in": int(s.TokenTTL.Seconds()),
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"client_id":  s.ClientId,
+		"login":      u.Login,
+		"scopes":     u.scopes,
+		"user_id":    u.ID,
+		"expires_in": int(s.TokenTTL.Seconds()),
+	})
+}
+
+func method(m string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{"error": http.StatusText(status), "status": status, "message": message})
+}
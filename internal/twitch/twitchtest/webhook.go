@@ -0,0 +1,35 @@
+package twitchtest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// WebhookRequest builds an EventSub webhook delivery signed with secret, as Twitch would POST it to the callback.
+func WebhookRequest(callback, secret, messageId, messageType, subscriptionType string, timestamp time.Time, body any) (*http.Request, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	rawTimestamp := timestamp.UTC().Format(time.RFC3339Nano)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(messageId + rawTimestamp))
+	mac.Write(payload)
+	req, err := http.NewRequest(http.MethodPost, callback, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Twitch-Eventsub-Message-Id", messageId)
+	req.Header.Set("Twitch-Eventsub-Message-Timestamp", rawTimestamp)
+	req.Header.Set("Twitch-Eventsub-Message-Type", messageType)
+	req.Header.Set("Twitch-Eventsub-Message-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set("Twitch-Eventsub-Subscription-Type", subscriptionType)
+	req.Header.Set("Twitch-Eventsub-Subscription-Version", "1")
+	return req, nil
+}